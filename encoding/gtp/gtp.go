@@ -11,6 +11,9 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -25,6 +28,8 @@ type GTP struct {
 	PeerTEID  uint32
 	QosFlowID uint8
 	HasExtensionHeader bool
+
+	closed int32 // accessed atomically.
 }
 
 func NewGTP(lteid uint32, pteid uint32) (p *GTP) {
@@ -47,6 +52,17 @@ func (gtp *GTP) SetExtensionHeader(flag bool) {
 	return
 }
 
+// Close stops the tunnel, e.g. on the Error Indication from the peer. the
+// packets are neither encapsulated nor decapsulated after that.
+func (gtp *GTP) Close() {
+	atomic.StoreInt32(&gtp.closed, 1)
+	return
+}
+
+func (gtp *GTP) Closed() bool {
+	return atomic.LoadInt32(&gtp.closed) != 0
+}
+
 // 5 GTP-U header
 // 5.1 General format
 const (
@@ -54,61 +70,238 @@ const (
 	protocolTypeGTP = 0x10
 	protocolTypeGTPprime = 0x00
 	hasExtensionHeader = 0x04
+	hasSequenceNumber = 0x02
+	hasNPDUNumber = 0x01
 )
 
-func (gtp *GTP) encGTPHeader(payloadLen int) (pdu []byte) {
+// encGTPHeader appends the header of the T-PDU to dst. the PDU session
+// container has the UL PDU session information if it is given.
+func (gtp *GTP) encGTPHeader(dst []byte, payloadLen int,
+	info *ULPduSessionInformation) (pdu []byte) {
 
 	var versAndFlags uint8
 	versAndFlags |= gtpuVersion
 	versAndFlags |= protocolTypeGTP
 
-	extHeaders := []uint8{}
-	if gtp.HasExtensionHeader {
+	if info != nil {
 		versAndFlags |= hasExtensionHeader
-		extHeaders = append(extHeaders,
-			extHeaderTypePDUSessionContainer)
 	}
-	pdu = append(pdu, versAndFlags)
+	pdu = append(dst, versAndFlags)
 
-	var messageType uint8 = 0xff // T-PDU
+	var messageType uint8 = MessageTypeTPDU
 	pdu = append(pdu, messageType)
 
-	extHead := []byte{}
-	extHeaders = append(extHeaders, extHeaderTypeNone)
-	for _, extType := range extHeaders {
-		extHead = append(extHead, gtp.encExtensionHeader(extType)...)
+	gtpLen := payloadLen + tpduHeaderLen(info) - headerLen
+	pdu = append(pdu, uint8(gtpLen>>8), uint8(gtpLen))
+	pdu = appendUint32(pdu, gtp.PeerTEID)
+
+	if info != nil {
+		// Sequence Number and N-PDU Number
+		pdu = append(pdu, 0, 0, 0, extHeaderTypePDUSessionContainer)
+		start := len(pdu)
+		pdu = append(pdu, 0) // length
+		pdu = encULPduSessionInformation(pdu, info)
+		pdu = encExtensionHeader(pdu, start)
+		pdu = append(pdu, extHeaderTypeNone)
 	}
 
-	if gtp.HasExtensionHeader {
-		padding := make([]byte, 3) // Sequence Number and N-PDU Number
-		extHead = append(padding, extHead...)
+	return
+}
+
+// tpduHeaderLen returns the length of the header of the T-PDU encoded by
+// encGTPHeader.
+func tpduHeaderLen(info *ULPduSessionInformation) int {
+	if info == nil {
+		return headerLen
 	}
+	return headerLen + optionalFieldsLen + extensionHeaderLen(info.length())
+}
 
-	gtpLen := payloadLen + len(extHead)
-	length := make([]byte, 2)
-	binary.BigEndian.PutUint16(length, uint16(gtpLen))
-	pdu = append(pdu, length...)
+// Header is the GTP-U header decoded from the packet. the optional fields
+// are valid only if the corresponding flag is set.
+type Header struct {
+	Flags            uint8
+	MessageType      uint8
+	Length           uint16
+	TEID             uint32
+	SequenceNumber   uint16
+	NPDUNumber       uint8
+	ExtensionHeaders []ExtensionHeader
+}
+
+// ExtensionHeader has the content of the extension header without the
+// length and the next extension header type.
+type ExtensionHeader struct {
+	Type    uint8
+	Content []byte
+}
+
+// 7.1 General (GTP-U message types)
+const (
+	MessageTypeEchoRequest                           = 1
+	MessageTypeEchoResponse                          = 2
+	MessageTypeErrorIndication                       = 26
+	MessageTypeSupportedExtensionHeadersNotification = 31
+	MessageTypeEndMarker                             = 254
+	MessageTypeTPDU                                  = 255
+)
 
-	teid := make([]byte, 4)
-	binary.BigEndian.PutUint32(teid, gtp.PeerTEID)
-	pdu = append(pdu, teid...)
-	pdu = append(pdu, extHead...)
+var messageTypeStr = map[uint8]string{
+	MessageTypeEchoRequest:                           "Echo Request",
+	MessageTypeEchoResponse:                          "Echo Response",
+	MessageTypeErrorIndication:                       "Error Indication",
+	MessageTypeSupportedExtensionHeadersNotification: "Supported Extension Headers Notification",
+	MessageTypeEndMarker:                             "End Marker",
+	MessageTypeTPDU:                                  "T-PDU",
+}
+
+const (
+	headerLen         = 8 // mandatory part of the header
+	optionalFieldsLen = 4 // Sequence Number, N-PDU Number and next type
+)
 
+// DecodeHeader decodes the GTP-U header and returns the payload, which is
+// the rest of the message indicated by the length field.
+func DecodeHeader(pdu []byte) (h Header, payload []byte, err error) {
+	payload, err = h.Decode(pdu)
 	return
 }
 
-func (gtp *GTP) decGTPHeader(payload []byte) (raw []byte) {
+// Decode decodes the GTP-U header into h like DecodeHeader. the extension
+// headers are decoded into h.ExtensionHeaders[:0], so that no allocation
+// is taken if it has the capacity for them.
+func (h *Header) Decode(pdu []byte) (payload []byte, err error) {
+
+	*h = Header{ExtensionHeaders: h.ExtensionHeaders[:0]}
+	if len(pdu) < headerLen {
+		err = fmt.Errorf("gtp: truncated header: %d bytes", len(pdu))
+		return
+	}
+	h.Flags = readPayloadByte(&pdu)
+	if h.Flags&0xe0 != gtpuVersion || h.Flags&protocolTypeGTP == 0 {
+		err = fmt.Errorf("gtp: unsupported version or protocol type: 0x%02x",
+			h.Flags)
+		return
+	}
+	h.MessageType = readPayloadByte(&pdu)
+	if _, ok := messageTypeStr[h.MessageType]; !ok {
+		err = fmt.Errorf("gtp: unknown message type: %d", h.MessageType)
+		return
+	}
+	h.Length = readPayloadUint16(&pdu)
+	h.TEID = readPayloadUint32(&pdu)
 
-	versAndFlags := readPayloadByte(&payload)
+	if int(h.Length) > len(pdu) {
+		err = fmt.Errorf("gtp: truncated message: length %d, remaining %d",
+			h.Length, len(pdu))
+		return
+	}
+	pdu = pdu[:h.Length] // trailing bytes after the message are ignored.
 
-	if (versAndFlags & hasExtensionHeader) == 0 {
-		raw = payload[7:]
+	var optional uint8 = hasExtensionHeader | hasSequenceNumber | hasNPDUNumber
+	if (h.Flags & optional) == 0 {
+		payload = pdu
 		return
 	}
-	raw = payload[15:]
+	if len(pdu) < optionalFieldsLen {
+		err = fmt.Errorf("gtp: truncated optional fields: %d bytes", len(pdu))
+		return
+	}
+	h.SequenceNumber = readPayloadUint16(&pdu)
+	h.NPDUNumber = readPayloadByte(&pdu)
+	extType := readPayloadByte(&pdu)
+	if (h.Flags & hasExtensionHeader) == 0 {
+		extType = extHeaderTypeNone
+	}
+
+	for extType != extHeaderTypeNone {
+		if len(pdu) == 0 {
+			err = fmt.Errorf("gtp: truncated extension header: 0x%02x",
+				extType)
+			return
+		}
+		length := int(pdu[0]) * 4
+		if length == 0 {
+			err = fmt.Errorf("gtp: invalid extension header length: 0x%02x",
+				extType)
+			return
+		}
+		if len(pdu) < length {
+			err = fmt.Errorf("gtp: truncated extension header: 0x%02x",
+				extType)
+			return
+		}
+		ext := readPayloadByteSlice(&pdu, length)
+		content := ext[1 : length-1]
+		if extType == extHeaderTypePDUSessionContainer {
+			var dl DLPduSessionInformation
+			var ul ULPduSessionInformation
+			if _, err = decPduSessionContainer(content, &dl, &ul); err != nil {
+				return
+			}
+		}
+		h.ExtensionHeaders = append(h.ExtensionHeaders, ExtensionHeader{
+			Type:    extType,
+			Content: content,
+		})
+		extType = ext[length-1]
+	}
+	payload = pdu
 	return
 }
 
+// DLPduSessionInformation returns the DL PDU session information in the PDU
+// session container, or nil if the container is not present or has the UL
+// one.
+func (h *Header) DLPduSessionInformation() *DLPduSessionInformation {
+	var dl DLPduSessionInformation
+	if !h.DecodeDLPduSessionInformation(&dl) {
+		return nil
+	}
+	return &dl
+}
+
+// DecodeDLPduSessionInformation decodes the DL PDU session information in
+// the PDU session container into info without the allocation, and returns
+// false if the container is not present or has the UL one.
+func (h *Header) DecodeDLPduSessionInformation(
+	info *DLPduSessionInformation) bool {
+
+	for _, ext := range h.ExtensionHeaders {
+		if ext.Type == extHeaderTypePDUSessionContainer {
+			pduType, err := decPduSessionContainer(ext.Content, info, nil)
+			return err == nil && pduType == pduTypeDL
+		}
+	}
+	return false
+}
+
+// ULPduSessionInformation returns the UL PDU session information in the PDU
+// session container, or nil if the container is not present or has the DL
+// one.
+func (h *Header) ULPduSessionInformation() *ULPduSessionInformation {
+	var ul ULPduSessionInformation
+	if !h.DecodeULPduSessionInformation(&ul) {
+		return nil
+	}
+	return &ul
+}
+
+// DecodeULPduSessionInformation decodes the UL PDU session information in
+// the PDU session container into info without the allocation, and returns
+// false if the container is not present or has the DL one.
+func (h *Header) DecodeULPduSessionInformation(
+	info *ULPduSessionInformation) bool {
+
+	for _, ext := range h.ExtensionHeaders {
+		if ext.Type == extHeaderTypePDUSessionContainer {
+			pduType, err := decPduSessionContainer(ext.Content, nil, info)
+			return err == nil && pduType == pduTypeUL
+		}
+	}
+	return false
+}
+
 // 5.2 GTP-U Extension Header
 // 5.2.1 General format of the GTP-U Extension Header
 const (
@@ -116,69 +309,1045 @@ const (
 	extHeaderTypePDUSessionContainer = 0x85
 )
 
-func (gtp *GTP) encExtensionHeader(extHeaderType uint8) (pdu []byte) {
-
-	var content []byte
+// encExtensionHeader pads the content of the extension header, which is
+// appended to pdu after the length octet at start, to the multiple of 4
+// octets, and sets the length. the next extension header type is appended
+// by the caller.
+func encExtensionHeader(pdu []byte, start int) []byte {
 
-	switch extHeaderType {
-	case extHeaderTypeNone:
-		pdu = append(pdu, extHeaderType)
-		return
-	case extHeaderTypePDUSessionContainer:
-		content = gtp.encULPduSessionInformation()
-	default:
-		fmt.Printf("unknown extension header type.")
-		return
+	for (len(pdu)-start+1)%4 != 0 {
+		pdu = append(pdu, 0) // padding
 	}
-	pdu = append(pdu, extHeaderType)
+	pdu[start] = uint8((len(pdu) - start + 1) / 4)
 
-	length := len(content)
-	if length%4 != 2 {
-		fmt.Printf("invalid extension header length=%d.", length)
-		return
-	}
-
-	length = (len(content) + 2) / 4
-	pdu = append(pdu, uint8(length))
-	pdu = append(pdu, content...)
+	return pdu
+}
 
-	return
+// extensionHeaderLen returns the length of the extension header having the
+// content of the length, including the length and the next type octets.
+func extensionHeaderLen(contentLen int) int {
+	return (contentLen + 2 + 3) / 4 * 4
 }
 
 // 5.2.2.7 PDU Session Container
-// 5.5.2.2 UL PDU SESSION INFORMATION (PDU Type 1) in TS 38.415
+// 5.5.2 Frame format for the PDU Session user plane protocol in TS 38.415
 const (
 	pduTypeDL = iota
 	pduTypeUL
 )
 
+// 5.5.3 Coding of information elements in frames in TS 38.415
+const (
+	pduQoSMonitoringPacket = 0x08 // QMP
+
+	dlSequenceNumberPresence = 0x04 // SNP
+	dlPagingPolicyPresence   = 0x80 // PPP
+	dlReflectiveQoSIndicator = 0x40 // RQI
+
+	ulDLDelayIndicator      = 0x04
+	ulULDelayIndicator      = 0x02
+	ulSequenceNumberPresent = 0x01 // SNP
+	ulN3N9DelayIndicator    = 0x80
+
+	qosFlowIDMask = 0x3f
+	timestampLen  = 8
+	delayLen      = 4
+	sequenceLen   = 3
+)
+
+// 5.5.2.1 DL PDU SESSION INFORMATION (PDU Type 0) in TS 38.415
+
+// DLPduSessionInformation is the PDU session information received in the
+// downlink. RQI indicates the reflective QoS activation for the packet.
+// the optional fields are valid only if the corresponding flag is set. the
+// timestamps are in the 64-bit NTP format, see NTPTimestamp.
+type DLPduSessionInformation struct {
+	QosFlowID uint8
+	RQI       bool
+
+	HasPPI bool // PPP
+	PPI    uint8
+
+	QMP                bool
+	DLSendingTimestamp uint64
+
+	HasSequenceNumber bool // SNP
+	SequenceNumber    uint32
+}
+
+// length returns the length of the DL PDU session information.
+func (info *DLPduSessionInformation) length() (length int) {
+
+	length = 2
+	if info.HasPPI {
+		length++
+	}
+	if info.QMP {
+		length += timestampLen
+	}
+	if info.HasSequenceNumber {
+		length += sequenceLen
+	}
+	return
+}
+
+func encDLPduSessionInformation(pdu []byte,
+	info *DLPduSessionInformation) []byte {
+
+	var flags uint8 = pduTypeDL << 4
+	if info.QMP {
+		flags |= pduQoSMonitoringPacket
+	}
+	if info.HasSequenceNumber {
+		flags |= dlSequenceNumberPresence
+	}
+	qfi := info.QosFlowID & qosFlowIDMask
+	if info.HasPPI {
+		qfi |= dlPagingPolicyPresence
+	}
+	if info.RQI {
+		qfi |= dlReflectiveQoSIndicator
+	}
+	pdu = append(pdu, flags, qfi)
+
+	if info.HasPPI {
+		pdu = append(pdu, info.PPI<<5)
+	}
+	if info.QMP {
+		pdu = appendUint64(pdu, info.DLSendingTimestamp)
+	}
+	if info.HasSequenceNumber {
+		pdu = appendUint24(pdu, info.SequenceNumber)
+	}
+	return pdu
+}
+
+func decDLPduSessionInformation(content []byte,
+	dl *DLPduSessionInformation) (err error) {
+
+	flags, qfi := content[0], content[1]
+	*dl = DLPduSessionInformation{
+		QosFlowID:         qfi & qosFlowIDMask,
+		RQI:               (qfi & dlReflectiveQoSIndicator) != 0,
+		HasPPI:            (qfi & dlPagingPolicyPresence) != 0,
+		QMP:               (flags & pduQoSMonitoringPacket) != 0,
+		HasSequenceNumber: (flags & dlSequenceNumberPresence) != 0,
+	}
+
+	length := dl.length()
+	if len(content) < length {
+		err = fmt.Errorf("gtp: truncated DL PDU session information: "+
+			"%d bytes, expect %d", len(content), length)
+		return
+	}
+
+	content = content[2:]
+	if dl.HasPPI {
+		dl.PPI = readPayloadByte(&content) >> 5
+	}
+	if dl.QMP {
+		dl.DLSendingTimestamp = readPayloadUint64(&content)
+	}
+	if dl.HasSequenceNumber {
+		dl.SequenceNumber = readPayloadUint24(&content)
+	}
+	return
+}
+
+// 5.5.2.2 UL PDU SESSION INFORMATION (PDU Type 1) in TS 38.415
+
+// ULPduSessionInformation is the PDU session information sent in the
+// uplink. with QMP, the timestamps of the QoS monitoring are reported to
+// the UPF. the delay results are in units of 0.1 ms.
 type ULPduSessionInformation struct {
-	pduTypeAndFlags   uint8
-	qosFlowIdentifier uint8
+	QosFlowID uint8
+
+	QMP                        bool
+	DLSendingTimestampRepeated uint64
+	DLReceivedTimestamp        uint64
+	ULSendingTimestamp         uint64
+
+	HasDLDelayResult bool
+	DLDelayResult    uint32
+
+	HasULDelayResult bool
+	ULDelayResult    uint32
+
+	HasSequenceNumber bool // SNP
+	SequenceNumber    uint32
+
+	HasN3N9DelayResult bool
+	N3N9DelayResult    uint32
+}
+
+// length returns the length of the UL PDU session information.
+func (info *ULPduSessionInformation) length() (length int) {
+
+	length = 2
+	if info.QMP {
+		length += 3 * timestampLen
+	}
+	if info.HasDLDelayResult {
+		length += delayLen
+	}
+	if info.HasULDelayResult {
+		length += delayLen
+	}
+	if info.HasSequenceNumber {
+		length += sequenceLen
+	}
+	if info.HasN3N9DelayResult {
+		length += delayLen
+	}
+	return
+}
+
+func encULPduSessionInformation(pdu []byte,
+	info *ULPduSessionInformation) []byte {
+
+	var flags uint8 = pduTypeUL << 4
+	if info.QMP {
+		flags |= pduQoSMonitoringPacket
+	}
+	if info.HasDLDelayResult {
+		flags |= ulDLDelayIndicator
+	}
+	if info.HasULDelayResult {
+		flags |= ulULDelayIndicator
+	}
+	if info.HasSequenceNumber {
+		flags |= ulSequenceNumberPresent
+	}
+	qfi := info.QosFlowID & qosFlowIDMask
+	if info.HasN3N9DelayResult {
+		qfi |= ulN3N9DelayIndicator
+	}
+	pdu = append(pdu, flags, qfi)
+
+	if info.QMP {
+		pdu = appendUint64(pdu, info.DLSendingTimestampRepeated)
+		pdu = appendUint64(pdu, info.DLReceivedTimestamp)
+		pdu = appendUint64(pdu, info.ULSendingTimestamp)
+	}
+	if info.HasDLDelayResult {
+		pdu = appendUint32(pdu, info.DLDelayResult)
+	}
+	if info.HasULDelayResult {
+		pdu = appendUint32(pdu, info.ULDelayResult)
+	}
+	if info.HasSequenceNumber {
+		pdu = appendUint24(pdu, info.SequenceNumber)
+	}
+	if info.HasN3N9DelayResult {
+		pdu = appendUint32(pdu, info.N3N9DelayResult)
+	}
+	return pdu
 }
 
-func (gtp *GTP) encULPduSessionInformation() (pdu []byte) {
+// decULPduSessionInformation ignores the new IEs indicated by the New IE
+// Flag, which follow all of the fields here.
+func decULPduSessionInformation(content []byte,
+	ul *ULPduSessionInformation) (err error) {
 
-	var pduTypeAndFlags uint8
-	pduTypeAndFlags = pduTypeUL << 4
+	flags, qfi := content[0], content[1]
+	*ul = ULPduSessionInformation{
+		QosFlowID:          qfi & qosFlowIDMask,
+		QMP:                (flags & pduQoSMonitoringPacket) != 0,
+		HasDLDelayResult:   (flags & ulDLDelayIndicator) != 0,
+		HasULDelayResult:   (flags & ulULDelayIndicator) != 0,
+		HasSequenceNumber:  (flags & ulSequenceNumberPresent) != 0,
+		HasN3N9DelayResult: (qfi & ulN3N9DelayIndicator) != 0,
+	}
 
-	pdu = append([]byte{}, pduTypeAndFlags)
-	pdu = append(pdu, gtp.QosFlowID)
+	length := ul.length()
+	if len(content) < length {
+		err = fmt.Errorf("gtp: truncated UL PDU session information: "+
+			"%d bytes, expect %d", len(content), length)
+		return
+	}
 
+	content = content[2:]
+	if ul.QMP {
+		ul.DLSendingTimestampRepeated = readPayloadUint64(&content)
+		ul.DLReceivedTimestamp = readPayloadUint64(&content)
+		ul.ULSendingTimestamp = readPayloadUint64(&content)
+	}
+	if ul.HasDLDelayResult {
+		ul.DLDelayResult = readPayloadUint32(&content)
+	}
+	if ul.HasULDelayResult {
+		ul.ULDelayResult = readPayloadUint32(&content)
+	}
+	if ul.HasSequenceNumber {
+		ul.SequenceNumber = readPayloadUint24(&content)
+	}
+	if ul.HasN3N9DelayResult {
+		ul.N3N9DelayResult = readPayloadUint32(&content)
+	}
 	return
 }
 
+// decPduSessionContainer decodes the content of the PDU session container,
+// which has either of the DL or the UL PDU session information, into dl or
+// ul of the PDU type. it is not decoded if the one of the PDU type is nil.
+func decPduSessionContainer(content []byte, dl *DLPduSessionInformation,
+	ul *ULPduSessionInformation) (pduType uint8, err error) {
+
+	if len(content) < 2 {
+		err = fmt.Errorf("gtp: truncated PDU session container: %d bytes",
+			len(content))
+		return
+	}
+	switch pduType = content[0] >> 4; pduType {
+	case pduTypeDL:
+		if dl != nil {
+			err = decDLPduSessionInformation(content, dl)
+		}
+	case pduTypeUL:
+		if ul != nil {
+			err = decULPduSessionInformation(content, ul)
+		}
+	default:
+		err = fmt.Errorf("gtp: unknown PDU type: %d", pduType)
+	}
+	return
+}
+
+// 5.5.3.16 DL Sending Time Stamp in TS 38.415
+// the timestamps are in the 64-bit format in section 6 of IETF RFC 5905.
+const ntpEpochOffset = 2208988800 // from 1900-01-01 to 1970-01-01 in seconds.
+
+// NTPTimestamp returns the 64-bit NTP timestamp of the time.
+func NTPTimestamp(t time.Time) uint64 {
+	sec := uint64(t.Unix() + ntpEpochOffset)
+	frac := (uint64(t.Nanosecond()) << 32) / uint64(time.Second)
+	return sec<<32 | frac
+}
+
+// NTPTime returns the time of the 64-bit NTP timestamp.
+func NTPTime(ts uint64) time.Time {
+	sec := int64(ts>>32) - ntpEpochOffset
+	nsec := ((ts & 0xffffffff) * uint64(time.Second)) >> 32
+	return time.Unix(sec, int64(nsec))
+}
+
 func (gtp *GTP) Encap(raw []byte) (payload []byte) {
+	var info *ULPduSessionInformation
+	if gtp.HasExtensionHeader {
+		info = &ULPduSessionInformation{QosFlowID: gtp.QosFlowID}
+	}
+	return gtp.EncapUL(raw, info)
+}
+
+// EncapUL encapsulates the packet with the UL PDU session information, e.g.
+// the timestamps for the QoS monitoring. the PDU session container is
+// omitted if info is nil.
+func (gtp *GTP) EncapUL(raw []byte, info *ULPduSessionInformation) (
+	payload []byte) {
+	if gtp.Closed() {
+		return
+	}
 	length := len(raw)
-	payload = append(payload, gtp.encGTPHeader(length)...)
+	payload = make([]byte, 0, HeaderRoom+length)
+	payload = gtp.encGTPHeader(payload, length, info)
 	payload = append(payload, raw...)
 	return
 }
 
+// HeaderRoom is the room left before the packet in the buffer for
+// EncapInPlace, which is enough for the header with any UL PDU session
+// information.
+const HeaderRoom = 64
+
+// EncapInPlace encapsulates the packet at buf[HeaderRoom:] without copying
+// it, by writing the header in the room before the packet. the T-PDU is
+// the tail of buf.
+func (gtp *GTP) EncapInPlace(buf []byte, info *ULPduSessionInformation) (
+	payload []byte) {
+	if gtp.Closed() || len(buf) < HeaderRoom {
+		return
+	}
+	start := HeaderRoom - tpduHeaderLen(info)
+	gtp.encGTPHeader(buf[start:start], len(buf)-HeaderRoom, info)
+	payload = buf[start:]
+	return
+}
+
+// Decap returns the payload of the T-PDU, or nil if the packet is not the
+// valid T-PDU to the local TEID.
 func (gtp *GTP) Decap(payload []byte) (raw []byte) {
-	raw = gtp.decGTPHeader(payload)
+	_, raw, err := gtp.Decode(payload)
+	if err != nil {
+		return nil
+	}
+	return
+}
+
+// DecapDL returns the payload and the PDU session information in the PDU
+// session container, which is nil if the container is not present.
+func (gtp *GTP) DecapDL(payload []byte) (
+	raw []byte, info *DLPduSessionInformation, err error) {
+
+	h, raw, err := gtp.Decode(payload)
+	if err != nil {
+		return
+	}
+	info = h.DLPduSessionInformation()
+	return
+}
+
+// Decode decodes the T-PDU received in the tunnel, and validates the TEID
+// with the local TEID.
+func (gtp *GTP) Decode(pdu []byte) (h Header, payload []byte, err error) {
+
+	h, payload, err = DecodeHeader(pdu)
+	if err != nil {
+		return
+	}
+	if gtp.Closed() {
+		err = fmt.Errorf("gtp: tunnel closed: TEID %d", gtp.LocalTEID)
+		return
+	}
+	if h.MessageType != MessageTypeTPDU {
+		err = fmt.Errorf("gtp: unexpected message type: %s",
+			messageTypeStr[h.MessageType])
+		return
+	}
+	if h.TEID != gtp.LocalTEID {
+		err = fmt.Errorf("gtp: unknown TEID: %d, expect %d",
+			h.TEID, gtp.LocalTEID)
+		return
+	}
+	return
+}
+
+// 7.2 Path Management Messages
+// 7.2.1 Echo Request and 7.2.2 Echo Response
+
+// 8 GTP-U Information Elements
+const (
+	ieTypeRecovery         = 14
+	ieTypeTEIDDataI        = 16
+	ieTypeGTPUPeerAddress  = 133
+	ieTypePrivateExtension = 255
+)
+
+// Echo is the Echo Request or the Echo Response. the restart counter is
+// in the Recovery IE of the Echo Response.
+type Echo struct {
+	Header         Header
+	HasRecovery    bool
+	RestartCounter uint8
+}
+
+// MakeEchoRequest returns the Echo Request with the sequence number.
+func MakeEchoRequest(seq uint16) (pdu []byte) {
+	pdu = encMessage(MessageTypeEchoRequest, 0, true, seq, nil)
+	return
+}
+
+// MakeEchoResponse returns the Echo Response to the request having the
+// sequence number. the restart counter should be zero. see 8.2 Recovery.
+func MakeEchoResponse(seq uint16, restart uint8) (pdu []byte) {
+	pdu = encMessage(MessageTypeEchoResponse, 0, true, seq,
+		[]byte{ieTypeRecovery, restart})
+	return
+}
+
+// encMessage encodes the message other than the T-PDU with the IEs. the
+// sequence number is present if hasSeq is true.
+func encMessage(msgType uint8, teid uint32,
+	hasSeq bool, seq uint16, ies []byte) (pdu []byte) {
+
+	var versAndFlags uint8
+	versAndFlags |= gtpuVersion
+	versAndFlags |= protocolTypeGTP
+	length := len(ies)
+	if hasSeq {
+		versAndFlags |= hasSequenceNumber
+		length += optionalFieldsLen
+	}
+	pdu = append(pdu, versAndFlags, msgType)
+
+	v := make([]byte, 6)
+	binary.BigEndian.PutUint16(v, uint16(length))
+	binary.BigEndian.PutUint32(v[2:], teid)
+	pdu = append(pdu, v...)
+
+	if hasSeq {
+		sn := make([]byte, 2)
+		binary.BigEndian.PutUint16(sn, seq)
+		pdu = append(pdu, sn...)
+		pdu = append(pdu, 0, extHeaderTypeNone) // N-PDU Number and next type
+	}
+	pdu = append(pdu, ies...)
+
+	return
+}
+
+// DecodeEcho decodes the Echo Request or the Echo Response.
+func DecodeEcho(pdu []byte) (e Echo, err error) {
+
+	h, payload, err := DecodeHeader(pdu)
+	if err != nil {
+		return
+	}
+	if h.MessageType != MessageTypeEchoRequest &&
+		h.MessageType != MessageTypeEchoResponse {
+		err = fmt.Errorf("gtp: not an echo message: %s",
+			messageTypeStr[h.MessageType])
+		return
+	}
+	if (h.Flags & hasSequenceNumber) == 0 {
+		err = fmt.Errorf("gtp: %s without sequence number",
+			messageTypeStr[h.MessageType])
+		return
+	}
+	e.Header = h
+
+	for len(payload) > 0 {
+		ieType := readPayloadByte(&payload)
+		switch {
+		case ieType == ieTypeRecovery && len(payload) >= 1:
+			e.HasRecovery = true
+			e.RestartCounter = readPayloadByte(&payload)
+		case ieType == ieTypePrivateExtension && len(payload) >= 2:
+			length := int(readPayloadUint16(&payload))
+			if len(payload) < length {
+				err = fmt.Errorf("gtp: truncated private extension")
+				return
+			}
+			readPayloadByteSlice(&payload, length)
+		default:
+			err = fmt.Errorf("gtp: invalid IE in %s: %d",
+				messageTypeStr[h.MessageType], ieType)
+			return
+		}
+	}
+
+	if h.MessageType == MessageTypeEchoResponse && !e.HasRecovery {
+		err = fmt.Errorf("gtp: Echo Response without Recovery")
+	}
+	return
+}
+
+// Path is the GTP-U path to the peer monitored by the echo. the methods
+// are safe for the concurrent use.
+type Path struct {
+	PeerAddr net.IP
+
+	mu      sync.Mutex
+	seq     uint16
+	pending map[uint16]time.Time // sent time of the Echo Requests.
+	stats   PathStats
+
+	// the restart counter received last.
+	hasRestartCounter bool
+	restartCounter    uint8
+}
+
+// PathStats is the statistics of the echo on the path.
+type PathStats struct {
+	Sent            int
+	Received        int
+	Lost            int
+	ConsecutiveLost int // the path failure is detected with this.
+	Restarts        int // detected with the change of the restart counter.
+	RTTMin          time.Duration
+	RTTMax          time.Duration
+	RTTAvg          time.Duration
+
+	rttSum time.Duration
+}
+
+func NewPath(peer net.IP) (p *Path) {
+	p = &Path{
+		PeerAddr: peer,
+		pending:  map[uint16]time.Time{},
+	}
+	return
+}
+
+// MakeEchoRequest returns the Echo Request with the next sequence number
+// to be sent at the time.
+func (p *Path) MakeEchoRequest(now time.Time) (pdu []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.seq++
+	p.pending[p.seq] = now
+	p.stats.Sent++
+	pdu = MakeEchoRequest(p.seq)
+	return
+}
+
+// HandleEchoResponse updates the round trip time with the Echo Response
+// received at the time, and returns true if the peer restarted.
+func (p *Path) HandleEchoResponse(e Echo, now time.Time) (
+	restarted bool, err error) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sent, ok := p.pending[e.Header.SequenceNumber]
+	if !ok {
+		err = fmt.Errorf("gtp: unexpected Echo Response: sequence number %d",
+			e.Header.SequenceNumber)
+		return
+	}
+	delete(p.pending, e.Header.SequenceNumber)
+
+	st := &p.stats
+	rtt := now.Sub(sent)
+	st.Received++
+	st.ConsecutiveLost = 0
+	if st.RTTMin == 0 || rtt < st.RTTMin {
+		st.RTTMin = rtt
+	}
+	if rtt > st.RTTMax {
+		st.RTTMax = rtt
+	}
+	st.rttSum += rtt
+	st.RTTAvg = st.rttSum / time.Duration(st.Received)
+
+	if p.hasRestartCounter && p.restartCounter != e.RestartCounter {
+		st.Restarts++
+		restarted = true
+	}
+	p.hasRestartCounter = true
+	p.restartCounter = e.RestartCounter
+	return
+}
+
+// Expire counts the Echo Requests sent before the timeout as lost, and
+// returns the number of the requests lost in succession.
+func (p *Path) Expire(now time.Time, timeout time.Duration) (lost int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for seq, sent := range p.pending {
+		if now.Sub(sent) >= timeout {
+			delete(p.pending, seq)
+			p.stats.Lost++
+			p.stats.ConsecutiveLost++
+		}
+	}
+	lost = p.stats.ConsecutiveLost
+	return
+}
+
+func (p *Path) Stats() (st PathStats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	st = p.stats
+	return
+}
+
+// 7.3 Tunnel Management Messages
+// 7.3.1 Error Indication
+
+// ErrorIndication is sent by the peer which received the T-PDU with the
+// unknown TEID. TEID is the one in the T-PDU, and PeerAddr is the address
+// of the peer sending the Error Indication.
+type ErrorIndication struct {
+	Header   Header
+	TEID     uint32
+	PeerAddr net.IP
+}
+
+// MakeErrorIndication returns the Error Indication for the T-PDU received
+// with the TEID. addr is the local address receiving the T-PDU.
+func MakeErrorIndication(teid uint32, addr net.IP) (pdu []byte) {
+
+	ies := []byte{ieTypeTEIDDataI, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(ies[1:], teid)
+
+	if v4 := addr.To4(); v4 != nil {
+		addr = v4
+	}
+	ies = append(ies, ieTypeGTPUPeerAddress, 0, byte(len(addr)))
+	ies = append(ies, addr...)
+
+	// the sequence number is not used since no response is expected.
+	pdu = encMessage(MessageTypeErrorIndication, 0, true, 0, ies)
+	return
+}
+
+func DecodeErrorIndication(pdu []byte) (e ErrorIndication, err error) {
+
+	h, payload, err := DecodeHeader(pdu)
+	if err != nil {
+		return
+	}
+	if h.MessageType != MessageTypeErrorIndication {
+		err = fmt.Errorf("gtp: not an Error Indication: %s",
+			messageTypeStr[h.MessageType])
+		return
+	}
+	e.Header = h
+
+	hasTEID := false
+	for len(payload) > 0 {
+		ieType := readPayloadByte(&payload)
+		switch {
+		case ieType == ieTypeTEIDDataI && len(payload) >= 4:
+			e.TEID = readPayloadUint32(&payload)
+			hasTEID = true
+		case ieType >= 128 && len(payload) >= 2: // TLV
+			length := int(readPayloadUint16(&payload))
+			if len(payload) < length {
+				err = fmt.Errorf("gtp: truncated IE in Error Indication: %d",
+					ieType)
+				return
+			}
+			v := readPayloadByteSlice(&payload, length)
+			if ieType == ieTypeGTPUPeerAddress {
+				if length != net.IPv4len && length != net.IPv6len {
+					err = fmt.Errorf("gtp: invalid GTP-U Peer Address: %x", v)
+					return
+				}
+				e.PeerAddr = net.IP(append([]byte{}, v...))
+			}
+		default:
+			err = fmt.Errorf("gtp: invalid IE in Error Indication: %d",
+				ieType)
+			return
+		}
+	}
+
+	if !hasTEID || e.PeerAddr == nil {
+		err = fmt.Errorf("gtp: mandatory IE missing in Error Indication")
+	}
+	return
+}
+
+// 7.3.2 End Marker
+// MakeEndMarker returns the End Marker to the TEID of the peer, which is
+// the last packet of the tunnel before the path is switched.
+func MakeEndMarker(teid uint32) (pdu []byte) {
+	pdu = encMessage(MessageTypeEndMarker, teid, false, 0, nil)
+	return
+}
+
+// Handler has the callbacks for the Echo Response, the Error Indication and
+// the End Marker received from the peer. the nil callback ignores the
+// message. the extension headers of the message are valid only in the
+// callback.
+type Handler struct {
+	EchoResponse    func(e Echo, from *net.UDPAddr)
+	ErrorIndication func(e ErrorIndication, from *net.UDPAddr)
+	EndMarker       func(teid uint32, from *net.UDPAddr)
+}
+
+// Handle calls the callback for the Echo Response, the Error Indication or
+// the End Marker, and returns false for the other messages.
+func (hd *Handler) Handle(pdu []byte, from *net.UDPAddr) (
+	handled bool, err error) {
+
+	h, _, err := DecodeHeader(pdu)
+	if err != nil {
+		return
+	}
+
+	switch h.MessageType {
+	case MessageTypeEchoResponse:
+		handled = true
+		var e Echo
+		if e, err = DecodeEcho(pdu); err != nil {
+			return
+		}
+		if hd.EchoResponse != nil {
+			hd.EchoResponse(e, from)
+		}
+	case MessageTypeErrorIndication:
+		handled = true
+		var e ErrorIndication
+		if e, err = DecodeErrorIndication(pdu); err != nil {
+			return
+		}
+		if hd.ErrorIndication != nil {
+			hd.ErrorIndication(e, from)
+		}
+	case MessageTypeEndMarker:
+		handled = true
+		if hd.EndMarker != nil {
+			hd.EndMarker(h.TEID, from)
+		}
+	}
+	return
+}
+
+// Dispatcher owns the N3 socket shared by all of the tunnels, and hands the
+// T-PDU to the queue of the tunnel looked up by the local TEID. the Echo
+// Request is answered, the T-PDU to the unknown TEID is answered with the
+// Error Indication, and the other messages are passed to the Handler.
+type Dispatcher struct {
+	Conn      *net.UDPConn
+	LocalAddr net.IP // in the Error Indication.
+	Handler   Handler
+
+	mu      sync.RWMutex
+	tunnels map[uint32]dispatchEntry // keyed by the local TEID.
+
+	stats DispatcherStats // accessed atomically.
+}
+
+type dispatchEntry struct {
+	tunnel *GTP
+	queue  chan<- Packet
+}
+
+// Packet is the T-PDU dispatched to the tunnel. the payload is owned by
+// the receiver of the queue, which may return the buffer of the payload to
+// the pool by Release when it is done.
+type Packet struct {
+	Tunnel  *GTP
+	Header  Header
+	Payload []byte
+	From    *net.UDPAddr
+	Buffer  *Buffer // nil if not from the pool.
+}
+
+// Release returns the buffer of the payload to the pool, if any.
+func (p Packet) Release() {
+	p.Buffer.Release()
+}
+
+// BufferSize is the size of the buffers in the pool, which is enough for
+// the message in the jumbo frame.
+const BufferSize = 9216
+
+// Buffer is the buffer of a message from the pool. the buffers are reused
+// to receive and to send the messages without the allocation.
+type Buffer struct {
+	B []byte
+
+	// the extension headers of the message decoded by the dispatcher,
+	// which refer to B as well.
+	ext [2]ExtensionHeader
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return &Buffer{B: make([]byte, BufferSize)}
+	},
+}
+
+// NewBuffer returns the buffer of BufferSize from the pool.
+func NewBuffer() *Buffer {
+	return bufferPool.Get().(*Buffer)
+}
+
+// Release returns the buffer to the pool. the buffer must not be used
+// after that.
+func (b *Buffer) Release() {
+	if b != nil {
+		bufferPool.Put(b)
+	}
+}
+
+// Message is the message read from or written to the socket in a batch.
+type Message struct {
+	Buffer  *Buffer
+	Payload []byte // in the buffer.
+	Addr    *net.UDPAddr
+}
+
+// BatchReader reads the messages into the buffers, and returns the number
+// of the messages read, e.g. by recvmmsg(2).
+type BatchReader interface {
+	ReadBatch(msgs []Message) (n int, err error)
+}
+
+// DispatcherStats has the counters of the received messages. Dropped is the
+// T-PDUs dropped because the queue of the tunnel is full.
+type DispatcherStats struct {
+	Received    uint64
+	Dispatched  uint64
+	Dropped     uint64
+	UnknownTEID uint64
+	Invalid     uint64
+}
+
+func NewDispatcher(conn *net.UDPConn, laddr net.IP) (d *Dispatcher) {
+	d = &Dispatcher{
+		Conn:      conn,
+		LocalAddr: laddr,
+		tunnels:   map[uint32]dispatchEntry{},
+	}
 	return
 }
+
+// Listen opens the N3 socket of the family of the local address, IPv4 or
+// IPv6, and returns the dispatcher of it. the port should be Port.
+func Listen(laddr *net.UDPAddr) (d *Dispatcher, err error) {
+	network := "udp4"
+	if laddr.IP.To4() == nil {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		err = fmt.Errorf("gtp: %v", err)
+		return
+	}
+	d = NewDispatcher(conn, laddr.IP)
+	return
+}
+
+// Register adds the tunnel with the queue, which may be shared by the
+// tunnels of the UE. the queue should be buffered, or the T-PDUs are
+// dropped while the receiver is busy.
+func (d *Dispatcher) Register(tunnel *GTP, queue chan<- Packet) (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.tunnels[tunnel.LocalTEID]; ok {
+		err = fmt.Errorf("gtp: TEID already registered: %d",
+			tunnel.LocalTEID)
+		return
+	}
+	d.tunnels[tunnel.LocalTEID] = dispatchEntry{tunnel, queue}
+	return
+}
+
+func (d *Dispatcher) Unregister(teid uint32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.tunnels, teid)
+	return
+}
+
+// Lookup returns the tunnel of the local TEID, or nil if not registered.
+func (d *Dispatcher) Lookup(teid uint32) *GTP {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.tunnels[teid].tunnel
+}
+
+func (d *Dispatcher) Stats() (st DispatcherStats) {
+	st.Received = atomic.LoadUint64(&d.stats.Received)
+	st.Dispatched = atomic.LoadUint64(&d.stats.Dispatched)
+	st.Dropped = atomic.LoadUint64(&d.stats.Dropped)
+	st.UnknownTEID = atomic.LoadUint64(&d.stats.UnknownTEID)
+	st.Invalid = atomic.LoadUint64(&d.stats.Invalid)
+	return
+}
+
+// Serve reads the messages from the socket until it fails, e.g. by closing
+// the socket.
+func (d *Dispatcher) Serve() error {
+
+	buf := NewBuffer()
+	for {
+		n, from, err := d.Conn.ReadFromUDP(buf.B)
+		if err != nil {
+			buf.Release()
+			return err
+		}
+		// the buffer handed over is not shared with the next message.
+		if handed, _ := d.dispatch(buf.B[:n], from, buf); handed {
+			buf = NewBuffer()
+		}
+	}
+}
+
+// ServeBatch reads the messages from the reader in batches of the size
+// until it fails. the buffers handed over are renewed from the pool.
+func (d *Dispatcher) ServeBatch(r BatchReader, size int) error {
+
+	msgs := make([]Message, size)
+	for i := range msgs {
+		msgs[i].Buffer = NewBuffer()
+	}
+	defer func() {
+		for _, m := range msgs {
+			m.Buffer.Release()
+		}
+	}()
+
+	for {
+		n, err := r.ReadBatch(msgs)
+		if err != nil {
+			return err
+		}
+		for i := range msgs[:n] {
+			m := &msgs[i]
+			if handed, _ := d.dispatch(m.Payload, m.Addr, m.Buffer); handed {
+				m.Buffer = NewBuffer()
+			}
+		}
+	}
+}
+
+// Dispatch handles the message received from the peer.
+func (d *Dispatcher) Dispatch(pdu []byte, from *net.UDPAddr) (err error) {
+	_, err = d.dispatch(pdu, from, nil)
+	return
+}
+
+// dispatch returns true if the buffer of the message is handed over to the
+// queue. the other messages are done with the buffer on return, which is
+// reused for the next message.
+func (d *Dispatcher) dispatch(pdu []byte, from *net.UDPAddr, buf *Buffer) (
+	handed bool, err error) {
+
+	atomic.AddUint64(&d.stats.Received, 1)
+
+	var h Header
+	if buf != nil {
+		h.ExtensionHeaders = buf.ext[:0]
+	}
+	payload, err := h.Decode(pdu)
+	if err != nil {
+		atomic.AddUint64(&d.stats.Invalid, 1)
+		return
+	}
+
+	switch h.MessageType {
+	case MessageTypeTPDU:
+		handed, err = d.dispatchTPDU(h, payload, from, buf)
+	case MessageTypeEchoRequest:
+		rsp := MakeEchoResponse(h.SequenceNumber, 0)
+		_, err = d.Conn.WriteToUDP(rsp, from)
+	default:
+		if _, err = d.Handler.Handle(pdu, from); err != nil {
+			atomic.AddUint64(&d.stats.Invalid, 1)
+		}
+	}
+	return
+}
+
+func (d *Dispatcher) dispatchTPDU(h Header, payload []byte,
+	from *net.UDPAddr, buf *Buffer) (handed bool, err error) {
+
+	d.mu.RLock()
+	e, ok := d.tunnels[h.TEID]
+	d.mu.RUnlock()
+
+	if !ok || e.tunnel.Closed() {
+		atomic.AddUint64(&d.stats.UnknownTEID, 1)
+		ind := MakeErrorIndication(h.TEID, d.LocalAddr)
+		if _, werr := d.Conn.WriteToUDP(ind, from); werr != nil {
+			err = werr
+			return
+		}
+		err = fmt.Errorf("gtp: unknown TEID: %d", h.TEID)
+		return
+	}
+
+	select {
+	case e.queue <- Packet{e.tunnel, h, payload, from, buf}:
+		atomic.AddUint64(&d.stats.Dispatched, 1)
+		handed = true
+	default:
+		atomic.AddUint64(&d.stats.Dropped, 1)
+	}
+	return
+}
+
 //-----
 func readPayloadByte(payload *[]byte) (val byte) {
 	val = byte((*payload)[0])
@@ -198,6 +1367,31 @@ func readPayloadUint32(payload *[]byte) (val uint32) {
 	return
 }
 
+func readPayloadUint24(payload *[]byte) (val uint32) {
+	p := *payload
+	val = uint32(p[0])<<16 | uint32(p[1])<<8 | uint32(p[2])
+	*payload = p[3:]
+	return
+}
+
+func readPayloadUint64(payload *[]byte) (val uint64) {
+	val = binary.BigEndian.Uint64(*payload)
+	*payload = (*payload)[8:]
+	return
+}
+
+func appendUint24(pdu []byte, val uint32) []byte {
+	return append(pdu, byte(val>>16), byte(val>>8), byte(val))
+}
+
+func appendUint32(pdu []byte, val uint32) []byte {
+	return append(pdu, byte(val>>24), byte(val>>16), byte(val>>8), byte(val))
+}
+
+func appendUint64(pdu []byte, val uint64) []byte {
+	return appendUint32(appendUint32(pdu, uint32(val>>32)), uint32(val))
+}
+
 func readPayloadByteSlice(payload *[]byte, length int) (val []byte) {
 	val = (*payload)[:length]
 	*payload = (*payload)[length:]
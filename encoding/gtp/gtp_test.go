@@ -1,10 +1,802 @@
 package gtp
 
 import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestXXX(t *testing.T) {
 
 	return
 }
+
+func TestDecapDL(t *testing.T) {
+
+	raw := []byte{0x45, 0x00, 0x00, 0x14}
+
+	// T-PDU with the PDU session container of QFI 5 and RQI.
+	pdu, _ := hex.DecodeString("34ff000c00000001000000850100450" + "0")
+	pdu = append(pdu, raw...)
+
+	gtp := NewGTP(1, 2)
+	payload, info, err := gtp.DecapDL(pdu)
+	if err != nil || bytes.Equal(payload, raw) == false {
+		t.Errorf("payload expect: %x, actual: %x, %v", raw, payload, err)
+	}
+	expect := DLPduSessionInformation{QosFlowID: 5, RQI: true}
+	if info == nil || *info != expect {
+		t.Errorf("PDU session information expect: %+v, actual: %+v",
+			expect, info)
+	}
+
+	// without the extension header.
+	pdu, _ = hex.DecodeString("30ff000400000001")
+	pdu = append(pdu, raw...)
+	payload, info, err = gtp.DecapDL(pdu)
+	if err != nil || bytes.Equal(payload, raw) == false || info != nil {
+		t.Errorf("unexpected payload: %x, %+v, %v", payload, info, err)
+	}
+
+	// the uplink packet encapsulated by the peer.
+	peer := NewGTP(2, 1)
+	peer.SetExtensionHeader(true)
+	peer.SetQosFlowID(9)
+	payload, info, err = gtp.DecapDL(peer.Encap(raw))
+	if err != nil || bytes.Equal(payload, raw) == false || info != nil {
+		t.Errorf("unexpected payload: %x, %+v, %v", payload, info, err)
+	}
+}
+
+func TestPduSessionContainer(t *testing.T) {
+
+	raw := []byte{0x45, 0x00, 0x00, 0x14}
+
+	// DL PDU session information with PPI, QMP and SNP.
+	content, _ := hex.DecodeString("0cc560" + "0102030405060708" + "000102")
+	pdu, _ := hex.DecodeString("34ff001800000001" + "00000085" + "04" +
+		hex.EncodeToString(content) + "00")
+	pdu = append(pdu, raw...)
+
+	gtp := NewGTP(1, 2)
+	payload, dl, err := gtp.DecapDL(pdu)
+	if err != nil || bytes.Equal(payload, raw) == false {
+		t.Errorf("payload expect: %x, actual: %x, %v", raw, payload, err)
+	}
+	expectDL := DLPduSessionInformation{
+		QosFlowID:          5,
+		RQI:                true,
+		HasPPI:             true,
+		PPI:                3,
+		QMP:                true,
+		DLSendingTimestamp: 0x0102030405060708,
+		HasSequenceNumber:  true,
+		SequenceNumber:     0x000102,
+	}
+	if dl == nil || *dl != expectDL {
+		t.Errorf("DL PDU session information expect: %+v, actual: %+v",
+			expectDL, dl)
+	}
+	if v := encDLPduSessionInformation(nil, &expectDL); !bytes.Equal(v, content) {
+		t.Errorf("DL PDU session information expect: %x, actual: %x",
+			content, v)
+	}
+
+	// UL PDU session information with all of the optional fields, which
+	// is padded to the multiple of 4 octets.
+	expectUL := ULPduSessionInformation{
+		QosFlowID:                  9,
+		QMP:                        true,
+		DLSendingTimestampRepeated: 0x0102030405060708,
+		DLReceivedTimestamp:        0x1112131415161718,
+		ULSendingTimestamp:         0x2122232425262728,
+		HasDLDelayResult:           true,
+		DLDelayResult:              10,
+		HasULDelayResult:           true,
+		ULDelayResult:              20,
+		HasSequenceNumber:          true,
+		SequenceNumber:             0xabcdef,
+		HasN3N9DelayResult:         true,
+		N3N9DelayResult:            30,
+	}
+	peer := NewGTP(2, 1)
+	pdu = peer.EncapUL(raw, &expectUL)
+	h, payload, err := DecodeHeader(pdu)
+	if err != nil || bytes.Equal(payload, raw) == false {
+		t.Errorf("payload expect: %x, actual: %x, %v", raw, payload, err)
+	}
+	if len(h.ExtensionHeaders) != 1 ||
+		len(h.ExtensionHeaders[0].Content) != 42 {
+		t.Errorf("unexpected extension headers: %+v", h.ExtensionHeaders)
+	}
+	ul := h.ULPduSessionInformation()
+	if ul == nil || *ul != expectUL {
+		t.Errorf("UL PDU session information expect: %+v, actual: %+v",
+			expectUL, ul)
+	}
+	if h.DLPduSessionInformation() != nil {
+		t.Errorf("unexpected DL PDU session information")
+	}
+
+	// the PDU session container is validated in the header.
+	for _, v := range []string{"0805", "2005", "1f09"} {
+		pdu, _ := hex.DecodeString("34ff000800000001" + "00000085" + "01" +
+			v + "00")
+		if _, _, err := DecodeHeader(pdu); err == nil {
+			t.Errorf("PDU session container %s: no error", v)
+		}
+	}
+
+	now := time.Unix(1600000000, 500000000)
+	ts := NTPTimestamp(now)
+	if ts != (1600000000+2208988800)<<32|0x80000000 {
+		t.Errorf("unexpected NTP timestamp: %x", ts)
+	}
+	if NTPTime(ts).Equal(now) == false {
+		t.Errorf("NTP time expect: %v, actual: %v", now, NTPTime(ts))
+	}
+}
+
+func TestDecodeHeader(t *testing.T) {
+
+	// T-PDU with the sequence number, the N-PDU number and two extension
+	// headers, followed by the padding out of the length.
+	pdu, _ := hex.DecodeString("37ff001212345678" + "abcd0140" +
+		"0100ff85" + "0210050000000000" + "4500" + "0000")
+	h, payload, err := DecodeHeader(pdu)
+	expect := Header{
+		Flags:          0x37,
+		MessageType:    MessageTypeTPDU,
+		Length:         0x12,
+		TEID:           0x12345678,
+		SequenceNumber: 0xabcd,
+		NPDUNumber:     0x01,
+		ExtensionHeaders: []ExtensionHeader{
+			{Type: 0x40, Content: []byte{0x00, 0xff}},
+			{Type: 0x85, Content: []byte{0x10, 0x05, 0x00, 0x00, 0x00, 0x00}},
+		},
+	}
+	if err != nil || reflect.DeepEqual(expect, h) == false {
+		t.Errorf("header expect: %+v, actual: %+v, %v", expect, h, err)
+	}
+	if bytes.Equal(payload, []byte{0x45, 0x00}) == false {
+		t.Errorf("unexpected payload: %x", payload)
+	}
+
+	// the uplink PDU session information is not the downlink one.
+	if info := h.DLPduSessionInformation(); info != nil {
+		t.Errorf("unexpected PDU session information: %+v", info)
+	}
+
+	var tests = []struct {
+		pdu  string
+		desc string
+	}{
+		{"30ff0000000000", "truncated header"},
+		{"50ff000000000001", "version 2"},
+		{"20ff000000000001", "GTP'"},
+		{"3064000000000001", "unknown message type"},
+		{"30ff000800000001" + "4500", "truncated message"},
+		{"34ff000400000001" + "000000", "truncated optional fields"},
+		{"34ff000800000001" + "0000008500000000", "zero length extension"},
+		{"34ff000800000001" + "0000008502000000", "truncated extension"},
+	}
+	for _, test := range tests {
+		pdu, _ := hex.DecodeString(test.pdu)
+		if _, _, err := DecodeHeader(pdu); err == nil {
+			t.Errorf("%s: no error", test.desc)
+		}
+	}
+
+	// the TEID is validated with the local TEID.
+	pdu, _ = hex.DecodeString("30ff000400000002" + "45000000")
+	if _, _, err := NewGTP(1, 2).Decode(pdu); err == nil {
+		t.Errorf("unknown TEID: no error")
+	}
+	if NewGTP(1, 2).Decap(pdu) != nil {
+		t.Errorf("unknown TEID: decapsulated")
+	}
+}
+
+func TestEcho(t *testing.T) {
+
+	expect, _ := hex.DecodeString("32010004000000000001" + "0000")
+	req := MakeEchoRequest(1)
+	if bytes.Equal(expect, req) == false {
+		t.Errorf("Echo Request expect: %x, actual: %x", expect, req)
+	}
+
+	// Echo Response with the Recovery and the private extension.
+	rsp, _ := hex.DecodeString("3202000b000000000001" + "0000" +
+		"0e05" + "ff0002abcd")
+	e, err := DecodeEcho(rsp)
+	if err != nil || e.Header.SequenceNumber != 1 ||
+		e.HasRecovery == false || e.RestartCounter != 5 {
+		t.Errorf("unexpected Echo Response: %+v, %v", e, err)
+	}
+
+	if _, err := DecodeEcho(MakeEchoRequest(1)); err != nil {
+		t.Errorf("Echo Request: %v", err)
+	}
+
+	// Echo Response without the Recovery.
+	rsp, _ = hex.DecodeString("32020004000000000001" + "0000")
+	if _, err := DecodeEcho(rsp); err == nil {
+		t.Errorf("Echo Response without Recovery: no error")
+	}
+}
+
+func TestPath(t *testing.T) {
+
+	p := NewPath(net.ParseIP("192.168.1.18"))
+	now := time.Now()
+
+	// the round trip time is 10 and 30 msec, and the restart counter is
+	// changed at the second response.
+	for i, restart := range []uint8{0, 1} {
+		req, _ := DecodeEcho(p.MakeEchoRequest(now))
+		rtt := time.Duration(10+20*i) * time.Millisecond
+		seq := req.Header.SequenceNumber
+		rsp, _ := DecodeEcho(MakeEchoResponse(seq, restart))
+		restarted, err := p.HandleEchoResponse(rsp, now.Add(rtt))
+		if err != nil || restarted != (i == 1) {
+			t.Errorf("response %d: restarted %v, %v", i, restarted, err)
+		}
+	}
+
+	// unknown sequence number.
+	rsp, _ := DecodeEcho(MakeEchoResponse(100, 1))
+	if _, err := p.HandleEchoResponse(rsp, now); err == nil {
+		t.Errorf("unexpected Echo Response: no error")
+	}
+
+	// two requests are lost.
+	p.MakeEchoRequest(now)
+	p.MakeEchoRequest(now.Add(time.Second))
+	if lost := p.Expire(now.Add(2*time.Second), 2*time.Second); lost != 1 {
+		t.Errorf("lost expect: 1, actual: %d", lost)
+	}
+	if lost := p.Expire(now.Add(3*time.Second), 2*time.Second); lost != 2 {
+		t.Errorf("lost expect: 2, actual: %d", lost)
+	}
+
+	expect := PathStats{
+		Sent:            4,
+		Received:        2,
+		Lost:            2,
+		ConsecutiveLost: 2,
+		Restarts:        1,
+		RTTMin:          10 * time.Millisecond,
+		RTTMax:          30 * time.Millisecond,
+		RTTAvg:          20 * time.Millisecond,
+		rttSum:          40 * time.Millisecond,
+	}
+	if st := p.Stats(); st != expect {
+		t.Errorf("stats expect: %+v, actual: %+v", expect, st)
+	}
+}
+
+func TestErrorIndicationAndEndMarker(t *testing.T) {
+
+	expect, _ := hex.DecodeString("321a0010000000000000" + "0000" +
+		"1000000064" + "850004c0a80112")
+	v := MakeErrorIndication(100, net.ParseIP("192.168.1.18"))
+	if bytes.Equal(expect, v) == false {
+		t.Errorf("Error Indication expect: %x, actual: %x", expect, v)
+	}
+
+	var indication ErrorIndication
+	var endMarker uint32
+	hd := Handler{
+		ErrorIndication: func(e ErrorIndication, from *net.UDPAddr) {
+			indication = e
+		},
+		EndMarker: func(teid uint32, from *net.UDPAddr) {
+			endMarker = teid
+		},
+	}
+
+	handled, err := hd.Handle(v, nil)
+	if !handled || err != nil || indication.TEID != 100 ||
+		indication.PeerAddr.Equal(net.ParseIP("192.168.1.18")) == false {
+		t.Errorf("unexpected Error Indication: %+v, %v", indication, err)
+	}
+
+	expect, _ = hex.DecodeString("30fe000000000001")
+	v = MakeEndMarker(1)
+	if bytes.Equal(expect, v) == false {
+		t.Errorf("End Marker expect: %x, actual: %x", expect, v)
+	}
+	if handled, err = hd.Handle(v, nil); !handled || endMarker != 1 {
+		t.Errorf("End Marker is not handled: %v", err)
+	}
+
+	// T-PDU is not handled, and the tunnel closed drops the packets.
+	gtp := NewGTP(1, 1)
+	v = gtp.Encap([]byte{0x45})
+	if handled, _ = hd.Handle(v, nil); handled {
+		t.Errorf("T-PDU is handled")
+	}
+	gtp.Close()
+	if gtp.Encap([]byte{0x45}) != nil || gtp.Decap(v) != nil {
+		t.Errorf("the tunnel is not closed")
+	}
+
+	// the GTP-U Peer Address is mandatory.
+	v, _ = hex.DecodeString("321a0009000000000000" + "0000" + "1000000064")
+	if _, err = DecodeErrorIndication(v); err == nil {
+		t.Errorf("Error Indication without GTP-U Peer Address: no error")
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+
+	lo := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	conn, err := net.ListenUDP("udp", lo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := net.ListenUDP("udp", lo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	from := peer.LocalAddr().(*net.UDPAddr)
+
+	d := NewDispatcher(conn, net.ParseIP("192.168.1.1"))
+
+	// the tunnels of the UE share the queue.
+	const nUE, nTunnel = 10, 1000
+	queues := make([]chan Packet, nUE)
+	for i := range queues {
+		queues[i] = make(chan Packet, nTunnel/nUE)
+	}
+	for teid := uint32(1); teid <= nTunnel; teid++ {
+		q := queues[teid%nUE]
+		if err := d.Register(NewGTP(teid, teid), q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Register(NewGTP(1, 1), queues[0]); err == nil {
+		t.Errorf("duplicate TEID: no error")
+	}
+	if d.Lookup(nTunnel) == nil || d.Lookup(nTunnel+1) != nil {
+		t.Errorf("unexpected lookup")
+	}
+
+	for teid := uint32(1); teid <= nTunnel; teid++ {
+		raw := []byte{0x45, byte(teid)}
+		pdu := NewGTP(teid, teid).Encap(raw)
+		if err := d.Dispatch(pdu, from); err != nil {
+			t.Errorf("TEID %d: %v", teid, err)
+		}
+	}
+	for i, q := range queues {
+		if len(q) != nTunnel/nUE {
+			t.Errorf("queue %d: %d packets", i, len(q))
+		}
+		for len(q) > 0 {
+			p := <-q
+			teid := p.Tunnel.LocalTEID
+			if p.Header.TEID != teid || int(teid%nUE) != i ||
+				bytes.Equal(p.Payload, []byte{0x45, byte(teid)}) == false {
+				t.Errorf("queue %d: unexpected packet: %+v", i, p)
+			}
+		}
+	}
+
+	// the packets are dropped while the queue is full.
+	for i := 0; i <= nTunnel/nUE; i++ {
+		d.Dispatch(NewGTP(nUE, nUE).Encap([]byte{0x45}), from)
+	}
+	if st := d.Stats(); st.Dispatched != nTunnel+nTunnel/nUE ||
+		st.Dropped != 1 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+
+	buf := make([]byte, 1500)
+	recv := func() []byte {
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := peer.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+
+	// the T-PDU to the unknown TEID is answered with the Error Indication.
+	d.Unregister(1)
+	if err := d.Dispatch(NewGTP(1, 1).Encap([]byte{0x45}), from); err == nil {
+		t.Errorf("unknown TEID: no error")
+	}
+	e, err := DecodeErrorIndication(recv())
+	if err != nil || e.TEID != 1 ||
+		e.PeerAddr.Equal(net.ParseIP("192.168.1.1")) == false {
+		t.Errorf("unexpected Error Indication: %+v, %v", e, err)
+	}
+
+	// the Echo Request is answered, and the others go to the handler.
+	d.Dispatch(MakeEchoRequest(7), from)
+	if echo, err := DecodeEcho(recv()); err != nil ||
+		echo.Header.MessageType != MessageTypeEchoResponse ||
+		echo.Header.SequenceNumber != 7 {
+		t.Errorf("unexpected Echo Response: %+v, %v", echo, err)
+	}
+	var endMarker uint32
+	d.Handler.EndMarker = func(teid uint32, from *net.UDPAddr) {
+		endMarker = teid
+	}
+	d.Dispatch(MakeEndMarker(2), from)
+	if endMarker != 2 {
+		t.Errorf("End Marker is not handled")
+	}
+
+	// the messages are read from the socket.
+	done := make(chan error)
+	go func() {
+		done <- d.Serve()
+	}()
+	for len(queues[2]) > 0 {
+		<-queues[2]
+	}
+	laddr := conn.LocalAddr().(*net.UDPAddr)
+	peer.WriteToUDP(NewGTP(2, 2).Encap([]byte{0x45}), laddr)
+	select {
+	case p := <-queues[2]:
+		if p.Tunnel.LocalTEID != 2 || p.From.Port != from.Port {
+			t.Errorf("unexpected packet: %+v", p)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no packet dispatched")
+	}
+	conn.Close()
+	if err := <-done; err == nil {
+		t.Errorf("Serve returns no error")
+	}
+}
+
+func TestListenIPv6(t *testing.T) {
+
+	lo := &net.UDPAddr{IP: net.IPv6loopback}
+	d, err := Listen(lo)
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	defer d.Conn.Close()
+	if laddr := d.Conn.LocalAddr().(*net.UDPAddr); laddr.IP.To4() != nil {
+		t.Errorf("unexpected local address: %v", laddr)
+	}
+
+	peer, err := net.ListenUDP("udp6", lo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	go d.Serve()
+
+	q := make(chan Packet, 1)
+	d.Register(NewGTP(1, 2), q)
+
+	buf := make([]byte, 1500)
+	send := func(pdu []byte) []byte {
+		_, err := peer.WriteToUDP(pdu, d.Conn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := peer.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+
+	e, err := DecodeEcho(send(MakeEchoRequest(7)))
+	if err != nil || e.Header.MessageType != MessageTypeEchoResponse ||
+		e.Header.SequenceNumber != 7 {
+		t.Errorf("unexpected Echo Response: %+v, %v", e, err)
+	}
+
+	// the Error Indication has the IPv6 address of the gNB.
+	ind, err := DecodeErrorIndication(send(NewGTP(3, 3).Encap([]byte{0x60})))
+	if err != nil || ind.TEID != 3 || ind.PeerAddr.Equal(lo.IP) == false {
+		t.Errorf("unexpected Error Indication: %+v, %v", ind, err)
+	}
+
+	peer.WriteToUDP(NewGTP(2, 1).Encap([]byte{0x60}),
+		d.Conn.LocalAddr().(*net.UDPAddr))
+	select {
+	case p := <-q:
+		if p.From.IP.To4() != nil || !bytes.Equal(p.Payload, []byte{0x60}) {
+			t.Errorf("unexpected packet: %+v", p)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no T-PDU dispatched")
+	}
+}
+
+func TestEncapInPlace(t *testing.T) {
+
+	raw := []byte{0x45, 0x00, 0x00, 0x14}
+	full := &ULPduSessionInformation{
+		QosFlowID:          9,
+		QMP:                true,
+		HasDLDelayResult:   true,
+		HasULDelayResult:   true,
+		HasSequenceNumber:  true,
+		HasN3N9DelayResult: true,
+	}
+	gtp := NewGTP(1, 2)
+
+	for _, info := range []*ULPduSessionInformation{nil, full} {
+		buf := NewBuffer()
+		copy(buf.B[HeaderRoom:], raw)
+		v := gtp.EncapInPlace(buf.B[:HeaderRoom+len(raw)], info)
+		expect := gtp.EncapUL(raw, info)
+		if bytes.Equal(expect, v) == false {
+			t.Errorf("EncapInPlace\nexpect: %x\nactual: %x", expect, v)
+		}
+		if &v[len(v)-1] != &buf.B[HeaderRoom+len(raw)-1] {
+			t.Errorf("the packet is copied")
+		}
+		buf.Release()
+	}
+
+	gtp.Close()
+	if gtp.EncapInPlace(make([]byte, HeaderRoom+len(raw)), nil) != nil {
+		t.Errorf("closed tunnel: encapsulated")
+	}
+}
+
+// batchReader returns the same messages in every batch.
+type batchReader struct {
+	pdu  []byte
+	from *net.UDPAddr
+	n    int // the batches left.
+	bufs map[*Buffer]bool
+}
+
+func (r *batchReader) ReadBatch(msgs []Message) (n int, err error) {
+	if r.n == 0 {
+		return 0, fmt.Errorf("closed")
+	}
+	r.n--
+	for i := range msgs {
+		if r.bufs != nil {
+			r.bufs[msgs[i].Buffer] = true
+		}
+		n := copy(msgs[i].Buffer.B, r.pdu)
+		msgs[i].Payload = msgs[i].Buffer.B[:n]
+		msgs[i].Addr = r.from
+	}
+	return len(msgs), nil
+}
+
+func TestServeBatch(t *testing.T) {
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	d := NewDispatcher(conn, net.ParseIP("192.168.1.1"))
+	q := make(chan Packet, 16)
+	d.Register(NewGTP(1, 1), q)
+
+	const size = 8
+	r := &batchReader{
+		pdu:  NewGTP(1, 1).Encap([]byte{0x45, 0x01}),
+		from: conn.LocalAddr().(*net.UDPAddr),
+		n:    3,
+	}
+	if err := d.ServeBatch(r, size); err == nil {
+		t.Errorf("ServeBatch returns no error")
+	}
+
+	// the packets have their own buffers, and the ones not queued are
+	// dropped.
+	seen := map[*Buffer]bool{}
+	for len(q) > 0 {
+		p := <-q
+		if p.Buffer == nil || seen[p.Buffer] ||
+			bytes.Equal(p.Payload, []byte{0x45, 0x01}) == false {
+			t.Errorf("unexpected packet: %+v", p)
+		}
+		seen[p.Buffer] = true
+		p.Release()
+	}
+	if st := d.Stats(); st.Received != 3*size || st.Dispatched != 16 ||
+		st.Dropped != 3*size-16 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+
+	// the buffers of the messages to the handler are reused.
+	markers := 0
+	d.Handler.EndMarker = func(teid uint32, from *net.UDPAddr) {
+		markers++
+	}
+	r = &batchReader{
+		pdu:  MakeEndMarker(1),
+		from: conn.LocalAddr().(*net.UDPAddr),
+		n:    3,
+		bufs: map[*Buffer]bool{},
+	}
+	d.ServeBatch(r, size)
+	if markers != 3*size || len(r.bufs) != size {
+		t.Errorf("unexpected buffers: %d markers, %d buffers",
+			markers, len(r.bufs))
+	}
+}
+
+// reportPacketRate reports the packets per second of the benchmark, which
+// runs on a core unless it is parallel.
+func reportPacketRate(b *testing.B, start time.Time, packets int) {
+	b.ReportMetric(float64(packets)/time.Since(start).Seconds(), "pkt/s")
+}
+
+func BenchmarkEncap(b *testing.B) {
+
+	raw := make([]byte, 1400)
+	gtp := NewGTP(1, 2)
+	info := &ULPduSessionInformation{QosFlowID: 9}
+	b.ReportAllocs()
+	start := time.Now()
+
+	for i := 0; i < b.N; i++ {
+		gtp.EncapUL(raw, info)
+	}
+	reportPacketRate(b, start, b.N)
+}
+
+func BenchmarkEncapInPlace(b *testing.B) {
+
+	buf := NewBuffer()
+	defer buf.Release()
+	pkt := buf.B[:HeaderRoom+1400]
+	gtp := NewGTP(1, 2)
+	b.ReportAllocs()
+	start := time.Now()
+
+	for i := 0; i < b.N; i++ {
+		gtp.EncapInPlace(pkt, nil)
+	}
+	reportPacketRate(b, start, b.N)
+}
+
+// the T-PDU with the PDU session container, which is encapsulated and
+// decoded without the allocation.
+var containerInfo = &ULPduSessionInformation{
+	QosFlowID:          9,
+	QMP:                true,
+	HasSequenceNumber:  true,
+	SequenceNumber:     0xabcdef,
+	HasN3N9DelayResult: true,
+}
+
+func containerPDU() []byte {
+	pdu, _ := hex.DecodeString("34ff001800000001" + "00000085" + "04" +
+		"0cc560" + "0102030405060708" + "000102" + "00" + "45000014")
+	return pdu
+}
+
+// noAllocs fails if f takes the allocation.
+func noAllocs(tb testing.TB, name string, f func()) {
+	if n := testing.AllocsPerRun(100, f); n != 0 {
+		tb.Errorf("%s: %v allocs/op", name, n)
+	}
+}
+
+func TestNoAllocation(t *testing.T) {
+
+	raw := []byte{0x45, 0x00, 0x00, 0x14}
+	buf := NewBuffer()
+	defer buf.Release()
+	pkt := buf.B[:HeaderRoom+len(raw)]
+	copy(pkt[HeaderRoom:], raw)
+
+	gtp := NewGTP(1, 2)
+	noAllocs(t, "EncapInPlace", func() {
+		gtp.EncapInPlace(pkt, containerInfo)
+	})
+	expect := gtp.EncapUL(raw, containerInfo)
+	if v := gtp.EncapInPlace(pkt, containerInfo); !bytes.Equal(v, expect) {
+		t.Errorf("T-PDU expect: %x, actual: %x", expect, v)
+	}
+
+	pdu := containerPDU()
+	h := Header{ExtensionHeaders: make([]ExtensionHeader, 0, 1)}
+	var dl DLPduSessionInformation
+	noAllocs(t, "Decode", func() {
+		h.Decode(pdu)
+		h.DecodeDLPduSessionInformation(&dl)
+	})
+	if dl.QosFlowID != 5 || dl.SequenceNumber != 0x000102 ||
+		len(h.ExtensionHeaders) != 1 {
+		t.Errorf("unexpected header: %+v, %+v", h, dl)
+	}
+
+	// the extension headers of the T-PDU dispatched are in the buffer.
+	d := NewDispatcher(nil, net.ParseIP("192.168.1.1"))
+	q := make(chan Packet, 1)
+	d.Register(NewGTP(1, 1), q)
+	msg := buf.B[:copy(buf.B, pdu)]
+	noAllocs(t, "dispatch", func() {
+		d.dispatch(msg, nil, buf)
+		<-q
+	})
+}
+
+func BenchmarkEncapInPlaceContainer(b *testing.B) {
+
+	buf := NewBuffer()
+	defer buf.Release()
+	pkt := buf.B[:HeaderRoom+1400]
+	gtp := NewGTP(1, 2)
+	noAllocs(b, "EncapInPlace", func() {
+		gtp.EncapInPlace(pkt, containerInfo)
+	})
+	b.ReportAllocs()
+	start := time.Now()
+
+	for i := 0; i < b.N; i++ {
+		gtp.EncapInPlace(pkt, containerInfo)
+	}
+	reportPacketRate(b, start, b.N)
+}
+
+func BenchmarkDecodeContainer(b *testing.B) {
+
+	pdu := containerPDU()
+	h := Header{ExtensionHeaders: make([]ExtensionHeader, 0, 1)}
+	var dl DLPduSessionInformation
+	decode := func() {
+		h.Decode(pdu)
+		h.DecodeDLPduSessionInformation(&dl)
+	}
+	noAllocs(b, "Decode", decode)
+	b.ReportAllocs()
+	start := time.Now()
+
+	for i := 0; i < b.N; i++ {
+		decode()
+	}
+	reportPacketRate(b, start, b.N)
+}
+
+// BenchmarkServeBatch dispatches the T-PDUs of the tunnels to the queues,
+// and the receivers return the buffers to the pool.
+func BenchmarkServeBatch(b *testing.B) {
+
+	const size, nTunnel = 64, 16
+	d := NewDispatcher(nil, net.ParseIP("192.168.1.1"))
+	q := make(chan Packet, 1024)
+	for teid := uint32(1); teid <= nTunnel; teid++ {
+		d.Register(NewGTP(teid, teid), q)
+	}
+	done := make(chan struct{})
+	go func() {
+		for p := range q {
+			p.Release()
+		}
+		close(done)
+	}()
+
+	r := &batchReader{
+		pdu:  NewGTP(1, 1).Encap(make([]byte, 1400)),
+		from: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: Port},
+		n:    b.N/size + 1,
+	}
+	b.ReportAllocs()
+	start := time.Now()
+
+	d.ServeBatch(r, size)
+	close(q)
+	<-done
+	reportPacketRate(b, start, (b.N/size+1)*size)
+}
@@ -18,10 +18,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aead/cmac"
 	"github.com/wmnsk/milenage"
@@ -34,33 +38,107 @@ type UE struct {
 	MCC              int
 	MNC              int
 	IMEISV           string
+	IMEI             string
+	MACAddress       string
 	RoutingIndicator uint16
 	ProtectionScheme string
 	AuthParam        AuthParam
 	SNSSAI           SNSSAI
+	RequestedNSSAI   []SNSSAI
+	SubscribedNSSAI  []SNSSAI
 	DNN              string
 	URL              string
+	URLv6            string
+	PDUSessionType   string // "IPv4", "IPv6" or "IPv4v6".
+
+	// PDU sessions to be established. the DNN, S-NSSAI and PDU session
+	// type above are used if not given.
+	PDUSessions []PDUSessionParam
+
+	// re-register automatically after the network initiated
+	// de-registration with "re-registration required".
+	AutoReRegistration bool
+
+	// go to CM-IDLE by the UE context release after the user plane test,
+	// and back to CM-CONNECTED by the service request.
+	IdleResume bool
+
+	// de-register by switching off. the UE does not wait for the
+	// De-registration Accept.
+	SwitchOff bool
+
+	// indicate the support of reflective QoS in the PDU session
+	// establishment request.
+	ReflectiveQoS bool
+
+	// request the DNS server addresses in the PDU session establishment
+	// request. see PDUSession.DNS.
+	RequestDNS bool
 
 	MMstate int
+	CMstate int
+
+	// Deprecated: the state of the first PDU session for the users of the
+	// single PDU session. use PDUSession and ActivePDUSessions instead.
 	SMstate int
 
+	UpdateStatus int
+
+	// set when the network rejected the UE with the 5GMM cause #3, #6
+	// or #7. the UE does not attempt the registration any more.
+	USIMInvalid        bool
+	ServicesNotAllowed bool
+
+	// TimerValue overrides the value of the 5GMM timers, e.g.
+	// {"T3510": "1s"} for the accelerated testing.
+	TimerValue map[string]string
+
+	timer          [timerMax]nasTimer
+	timerEvent     chan TimerEvent
+	attemptCounter int // registration attempt counter.
+
 	sm struct {
-		pduSessionId           uint8
-		procedureTransactionId uint8
+		session map[uint8]*PDUSession // keyed by PSI.
+		pti     uint8                 // last allocated PTI.
+		current *PDUSession           // the PDU session being decoded.
 	}
 
 	Recv struct {
 		flag struct {
-			imeisv bool
-			rinmr  bool
+			imeisv                bool
+			rinmr                 bool
+			configUpdateAck       bool
+			registrationRequested bool
 		}
 		state        int
+		identityType int
 		fiveGGUTI    []byte
 		tai          []TAI
 		allowedNSSAI []SNSSAI
+		configNSSAI  []SNSSAI
+		rejectNSSAI  []RejectedSNSSAI
 		t3502        int
 		t3512        int
-		PDUAddress   net.IP
+		t3346        int
+
+		// received by the Configuration Update Command.
+		NetworkFullName  string
+		NetworkShortName string
+		NetworkTime      time.Time
+		TimeZone         int // offset from UTC in minutes.
+		DaylightSaving   int // adjustment in hours.
+		ladn             []LADN
+
+		ngKSI                  uint8
+		pduSessionStatus       uint16
+		pduSessionReactivation uint16
+		mmCause                uint8
+		authFailureCause       uint8
+		reRegistrationRequired bool
+
+		// Deprecated: the IPv4 address of the first PDU session. use
+		// PDUSession.Address instead.
+		PDUAddress net.IP
 	}
 
 	NasCount uint32
@@ -96,6 +174,32 @@ var MMstateStr = map[int]string{
 	MMDeregistaredInitiated:   "5GMM DEREGISTERED-INITIATED",
 }
 
+// TS 23.501 5.3.3.2 5GS Connection Management states
+// actual value is not defined in the standard.
+const (
+	CMIdle = iota
+	CMConnected
+)
+
+var CMstateStr = map[int]string{
+	CMIdle:      "CM-IDLE",
+	CMConnected: "CM-CONNECTED",
+}
+
+// 5.1.3.2.2 5GS update status
+// actual value is not defined in the standard.
+const (
+	UpdateStatusUpdated = iota
+	UpdateStatusNotUpdated
+	UpdateStatusRoamingNotAllowed
+)
+
+var UpdateStatusStr = map[int]string{
+	UpdateStatusUpdated:           "5U1 UPDATED",
+	UpdateStatusNotUpdated:        "5U2 NOT UPDATED",
+	UpdateStatusRoamingNotAllowed: "5U3 ROAMING NOT ALLOWED",
+}
+
 // 6.1.3 5GSM sublayer states
 // actual value is not defined in the standard.
 const (
@@ -114,12 +218,61 @@ var SMstateStr = map[int]string{
 	SMActive:              "5GSM PDU SESSION ACTIVE",
 }
 
+// PDUSession is the context of the PDU session in the UE.
+type PDUSession struct {
+	PSI      uint8
+	PTI      uint8 // PTI of the procedure in progress.
+	State    int
+	DNN      string
+	SNSSAI   SNSSAI
+	Type     uint8
+	Address  net.IP // IPv4 address.
+	QoSRules []QoSRule
+	QoSFlows []QoSFlowDescription
+	AMBR     SessionAMBR
+
+	// IPv6 interface identifier assigned by the network, and the address
+	// configured with the prefix advertised in the user plane.
+	InterfaceID net.IP
+	AddressV6   net.IP
+
+	// 5GSM cause and back-off timer received last.
+	Cause   uint8
+	Backoff time.Duration
+
+	// RQ timer of the UE-derived QoS rules. see DerivedQoSRules.
+	RQTimer time.Duration
+	rqos    *reflectiveQoS
+
+	// the indexes of QoSRules in the order of the precedence.
+	ruleOrder []int
+
+	// DNS server addresses given by the network.
+	DNS []net.IP
+}
+
+// PDUSessionParam is the parameter of the PDU session to be established.
+type PDUSessionParam struct {
+	DNN    string
+	SNSSAI *SNSSAI
+	Type   string // "IPv4", "IPv6" or "IPv4v6".
+}
+
 // my receive flag definition
 const (
 	rcvdNull = iota
 	rcvdAuthenticationRequest
 	rcvdSecurityModeCommand
 	rcvdRegistrationAccept
+	rcvdServiceAccept
+	rcvdServiceReject
+	rcvdIdentityRequest
+	rcvdAuthRequestFailed
+	rcvdAuthenticationReject
+	rcvdDeregistrationRequest
+	rcvdDeregistrationAccept
+	rcvdConfigUpdateCommand
+	rcvdRegistrationReject
 )
 
 var rcvdStateStr = map[int]string{
@@ -127,6 +280,15 @@ var rcvdStateStr = map[int]string{
 	rcvdAuthenticationRequest: "Received Authentication Request",
 	rcvdSecurityModeCommand:   "Received Security Mode Command",
 	rcvdRegistrationAccept:    "Received Registration Accept",
+	rcvdServiceAccept:         "Received Service Accept",
+	rcvdServiceReject:         "Received Service Reject",
+	rcvdIdentityRequest:       "Received Identity Request",
+	rcvdAuthRequestFailed:     "Received Authentication Request (failed)",
+	rcvdAuthenticationReject:  "Received Authentication Reject",
+	rcvdDeregistrationRequest: "Received Deregistration Request",
+	rcvdDeregistrationAccept:  "Received Deregistration Accept",
+	rcvdConfigUpdateCommand:   "Received Configuration Update Command",
+	rcvdRegistrationReject:    "Received Registration Reject",
 }
 
 // TS 24.007 11.2.3.1.1A Extended protocol discriminator (EPD)
@@ -154,39 +316,87 @@ const (
 	MessageTypeRegistrationRequest            = 0x41
 	MessageTypeRegistrationAccept             = 0x42
 	MessageTypeRegistrationComplete           = 0x43
+	MessageTypeRegistrationReject             = 0x44
 	MessageTypeDeregistrationRequest          = 0x45
 	MessageTypeDeregistrationAccept           = 0x46
+	MessageTypeDeregistrationRequestUETerm    = 0x47
+	MessageTypeDeregistrationAcceptUETerm     = 0x48
+	MessageTypeServiceRequest                 = 0x4c
+	MessageTypeServiceReject                  = 0x4d
+	MessageTypeServiceAccept                  = 0x4e
+	MessageTypeConfigurationUpdateCommand     = 0x54
+	MessageTypeConfigurationUpdateComplete    = 0x55
 	MessageTypeAuthenticationRequest          = 0x56
 	MessageTypeAuthenticationResponse         = 0x57
+	MessageTypeAuthenticationReject           = 0x58
+	MessageTypeAuthenticationFailure          = 0x59
+	MessageTypeAuthenticationResult           = 0x5a
+	MessageTypeIdentityRequest                = 0x5b
+	MessageTypeIdentityResponse               = 0x5c
 	MessageTypeSecurityModeCommand            = 0x5d
 	MessageTypeSecurityModeComplete           = 0x5e
+	MessageType5GMMStatus                     = 0x64
 	MessageTypeULNasTransport                 = 0x67
 	MessageTypeDLNasTransport                 = 0x68
 	MessageTypePDUSessionEstablishmentRequest = 0xc1
 	MessageTypePDUSessionEstablishmentAccept  = 0xc2
+	MessageTypePDUSessionEstablishmentReject  = 0xc3
+	MessageTypePDUSessionModificationRequest  = 0xc9
+	MessageTypePDUSessionModificationReject   = 0xca
+	MessageTypePDUSessionModificationCommand  = 0xcb
+	MessageTypePDUSessionModificationComplete = 0xcc
+	MessageTypePDUSessionReleaseRequest       = 0xd1
+	MessageTypePDUSessionReleaseReject        = 0xd2
+	MessageTypePDUSessionReleaseCommand       = 0xd3
+	MessageTypePDUSessionReleaseComplete      = 0xd4
 )
 
 var msgTypeStr = map[int]string{
 	MessageTypeRegistrationRequest:            "Registration Request",
 	MessageTypeRegistrationAccept:             "Registration Accept",
 	MessageTypeRegistrationComplete:           "Registration Complete",
+	MessageTypeRegistrationReject:             "Registration Reject",
 	MessageTypeDeregistrationRequest:          "Deregistration Request",
 	MessageTypeDeregistrationAccept:           "Deregistration Accept",
+	MessageTypeDeregistrationRequestUETerm:    "Deregistration Request (UE terminated)",
+	MessageTypeDeregistrationAcceptUETerm:     "Deregistration Accept (UE terminated)",
+	MessageTypeServiceRequest:                 "Service Request",
+	MessageTypeServiceReject:                  "Service Reject",
+	MessageTypeServiceAccept:                  "Service Accept",
+	MessageTypeConfigurationUpdateCommand:     "Configuration Update Command",
+	MessageTypeConfigurationUpdateComplete:    "Configuration Update Complete",
 	MessageTypeAuthenticationRequest:          "Authentication Request",
 	MessageTypeAuthenticationResponse:         "Authentication Response",
+	MessageTypeAuthenticationReject:           "Authentication Reject",
+	MessageTypeAuthenticationFailure:          "Authentication Failure",
+	MessageTypeAuthenticationResult:           "Authentication Result",
+	MessageTypeIdentityRequest:                "Identity Request",
+	MessageTypeIdentityResponse:               "Identity Response",
 	MessageTypeSecurityModeCommand:            "Security Mode Command",
 	MessageTypeSecurityModeComplete:           "Security Mode Complete",
+	MessageType5GMMStatus:                     "5GMM Status",
 	MessageTypeULNasTransport:                 "UL NAS Transport",
 	MessageTypeDLNasTransport:                 "DL NAS Transport",
 	MessageTypePDUSessionEstablishmentRequest: "PDU Session Establishment Request",
 	MessageTypePDUSessionEstablishmentAccept:  "PDU Session Establishment Accept",
+	MessageTypePDUSessionEstablishmentReject:  "PDU Session Establishment Reject",
+	MessageTypePDUSessionModificationRequest:  "PDU Session Modification Request",
+	MessageTypePDUSessionModificationReject:   "PDU Session Modification Reject",
+	MessageTypePDUSessionModificationCommand:  "PDU Session Modification Command",
+	MessageTypePDUSessionModificationComplete: "PDU Session Modification Complete",
+	MessageTypePDUSessionReleaseRequest:       "PDU Session Release Request",
+	MessageTypePDUSessionReleaseReject:        "PDU Session Release Reject",
+	MessageTypePDUSessionReleaseCommand:       "PDU Session Release Command",
+	MessageTypePDUSessionReleaseComplete:      "PDU Session Release Complete",
 }
 
 const (
 	ieiRequestType          = 0x8
 	ieiPDUSessionType       = 0x9
+	ieiConfigUpdateInd      = 0xd
 	ieiIMEISVRequest        = 0xe
 	iei5GMMCapability       = 0x10
+	ieiRejectedNSSAI        = 0x11
 	ieiPDUSessionID2        = 0x12
 	ieiNSSAI                = 0x15
 	ieiGPRSTimer2           = 0x16
@@ -194,23 +404,60 @@ const (
 	ieiAuthParamRAND        = 0x21
 	ieiSNSSAI               = 0x22
 	ieiDNN                  = 0x25
+	ieiPDUSessionReactRes   = 0x26
+	iei5GSMCapability       = 0x28
 	ieiPDUAddress           = 0x29
+	ieiSessionAMBR          = 0x2a
 	ieiAuthParamRES         = 0x2d
 	ieiUESecurityCapability = 0x2e
+	ieiRequestedNSSAI       = 0x2f
+	ieiAuthFailureParam     = 0x30
+	ieiConfiguredNSSAI      = 0x31
 	ieiAdditional5GSecInfo  = 0x36
+	ieiBackoffTimerValue    = 0x37
+	ieiABBA                 = 0x38
+	ieiUplinkDataStatus     = 0x40
+	ieiFullNameForNetwork   = 0x43
+	ieiShortNameForNetwork  = 0x45
+	ieiLocalTimeZone        = 0x46
+	ieiUniversalTimeAndLTZ  = 0x47
+	ieiDaylightSavingTime   = 0x49
+	ieiPDUSessionStatus     = 0x50
 	ieiTAIList              = 0x54
+	ieiRQTimerValue         = 0x56
+	iei5GMMCause            = 0x58
 	iei5GSMCause            = 0x59
 	ieiGPRSTimer3           = 0x5e
+	ieiT3346Value           = 0x5f
+	ieiRejectedNSSAIRegRej  = 0x69
 	ieiNASMessageContainer  = 0x71
+	ieiPDUSessionReactErr   = 0x72
 	iei5GSMobileIdentity    = 0x77
+	ieiEAPMessage           = 0x78
+	ieiLADNInformation      = 0x79
+	ieiAuthorizedQoSRules   = 0x7a
+	ieiExtendedPCO          = 0x7b
 	ieiNonSupported         = 0xff
+
+	// the same IEI as LADN information in 5GMM.
+	ieiQoSFlowDescriptions = 0x79
+
+	// the IEIs of the Configuration Update Command not decoded.
+	ieiNetworkSlicingInd  = 0x9
+	ieiMICOIndication     = 0xb
+	ieiSMSIndication      = 0xf
+	ieiServiceAreaList    = 0x27
+	ieiOperatorDefinedAC  = 0x76
+	ieiSORTransparentCont = 0x73
 )
 
 var ieStr = map[int]string{
 	ieiRequestType:          "Request Type",
 	ieiPDUSessionType:       "PDU Session Type",
+	ieiConfigUpdateInd:      "Configuration update indication",
 	ieiIMEISVRequest:        "IMEISV Request",
 	iei5GMMCapability:       "5G MM Capability",
+	ieiRejectedNSSAI:        "Rejected NSSAI",
 	ieiPDUSessionID2:        "PDU session identity 2",
 	ieiNSSAI:                "NSSAI",
 	ieiGPRSTimer2:           "GPRS Timer 2",
@@ -218,15 +465,39 @@ var ieStr = map[int]string{
 	ieiAuthParamRAND:        "Authentication Parameter RAND",
 	ieiSNSSAI:               "S-NSSAI",
 	ieiDNN:                  "DNN",
+	ieiPDUSessionReactRes:   "PDU session reactivation result",
+	iei5GSMCapability:       "5GSM capability",
 	ieiPDUAddress:           "PDU address",
+	ieiSessionAMBR:          "Session-AMBR",
 	ieiAuthParamRES:         "Authentication response parameter",
+	ieiRequestedNSSAI:       "Requested NSSAI",
+	ieiAuthFailureParam:     "Authentication failure parameter",
+	ieiConfiguredNSSAI:      "Configured NSSAI",
 	ieiUESecurityCapability: "UE Security Capability",
 	ieiAdditional5GSecInfo:  "Additional 5G Security Information",
+	ieiBackoffTimerValue:    "Back-off timer value",
+	ieiABBA:                 "ABBA",
+	ieiUplinkDataStatus:     "Uplink data status",
+	ieiFullNameForNetwork:   "Full name for network",
+	ieiShortNameForNetwork:  "Short name for network",
+	ieiLocalTimeZone:        "Local time zone",
+	ieiUniversalTimeAndLTZ:  "Universal time and local time zone",
+	ieiDaylightSavingTime:   "Network daylight saving time",
+	ieiPDUSessionStatus:     "PDU session status",
 	ieiTAIList:              "Tracking Area Identity List",
+	ieiRQTimerValue:         "RQ timer value",
+	iei5GMMCause:            "5GMM cause",
 	iei5GSMCause:            "5GSM cause",
 	ieiGPRSTimer3:           "GPRS Timer 3",
+	ieiT3346Value:           "T3346 value",
+	ieiRejectedNSSAIRegRej:  "Rejected NSSAI",
 	ieiNASMessageContainer:  "NAS Message Container",
+	ieiPDUSessionReactErr:   "PDU session reactivation result error cause",
 	iei5GSMobileIdentity:    "5GS Mobile Identity",
+	ieiEAPMessage:           "EAP message",
+	ieiLADNInformation:      "LADN information",
+	ieiAuthorizedQoSRules:   "Authorized QoS rules",
+	ieiExtendedPCO:          "Extended protocol configuration options",
 	ieiNonSupported:         "Non Supported",
 }
 
@@ -250,8 +521,15 @@ func (ue *UE) PowerON() {
 	ue.dbgLevel = 0
 
 	ue.MMstate = MMDeregistared
+	ue.CMstate = CMIdle
 	ue.Recv.state = rcvdNull
+	ue.Recv.ngKSI = KeySetIdentityNoKeyIsAvailable
 	ue.SUPI = fmt.Sprintf("%d%02d%s", ue.MCC, ue.MNC, ue.MSIN)
+
+	// the UE may be copied from the template, so the timers are not shared.
+	ue.timer = [timerMax]nasTimer{}
+	ue.timerEvent = make(chan TimerEvent, timerMax)
+	ue.sm.session = map[uint8]*PDUSession{}
 }
 
 func (ue *UE) Receive(pdu *[]byte) {
@@ -272,6 +550,16 @@ func (ue *UE) MakeNasPdu() (pdu []byte) {
 	case rcvdRegistrationAccept:
 		pdu = ue.MakeRegistrationComplete()
 		ue.dprint("GNBSIM: [REGISTERED]")
+	case rcvdIdentityRequest:
+		pdu = ue.MakeIdentityResponse()
+	case rcvdAuthRequestFailed:
+		pdu = ue.MakeAuthenticationFailure()
+	case rcvdDeregistrationRequest:
+		pdu = ue.MakeDeregistrationAccept()
+	case rcvdConfigUpdateCommand:
+		if ue.NeedConfigurationUpdateComplete() {
+			pdu = ue.MakeConfigurationUpdateComplete()
+		}
 	}
 	return
 }
@@ -279,6 +567,7 @@ func (ue *UE) MakeNasPdu() (pdu []byte) {
 func (ue *UE) Decode(pdu *[]byte) (msgType int) {
 
 	ue.DecodeError = nil
+	defer ue.updateFirstPDUSession()
 
 	epd := readPduByte(pdu)
 	ue.dprint("EPD: %s (0x%x)", epdStr[epd], epd)
@@ -337,15 +626,45 @@ func (ue *UE) Decode5GMM(pdu *[]byte) (msgType int) {
 	case MessageTypeRegistrationAccept:
 		ue.decRegistrationAccept(pdu)
 		break
+	case MessageTypeRegistrationReject:
+		ue.decRegistrationReject(pdu)
+		break
+	case MessageTypeDeregistrationAccept:
+		ue.decDeregistrationAccept(pdu)
+		break
+	case MessageTypeDeregistrationRequestUETerm:
+		ue.decDeregistrationRequestUETerm(pdu)
+		break
+	case MessageTypeServiceAccept:
+		ue.decServiceAccept(pdu)
+		break
+	case MessageTypeServiceReject:
+		ue.decServiceReject(pdu)
+		break
+	case MessageTypeConfigurationUpdateCommand:
+		ue.decConfigurationUpdateCommand(pdu)
+		break
 	case MessageTypeAuthenticationRequest:
 		ue.decAuthenticationRequest(pdu)
 		break
+	case MessageTypeAuthenticationReject:
+		ue.decAuthenticationReject(pdu)
+		break
+	case MessageTypeAuthenticationResult:
+		ue.decAuthenticationResult(pdu)
+		break
+	case MessageTypeIdentityRequest:
+		ue.decIdentityRequest(pdu)
+		break
 	case MessageTypeSecurityModeCommand:
 		ue.decSecurityModeCommand(pdu)
 		break
 	case MessageTypeDLNasTransport:
 		ue.decDLNasTransport(pdu)
 		break
+	case MessageType5GMMStatus:
+		ue.dec5GMMStatus(pdu)
+		break
 	default:
 		break
 	}
@@ -358,20 +677,43 @@ func (ue *UE) Decode5GMM(pdu *[]byte) (msgType int) {
 // 8.3 5GS session management messages
 func (ue *UE) Decode5GSM(pdu *[]byte) (msgType int) {
 
-	ue.decPDUSessionIdentity(pdu)
-	ue.decProcedureTransactionIdentity(pdu)
+	psi := ue.decPDUSessionIdentity(pdu)
+	pti := ue.decProcedureTransactionIdentity(pdu)
 
 	msgType = ue.decMessageType(pdu)
 
+	s := ue.sm.session[psi]
+	if s == nil {
+		ue.DecodeError = fmt.Errorf("nas: unknown PDU session: %d", psi)
+		ue.dprint("***** unknown PDU session: %d", psi)
+		return
+	}
+	if pti != 0 && pti != s.PTI {
+		ue.dprint("***** unexpected PTI %d for PDU session %d", pti, psi)
+	}
+
+	ue.sm.current = s
 	ue.indent++
 	switch msgType {
 	case MessageTypePDUSessionEstablishmentAccept:
-		ue.decPDUSessionEstablishmentAccept(pdu)
-		break
+		ue.decPDUSessionEstablishmentAccept(s, pdu)
+	case MessageTypePDUSessionEstablishmentReject:
+		ue.decPDUSessionEstablishmentReject(s, pdu)
+	case MessageTypePDUSessionModificationReject:
+		ue.decPDUSessionModificationReject(s, pdu)
+	case MessageTypePDUSessionModificationCommand:
+		s.PTI = pti
+		ue.decPDUSessionModificationCommand(s, pdu)
+	case MessageTypePDUSessionReleaseReject:
+		ue.decPDUSessionReleaseReject(s, pdu)
+	case MessageTypePDUSessionReleaseCommand:
+		s.PTI = pti
+		ue.decPDUSessionReleaseCommand(s, pdu)
 	default:
 		break
 	}
 	ue.indent--
+	ue.sm.current = nil
 
 	return
 }
@@ -391,59 +733,138 @@ func (ue *UE) decInformationElement(pdu *[]byte, ieStrMap map[int]string) {
 
 		msg := ieStrMap[iei]
 
-		if msg == "" {
-			break
-		}
-
-		ue.dprint("%s: 0x%x", msg, iei)
-
 		if type1ie {
 			(*pdu)[0] &= 0x0f
 		} else {
 			readPduByte(pdu)
 		}
 
+		// the optional IE not known is skipped by the format of the IEI.
+		if msg == "" {
+			ue.dprint("info: This IE(0x%x) is skipped.", iei)
+			skipInformationElement(pdu, iei, type1ie)
+			continue
+		}
+
+		ue.dprint("%s: 0x%x", msg, iei)
+
 		switch iei {
 		case ieiIMEISVRequest:
 			ue.decIMEISVRequest(pdu)
 		case ieiPDUSessionID2:
 			ue.decPDUSessionID2(pdu)
+		case ieiConfigUpdateInd:
+			ue.decConfigurationUpdateIndication(pdu)
 		case ieiNSSAI:
-			ue.decNSSAI(pdu)
+			ue.Recv.allowedNSSAI = ue.decNSSAI(pdu)
+		case ieiConfiguredNSSAI:
+			ue.Recv.configNSSAI = ue.decNSSAI(pdu)
+		case ieiRejectedNSSAI, ieiRejectedNSSAIRegRej:
+			ue.Recv.rejectNSSAI = ue.decRejectedNSSAI(pdu)
 		case ieiGPRSTimer2:
-			ue.decGPRSTimer2(pdu)
+			ue.Recv.t3502 = ue.decGPRSTimer2(pdu)
 		case ieiAuthParamAUTN:
 			ue.decAuthParamAUTN(pdu)
 		case ieiAuthParamRAND:
 			ue.decAuthParamRAND(pdu)
+		case ieiPDUSessionReactRes:
+			ue.decPDUSessionReactivationResult(pdu)
 		case ieiPDUAddress:
 			ue.decPDUAddress(pdu)
 		case ieiAdditional5GSecInfo:
 			ue.decAdditional5GSecInfo(pdu)
+		case ieiABBA:
+			ue.decABBA(pdu)
+		case ieiPDUSessionStatus:
+			ue.decPDUSessionStatus(pdu)
+		case ieiFullNameForNetwork:
+			ue.Recv.NetworkFullName = ue.decNetworkName(pdu)
+		case ieiShortNameForNetwork:
+			ue.Recv.NetworkShortName = ue.decNetworkName(pdu)
+		case ieiLocalTimeZone:
+			ue.Recv.TimeZone = ue.decTimeZone(pdu)
+		case ieiUniversalTimeAndLTZ:
+			ue.decTimeZoneAndTime(pdu)
+		case ieiDaylightSavingTime:
+			ue.decDaylightSavingTime(pdu)
 		case ieiTAIList:
-			ue.decTAIList(pdu)
+			ue.setTAIList(ue.decTAIList(pdu))
+		case ieiLADNInformation: // QoS flow descriptions in 5GSM.
+			if ue.sm.current != nil {
+				ue.setQoSFlows(ue.decQoSFlowDescriptions(pdu))
+			} else {
+				ue.decLADNInformation(pdu)
+			}
+		case iei5GMMCause:
+			ue.Recv.mmCause = ue.dec5GMMCause(pdu)
 		case iei5GSMCause:
-			ue.dec5GSMCause(pdu)
+			ue.setSMCause(ue.dec5GSMCause(pdu))
+		case ieiSessionAMBR:
+			ue.setSessionAMBR(ue.decSessionAMBR(pdu))
+		case ieiAuthorizedQoSRules:
+			ue.setQoSRules(ue.decQoSRules(pdu))
+		case ieiExtendedPCO:
+			ue.setDNS(ue.decExtendedPCO(pdu))
+		case ieiBackoffTimerValue:
+			ue.setSMBackoff(ue.decGPRSTimer3(pdu))
+		case ieiRQTimerValue:
+			ue.setRQTimer(ue.decGPRSTimer(pdu))
 		case ieiGPRSTimer3:
-			ue.decGPRSTimer3(pdu)
+			ue.Recv.t3512 = ue.decGPRSTimer3(pdu)
+		case ieiT3346Value:
+			ue.Recv.t3346 = ue.decGPRSTimer2(pdu)
+		case ieiPDUSessionReactErr:
+			ue.decPDUSessionReactivationResultErrorCause(pdu)
 		case iei5GSMobileIdentity:
 			ue.dec5GSMobileID(pdu)
+		case ieiEAPMessage:
+			ue.decEAPMessage(pdu)
 		default:
 			ue.dprint("info: This IE(0x%x) has not been supported yet.", iei)
-			*pdu = []byte{}
+			skipInformationElement(pdu, iei, type1ie)
+		}
+	}
+}
+
+// skipInformationElement skips the value of the IE after the IEI. the IE
+// of the IEI with bit 8 set is one octet, the IE of the IEI 0x7x is
+// TLV-E, and the others are TLV. the IE truncated is skipped to the end.
+// see 11.2.4 in TS 24.007.
+func skipInformationElement(pdu *[]byte, iei int, type1ie bool) {
+
+	n := len(*pdu)
+	switch {
+	case type1ie:
+		n = 1 // the value in the half octet, or none in type 2.
+	case iei&0xf0 == 0x70:
+		if len(*pdu) >= 2 {
+			n = 2 + int(binary.BigEndian.Uint16(*pdu))
+		}
+	default:
+		if len(*pdu) >= 1 {
+			n = 1 + int((*pdu)[0])
 		}
 	}
+	if n > len(*pdu) {
+		n = len(*pdu)
+	}
+	*pdu = (*pdu)[n:]
+	return
 }
 
 // 8.2.1 Authentication request
 var ieStrAuthReq = map[int]string{
 	ieiAuthParamAUTN: "Authentication Parameter AUTN IE",
 	ieiAuthParamRAND: "Authentication Parameter RAND IE",
+	ieiEAPMessage:    "EAP message IE",
 }
 
 func (ue *UE) decAuthenticationRequest(pdu *[]byte) {
 	ue.dprint("Authentication Request")
 
+	ue.AuthParam.eap = nil
+	ue.AuthParam.eapResp = nil
+
 	orig := ue.indent
 	ue.indent++
 	ue.dprint("ngKSI IE")
@@ -455,18 +876,61 @@ func (ue *UE) decAuthenticationRequest(pdu *[]byte) {
 	ue.decInformationElement(pdu, ieStrAuthReq)
 	ue.indent--
 
+	if ue.AuthParam.eap != nil {
+		ue.indent++
+		ue.decEAPAKAPrimeRequest()
+		ue.indent = orig
+		ue.Recv.state = rcvdAuthenticationRequest
+		return
+	}
+
+	ue.indent++
+	m, cause := ue.runAKA()
+	if cause != 0 {
+		ue.indent = orig
+		ue.authenticationFailed(cause)
+		return
+	}
+
+	ue.ComputeKausf(m.CK, m.IK)
+	ue.ComputeKseaf()
+	ue.ComputeKamf()
+	ue.ComputeAlgKey()
+
+	ue.ComputeRESstar(m.RAND, m.RES, m.CK, m.IK)
+
+	/*
+		ue.dprint("Kausf: %x", ue.AuthParam.Kausf)
+		ue.dprint("Kseaf: %x", ue.AuthParam.Kseaf)
+		ue.dprint("Kamf : %x", ue.AuthParam.Kamf)
+		ue.dprint("Kenc : %x", ue.AuthParam.Kenc)
+		ue.dprint("Kint : %x", ue.AuthParam.Kint)
+		ue.dprint("RES* : %x", ue.AuthParam.RESstar)
+	*/
+	ue.dprint("received and calculated MAC values match.")
+	ue.indent = orig
+
+	ue.Recv.state = rcvdAuthenticationRequest
+
+	return
+}
+
+// runAKA runs the AKA on the USIM with the received RAND and AUTN, and
+// returns the 5GMM cause if the AUTN is not accepted.
+// see 5.4.1.3.7 Authentication not accepted by the UE
+func (ue *UE) runAKA() (m *milenage.Milenage, cause uint8) {
+
 	k, _ := hex.DecodeString(ue.AuthParam.K)
 	opc, _ := hex.DecodeString(ue.AuthParam.OPc)
 	amf := binary.BigEndian.Uint16(ue.AuthParam.amf)
 
-	m := milenage.NewWithOPc(k, opc, ue.AuthParam.rand, 0, amf)
+	m = milenage.NewWithOPc(k, opc, ue.AuthParam.rand, 0, amf)
 	m.F2345()
 	for n, v := range ue.AuthParam.seqxorak {
 		m.SQN[n] = v ^ m.AK[n]
 	}
 	m.F1()
 
-	ue.indent++
 	/*
 		ue.dprint("K   : %x", m.K)
 		ue.dprint("OP  : %x", m.OP)
@@ -486,30 +950,37 @@ func (ue *UE) decAuthenticationRequest(pdu *[]byte) {
 		ue.dprinti("received and calculated MAC values do not match.")
 		ue.dprinti("received  : %x", ue.AuthParam.mac)
 		ue.dprinti("calculated: %x", m.MACA)
-		ue.indent = orig
-		// need response for error.
+		cause = mmCauseMACFailure
 		return
 	}
 
-	ue.ComputeKausf(m.CK, m.IK)
-	ue.ComputeKseaf()
-	ue.ComputeKamf()
-	ue.ComputeAlgKey()
+	// the "separation bit" of the AMF field shall be set to 1 for 5G.
+	// see Annex H in TS 33.102 and 6.1.3.2 in TS 33.501.
+	if ue.AuthParam.amf[0]&0x80 == 0 {
+		ue.dprinti("AMF separation bit is not set: %x", ue.AuthParam.amf)
+		cause = mmCauseNon5GAuthUnacceptable
+		return
+	}
 
-	ue.ComputeRESstar(m.RAND, m.RES, m.CK, m.IK)
+	if ue.verifySQN(m.SQN) == false {
+		ue.dprinti("SQN is out of range: %x", m.SQN)
+		ue.AuthParam.auts = ue.computeAUTS(k, opc)
+		ue.dprinti("AUTS: %x", ue.AuthParam.auts)
+		cause = mmCauseSynchFailure
+		return
+	}
 
-	/*
-		ue.dprint("Kausf: %x", ue.AuthParam.Kausf)
-		ue.dprint("Kseaf: %x", ue.AuthParam.Kseaf)
-		ue.dprint("Kamf : %x", ue.AuthParam.Kamf)
-		ue.dprint("Kenc : %x", ue.AuthParam.Kenc)
-		ue.dprint("Kint : %x", ue.AuthParam.Kint)
-		ue.dprint("RES* : %x", ue.AuthParam.RESstar)
-	*/
-	ue.dprint("received and calculated MAC values match.")
-	ue.indent = orig
+	return
+}
 
-	ue.Recv.state = rcvdAuthenticationRequest
+// 5.4.1.3.7 Authentication not accepted by the UE
+func (ue *UE) authenticationFailed(cause uint8) {
+
+	ue.dprint("authentication failed: %s(%d)", mmCauseStr[cause], cause)
+	ue.Recv.authFailureCause = cause
+	ue.Recv.state = rcvdAuthRequestFailed
+
+	// start T3520 timer.
 
 	return
 }
@@ -520,6 +991,11 @@ func (ue *UE) MakeAuthenticationResponse() (pdu []byte) {
 	pdu = ue.enc5GSMMMessageHeader(SecurityHeaderTypePlain,
 		MessageTypeAuthenticationResponse)
 
+	if ue.AuthParam.eapResp != nil {
+		pdu = append(pdu, ue.encEAPMessage(true, ue.AuthParam.eapResp)...)
+		return
+	}
+
 	data := new(bytes.Buffer)
 	binary.Write(data, binary.BigEndian, ue.encAuthParamRes())
 	pdu = append(pdu, data.Bytes()...)
@@ -527,10 +1003,103 @@ func (ue *UE) MakeAuthenticationResponse() (pdu []byte) {
 	return
 }
 
+// 8.2.3 Authentication result
+var ieStrAuthResult = map[int]string{
+	ieiABBA: ieStr[ieiABBA],
+}
+
+func (ue *UE) decAuthenticationResult(pdu *[]byte) {
+
+	ue.dprint("Authentication Result")
+
+	ue.indent++
+	ue.dprint("ngKSI IE")
+	ue.decNASKeySetIdentifier(pdu)
+
+	ue.dprint("EAP message IE")
+	ue.decEAPMessage(pdu)
+
+	ue.decInformationElement(pdu, ieStrAuthResult)
+	ue.indent--
+
+	return
+}
+
+// 8.2.4 Authentication failure
+func (ue *UE) MakeAuthenticationFailure() (pdu []byte) {
+
+	pdu = ue.enc5GSMMMessageHeader(SecurityHeaderTypePlain,
+		MessageTypeAuthenticationFailure)
+
+	cause := ue.Recv.authFailureCause
+	pdu = append(pdu, cause)
+
+	if cause == mmCauseSynchFailure {
+		pdu = append(pdu, ue.encAuthFailureParam()...)
+	}
+
+	return
+}
+
+// 8.2.5 Authentication reject
+// 5.4.1.3.5 Authentication not accepted by the network
+var ieStrAuthReject = map[int]string{
+	ieiEAPMessage: ieStr[ieiEAPMessage],
+}
+
+func (ue *UE) decAuthenticationReject(pdu *[]byte) {
+
+	ue.dprint("Authentication Reject")
+
+	ue.indent++
+	ue.decInformationElement(pdu, ieStrAuthReject)
+	ue.indent--
+
+	// the UE shall set the update status to 5U3 ROAMING NOT ALLOWED,
+	// delete the stored 5G-GUTI, TAI list, last visited registered TAI
+	// and ngKSI, consider the USIM as invalid and enter 5GMM-DEREGISTERED
+	// state.
+	ue.UpdateStatus = UpdateStatusRoamingNotAllowed
+	ue.deleteRegistrationInfo()
+	ue.USIMInvalid = true
+	ue.MMstate = MMDeregistared
+	ue.Recv.state = rcvdAuthenticationReject
+
+	ue.stopTimer(TimerT3510)
+	ue.stopTimer(TimerT3517)
+	ue.stopTimer(TimerT3521)
+
+	ue.dprint("GNBSIM: [%s]", MMstateStr[ue.MMstate])
+
+	return
+}
+
 // 8.2.6 Registration request
 // 5.5.1.2 Registration procedure for initial registration
 func (ue *UE) MakeRegistrationRequest() (pdu []byte) {
 
+	/*
+	 * the UE has no valid 5G NAS security context at the initial
+	 * registration, so only the cleartext IEs are sent. the entire message
+	 * is sent in the NAS message container of the security mode complete.
+	 * see 4.4.6 Protection of initial NAS signalling messages.
+	 */
+	pdu = ue.encRegistrationRequest(false)
+
+	ue.MMstate = MMRegisteredInitiated
+	ue.CMstate = CMConnected
+	ue.Recv.reRegistrationRequired = false
+
+	// see 5.5.1.2.2 Initial registration initiation
+	ue.stopTimer(TimerT3502)
+	ue.stopTimer(TimerT3511)
+	ue.startTimer(TimerT3510)
+
+	return
+}
+
+func (ue *UE) encRegistrationRequest(full bool) (pdu []byte) {
+
 	pdu = ue.enc5GSMMMessageHeader(SecurityHeaderTypePlain,
 		MessageTypeRegistrationRequest)
 
@@ -543,9 +1112,13 @@ func (ue *UE) MakeRegistrationRequest() (pdu []byte) {
 	binary.Write(data, binary.BigEndian, encUESecurityCapability())
 	pdu = append(pdu, data.Bytes()...)
 
-	ue.MMstate = MMRegisteredInitiated
+	if full == false {
+		return
+	}
 
-	// start T3510 timer. see 5.5.1.2.2 Initial registration initiation
+	if nssai := ue.requestedNSSAI(); len(nssai) != 0 {
+		pdu = append(pdu, encNSSAI(ieiRequestedNSSAI, nssai)...)
+	}
 
 	return
 }
@@ -553,6 +1126,8 @@ func (ue *UE) MakeRegistrationRequest() (pdu []byte) {
 // 8.2.7 Registration accept
 var ieStrRegAcc = map[int]string{
 	ieiNSSAI:             "Allowed NSSAI",
+	ieiRejectedNSSAI:     ieStr[ieiRejectedNSSAI],
+	ieiConfiguredNSSAI:   ieStr[ieiConfiguredNSSAI],
 	ieiGPRSTimer2:        "T3502 value",
 	ieiTAIList:           "TAI list",
 	ieiGPRSTimer3:        "T3512 value",
@@ -569,6 +1144,15 @@ func (ue *UE) decRegistrationAccept(pdu *[]byte) {
 	ue.decInformationElement(pdu, ieStrRegAcc)
 	ue.indent--
 
+	// 5.5.1.2.4 Initial registration accepted by the network
+	ue.MMstate = MMRegistered
+	ue.UpdateStatus = UpdateStatusUpdated
+	ue.attemptCounter = 0
+	ue.checkAllowedNSSAI()
+	ue.stopTimer(TimerT3510)
+	ue.stopTimer(TimerT3502)
+	ue.stopTimer(TimerT3511)
+
 	ue.Recv.state = rcvdRegistrationAccept
 
 	return
@@ -589,9 +1173,151 @@ func (ue *UE) MakeRegistrationComplete() (pdu []byte) {
 	return
 }
 
+// 8.2.9 Registration reject
+// 5.5.1.2.5 Initial registration not accepted by the network
+var ieStrRegReject = map[int]string{
+	ieiT3346Value: ieStr[ieiT3346Value],
+	ieiGPRSTimer2: "T3502 value",
+	ieiEAPMessage: ieStr[ieiEAPMessage],
+
+	ieiRejectedNSSAIRegRej: ieStr[ieiRejectedNSSAIRegRej],
+}
+
+func (ue *UE) decRegistrationReject(pdu *[]byte) {
+
+	ue.dprint("Registration Reject")
+
+	ue.Recv.t3346 = 0
+	ue.Recv.t3502 = 0
+
+	ue.indent++
+	ue.dprint("5GMM cause IE")
+	ue.Recv.mmCause = ue.dec5GMMCause(pdu)
+	ue.decInformationElement(pdu, ieStrRegReject)
+	ue.indent--
+
+	ue.stopTimer(TimerT3510)
+
+	if ue.apply5GMMCause(ue.Recv.mmCause) == false {
+		// 5.5.1.2.7 Abnormal cases in the UE
+		ue.registrationAttemptFailed()
+	}
+	ue.MMstate = MMDeregistared
+	ue.Recv.state = rcvdRegistrationReject
+
+	ue.dprint("GNBSIM: [%s] [%s]", MMstateStr[ue.MMstate],
+		UpdateStatusStr[ue.UpdateStatus])
+
+	return
+}
+
+// apply5GMMCause takes the actions common to the registration reject,
+// the service reject and the network-initiated de-registration for the
+// given 5GMM cause, and returns false if the cause is not handled.
+// see 5.5.1.2.5, 5.5.2.3.2 and 5.6.1.5.
+func (ue *UE) apply5GMMCause(cause uint8) bool {
+
+	switch cause {
+	case mmCauseIllegalUE, mmCauseIllegalME:
+		ue.USIMInvalid = true
+		fallthrough
+	case mmCause5GSServicesNotAllowed:
+		ue.ServicesNotAllowed = true
+		ue.UpdateStatus = UpdateStatusRoamingNotAllowed
+		ue.deleteRegistrationInfo()
+		ue.attemptCounter = 0
+		ue.MMstate = MMDeregistared
+
+	case mmCausePLMNNotAllowed, mmCauseTANotAllowed:
+		ue.UpdateStatus = UpdateStatusRoamingNotAllowed
+		ue.deleteRegistrationInfo()
+		ue.attemptCounter = 0
+		ue.MMstate = MMDeregistared
+
+	case mmCauseRoamingNotAllowedInTA, mmCauseNoSuitableCellsInTA:
+		// the UE searches for a suitable cell in another tracking area.
+		ue.UpdateStatus = UpdateStatusRoamingNotAllowed
+		ue.setTAIList(nil)
+		ue.attemptCounter = 0
+
+	case mmCauseCongestion:
+		// the cause without T3346 value is treated as the abnormal case.
+		if ue.Recv.t3346 == 0 {
+			return false
+		}
+		ue.UpdateStatus = UpdateStatusNotUpdated
+		ue.attemptCounter = 0
+		ue.startTimer(TimerT3346)
+
+	default:
+		return false
+	}
+
+	return true
+}
+
+// registrationAttemptFailed increments the registration attempt counter.
+// the UE retries the registration after T3511 expiry, and after T3502
+// expiry once the counter reached 5.
+// see 5.5.1.2.7 Abnormal cases in the UE
+func (ue *UE) registrationAttemptFailed() {
+
+	const maxAttempt = 5
+
+	ue.attemptCounter++
+	ue.dprint("registration attempt counter: %d", ue.attemptCounter)
+
+	if ue.attemptCounter < maxAttempt {
+		ue.startTimer(TimerT3511)
+		return
+	}
+
+	ue.UpdateStatus = UpdateStatusNotUpdated
+	ue.deleteRegistrationInfo()
+	ue.startTimer(TimerT3502)
+
+	return
+}
+
+// Backoff returns the remaining time until the UE is allowed to initiate
+// the registration or the service request procedure again.
+func (ue *UE) Backoff() (wait time.Duration) {
+
+	now := time.Now()
+	for _, id := range []int{TimerT3346, TimerT3502, TimerT3511} {
+		t := &ue.timer[id]
+		if t.timer == nil {
+			continue
+		}
+		if d := t.expiry.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return
+}
+
+// deleteRegistrationInfo deletes the 5G-GUTI, last visited registered TAI,
+// TAI list and ngKSI stored in the UE.
+func (ue *UE) deleteRegistrationInfo() {
+	ue.Recv.fiveGGUTI = nil
+	ue.setTAIList(nil)
+	ue.Recv.ngKSI = KeySetIdentityNoKeyIsAvailable
+	return
+}
+
 // 8.2.10 UL NAS transport
-func (ue *UE) MakeULNasTransport(
-	payloadType uint8, msgType uint8, payload *[]byte) (pdu []byte) {
+// MakeULNasTransport returns nil for the PDU session establishment of the
+// PSI not allocated, as the S-NSSAI and the DNN are of the PDU session.
+func (ue *UE) MakeULNasTransport(payloadType uint8, psi uint8,
+	msgType uint8, payload *[]byte) (pdu []byte) {
+
+	establishment := payloadType == PayloadContainerN1SMInformation &&
+		msgType == MessageTypePDUSessionEstablishmentRequest
+	s := ue.sm.session[psi]
+	if establishment && s == nil {
+		ue.dprint("PDU session %d not found.", psi)
+		return
+	}
 
 	pdu = ue.enc5GSMMMessageHeader(
 		SecurityHeaderTypePlain,
@@ -605,7 +1331,7 @@ func (ue *UE) MakeULNasTransport(
 	pdu = append(pdu, *payload...)
 
 	if payloadType == PayloadContainerN1SMInformation {
-		pdu = append(pdu, ue.encPDUSessionID2(ue.sm.pduSessionId)...)
+		pdu = append(pdu, ue.encPDUSessionID2(psi)...)
 	}
 
 	switch msgType {
@@ -613,10 +1339,9 @@ func (ue *UE) MakeULNasTransport(
 		pdu = append(pdu, ue.encRequestType(RequestTypeInitialRequest)...)
 	}
 
-	if payloadType == PayloadContainerN1SMInformation &&
-		msgType == MessageTypePDUSessionEstablishmentRequest {
-		pdu = append(pdu, ue.encSNSSAI()...)
-		pdu = append(pdu, ue.encDNN()...)
+	if establishment {
+		pdu = append(pdu, encSNSSAI(s.SNSSAI)...)
+		pdu = append(pdu, encDNN(s.DNN)...)
 	}
 
 	return
@@ -650,6 +1375,29 @@ func (ue *UE) decDLNasTransport(pdu *[]byte) {
 // 8.2.12 De-registration request (UE originating de-registration)
 func (ue *UE) MakeDeregistrationRequest() (pdu []byte) {
 
+	pdu = ue.encDeregistrationRequest()
+
+	// T3521 is not started at switch off, and the de-registration is
+	// completed without the De-registration Accept.
+	// see 5.5.2.2.1 UE-initiated de-registration procedure initiation and
+	// 5.5.2.2.2 UE-initiated de-registration procedure completion
+	if ue.SwitchOff {
+		ue.MMstate = MMDeregistared
+		ue.releasePDUSessions()
+		ue.dprint("GNBSIM: [%s]", MMstateStr[ue.MMstate])
+		return
+	}
+	ue.MMstate = MMDeregistaredInitiated
+	ue.startTimer(TimerT3521)
+
+	return
+}
+
+// encDeregistrationRequest returns the De-registration Request protected
+// with the next NAS COUNT, which is also used for the retransmission as a
+// new NAS message. see 4.4.3.1 NAS COUNT.
+func (ue *UE) encDeregistrationRequest() (pdu []byte) {
+
 	pdu = ue.enc5GSMMMessageHeader(SecurityHeaderTypePlain,
 		MessageTypeDeregistrationRequest)
 	tmp := ue.encDeregistrationType()
@@ -662,31 +1410,329 @@ func (ue *UE) MakeDeregistrationRequest() (pdu []byte) {
 		&pdu)
 
 	pdu = append(head, pdu...)
+
 	return
 }
 
-// 8.2.25 Security mode command
-var ieStrSecModeCmd = map[int]string{
-	ieiIMEISVRequest:       ieStr[ieiIMEISVRequest],
-	ieiAdditional5GSecInfo: ieStr[ieiAdditional5GSecInfo],
-}
+// 8.2.13 De-registration accept (UE originating de-registration)
+func (ue *UE) decDeregistrationAccept(pdu *[]byte) {
 
-func (ue *UE) decSecurityModeCommand(pdu *[]byte) {
+	ue.dprint("Deregistration Accept")
 
-	ue.dprint("Security Mode Command")
+	ue.stopTimer(TimerT3521)
 
-	ue.indent++
-	ue.dprint("Selected NAS security algorithms IE")
-	ue.decNASSecurityAlgorithms(pdu)
+	ue.MMstate = MMDeregistared
+	ue.releasePDUSessions()
+	ue.Recv.state = rcvdDeregistrationAccept
 
-	ue.dprint("ngKSI IE")
-	ue.decNASKeySetIdentifier(pdu)
+	ue.dprint("GNBSIM: [%s]", MMstateStr[ue.MMstate])
 
-	ue.dprint("Replayed UE security capabilities IE")
-	ue.decUESecurityCapability(pdu)
+	return
+}
 
-	ue.decInformationElement(pdu, ieStrSecModeCmd)
-	ue.indent--
+// 8.2.14 De-registration request (UE terminated de-registration)
+// 5.5.2.3 Network-initiated de-registration procedure
+var ieStrDeregReqUETerm = map[int]string{
+	iei5GMMCause:  ieStr[iei5GMMCause],
+	ieiT3346Value: ieStr[ieiT3346Value],
+}
+
+func (ue *UE) decDeregistrationRequestUETerm(pdu *[]byte) {
+
+	ue.dprint("Deregistration Request (UE terminated)")
+
+	ue.Recv.mmCause = 0
+	ue.Recv.t3346 = 0
+
+	ue.indent++
+	ue.dprint("De-registration type IE")
+	ue.Recv.reRegistrationRequired = ue.decDeregistrationType(pdu)
+	ue.decInformationElement(pdu, ieStrDeregReqUETerm)
+	ue.indent--
+
+	ue.Recv.state = rcvdDeregistrationRequest
+
+	return
+}
+
+// 8.2.15 De-registration accept (UE terminated de-registration)
+func (ue *UE) MakeDeregistrationAccept() (pdu []byte) {
+
+	pdu = ue.enc5GSMMMessageHeader(SecurityHeaderTypePlain,
+		MessageTypeDeregistrationAcceptUETerm)
+
+	head := ue.enc5GSecurityProtectedMessageHeader(
+		SecurityHeaderTypeIntegrityProtectedAndCiphered, &pdu)
+	pdu = append(head, pdu...)
+
+	// the PDU sessions are released locally.
+	// see 5.5.2.3.2 Network-initiated de-registration procedure completion
+	// by the UE
+	ue.MMstate = MMDeregistared
+	ue.releasePDUSessions()
+
+	ue.stopTimer(TimerT3510)
+	ue.stopTimer(TimerT3517)
+	ue.apply5GMMCause(ue.Recv.mmCause)
+
+	ue.dprint("GNBSIM: [%s]", MMstateStr[ue.MMstate])
+
+	return
+}
+
+// DeregistrationRequested returns true if the network initiated the
+// de-registration and the UE has not accepted it yet.
+func (ue *UE) DeregistrationRequested() bool {
+	return ue.Recv.state == rcvdDeregistrationRequest &&
+		ue.MMstate != MMDeregistared
+}
+
+// NeedReRegistration returns true if the UE is going to re-register
+// because the network required it in the de-registration request.
+func (ue *UE) NeedReRegistration() bool {
+	return ue.AutoReRegistration && ue.Recv.reRegistrationRequired &&
+		ue.MMstate == MMDeregistared
+}
+
+// 8.2.16 Service request
+// 5.6.1.2 Service request procedure initiation
+func (ue *UE) MakeServiceRequest(serviceType uint8) (pdu []byte) {
+
+	/*
+	 * In 5GMM-IDLE mode, the service request is sent as an initial NAS
+	 * message. Only the cleartext IEs are sent as they are and the entire
+	 * message is included in the NAS message container.
+	 * see 4.4.6 Protection of initial NAS signalling messages.
+	 */
+	if ue.CMstate == CMIdle {
+		pdu = ue.encServiceRequest(serviceType, false)
+		pdu = append(pdu, ue.encNASMessageContainer(true,
+			MessageTypeServiceRequest, serviceType)...)
+		head := ue.enc5GSecurityProtectedMessageHeader(
+			SecurityHeaderTypeIntegrityProtected, &pdu)
+		pdu = append(head, pdu...)
+	} else {
+		pdu = ue.encServiceRequest(serviceType, true)
+		head := ue.enc5GSecurityProtectedMessageHeader(
+			SecurityHeaderTypeIntegrityProtectedAndCiphered, &pdu)
+		pdu = append(head, pdu...)
+	}
+
+	ue.MMstate = MMServiceRequestInitiated
+	ue.CMstate = CMConnected
+
+	// see 5.6.1.2 Service request procedure initiation
+	ue.startTimer(TimerT3517)
+
+	return
+}
+
+func (ue *UE) encServiceRequest(serviceType uint8, full bool) (pdu []byte) {
+
+	pdu = ue.enc5GSMMMessageHeader(SecurityHeaderTypePlain,
+		MessageTypeServiceRequest)
+
+	pdu = append(pdu, ue.Recv.ngKSI|ue.encServiceType(serviceType))
+	pdu = append(pdu, ue.enc5GSMobileID(false, TypeID5GSTMSI)...)
+
+	if full == false {
+		return
+	}
+
+	active := ue.activePDUSessions()
+	if serviceType == ServiceTypeData && active != 0 {
+		pdu = append(pdu, ue.encUplinkDataStatus(active)...)
+	}
+	pdu = append(pdu, ue.encPDUSessionStatus(active)...)
+
+	return
+}
+
+// 8.2.17 Service accept
+var ieStrServiceAccept = map[int]string{
+	ieiPDUSessionStatus:   ieStr[ieiPDUSessionStatus],
+	ieiPDUSessionReactRes: ieStr[ieiPDUSessionReactRes],
+	ieiPDUSessionReactErr: ieStr[ieiPDUSessionReactErr],
+}
+
+func (ue *UE) decServiceAccept(pdu *[]byte) {
+
+	ue.dprint("Service Accept")
+
+	ue.indent++
+	ue.decInformationElement(pdu, ieStrServiceAccept)
+	ue.indent--
+
+	ue.MMstate = MMRegistered
+	ue.Recv.state = rcvdServiceAccept
+
+	// see 5.6.1.4 Service request procedure accepted by the network
+	ue.stopTimer(TimerT3517)
+
+	return
+}
+
+// 8.2.18 Service reject
+var ieStrServiceReject = map[int]string{
+	ieiPDUSessionStatus: ieStr[ieiPDUSessionStatus],
+	ieiT3346Value:       ieStr[ieiT3346Value],
+}
+
+func (ue *UE) decServiceReject(pdu *[]byte) {
+
+	ue.dprint("Service Reject")
+
+	ue.Recv.t3346 = 0
+
+	ue.indent++
+	ue.dprint("5GMM cause IE")
+	ue.Recv.mmCause = ue.dec5GMMCause(pdu)
+	ue.decInformationElement(pdu, ieStrServiceReject)
+	ue.indent--
+
+	// 5.6.1.5 Service request procedure not accepted by the network
+	ue.stopTimer(TimerT3517)
+	ue.MMstate = MMRegistered
+	switch ue.Recv.mmCause {
+	case mmCauseUEIdentityCannotBeDerived:
+		ue.UpdateStatus = UpdateStatusNotUpdated
+		ue.deleteRegistrationInfo()
+		ue.MMstate = MMDeregistared
+	case mmCauseImplicitlyDeregistered:
+		ue.MMstate = MMDeregistared
+	default:
+		ue.apply5GMMCause(ue.Recv.mmCause)
+	}
+	ue.Recv.state = rcvdServiceReject
+
+	return
+}
+
+// ReleaseNASSignallingConnection is called when the N1 NAS signalling
+// connection is released, e.g. by the AN release procedure.
+func (ue *UE) ReleaseNASSignallingConnection() {
+	ue.CMstate = CMIdle
+	ue.dprint("GNBSIM: [%s]", CMstateStr[ue.CMstate])
+	return
+}
+
+// 8.2.19 Configuration update command
+// 5.4.4 Generic UE configuration update procedure
+var ieStrConfUpdateCmd = map[int]string{
+	ieiConfigUpdateInd:     ieStr[ieiConfigUpdateInd],
+	iei5GSMobileIdentity:   "5G-GUTI",
+	ieiServiceAreaList:     "Service area list",
+	ieiMICOIndication:      "MICO indication",
+	ieiNetworkSlicingInd:   "Network slicing indication",
+	ieiSMSIndication:       "SMS indication",
+	ieiOperatorDefinedAC:   "Operator-defined access category definitions",
+	ieiSORTransparentCont:  "SOR transparent container",
+	ieiTAIList:             ieStr[ieiTAIList],
+	ieiNSSAI:               "Allowed NSSAI",
+	ieiConfiguredNSSAI:     ieStr[ieiConfiguredNSSAI],
+	ieiRejectedNSSAI:       ieStr[ieiRejectedNSSAI],
+	ieiFullNameForNetwork:  ieStr[ieiFullNameForNetwork],
+	ieiShortNameForNetwork: ieStr[ieiShortNameForNetwork],
+	ieiLocalTimeZone:       ieStr[ieiLocalTimeZone],
+	ieiUniversalTimeAndLTZ: ieStr[ieiUniversalTimeAndLTZ],
+	ieiDaylightSavingTime:  ieStr[ieiDaylightSavingTime],
+	ieiLADNInformation:     ieStr[ieiLADNInformation],
+}
+
+func (ue *UE) decConfigurationUpdateCommand(pdu *[]byte) {
+
+	ue.dprint("Configuration Update Command")
+
+	ue.Recv.flag.configUpdateAck = false
+	ue.Recv.flag.registrationRequested = false
+
+	ue.indent++
+	ue.decInformationElement(pdu, ieStrConfUpdateCmd)
+	ue.indent--
+
+	ue.Recv.state = rcvdConfigUpdateCommand
+
+	return
+}
+
+// NeedConfigurationUpdateComplete returns true if the network requested
+// the acknowledgement for the last Configuration Update Command.
+func (ue *UE) NeedConfigurationUpdateComplete() bool {
+	return ue.Recv.state == rcvdConfigUpdateCommand &&
+		ue.Recv.flag.configUpdateAck
+}
+
+// 8.2.20 Configuration update complete
+func (ue *UE) MakeConfigurationUpdateComplete() (pdu []byte) {
+
+	pdu = ue.enc5GSMMMessageHeader(SecurityHeaderTypePlain,
+		MessageTypeConfigurationUpdateComplete)
+
+	head := ue.enc5GSecurityProtectedMessageHeader(
+		SecurityHeaderTypeIntegrityProtectedAndCiphered, &pdu)
+	pdu = append(head, pdu...)
+
+	ue.Recv.flag.configUpdateAck = false
+
+	return
+}
+
+// 8.2.21 Identity request
+func (ue *UE) decIdentityRequest(pdu *[]byte) {
+
+	ue.dprint("Identity Request")
+
+	ue.indent++
+	ue.Recv.identityType = ue.decIdentityType(pdu)
+	ue.indent--
+
+	ue.Recv.state = rcvdIdentityRequest
+
+	return
+}
+
+// 8.2.22 Identity response
+// 5.4.3.3 Identification response by the UE
+func (ue *UE) MakeIdentityResponse() (pdu []byte) {
+
+	pdu = ue.enc5GSMMMessageHeader(SecurityHeaderTypePlain,
+		MessageTypeIdentityResponse)
+	pdu = append(pdu, ue.enc5GSMobileID(false, ue.Recv.identityType)...)
+
+	// the identity request may come before the NAS security context is
+	// established, e.g. when the AMF cannot identify the 5G-GUTI.
+	if ue.AuthParam.Kint != nil {
+		head := ue.enc5GSecurityProtectedMessageHeader(
+			SecurityHeaderTypeIntegrityProtectedAndCiphered, &pdu)
+		pdu = append(head, pdu...)
+	}
+
+	return
+}
+
+// 8.2.25 Security mode command
+var ieStrSecModeCmd = map[int]string{
+	ieiIMEISVRequest:       ieStr[ieiIMEISVRequest],
+	ieiEAPMessage:          ieStr[ieiEAPMessage],
+	ieiAdditional5GSecInfo: ieStr[ieiAdditional5GSecInfo],
+}
+
+func (ue *UE) decSecurityModeCommand(pdu *[]byte) {
+
+	ue.dprint("Security Mode Command")
+
+	ue.indent++
+	ue.dprint("Selected NAS security algorithms IE")
+	ue.decNASSecurityAlgorithms(pdu)
+
+	ue.dprint("ngKSI IE")
+	ue.decNASKeySetIdentifier(pdu)
+
+	ue.dprint("Replayed UE security capabilities IE")
+	ue.decUESecurityCapability(pdu)
+
+	ue.decInformationElement(pdu, ieStrSecModeCmd)
+	ue.indent--
 
 	ue.Recv.state = rcvdSecurityModeCommand
 
@@ -719,23 +1765,94 @@ func (ue *UE) MakeSecurityModeComplete() (pdu []byte) {
 	return
 }
 
+// 8.2.29 5GMM status
+// the local actions on receipt of a 5GMM STATUS message are implementation
+// dependent, so the UE only records the cause.
+func (ue *UE) dec5GMMStatus(pdu *[]byte) {
+
+	ue.dprint("5GMM Status")
+
+	ue.indent++
+	ue.dprint("5GMM cause IE")
+	ue.Recv.mmCause = ue.dec5GMMCause(pdu)
+	ue.indent--
+
+	return
+}
+
 // 8.3.1 PDU session establishment request
+// MakePDUSessionEstablishmentRequest requests a new PDU session with the
+// DNN, the S-NSSAI and the PDU session type in the UE configuration.
 func (ue *UE) MakePDUSessionEstablishmentRequest() (pdu []byte) {
+	pdu, _ = ue.MakePDUSessionEstablishmentRequestFor(
+		PDUSessionParam{DNN: ue.DNN, Type: ue.PDUSessionType})
+	return
+}
+
+// MakePDUSessionEstablishmentRequestFor requests a new PDU session with the
+// parameter, and returns the allocated PSI. the S-NSSAI is selected from
+// the allowed NSSAI if not given, and the PDU session type is IPv4 if not
+// given.
+// see 6.4.1.2 UE-requested PDU session establishment procedure initiation
+func (ue *UE) MakePDUSessionEstablishmentRequestFor(
+	p PDUSessionParam) (pdu []byte, psi uint8) {
+
+	defer ue.updateFirstPDUSession()
+	psi = ue.allocatePSI()
+	if psi == 0 {
+		ue.dprint("no PDU session identity is available.")
+		return
+	}
 
-	ue.sm.pduSessionId = 0x01
-	ue.sm.procedureTransactionId = 0x01
+	s := &PDUSession{
+		PSI:   psi,
+		PTI:   ue.allocatePTI(),
+		State: SMActivePending,
+		DNN:   p.DNN,
+		Type:  pduSessionType(p.Type),
+	}
+	// the QoS rules are derived only if the UE indicates the support of
+	// reflective QoS in the 5GSM capability.
+	if ue.ReflectiveQoS {
+		s.rqos = &reflectiveQoS{}
+	}
+	if p.SNSSAI != nil {
+		s.SNSSAI = *p.SNSSAI
+	} else {
+		s.SNSSAI = ue.selectSNSSAI()
+	}
+	ue.sm.session[psi] = s
 
 	pdu = ue.enc5GSSMMessageHeader(
-		ue.sm.pduSessionId,           // 9.4 PDU Session ID
-		ue.sm.procedureTransactionId, // 9.6 Procedure Transaction ID
+		s.PSI, // 9.4 PDU Session ID
+		s.PTI, // 9.6 Procedure Transaction ID
 		MessageTypePDUSessionEstablishmentRequest)
 
 	pdu = append(pdu, ue.encIntegrityProtectionMaximuDataRate()...)
-	pdu = append(pdu, ue.encPDUSessionType()...)
+	pdu = append(pdu, encPDUSessionType(s.Type)...)
+	if ue.ReflectiveQoS {
+		pdu = append(pdu, enc5GSMCapability(true)...)
+	}
+	if ue.RequestDNS {
+		pdu = append(pdu, encExtendedPCO(s.Type)...)
+	}
+
+	pdu = ue.encUL5GSMMessage(
+		s.PSI, MessageTypePDUSessionEstablishmentRequest, pdu)
+
+	return
+}
+
+// encUL5GSMMessage carries the 5GSM message in the UL NAS transport
+// protected with the security context.
+func (ue *UE) encUL5GSMMessage(
+	psi uint8, msgType uint8, sm []byte) (pdu []byte) {
 
 	pdu = ue.MakeULNasTransport(
-		PayloadContainerN1SMInformation,
-		MessageTypePDUSessionEstablishmentRequest, &pdu)
+		PayloadContainerN1SMInformation, psi, msgType, &sm)
+	if pdu == nil {
+		return
+	}
 
 	head := ue.enc5GSecurityProtectedMessageHeader(
 		SecurityHeaderTypeIntegrityProtectedAndCiphered, &pdu)
@@ -747,148 +1864,571 @@ func (ue *UE) MakePDUSessionEstablishmentRequest() (pdu []byte) {
 
 // 8.3.2 PDU session establishment accept
 var ieStrPSEAccept = map[int]string{
-	ieiPDUAddress: ieStr[ieiPDUAddress],
-	iei5GSMCause:  ieStr[iei5GSMCause],
+	ieiPDUAddress:          ieStr[ieiPDUAddress],
+	iei5GSMCause:           ieStr[iei5GSMCause],
+	ieiQoSFlowDescriptions: "Authorized QoS flow descriptions",
+	ieiRQTimerValue:        ieStr[ieiRQTimerValue],
+	ieiExtendedPCO:         ieStr[ieiExtendedPCO],
 }
 
-func (ue *UE) decPDUSessionEstablishmentAccept(pdu *[]byte) {
+func (ue *UE) decPDUSessionEstablishmentAccept(s *PDUSession, pdu *[]byte) {
 
 	ue.dprint("PDU Session Establishment Accept")
 
 	ue.indent++
 	ue.dprint("Selected PDU session type")
-	ue.decPDUSessionType(false, pdu)
+	s.Type = ue.decPDUSessionType(false, pdu)
 
 	ue.dprint("Selected SSC mode")
 	ue.decSSCMode(false, pdu)
 	*pdu = (*pdu)[1:]
 
 	ue.dprint("Authorized QoS rules")
-	ue.decQoSRules(pdu)
+	s.QoSRules = nil
+	for _, rule := range ue.decQoSRules(pdu) {
+		s.applyQoSRule(rule)
+	}
 
 	ue.dprint("Session AMBR")
-	ue.decSessionAMBR(pdu)
+	s.AMBR = ue.decSessionAMBR(pdu)
 
 	ue.decInformationElement(pdu, ieStrPSEAccept)
 
 	ue.indent--
 
+	s.PTI = 0
+	s.State = SMActive
+
 	return
 }
 
-// 9.1.1 NAS message format
-func (ue *UE) enc5GSMMMessageHeader(
-	headType uint8, msgType uint8) (head []byte) {
+// 8.3.3 PDU session establishment reject
+var ieStrPSEReject = map[int]string{
+	ieiBackoffTimerValue: ieStr[ieiBackoffTimerValue],
+	ieiEAPMessage:        ieStr[ieiEAPMessage],
+}
 
-	head = append(head, EPD5GSMobilityManagement)
-	head = append(head, headType)
-	head = append(head, msgType)
+func (ue *UE) decPDUSessionEstablishmentReject(s *PDUSession, pdu *[]byte) {
 
-	return
-}
+	ue.dprint("PDU Session Establishment Reject")
 
-func (ue *UE) enc5GSSMMessageHeader(
-	psi uint8, pti uint8, msgType uint8) (head []byte) {
+	ue.indent++
+	ue.dprint("5GSM cause")
+	ue.setSMCause(ue.dec5GSMCause(pdu))
 
-	head = append(head, EPD5GSSessionManagement)
-	head = append(head, psi)
-	head = append(head, pti)
-	head = append(head, msgType)
+	ue.decInformationElement(pdu, ieStrPSEReject)
+	ue.indent--
+
+	s.PTI = 0
+	s.State = SMInactive
 
 	return
 }
 
-func (ue *UE) enc5GSecurityProtectedMessageHeader(
-	headType uint8, pdu *[]byte) (head []byte) {
+// 8.3.7 PDU session modification request
+// MakePDUSessionModificationRequest requests the network to modify the
+// active PDU session.
+// see 6.4.2.2 UE-requested PDU session modification procedure initiation
+func (ue *UE) MakePDUSessionModificationRequest(psi uint8) (pdu []byte) {
 
-	head = append(head, []byte{EPD5GSMobilityManagement}...)
-	head = append(head, []byte{headType}...)
+	defer ue.updateFirstPDUSession()
+	s := ue.sm.session[psi]
+	if s == nil || s.State != SMActive {
+		ue.dprint("PDU session %d is not active.", psi)
+		return
+	}
 
-	seq := []byte{uint8(ue.NasCount)}
-	*pdu = append(seq, *pdu...)
+	s.PTI = ue.allocatePTI()
+	s.State = SMModificationPending
 
-	mac := ue.ComputeMAC(0, pdu)
-	head = append(head, mac...)
+	pdu = ue.enc5GSSMMessageHeader(
+		s.PSI, s.PTI, MessageTypePDUSessionModificationRequest)
 
-	ue.NasCount++
+	pdu = ue.encUL5GSMMessage(
+		s.PSI, MessageTypePDUSessionModificationRequest, pdu)
 
 	return
 }
 
-// 9.4 PDU session identity
-func (ue *UE) decPDUSessionIdentity(pdu *[]byte) {
+// 8.3.8 PDU session modification reject
+var ieStrPSMReject = map[int]string{
+	ieiBackoffTimerValue: ieStr[ieiBackoffTimerValue],
+}
+
+func (ue *UE) decPDUSessionModificationReject(s *PDUSession, pdu *[]byte) {
+
+	ue.dprint("PDU Session Modification Reject")
+
+	ue.indent++
+	ue.dprint("5GSM cause")
+	ue.setSMCause(ue.dec5GSMCause(pdu))
+
+	ue.decInformationElement(pdu, ieStrPSMReject)
+	ue.indent--
+
+	s.PTI = 0
+	if s.State == SMModificationPending {
+		s.State = SMActive
+	}
 
-	id := int((*pdu)[0])
-	*pdu = (*pdu)[1:]
-	ue.dprint("PDU Session Identity: 0x%x", id)
 	return
 }
 
-// 9.6 Procedure transaction identity
-func (ue *UE) decProcedureTransactionIdentity(pdu *[]byte) {
-	id := int((*pdu)[0])
-	*pdu = (*pdu)[1:]
-	ue.dprint("Procedure Transaction Identity: 0x%x", id)
-	return
+// 8.3.9 PDU session modification command
+var ieStrPSMCommand = map[int]string{
+	iei5GSMCause:           ieStr[iei5GSMCause],
+	ieiSessionAMBR:         ieStr[ieiSessionAMBR],
+	ieiAuthorizedQoSRules:  ieStr[ieiAuthorizedQoSRules],
+	ieiQoSFlowDescriptions: "Authorized QoS flow descriptions",
+	ieiRQTimerValue:        ieStr[ieiRQTimerValue],
+	ieiExtendedPCO:         ieStr[ieiExtendedPCO],
 }
 
-// 9.7 Message type
-func (ue *UE) decMessageType(pdu *[]byte) (msgType int) {
-	msgType = int((*pdu)[0])
-	ue.dprint("Message Type: %s (0x%x)", msgTypeStr[msgType], msgType)
-	*pdu = (*pdu)[1:]
+func (ue *UE) decPDUSessionModificationCommand(s *PDUSession, pdu *[]byte) {
+
+	ue.dprint("PDU Session Modification Command")
+
+	ue.indent++
+	ue.decInformationElement(pdu, ieStrPSMCommand)
+	ue.indent--
+
+	s.State = SMActive
+
 	return
 }
 
-// 9.11.2.1B DNN
-func (ue *UE) encDNN() (pdu []byte) {
-
-	pdu = append(pdu, byte(ieiDNN))
+// 8.3.10 PDU session modification complete
+// MakePDUSessionModificationComplete completes the modification commanded
+// by the network.
+func (ue *UE) MakePDUSessionModificationComplete(psi uint8) (pdu []byte) {
 
-	dnn := []byte{}
-	for _, str := range strings.Split(ue.DNN, ".") {
-		dnn = append(dnn, byte(len(str)))
-		dnn = append(dnn, []byte(str)...)
+	s := ue.sm.session[psi]
+	if s == nil {
+		ue.dprint("unknown PDU session: %d", psi)
+		return
 	}
 
-	pdu = append(pdu, byte(len(dnn)))
-	pdu = append(pdu, dnn...)
+	pdu = ue.enc5GSSMMessageHeader(
+		s.PSI, s.PTI, MessageTypePDUSessionModificationComplete)
+	s.PTI = 0
+
+	pdu = ue.encUL5GSMMessage(
+		s.PSI, MessageTypePDUSessionModificationComplete, pdu)
 
 	return
 }
 
-// 9.11.2.4 GPRS timer 2
-// See subclause 10.5.7.4 in 3GPP TS 24.008.
-func (ue *UE) decGPRSTimer2(pdu *[]byte) {
+// 8.3.12 PDU session release request
+// MakePDUSessionReleaseRequest requests the network to release the PDU
+// session with the 5GSM cause, e.g. #36 regular deactivation.
+// see 6.4.3.2 UE-requested PDU session release procedure initiation
+func (ue *UE) MakePDUSessionReleaseRequest(
+	psi uint8, cause uint8) (pdu []byte) {
+
+	defer ue.updateFirstPDUSession()
+	s := ue.sm.session[psi]
+	if s == nil || s.State != SMActive {
+		ue.dprint("PDU session %d is not active.", psi)
+		return
+	}
 
-	tmp := int((*pdu)[1])
+	s.PTI = ue.allocatePTI()
+	s.State = SMInactivePending
 
-	multiple := 2 // 2 seconds
-	switch tmp >> 5 {
-	case 0x1:
-		multiple = 60 // 1 minute
-	case 0x2:
-		multiple = 60 * 60 / 10 // 1 decihours
-	case 0x7:
-		multiple = 0 // deactivated
-	}
+	pdu = ue.enc5GSSMMessageHeader(
+		s.PSI, s.PTI, MessageTypePDUSessionReleaseRequest)
+	pdu = append(pdu, enc5GSMCause(cause)...)
 
-	ue.Recv.t3502 = (tmp & 0x1f) * multiple
-	*pdu = (*pdu)[2:]
-	ue.dprinti("GPRS timer 2: %d sec", ue.Recv.t3502)
+	pdu = ue.encUL5GSMMessage(
+		s.PSI, MessageTypePDUSessionReleaseRequest, pdu)
 
 	return
 }
 
-// 9.11.2.5 GPRS timer 3
-// See subclause 10.5.7.4a in 3GPP TS 24.008.
-func (ue *UE) decGPRSTimer3(pdu *[]byte) {
+// 8.3.13 PDU session release reject
+func (ue *UE) decPDUSessionReleaseReject(s *PDUSession, pdu *[]byte) {
 
-	tmp := int((*pdu)[1])
+	ue.dprint("PDU Session Release Reject")
 
-	multiple := 60 * 10 // 60 minutes
-	switch tmp >> 5 {
-	case 0x1:
+	ue.indent++
+	ue.dprint("5GSM cause")
+	ue.setSMCause(ue.dec5GSMCause(pdu))
+	ue.indent--
+
+	s.PTI = 0
+	if s.State == SMInactivePending {
+		s.State = SMActive
+	}
+
+	return
+}
+
+// 8.3.14 PDU session release command
+var ieStrPSRCommand = map[int]string{
+	ieiBackoffTimerValue: ieStr[ieiBackoffTimerValue],
+	ieiEAPMessage:        ieStr[ieiEAPMessage],
+}
+
+func (ue *UE) decPDUSessionReleaseCommand(s *PDUSession, pdu *[]byte) {
+
+	ue.dprint("PDU Session Release Command")
+
+	ue.indent++
+	ue.dprint("5GSM cause")
+	ue.setSMCause(ue.dec5GSMCause(pdu))
+
+	ue.decInformationElement(pdu, ieStrPSRCommand)
+	ue.indent--
+
+	s.State = SMInactive
+	s.rqos.deleteRules(0)
+
+	return
+}
+
+// 8.3.15 PDU session release complete
+// MakePDUSessionReleaseComplete completes the release commanded by the
+// network.
+func (ue *UE) MakePDUSessionReleaseComplete(psi uint8) (pdu []byte) {
+
+	s := ue.sm.session[psi]
+	if s == nil {
+		ue.dprint("unknown PDU session: %d", psi)
+		return
+	}
+
+	pdu = ue.enc5GSSMMessageHeader(
+		s.PSI, s.PTI, MessageTypePDUSessionReleaseComplete)
+	s.PTI = 0
+
+	pdu = ue.encUL5GSMMessage(
+		s.PSI, MessageTypePDUSessionReleaseComplete, pdu)
+
+	return
+}
+
+// setSMCause, setSMBackoff, setSessionAMBR and setQoSRules store the IEs
+// into the PDU session being decoded.
+func (ue *UE) setSMCause(cause uint8) {
+	if s := ue.sm.current; s != nil {
+		s.Cause = cause
+	}
+}
+
+func (ue *UE) setSMBackoff(sec int) {
+	if s := ue.sm.current; s != nil {
+		s.Backoff = time.Duration(sec) * time.Second
+	}
+}
+
+func (ue *UE) setRQTimer(sec int) {
+	if s := ue.sm.current; s != nil {
+		s.RQTimer = time.Duration(sec) * time.Second
+	}
+}
+
+func (ue *UE) setDNS(dns []net.IP) {
+	if s := ue.sm.current; s != nil && len(dns) != 0 {
+		s.DNS = dns
+	}
+}
+
+func (ue *UE) setSessionAMBR(ambr SessionAMBR) {
+	if s := ue.sm.current; s != nil {
+		s.AMBR = ambr
+	}
+}
+
+func (ue *UE) setQoSFlows(flows []QoSFlowDescription) {
+	s := ue.sm.current
+	if s == nil {
+		return
+	}
+	for _, flow := range flows {
+		s.applyQoSFlowDescription(flow)
+	}
+}
+
+func (ue *UE) setQoSRules(rules []QoSRule) {
+	s := ue.sm.current
+	if s == nil {
+		return
+	}
+	for _, rule := range rules {
+		s.applyQoSRule(rule)
+	}
+}
+
+// PDUSession returns the PDU session identified by the PSI.
+func (ue *UE) PDUSession(psi uint8) *PDUSession {
+	return ue.sm.session[psi]
+}
+
+// ActivePDUSessions returns the PDU sessions in the 5GSM state PDU SESSION
+// ACTIVE in the order of the PSI.
+func (ue *UE) ActivePDUSessions() (list []*PDUSession) {
+	for psi := uint8(1); psi <= maxPSI; psi++ {
+		if s := ue.sm.session[psi]; s != nil && s.State == SMActive {
+			list = append(list, s)
+		}
+	}
+	return
+}
+
+// releasePDUSessions releases all the PDU sessions locally.
+func (ue *UE) releasePDUSessions() {
+	ue.sm.session = map[uint8]*PDUSession{}
+	ue.updateFirstPDUSession()
+	return
+}
+
+// updateFirstPDUSession updates the deprecated SMstate and PDUAddress by
+// the PDU session of the smallest PSI.
+func (ue *UE) updateFirstPDUSession() {
+
+	ue.SMstate = SMInactive
+	ue.Recv.PDUAddress = nil
+	for psi := uint8(1); psi <= maxPSI; psi++ {
+		if s := ue.sm.session[psi]; s != nil {
+			ue.SMstate = s.State
+			ue.Recv.PDUAddress = s.Address
+			return
+		}
+	}
+	return
+}
+
+// 9.1.1 NAS message format
+func (ue *UE) enc5GSMMMessageHeader(
+	headType uint8, msgType uint8) (head []byte) {
+
+	head = append(head, EPD5GSMobilityManagement)
+	head = append(head, headType)
+	head = append(head, msgType)
+
+	return
+}
+
+func (ue *UE) enc5GSSMMessageHeader(
+	psi uint8, pti uint8, msgType uint8) (head []byte) {
+
+	head = append(head, EPD5GSSessionManagement)
+	head = append(head, psi)
+	head = append(head, pti)
+	head = append(head, msgType)
+
+	return
+}
+
+func (ue *UE) enc5GSecurityProtectedMessageHeader(
+	headType uint8, pdu *[]byte) (head []byte) {
+
+	head = append(head, []byte{EPD5GSMobilityManagement}...)
+	head = append(head, []byte{headType}...)
+
+	seq := []byte{uint8(ue.NasCount)}
+	*pdu = append(seq, *pdu...)
+
+	mac := ue.ComputeMAC(0, pdu)
+	head = append(head, mac...)
+
+	ue.NasCount++
+
+	return
+}
+
+// 9.4 PDU session identity
+const maxPSI = 15
+
+func (ue *UE) decPDUSessionIdentity(pdu *[]byte) (id uint8) {
+
+	id = readPduByte(pdu)
+	ue.dprint("PDU Session Identity: 0x%x", id)
+	return
+}
+
+// allocatePSI returns the lowest PSI not in use, or 0 if all are in use.
+// the PDU session in the state PDU SESSION INACTIVE is kept to see the
+// result until the PSI is allocated again.
+func (ue *UE) allocatePSI() uint8 {
+	for psi := uint8(1); psi <= maxPSI; psi++ {
+		if s, ok := ue.sm.session[psi]; !ok || s.State == SMInactive {
+			return psi
+		}
+	}
+	return 0
+}
+
+// 9.6 Procedure transaction identity
+// PTI values 1 to 254 are assigned by the UE.
+func (ue *UE) decProcedureTransactionIdentity(pdu *[]byte) (id uint8) {
+	id = readPduByte(pdu)
+	ue.dprint("Procedure Transaction Identity: 0x%x", id)
+	return
+}
+
+func (ue *UE) allocatePTI() uint8 {
+	ue.sm.pti++
+	if ue.sm.pti == 0 || ue.sm.pti == 0xff {
+		ue.sm.pti = 1
+	}
+	return ue.sm.pti
+}
+
+// 9.7 Message type
+func (ue *UE) decMessageType(pdu *[]byte) (msgType int) {
+	msgType = int((*pdu)[0])
+	ue.dprint("Message Type: %s (0x%x)", msgTypeStr[msgType], msgType)
+	*pdu = (*pdu)[1:]
+	return
+}
+
+// 9.11.2.1B DNN
+func encDNN(dnn string) (pdu []byte) {
+
+	pdu = append(pdu, byte(ieiDNN))
+
+	v := []byte{}
+	for _, str := range strings.Split(dnn, ".") {
+		v = append(v, byte(len(str)))
+		v = append(v, []byte(str)...)
+	}
+
+	pdu = append(pdu, byte(len(v)))
+	pdu = append(pdu, v...)
+
+	return
+}
+
+func decDNN(pdu *[]byte) (dnn string) {
+
+	length := int(readPduByte(pdu))
+	val := readPduByteSlice(pdu, length)
+
+	var labels []string
+	for len(val) > 0 {
+		l := int(val[0])
+		if l+1 > len(val) {
+			break
+		}
+		labels = append(labels, string(val[1:l+1]))
+		val = val[l+1:]
+	}
+	dnn = strings.Join(labels, ".")
+
+	return
+}
+
+// 9.11.2.2 EAP message
+// RFC 3748 4. EAP Packet Format
+const (
+	EAPCodeRequest = iota + 1
+	EAPCodeResponse
+	EAPCodeSuccess
+	EAPCodeFailure
+)
+
+var eapCodeStr = map[uint8]string{
+	EAPCodeRequest:  "Request",
+	EAPCodeResponse: "Response",
+	EAPCodeSuccess:  "Success",
+	EAPCodeFailure:  "Failure",
+}
+
+func (ue *UE) decEAPMessage(pdu *[]byte) {
+
+	length := int(readPduUint16(pdu))
+	eap := readPduByteSlice(pdu, length)
+	ue.AuthParam.eap = eap
+
+	if len(eap) < 4 {
+		ue.dprinti("EAP message is too short: %x", eap)
+		return
+	}
+	ue.dprinti("EAP code: %s(%d), identifier: %d",
+		eapCodeStr[eap[0]], eap[0], eap[1])
+
+	switch eap[0] {
+	case EAPCodeSuccess:
+		// Kausf has been derived from EMSK when the UE responded to
+		// the EAP-Request/AKA'-Challenge. see 6.1.3.1 in TS 33.501.
+		ue.dprinti("EAP based primary authentication succeeded.")
+	case EAPCodeFailure:
+		ue.dprinti("EAP based primary authentication failed.")
+	}
+
+	return
+}
+
+func (ue *UE) encEAPMessage(iei bool, eap []byte) (pdu []byte) {
+
+	if iei {
+		pdu = append(pdu, ieiEAPMessage)
+	}
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(eap)))
+	pdu = append(pdu, length...)
+	pdu = append(pdu, eap...)
+
+	return
+}
+
+// 9.11.2.3 GPRS timer
+// See subclause 10.5.7.3 in 3GPP TS 24.008.
+func (ue *UE) decGPRSTimer(pdu *[]byte) (sec int) {
+
+	tmp := int((*pdu)[0])
+
+	multiple := 2 // 2 seconds
+	switch tmp >> 5 {
+	case 0x1:
+		multiple = 60 // 1 minute
+	case 0x2:
+		multiple = 60 * 60 / 10 // 1 decihours
+	case 0x7:
+		multiple = 0 // deactivated
+	}
+
+	sec = (tmp & 0x1f) * multiple
+	*pdu = (*pdu)[1:]
+	ue.dprinti("GPRS timer: %d sec", sec)
+
+	return
+}
+
+// 9.11.2.4 GPRS timer 2
+// See subclause 10.5.7.4 in 3GPP TS 24.008.
+func (ue *UE) decGPRSTimer2(pdu *[]byte) (sec int) {
+
+	tmp := int((*pdu)[1])
+
+	multiple := 2 // 2 seconds
+	switch tmp >> 5 {
+	case 0x1:
+		multiple = 60 // 1 minute
+	case 0x2:
+		multiple = 60 * 60 / 10 // 1 decihours
+	case 0x7:
+		multiple = 0 // deactivated
+	}
+
+	sec = (tmp & 0x1f) * multiple
+	*pdu = (*pdu)[2:]
+	ue.dprinti("GPRS timer 2: %d sec", sec)
+
+	return
+}
+
+// 9.11.2.5 GPRS timer 3
+// See subclause 10.5.7.4a in 3GPP TS 24.008.
+func (ue *UE) decGPRSTimer3(pdu *[]byte) (sec int) {
+
+	tmp := int((*pdu)[1])
+
+	multiple := 60 * 10 // 60 minutes
+	switch tmp >> 5 {
+	case 0x1:
 		multiple = 60 * 60 // 1 hour
 	case 0x2:
 		multiple = 60 * 60 * 10 // 10 hours
@@ -904,9 +2444,9 @@ func (ue *UE) decGPRSTimer3(pdu *[]byte) {
 		multiple = 0 // deactivated
 	}
 
-	ue.Recv.t3512 = (tmp & 0x1f) * multiple
+	sec = (tmp & 0x1f) * multiple
 	*pdu = (*pdu)[2:]
-	ue.dprinti("GPRS timer 3: %d sec", ue.Recv.t3512)
+	ue.dprinti("GPRS timer 3: %d sec", sec)
 	return
 }
 
@@ -959,18 +2499,33 @@ func (ue *UE) decSNSSAI(iei bool, pdu *[]byte) (snssai SNSSAI) {
 	return
 }
 
-func (ue *UE) encSNSSAI() (pdu []byte) {
+func encSNSSAI(snssai SNSSAI) (pdu []byte) {
 
 	pdu = append(pdu, byte(ieiSNSSAI))
-	pdu = append(pdu, byte(4)) // length: sst = 1, ssd = 3
-	pdu = append(pdu, byte(ue.SNSSAI.SST))
+	pdu = append(pdu, encSNSSAIValue(snssai)...)
 
-	tmp, _ := hex.DecodeString(ue.SNSSAI.SD)
-	pdu = append(pdu, tmp...)
+	return
+}
+
+// encSNSSAIValue returns the S-NSSAI in LV format.
+func encSNSSAIValue(snssai SNSSAI) (pdu []byte) {
+
+	v := []byte{byte(snssai.SST)}
+	if snssai.SD != "" {
+		sd, _ := hex.DecodeString(snssai.SD)
+		v = append(v, sd...)
+	}
+
+	pdu = append(pdu, byte(len(v)))
+	pdu = append(pdu, v...)
 
 	return
 }
 
+func (s SNSSAI) equal(t SNSSAI) bool {
+	return s.SST == t.SST && strings.EqualFold(s.SD, t.SD)
+}
+
 // 9.11.3.1 5GMM capability
 type FiveGMMCapability struct {
 	iei         uint8
@@ -997,6 +2552,130 @@ func enc5GMMCapability() (pdu []byte) {
 	return
 }
 
+// 9.11.3.2 5GMM cause
+// Annex A Cause values for 5GS mobility management
+const (
+	mmCauseIllegalUE                 = 0x03
+	mmCausePEINotAccepted            = 0x05
+	mmCauseIllegalME                 = 0x06
+	mmCause5GSServicesNotAllowed     = 0x07
+	mmCauseUEIdentityCannotBeDerived = 0x09
+	mmCauseImplicitlyDeregistered    = 0x0a
+	mmCausePLMNNotAllowed            = 0x0b
+	mmCauseTANotAllowed              = 0x0c
+	mmCauseRoamingNotAllowedInTA     = 0x0d
+	mmCauseNoSuitableCellsInTA       = 0x0f
+	mmCauseMACFailure                = 0x14
+	mmCauseSynchFailure              = 0x15
+	mmCauseCongestion                = 0x16
+	mmCauseUESecurityCapMismatch     = 0x17
+	mmCauseSecurityModeRejected      = 0x18
+	mmCauseNon5GAuthUnacceptable     = 0x1a
+	mmCauseN1ModeNotAllowed          = 0x1b
+	mmCauseRestrictedServiceArea     = 0x1c
+	mmCauseRedirectionToEPCRequired  = 0x1f
+	mmCauseLADNNotAvailable          = 0x2b
+	mmCauseNoNetworkSlicesAvailable  = 0x3e
+	mmCauseMaxPDUSessionsReached     = 0x41
+	mmCauseInsufficientResSliceDNN   = 0x43
+	mmCauseInsufficientResSlice      = 0x45
+	mmCauseNgKSIAlreadyInUse         = 0x47
+	mmCauseNon3GPPAccessNotAllowed   = 0x48
+	mmCauseServingNetworkNotAuth     = 0x49
+	mmCauseTempNotAuthorizedForSNPN  = 0x4a
+	mmCausePermNotAuthorizedForSNPN  = 0x4b
+	mmCauseNotAuthorizedForCAG       = 0x4c
+	mmCauseWirelineAccessNotAllowed  = 0x4d
+	mmCausePLMNNotAllowedAtLocation  = 0x4e
+	mmCauseUASServicesNotAllowed     = 0x4f
+	mmCausePayloadNotForwarded       = 0x5a
+	mmCauseDNNNotSupportedInSlice    = 0x5b
+	mmCauseInsufficientUPResources   = 0x5c
+	mmCauseSemanticallyIncorrectMsg  = 0x5f
+	mmCauseInvalidMandatoryInfo      = 0x60
+	mmCauseMsgTypeNonExistent        = 0x61
+	mmCauseMsgTypeNotCompatible      = 0x62
+	mmCauseIENonExistent             = 0x63
+	mmCauseConditionalIEError        = 0x64
+	mmCauseMsgNotCompatible          = 0x65
+	mmCauseProtocolErrorUnspecified  = 0x6f
+)
+
+var mmCauseStr = map[uint8]string{
+	mmCauseIllegalUE:                 "Illegal UE",
+	mmCausePEINotAccepted:            "PEI not accepted",
+	mmCauseIllegalME:                 "Illegal ME",
+	mmCause5GSServicesNotAllowed:     "5GS services not allowed",
+	mmCauseUEIdentityCannotBeDerived: "UE identity cannot be derived by the network",
+	mmCauseImplicitlyDeregistered:    "Implicitly de-registered",
+	mmCausePLMNNotAllowed:            "PLMN not allowed",
+	mmCauseTANotAllowed:              "Tracking area not allowed",
+	mmCauseRoamingNotAllowedInTA:     "Roaming not allowed in this tracking area",
+	mmCauseNoSuitableCellsInTA:       "No suitable cells in tracking area",
+	mmCauseMACFailure:                "MAC failure",
+	mmCauseSynchFailure:              "Synch failure",
+	mmCauseCongestion:                "Congestion",
+	mmCauseUESecurityCapMismatch:     "UE security capabilities mismatch",
+	mmCauseSecurityModeRejected:      "Security mode rejected, unspecified",
+	mmCauseNon5GAuthUnacceptable:     "Non-5G authentication unacceptable",
+	mmCauseN1ModeNotAllowed:          "N1 mode not allowed",
+	mmCauseRestrictedServiceArea:     "Restricted service area",
+	mmCauseRedirectionToEPCRequired:  "Redirection to EPC required",
+	mmCauseLADNNotAvailable:          "LADN not available",
+	mmCauseNoNetworkSlicesAvailable:  "No network slices available",
+	mmCauseMaxPDUSessionsReached:     "Maximum number of PDU sessions reached",
+	mmCauseInsufficientResSliceDNN:   "Insufficient resources for specific slice and DNN",
+	mmCauseInsufficientResSlice:      "Insufficient resources for specific slice",
+	mmCauseNgKSIAlreadyInUse:         "ngKSI already in use",
+	mmCauseNon3GPPAccessNotAllowed:   "Non-3GPP access to 5GCN not allowed",
+	mmCauseServingNetworkNotAuth:     "Serving network not authorized",
+	mmCauseTempNotAuthorizedForSNPN:  "Temporarily not authorized for this SNPN",
+	mmCausePermNotAuthorizedForSNPN:  "Permanently not authorized for this SNPN",
+	mmCauseNotAuthorizedForCAG:       "Not authorized for this CAG or authorized for CAG cells only",
+	mmCauseWirelineAccessNotAllowed:  "Wireline access area not allowed",
+	mmCausePLMNNotAllowedAtLocation:  "PLMN not allowed to operate at the present UE location",
+	mmCauseUASServicesNotAllowed:     "UAS services not allowed",
+	mmCausePayloadNotForwarded:       "Payload was not forwarded",
+	mmCauseDNNNotSupportedInSlice:    "DNN not supported or not subscribed in the slice",
+	mmCauseInsufficientUPResources:   "Insufficient user-plane resources for the PDU session",
+	mmCauseSemanticallyIncorrectMsg:  "Semantically incorrect message",
+	mmCauseInvalidMandatoryInfo:      "Invalid mandatory information",
+	mmCauseMsgTypeNonExistent:        "Message type non-existent or not implemented",
+	mmCauseMsgTypeNotCompatible:      "Message type not compatible with the protocol state",
+	mmCauseIENonExistent:             "Information element non-existent or not implemented",
+	mmCauseConditionalIEError:        "Conditional IE error",
+	mmCauseMsgNotCompatible:          "Message not compatible with the protocol state",
+	mmCauseProtocolErrorUnspecified:  "Protocol error, unspecified",
+}
+
+func (ue *UE) dec5GMMCause(pdu *[]byte) (cause uint8) {
+
+	cause = readPduByte(pdu)
+	ue.dprinti("cause: %s(%d)", mmCauseStr[cause], cause)
+
+	return
+}
+
+// 9.11.3.3 5GS identity type
+var identityTypeStr = map[int]string{
+	TypeIDNoIdentity: "No identity",
+	TypeIDSUCI:       "SUCI",
+	TypeID5GGUTI:     "5G-GUTI",
+	TypeIDIMEI:       "IMEI",
+	TypeID5GSTMSI:    "5G-S-TMSI",
+	TypeIDIMEISV:     "IMEISV",
+	TypeIDMACAddress: "MAC address",
+	TypeIDEUI64:      "EUI-64",
+}
+
+func (ue *UE) decIdentityType(pdu *[]byte) (typeID int) {
+
+	typeID = int(readPduByte(pdu) & 0x7)
+	ue.dprinti("identity type: %s(%d)", identityTypeStr[typeID], typeID)
+
+	return
+}
+
 // 9.11.3.4 5GS mobile identity
 // I need C 'union' for golang...
 const (
@@ -1006,6 +2685,8 @@ const (
 	TypeIDIMEI
 	TypeID5GSTMSI
 	TypeIDIMEISV
+	TypeIDMACAddress
+	TypeIDEUI64
 )
 
 const (
@@ -1026,22 +2707,35 @@ func (ue *UE) enc5GSMobileID(iei bool, typeID int) (pdu []byte) {
 	}
 
 	switch typeID {
-	//case TypeIDNoIdentity:
 	case TypeIDSUCI:
 		pdu = append(pdu, ue.enc5GSMobileIDTypeSUCI()...)
 	case TypeID5GGUTI:
 		pdu = append(pdu, ue.enc5GSMobileIDType5GGUTI()...)
-	//case TypeIDIMEI:
-	//case TypeID5GSTMSI:
+	case TypeIDIMEI:
+		pdu = append(pdu, ue.enc5GSMobileIDTypeIMEI()...)
+	case TypeID5GSTMSI:
+		pdu = append(pdu, ue.enc5GSMobileIDType5GSTMSI()...)
 	case TypeIDIMEISV:
 		pdu = append(pdu, ue.enc5GSMobileIDTypeIMEISV()...)
+	case TypeIDMACAddress:
+		pdu = append(pdu, ue.enc5GSMobileIDTypeMACAddress()...)
+	default:
+		pdu = append(pdu, ue.enc5GSMobileIDTypeNoIdentity()...)
 	}
 	return
 }
 
-type FiveGSMobileIDSUCI struct {
-	length                 uint16
-	supiFormatAndTypeID    uint8
+// the UE answers with "No identity" if the requested identity is not
+// available. see 5.4.3.3 Identification response by the UE
+func (ue *UE) enc5GSMobileIDTypeNoIdentity() (pdu []byte) {
+
+	pdu = []byte{0x00, 0x01, TypeIDNoIdentity}
+	return
+}
+
+type FiveGSMobileIDSUCI struct {
+	length                 uint16
+	supiFormatAndTypeID    uint8
 	plmn                   [3]uint8
 	routingIndicator       [2]uint8
 	protectionScheme       uint8
@@ -1087,6 +2781,74 @@ func (ue *UE) enc5GSMobileIDType5GGUTI() (pdu []byte) {
 	return
 }
 
+// 5G-S-TMSI is the shortened form of the 5G-GUTI.
+// <5G-S-TMSI> := <AMF Set ID><AMF Pointer><5G-TMSI>
+// see 5.9.4 in TS 23.003.
+func (ue *UE) enc5GSMobileIDType5GSTMSI() (pdu []byte) {
+
+	id := byte(TypeID5GSTMSI)
+	id |= 0xf0
+	pdu = append(pdu, id)
+
+	const sTMSIOffset = 4 // PLMN(3) + AMF Region ID(1)
+	if len(ue.Recv.fiveGGUTI) > sTMSIOffset {
+		pdu = append(pdu, ue.Recv.fiveGGUTI[sTMSIOffset:]...)
+	}
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(pdu)))
+	pdu = append(length, pdu...)
+	return
+}
+
+func (ue *UE) enc5GSMobileIDTypeIMEI() (pdu []byte) {
+
+	imei := ue.IMEI
+	if imei == "" {
+		imei = IMEISV2IMEI(ue.IMEISV)
+	}
+	if len(imei) != 15 {
+		ue.dprint("IMEI is not available: %q", imei)
+		pdu = ue.enc5GSMobileIDTypeNoIdentity()
+		return
+	}
+
+	var typeID uint8 = TypeIDIMEI
+	typeID |= 0x08 // odd even bit. IMEI has 15 digits.
+
+	pdu = Str2BCD(fmt.Sprintf("%x%s", typeID, imei))
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(pdu)))
+	pdu = append(length, pdu...)
+	return
+}
+
+// IMEISV2IMEI derives the IMEI from the IMEISV, i.e. TAC and SNR followed
+// by the Luhn check digit. see 6.2.1 and Annex B in TS 23.003.
+func IMEISV2IMEI(imeisv string) (imei string) {
+
+	if len(imeisv) != 16 {
+		return
+	}
+	imei = imeisv[:14]
+
+	sum := 0
+	for i, c := range imei {
+		d := int(c - '0')
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	imei += strconv.Itoa((10 - sum%10) % 10)
+
+	return
+}
+
 type FiveGSMobileIDIMEISV struct {
 	length uint16
 	imeisv [9]byte
@@ -1114,6 +2876,25 @@ func (ue *UE) enc5GSMobileIDTypeIMEISV() (pdu []byte) {
 	return
 }
 
+func (ue *UE) enc5GSMobileIDTypeMACAddress() (pdu []byte) {
+
+	mac, err := net.ParseMAC(ue.MACAddress)
+	if err != nil || len(mac) != 6 {
+		ue.dprint("MAC address is not available: %q", ue.MACAddress)
+		pdu = ue.enc5GSMobileIDTypeNoIdentity()
+		return
+	}
+
+	// MAUri (MAC address usage restriction indication) is not set.
+	pdu = append(pdu, TypeIDMACAddress)
+	pdu = append(pdu, mac...)
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(pdu)))
+	pdu = append(length, pdu...)
+	return
+}
+
 func encPLMN(mcc, mnc int) (plmn [3]byte) {
 	format := "%d%d"
 	if mnc < 100 {
@@ -1263,7 +3044,7 @@ func (ue *UE) encRegistrationType() (pdu []byte) {
 }
 
 // 9.11.3.9 5GS tracking area identity list
-func (ue *UE) decTAIList(pdu *[]byte) {
+func (ue *UE) decTAIList(pdu *[]byte) (tai []TAI) {
 	length := int((*pdu)[0])
 	*pdu = (*pdu)[1:]
 
@@ -1279,7 +3060,7 @@ func (ue *UE) decTAIList(pdu *[]byte) {
 
 	switch typeOfList {
 	case 0x00:
-		ue.decTAIListType00(pdu, elementNum)
+		tai = ue.decTAIListType00(pdu, elementNum)
 		/*
 			case 0x01:
 				break
@@ -1300,7 +3081,36 @@ type TAI struct {
 	tac []byte
 }
 
-func (ue *UE) decTAIListType00(pdu *[]byte, num int) {
+func (t TAI) equal(u TAI) bool {
+	return t.mcc == u.mcc && t.mnc == u.mnc && bytes.Equal(t.tac, u.tac)
+}
+
+// setTAIList stores the TAI list as the registration area. the S-NSSAIs
+// rejected in the current registration area are forgotten if the area is
+// changed, while the ones rejected in the current PLMN are kept.
+// see 4.6.2.2 NSSAI storage.
+func (ue *UE) setTAIList(tai []TAI) {
+
+	changed := len(tai) != len(ue.Recv.tai)
+	for i := 0; !changed && i < len(tai); i++ {
+		changed = !tai[i].equal(ue.Recv.tai[i])
+	}
+	ue.Recv.tai = tai
+	if changed == false {
+		return
+	}
+
+	nssai := ue.Recv.rejectNSSAI[:0]
+	for _, r := range ue.Recv.rejectNSSAI {
+		if r.Cause != RejectedNSSAICauseRegistrationArea {
+			nssai = append(nssai, r)
+		}
+	}
+	ue.Recv.rejectNSSAI = nssai
+	return
+}
+
+func (ue *UE) decTAIListType00(pdu *[]byte, num int) (tai []TAI) {
 
 	mcc, mnc := ue.decPLMN(pdu)
 
@@ -1308,7 +3118,7 @@ func (ue *UE) decTAIListType00(pdu *[]byte, num int) {
 	for num > 0 {
 		tac := (*pdu)[:tacSize]
 		*pdu = (*pdu)[tacSize:]
-		ue.Recv.tai = append(ue.Recv.tai, TAI{mcc, mnc, tac})
+		tai = append(tai, TAI{mcc, mnc, tac})
 		ue.dprinti("tac: 0x%x", tac)
 		num--
 	}
@@ -1367,11 +3177,24 @@ func (ue *UE) decAdditional5GSecInfo(pdu *[]byte) {
 	return
 }
 
+// 9.11.3.14 Authentication failure parameter
+// TS 24.008 10.5.3.2.2 Authentication Failure parameter
+func (ue *UE) encAuthFailureParam() (pdu []byte) {
+
+	pdu = append(pdu, ieiAuthFailureParam)
+	pdu = append(pdu, uint8(len(ue.AuthParam.auts)))
+	pdu = append(pdu, ue.AuthParam.auts...)
+
+	return
+}
+
 // 9.11.3.15 Authentication parameter AUTN
 // TS 24.008 10.5.3.1.1 Authentication Parameter AUTN (UMTS and EPS authentication challenge)
 type AuthParam struct {
 	K        string
 	OPc      string
+	SQN      string // initial SQNms stored in the USIM in hex.
+	Method   string // AuthMethod5GAKA or AuthMethodEAPAKAPrime.
 	rand     []byte
 	autn     []byte
 	seqxorak []byte
@@ -1384,6 +3207,16 @@ type AuthParam struct {
 	Kamf     []byte
 	Kenc     []byte
 	Kint     []byte
+
+	eap     []byte
+	eapResp []byte
+	auts    []byte
+	sqn     struct {
+		loaded bool
+		known  bool
+		max    uint64             // the highest SQN accepted so far.
+		seq    [sqnIndSize]uint64 // the highest SEQ accepted for each IND.
+	}
 }
 
 func (ue *UE) decAuthParamAUTN(pdu *[]byte) {
@@ -1391,8 +3224,15 @@ func (ue *UE) decAuthParamAUTN(pdu *[]byte) {
 	autnlen := int((*pdu)[0])
 	*pdu = (*pdu)[1:]
 
-	ue.AuthParam.autn = (*pdu)[:autnlen]
+	ue.setAUTN((*pdu)[:autnlen])
 	*pdu = (*pdu)[autnlen:]
+
+	return
+}
+
+func (ue *UE) setAUTN(autn []byte) {
+
+	ue.AuthParam.autn = autn
 	ue.dprinti("AUTN: %02x", ue.AuthParam.autn)
 	ue.AuthParam.seqxorak = ue.AuthParam.autn[:6]
 	ue.AuthParam.amf = ue.AuthParam.autn[6:8]
@@ -1437,6 +3277,32 @@ func (ue *UE) encAuthParamRes() (res AuthParamRes) {
 	return
 }
 
+// 9.11.3.18 Configuration update indication
+func (ue *UE) decConfigurationUpdateIndication(pdu *[]byte) {
+
+	val := readPduByte(pdu)
+	ue.Recv.flag.configUpdateAck = val&0x01 != 0
+	ue.Recv.flag.registrationRequested = val&0x02 != 0
+	ue.dprinti("acknowledgement requested: %t", ue.Recv.flag.configUpdateAck)
+	ue.dprinti("registration requested: %t",
+		ue.Recv.flag.registrationRequested)
+
+	return
+}
+
+// 9.11.3.19 Daylight saving time
+// TS 24.008 10.5.3.12 Daylight Saving Time
+func (ue *UE) decDaylightSavingTime(pdu *[]byte) {
+
+	length := int(readPduByte(pdu))
+	val := readPduByteSlice(pdu, length)
+
+	ue.Recv.DaylightSaving = int(val[0] & 0x03)
+	ue.dprinti("daylight saving time: +%d hour", ue.Recv.DaylightSaving)
+
+	return
+}
+
 // 9.11.3.20 De-registration type
 const (
 	accessTypeNull = iota
@@ -1445,12 +3311,35 @@ const (
 	accessType3GPPandNon3GPP
 )
 
+const (
+	deregTypeSwitchOff      = 0x08
+	deregTypeReRegistration = 0x04
+	deregTypeAccessType     = 0x03
+)
+
+var accessTypeStr = map[uint8]string{
+	accessType3GPP:           "3GPP access",
+	accessTypeNon3GPP:        "Non-3GPP access",
+	accessType3GPPandNon3GPP: "3GPP access and non-3GPP access",
+}
+
+func (ue *UE) decDeregistrationType(pdu *[]byte) (reRegistration bool) {
+
+	val := readPduByte(pdu) & 0x0f
+	reRegistration = val&deregTypeReRegistration != 0
+
+	ue.dprinti("switch off: %t", val&deregTypeSwitchOff != 0)
+	ue.dprinti("re-registration required: %t", reRegistration)
+	ue.dprinti("access type: %s", accessTypeStr[val&deregTypeAccessType])
+
+	return
+}
+
 func (ue *UE) encDeregistrationType() (pdu []byte) {
 
 	pdu = []byte{0}
-	switchOff := false
-	if switchOff {
-		pdu[0] |= (1 << 3)
+	if ue.SwitchOff {
+		pdu[0] |= deregTypeSwitchOff
 	}
 	pdu[0] |= accessType3GPP
 	return
@@ -1469,6 +3358,34 @@ func (ue *UE) decIMEISVRequest(pdu *[]byte) {
 	return
 }
 
+// 9.11.3.30 LADN information
+type LADN struct {
+	DNN string
+	TAI []TAI
+}
+
+func (ue *UE) decLADNInformation(pdu *[]byte) {
+
+	length := int(readPduUint16(pdu))
+	val := readPduByteSlice(pdu, length)
+
+	ue.Recv.ladn = nil
+	for len(val) > 0 {
+		var ladn LADN
+		ladn.DNN = decDNN(&val)
+		ue.dprinti("LADN DNN: %s", ladn.DNN)
+		if len(val) == 0 || int(val[0])+1 > len(val) {
+			break
+		}
+		list := val[:int(val[0])+1]
+		val = val[len(list):]
+		ladn.TAI = ue.decTAIList(&list)
+		ue.Recv.ladn = append(ue.Recv.ladn, ladn)
+	}
+
+	return
+}
+
 // 9.11.3.32 NAS key set identifier
 const (
 	KeySetIdentityNoKeyIsAvailable          = 0x07
@@ -1479,6 +3396,7 @@ func (ue *UE) decNASKeySetIdentifier(pdu *[]byte) {
 
 	ksi := int((*pdu)[0])
 	ue.dprinti("NAS key set identifier: 0x%x", ksi)
+	ue.Recv.ngKSI = uint8(ksi & 0x0f)
 	*pdu = (*pdu)[1:]
 
 	return
@@ -1495,7 +3413,8 @@ func (ue *UE) encNASKeySetIdentifier(type1ie *[]byte) (pdu []byte) {
 }
 
 // 9.11.3.33 NAS message container
-func (ue *UE) encNASMessageContainer(iei bool, msgType int) (pdu []byte) {
+func (ue *UE) encNASMessageContainer(
+	iei bool, msgType int, arg ...uint8) (pdu []byte) {
 
 	if iei == true {
 		pdu = append(pdu, []byte{ieiNASMessageContainer}...)
@@ -1504,7 +3423,9 @@ func (ue *UE) encNASMessageContainer(iei bool, msgType int) (pdu []byte) {
 	tmp := []byte{}
 	switch msgType {
 	case MessageTypeRegistrationRequest:
-		tmp = ue.MakeRegistrationRequest()
+		tmp = ue.encRegistrationRequest(true)
+	case MessageTypeServiceRequest:
+		tmp = ue.encServiceRequest(arg[0], true)
 	default:
 	}
 
@@ -1527,8 +3448,72 @@ func (ue *UE) decNASSecurityAlgorithms(pdu *[]byte) {
 	return
 }
 
+// 9.11.3.35 Network name
+// TS 24.008 10.5.3.5a Network Name
+const (
+	networkNameCodingGSM7bit = 0
+	networkNameCodingUCS2    = 1
+)
+
+func (ue *UE) decNetworkName(pdu *[]byte) (name string) {
+
+	length := int(readPduByte(pdu))
+	val := readPduByteSlice(pdu, length)
+
+	coding := (val[0] >> 4) & 0x07
+	spare := int(val[0] & 0x07)
+	text := val[1:]
+
+	switch coding {
+	case networkNameCodingGSM7bit:
+		name = decGSM7bit(text, (len(text)*8-spare)/7)
+	case networkNameCodingUCS2:
+		var runes []rune
+		for i := 0; i+1 < len(text); i += 2 {
+			runes = append(runes, rune(binary.BigEndian.Uint16(text[i:])))
+		}
+		name = string(runes)
+	default:
+		ue.dprinti("unsupported coding scheme: %d", coding)
+		return
+	}
+	ue.dprinti("network name: %s", name)
+
+	return
+}
+
+// decGSM7bit unpacks the GSM 7 bit default alphabet.
+// only the characters common to ASCII are supported.
+// see TS 23.038 6.1.2.2 SMS Packing
+func decGSM7bit(v []byte, num int) (str string) {
+
+	var runes []rune
+	for i := 0; i < num; i++ {
+		bit := i * 7
+		c := uint16(v[bit/8]) >> (bit % 8)
+		if bit%8 > 1 && bit/8+1 < len(v) {
+			c |= uint16(v[bit/8+1]) << (8 - bit%8)
+		}
+		c &= 0x7f
+
+		switch c {
+		case 0x00:
+			runes = append(runes, '@')
+		case 0x02:
+			runes = append(runes, '$')
+		case 0x11:
+			runes = append(runes, '_')
+		default:
+			runes = append(runes, rune(c))
+		}
+	}
+	str = string(runes)
+
+	return
+}
+
 // 9.11.3.37 NSSAI
-func (ue *UE) decNSSAI(pdu *[]byte) {
+func (ue *UE) decNSSAI(pdu *[]byte) (nssai []SNSSAI) {
 
 	length := int((*pdu)[0])
 	*pdu = (*pdu)[1:]
@@ -1536,7 +3521,7 @@ func (ue *UE) decNSSAI(pdu *[]byte) {
 	for length > 0 {
 		lenBefore := len(*pdu)
 		snssai := ue.decSNSSAI(false, pdu)
-		ue.Recv.allowedNSSAI = append(ue.Recv.allowedNSSAI, snssai)
+		nssai = append(nssai, snssai)
 
 		lenAfter := len(*pdu)
 		length -= lenBefore - lenAfter
@@ -1545,6 +3530,89 @@ func (ue *UE) decNSSAI(pdu *[]byte) {
 	return
 }
 
+func encNSSAI(iei int, nssai []SNSSAI) (pdu []byte) {
+
+	v := []byte{}
+	for _, snssai := range nssai {
+		v = append(v, encSNSSAIValue(snssai)...)
+	}
+
+	pdu = append(pdu, byte(iei))
+	pdu = append(pdu, byte(len(v)))
+	pdu = append(pdu, v...)
+
+	return
+}
+
+// requestedNSSAI returns the configured S-NSSAIs, or the subscribed ones
+// if not configured, except the ones rejected by the network.
+// see 5.5.1.2.2 Initial registration initiation
+func (ue *UE) requestedNSSAI() (nssai []SNSSAI) {
+
+	requested := ue.RequestedNSSAI
+	if len(requested) == 0 {
+		requested = ue.SubscribedNSSAI
+	}
+	for _, snssai := range requested {
+		rejected := false
+		for _, r := range ue.Recv.rejectNSSAI {
+			if snssai.equal(r.SNSSAI) {
+				rejected = true
+				break
+			}
+		}
+		if rejected == false {
+			nssai = append(nssai, snssai)
+		}
+	}
+
+	return
+}
+
+// checkAllowedNSSAI reports the S-NSSAIs allowed by the network but not
+// subscribed by the UE, if the subscribed NSSAI is configured.
+func (ue *UE) checkAllowedNSSAI() {
+
+	if len(ue.SubscribedNSSAI) == 0 {
+		return
+	}
+	for _, snssai := range ue.Recv.allowedNSSAI {
+		subscribed := false
+		for _, s := range ue.SubscribedNSSAI {
+			if snssai.equal(s) {
+				subscribed = true
+				break
+			}
+		}
+		if subscribed == false {
+			ue.dprinti("allowed S-NSSAI not subscribed: SST %d, SD %s",
+				snssai.SST, snssai.SD)
+		}
+	}
+	return
+}
+
+// AllowedNSSAI returns the allowed NSSAI received from the network.
+func (ue *UE) AllowedNSSAI() []SNSSAI {
+	return ue.Recv.allowedNSSAI
+}
+
+// selectSNSSAI returns the S-NSSAI for the PDU session. the configured
+// S-NSSAI is used if the network allowed it, otherwise the first S-NSSAI
+// in the allowed NSSAI is used.
+func (ue *UE) selectSNSSAI() SNSSAI {
+
+	if len(ue.Recv.allowedNSSAI) == 0 {
+		return ue.SNSSAI
+	}
+	for _, snssai := range ue.Recv.allowedNSSAI {
+		if snssai.equal(ue.SNSSAI) {
+			return snssai
+		}
+	}
+	return ue.Recv.allowedNSSAI[0]
+}
+
 // 9.11.3.39 Payload container
 func (ue *UE) decPayloadContainer(pdu *[]byte) {
 
@@ -1594,6 +3662,109 @@ func (ue *UE) encPDUSessionID2(id uint8) (pdu []byte) {
 	return
 }
 
+// 9.11.3.42 PDU session reactivation result
+func (ue *UE) decPDUSessionReactivationResult(pdu *[]byte) {
+
+	ue.Recv.pduSessionReactivation = ue.decPSIBitmap(pdu)
+	ue.dprinti("failed to re-establish the user-plane resources: 0x%04x",
+		ue.Recv.pduSessionReactivation)
+
+	return
+}
+
+// 9.11.3.43 PDU session reactivation result error cause
+func (ue *UE) decPDUSessionReactivationResultErrorCause(pdu *[]byte) {
+
+	length := int(readPduUint16(pdu))
+	for length >= 2 {
+		psi := readPduByte(pdu)
+		cause := readPduByte(pdu)
+		ue.dprinti("PDU session ID %d: %s(%d)", psi, mmCauseStr[cause], cause)
+		length -= 2
+	}
+	readPduByteSlice(pdu, length)
+
+	return
+}
+
+// 9.11.3.44 PDU session status
+func (ue *UE) decPDUSessionStatus(pdu *[]byte) {
+
+	ue.Recv.pduSessionStatus = ue.decPSIBitmap(pdu)
+	ue.dprinti("PDU session status: 0x%04x", ue.Recv.pduSessionStatus)
+
+	/*
+	 * the UE shall perform a local release of all those PDU sessions which
+	 * are in the 5GSM state PDU SESSION ACTIVE on the UE side, but are
+	 * indicated by the AMF as being in 5GSM state PDU SESSION INACTIVE.
+	 * see 5.6.1.4.1 UE is not using 5GS services with control plane CIoT
+	 * 5GS optimization.
+	 */
+	inactive := ue.activePDUSessions() &^ ue.Recv.pduSessionStatus
+	if inactive != 0 {
+		ue.dprinti("local release of PDU sessions: 0x%04x", inactive)
+		for psi := range ue.sm.session {
+			if inactive&(1<<psi) != 0 {
+				delete(ue.sm.session, psi)
+			}
+		}
+	}
+
+	return
+}
+
+func (ue *UE) encPDUSessionStatus(status uint16) (pdu []byte) {
+	pdu = append(pdu, byte(ieiPDUSessionStatus))
+	pdu = append(pdu, encPSIBitmap(status)...)
+	return
+}
+
+// 9.11.3.46 Rejected NSSAI
+const (
+	RejectedNSSAICausePLMN = iota
+	RejectedNSSAICauseRegistrationArea
+	RejectedNSSAICauseNSSAA
+	RejectedNSSAICauseMaxUEs
+)
+
+var rejectedNSSAICauseStr = map[uint8]string{
+	RejectedNSSAICausePLMN:             "not available in the current PLMN or SNPN",
+	RejectedNSSAICauseRegistrationArea: "not available in the current registration area",
+	RejectedNSSAICauseNSSAA:            "not available due to the failed or revoked NSSAA",
+	RejectedNSSAICauseMaxUEs:           "not available due to maximum number of UEs reached",
+}
+
+type RejectedSNSSAI struct {
+	SNSSAI
+	Cause uint8
+}
+
+func (ue *UE) decRejectedNSSAI(pdu *[]byte) (nssai []RejectedSNSSAI) {
+
+	length := int(readPduByte(pdu))
+	val := readPduByteSlice(pdu, length)
+
+	for len(val) > 0 {
+		var r RejectedSNSSAI
+		l := int(val[0] >> 4)
+		r.Cause = val[0] & 0x0f
+		if l < 1 || l+1 > len(val) {
+			break
+		}
+		r.SST = int(val[1])
+		if l >= 4 {
+			r.SD = hex.EncodeToString(val[2:5])
+		}
+		val = val[l+1:]
+
+		ue.dprinti("rejected S-NSSAI: SST %d, SD %s, cause: %s(%d)",
+			r.SST, r.SD, rejectedNSSAICauseStr[r.Cause], r.Cause)
+		nssai = append(nssai, r)
+	}
+
+	return
+}
+
 // 9.11.3.47 Request type
 const (
 	RequestTypeInitialRequest = 0x01
@@ -1604,6 +3775,65 @@ func (ue *UE) encRequestType(val uint8) (pdu []byte) {
 	return
 }
 
+// 9.11.3.50 Service type
+const (
+	ServiceTypeSignalling = iota
+	ServiceTypeData
+	ServiceTypeMobileTerminatedServices
+	ServiceTypeEmergencyServices
+	ServiceTypeEmergencyServicesFallback
+	ServiceTypeHighPriorityAccess
+	ServiceTypeElevatedSignalling
+)
+
+func (ue *UE) encServiceType(serviceType uint8) (val uint8) {
+	val = (serviceType & 0x0f) << 4
+	return
+}
+
+// 9.11.3.52 Time zone
+// TS 24.008 10.5.3.8 Time Zone
+func (ue *UE) decTimeZone(pdu *[]byte) (minutes int) {
+
+	minutes = decTimeZoneValue(readPduByte(pdu))
+	ue.dprinti("time zone: %+d min", minutes)
+
+	return
+}
+
+// the time zone is expressed in quarters of an hour, and the bit 4 is
+// the algebraic sign. see TS 23.040 9.2.3.11
+func decTimeZoneValue(val byte) (minutes int) {
+
+	minutes = (int(val&0x07)*10 + int(val>>4)) * 15
+	if val&0x08 != 0 {
+		minutes = -minutes
+	}
+	return
+}
+
+// 9.11.3.53 Time zone and time
+// TS 24.008 10.5.3.9 Time Zone and Time
+func (ue *UE) decTimeZoneAndTime(pdu *[]byte) {
+
+	val := readPduByteSlice(pdu, 7)
+
+	bcd := func(b byte) int {
+		return int(b&0x0f)*10 + int(b>>4)
+	}
+	ue.Recv.TimeZone = decTimeZoneValue(val[6])
+
+	loc := time.FixedZone("", ue.Recv.TimeZone*60)
+	ue.Recv.NetworkTime = time.Date(2000+bcd(val[0]), time.Month(bcd(val[1])),
+		bcd(val[2]), bcd(val[3]), bcd(val[4]), bcd(val[5]), 0,
+		time.UTC).In(loc)
+
+	ue.dprinti("universal time: %s",
+		ue.Recv.NetworkTime.Format(time.RFC3339))
+
+	return
+}
+
 // 9.11.3.54 UE security capability
 type UESecurityCapability struct {
 	iei    uint8
@@ -1646,36 +3876,206 @@ func (ue *UE) decUESecurityCapability(pdu *[]byte) {
 	return
 }
 
-// 9.11.4.2 5GSM cause
+// 9.11.3.57 Uplink data status
+func (ue *UE) encUplinkDataStatus(status uint16) (pdu []byte) {
+	pdu = append(pdu, byte(ieiUplinkDataStatus))
+	pdu = append(pdu, encPSIBitmap(status)...)
+	return
+}
+
+// 9.11.4.1 5GSM capability
 const (
-	smCausePDUSessionTypeIPv4OnlyeAllowed = 0x32
+	smCapabilityRqoS = 0x01
 )
 
-var smCauseStr = map[byte]string{
-	smCausePDUSessionTypeIPv4OnlyeAllowed: "PDU session type IPv4 only allowed",
+func enc5GSMCapability(rqos bool) (pdu []byte) {
+	var cap uint8
+	if rqos {
+		cap |= smCapabilityRqoS
+	}
+	pdu = []byte{iei5GSMCapability, 1, cap}
+	return
 }
 
-func (ue *UE) dec5GSMCause(pdu *[]byte) {
+// 9.11.4.2 5GSM cause
+// see Annex B Cause values for 5GS session management.
+const (
+	SMCauseODB                     = 8
+	SMCauseInsufficientResources   = 26
+	SMCauseUnknownDNN              = 27
+	SMCauseUnknownPDUSessionType   = 28
+	SMCauseUserAuthFailed          = 29
+	SMCauseRequestRejected         = 31
+	SMCauseServiceNotSupported     = 32
+	SMCauseServiceNotSubscribed    = 33
+	SMCausePTIAlreadyInUse         = 35
+	SMCauseRegularDeactivation     = 36
+	SMCauseNetworkFailure          = 38
+	SMCauseReactivationRequested   = 39
+	SMCauseInvalidPSI              = 43
+	SMCauseOutOfLADNServiceArea    = 46
+	SMCausePTIMismatch             = 47
+	SMCauseIPv4OnlyAllowed         = 50
+	SMCauseIPv6OnlyAllowed         = 51
+	SMCausePDUSessionNotExist      = 54
+	SMCauseIPv4v6OnlyAllowed       = 57
+	SMCauseUnsupported5QI          = 59
+	SMCauseInsufficientForSliceDNN = 67
+	SMCauseSSCModeNotSupported     = 68
+	SMCauseInsufficientForSlice    = 69
+	SMCauseUnknownDNNInSlice       = 70
+	SMCauseInvalidPTI              = 81
+	SMCauseMaxDataRateTooLow       = 82
+	SMCauseSemanticQoSError        = 83
+	SMCauseSyntacticalQoSError     = 84
+	SMCauseSemanticIncorrectMsg    = 95
+	SMCauseInvalidMandatoryInfo    = 96
+	SMCauseMsgTypeNotImplemented   = 97
+	SMCauseMsgTypeNotCompatible    = 98
+	SMCauseIENotImplemented        = 99
+	SMCauseConditionalIEError      = 100
+	SMCauseMsgNotCompatible        = 101
+	SMCauseProtocolError           = 111
+)
 
-	cause := readPduByte(pdu)
-	ue.dprinti("cause: %s(%d)", smCauseStr[cause], cause)
+var smCauseStr = map[byte]string{
+	SMCauseODB:                     "Operator determined barring",
+	SMCauseInsufficientResources:   "Insufficient resources",
+	SMCauseUnknownDNN:              "Missing or unknown DNN",
+	SMCauseUnknownPDUSessionType:   "Unknown PDU session type",
+	SMCauseUserAuthFailed:          "User authentication or authorization failed",
+	SMCauseRequestRejected:         "Request rejected, unspecified",
+	SMCauseServiceNotSupported:     "Service option not supported",
+	SMCauseServiceNotSubscribed:    "Requested service option not subscribed",
+	SMCausePTIAlreadyInUse:         "PTI already in use",
+	SMCauseRegularDeactivation:     "Regular deactivation",
+	SMCauseNetworkFailure:          "Network failure",
+	SMCauseReactivationRequested:   "Reactivation requested",
+	SMCauseInvalidPSI:              "Invalid PDU session identity",
+	SMCauseOutOfLADNServiceArea:    "Out of LADN service area",
+	SMCausePTIMismatch:             "PTI mismatch",
+	SMCauseIPv4OnlyAllowed:         "PDU session type IPv4 only allowed",
+	SMCauseIPv6OnlyAllowed:         "PDU session type IPv6 only allowed",
+	SMCausePDUSessionNotExist:      "PDU session does not exist",
+	SMCauseIPv4v6OnlyAllowed:       "PDU session type IPv4v6 only allowed",
+	SMCauseUnsupported5QI:          "Unsupported 5QI value",
+	SMCauseInsufficientForSliceDNN: "Insufficient resources for specific slice and DNN",
+	SMCauseSSCModeNotSupported:     "Not supported SSC mode",
+	SMCauseInsufficientForSlice:    "Insufficient resources for specific slice",
+	SMCauseUnknownDNNInSlice:       "Missing or unknown DNN in a slice",
+	SMCauseInvalidPTI:              "Invalid PTI value",
+	SMCauseMaxDataRateTooLow:       "Maximum data rate per UE for user-plane integrity protection is too low",
+	SMCauseSemanticQoSError:        "Semantic error in the QoS operation",
+	SMCauseSyntacticalQoSError:     "Syntactical error in the QoS operation",
+	SMCauseSemanticIncorrectMsg:    "Semantically incorrect message",
+	SMCauseInvalidMandatoryInfo:    "Invalid mandatory information",
+	SMCauseMsgTypeNotImplemented:   "Message type non-existent or not implemented",
+	SMCauseMsgTypeNotCompatible:    "Message type not compatible with the protocol state",
+	SMCauseIENotImplemented:        "Information element non-existent or not implemented",
+	SMCauseConditionalIEError:      "Conditional IE error",
+	SMCauseMsgNotCompatible:        "Message not compatible with the protocol state",
+	SMCauseProtocolError:           "Protocol error, unspecified",
+}
 
+func enc5GSMCause(cause uint8) (pdu []byte) {
+	pdu = []byte{iei5GSMCause, cause}
 	return
 }
 
-// 9.11.4.7 Integrity protection maximum data rate
-func (ue *UE) encIntegrityProtectionMaximuDataRate() (pdu []byte) {
+func (ue *UE) dec5GSMCause(pdu *[]byte) (cause uint8) {
 
-	uplink := 0xff
-	downlink := 0xff
+	cause = readPduByte(pdu)
+	ue.dprinti("cause: %s(%d)", smCauseStr[cause], cause)
 
-	pdu = append(pdu, byte(uplink))
-	pdu = append(pdu, byte(downlink))
 	return
 }
 
-// 9.11.4.10 PDU address
-func (ue *UE) decPDUAddress(pdu *[]byte) {
+// 9.11.4.6 Extended protocol configuration options
+// see 10.5.6.3 and 10.5.6.3A in TS 24.008.
+const (
+	// the extension bit and the configuration protocol PPP for use with
+	// IP PDP type or IP PDN type.
+	pcoConfigProtocolPPP = 0x80
+
+	pcoDNSServerIPv6Address = 0x0003
+	pcoDNSServerIPv4Address = 0x000d
+)
+
+// encExtendedPCO requests the DNS server addresses of the PDU session type.
+func encExtendedPCO(pduSessionType uint8) (pdu []byte) {
+
+	contents := []byte{pcoConfigProtocolPPP}
+	if pduSessionType != PDUSessionIPv6 {
+		contents = append(contents, 0, pcoDNSServerIPv4Address, 0)
+	}
+	if pduSessionType != PDUSessionIPv4 {
+		contents = append(contents, 0, pcoDNSServerIPv6Address, 0)
+	}
+
+	pdu = []byte{ieiExtendedPCO, 0, 0}
+	binary.BigEndian.PutUint16(pdu[1:], uint16(len(contents)))
+	pdu = append(pdu, contents...)
+	return
+}
+
+// decExtendedPCO returns the DNS server addresses in the containers. the
+// other containers are skipped.
+func (ue *UE) decExtendedPCO(pdu *[]byte) (dns []net.IP) {
+
+	ue.indent++
+	ue.dprint("Extended protocol configuration options")
+
+	length := int(binary.BigEndian.Uint16(*pdu))
+	*pdu = (*pdu)[2:]
+	ue.dprinti("Length: %d", length)
+	if length > len(*pdu) {
+		length = len(*pdu)
+	}
+	v := (*pdu)[:length]
+	*pdu = (*pdu)[length:]
+
+	if len(v) > 0 {
+		v = v[1:] // configuration protocol
+	}
+	for len(v) >= 3 {
+		id := binary.BigEndian.Uint16(v)
+		n := int(v[2])
+		v = v[3:]
+		if n > len(v) {
+			ue.dprinti("truncated container: 0x%04x", id)
+			break
+		}
+		content := v[:n]
+		v = v[n:]
+
+		switch {
+		case id == pcoDNSServerIPv4Address && n == net.IPv4len,
+			id == pcoDNSServerIPv6Address && n == net.IPv6len:
+			addr := net.IP(append([]byte{}, content...))
+			ue.dprinti("DNS server address: %v", addr)
+			dns = append(dns, addr)
+		default:
+			ue.dprinti("container 0x%04x: %x", id, content)
+		}
+	}
+
+	ue.indent--
+	return
+}
+
+// 9.11.4.7 Integrity protection maximum data rate
+func (ue *UE) encIntegrityProtectionMaximuDataRate() (pdu []byte) {
+
+	uplink := 0xff
+	downlink := 0xff
+
+	pdu = append(pdu, byte(uplink))
+	pdu = append(pdu, byte(downlink))
+	return
+}
+
+// 9.11.4.10 PDU address
+func (ue *UE) decPDUAddress(pdu *[]byte) {
 
 	length := readPduByte(pdu)
 	ue.dprinti("Length: %d", length)
@@ -1684,14 +4084,70 @@ func (ue *UE) decPDUAddress(pdu *[]byte) {
 	ue.dprinti("PDU session type: %s(%d)",
 		pduSessionTypeStr[pduSessionType], pduSessionType)
 
+	var addr, iid net.IP
 	switch pduSessionType {
 	case PDUSessionIPv4:
-		ue.Recv.PDUAddress = readPduByteSlice(pdu, net.IPv4len)
-		ue.dprinti("PDU address information: %v", ue.Recv.PDUAddress)
+		addr = readPduByteSlice(pdu, net.IPv4len)
+	case PDUSessionIPv6:
+		iid = readPduByteSlice(pdu, ifIDLen)
+	case PDUSessionIPv4v6:
+		iid = readPduByteSlice(pdu, ifIDLen)
+		addr = readPduByteSlice(pdu, net.IPv4len)
 	default:
 		ue.dprinti("unsupported PDU session type: %d", pduSessionType)
+		readPduByteSlice(pdu, int(length)-1)
+		return
+	}
+	if iid != nil {
+		ue.dprinti("interface identifier: %v", iid)
+	}
+	if addr != nil {
+		ue.dprinti("PDU address information: %v", addr)
 	}
 
+	// the SMF's IPv6 link local address may follow.
+	if remain := int(length) - 1 - len(iid) - len(addr); remain > 0 {
+		lla := net.IP(readPduByteSlice(pdu, remain))
+		ue.dprinti("SMF's IPv6 link local address: %v", lla)
+	}
+
+	if s := ue.sm.current; s != nil {
+		s.Address = addr
+		s.InterfaceID = iid
+	}
+	return
+}
+
+// the length of the IPv6 interface identifier.
+const ifIDLen = 8
+
+// LinkLocalAddress returns the IPv6 link local address made of the interface
+// identifier, or nil for the IPv4 PDU session.
+func (s *PDUSession) LinkLocalAddress() (addr net.IP) {
+	if len(s.InterfaceID) != ifIDLen {
+		return
+	}
+	addr = make(net.IP, net.IPv6len)
+	addr[0], addr[1] = 0xfe, 0x80
+	copy(addr[net.IPv6len-ifIDLen:], s.InterfaceID)
+	return
+}
+
+// SetIPv6Prefix configures the IPv6 address of the PDU session with the
+// prefix advertised by the router and the interface identifier.
+// see 5.8.2.2.1 in TS 23.501 and RFC 4862
+func (s *PDUSession) SetIPv6Prefix(prefix *net.IPNet) (err error) {
+	if len(s.InterfaceID) != ifIDLen {
+		return fmt.Errorf("nas: no interface identifier in PDU session %d",
+			s.PSI)
+	}
+	if ones, bits := prefix.Mask.Size(); bits != 128 || ones != 64 {
+		return fmt.Errorf("nas: unsupported IPv6 prefix: %v", prefix)
+	}
+	addr := make(net.IP, net.IPv6len)
+	copy(addr, prefix.IP.To16()[:net.IPv6len-ifIDLen])
+	copy(addr[net.IPv6len-ifIDLen:], s.InterfaceID)
+	s.AddressV6 = addr
 	return
 }
 
@@ -1708,25 +4164,176 @@ var pduSessionTypeStr = map[byte]string{
 	PDUSessionIPv4v6: "IPv4v6",
 }
 
-func (ue *UE) encPDUSessionType() (pdu []byte) {
+// pduSessionType returns the PDU session type of the name, or IPv4 if the
+// name is empty or unknown.
+func pduSessionType(name string) uint8 {
+	for t, str := range pduSessionTypeStr {
+		if str == name {
+			return t
+		}
+	}
+	return PDUSessionIPv4
+}
+
+func encPDUSessionType(pduSessionType uint8) (pdu []byte) {
 	/*
-	 * free5gc v3.0.5 doesn't support PDUSessionIPv4v6?
+	 * free5gc v3.0.5 doesn't support PDUSessionIPv4v6, so IPv4 is the
+	 * default.
 	 */
-	//pdu = []byte{byte((ieiPDUSessionType << 4) | PDUSessionIPv4v6)}
-	pdu = []byte{byte((ieiPDUSessionType << 4) | PDUSessionIPv4)}
+	pdu = []byte{byte((ieiPDUSessionType << 4) | pduSessionType)}
 	return
 }
 
-func (ue *UE) decPDUSessionType(iei bool, pdu *[]byte) {
-	pduSessionType := 0x0f & (*pdu)[0]
+func (ue *UE) decPDUSessionType(iei bool, pdu *[]byte) (pduSessionType uint8) {
+	pduSessionType = 0x07 & (*pdu)[0]
 	ue.dprinti("PDU Session Type: %s(%d)",
 		pduSessionTypeStr[pduSessionType], pduSessionType)
 	ShiftType1IE(iei, pdu)
 	return
 }
 
+// 9.11.4.12 QoS flow descriptions
+// the bit rates are in bits per second.
+type QoSFlowDescription struct {
+	QFI             uint8
+	FiveQI          uint8
+	GFBRUL          uint64
+	GFBRDL          uint64
+	MFBRUL          uint64
+	MFBRDL          uint64
+	AveragingWindow uint16 // milliseconds
+	EBI             uint8
+
+	op int // operation code.
+}
+
+const (
+	flowOpCodeCreate = 1
+	flowOpCodeDelete = 2
+	flowOpCodeModify = 3
+)
+
+var flowOpCodeStr = map[int]string{
+	flowOpCodeCreate: "Create new QoS flow description",
+	flowOpCodeDelete: "Delete existing QoS flow description",
+	flowOpCodeModify: "Modify existing QoS flow description",
+}
+
+const (
+	flowParam5QI             = 0x01
+	flowParamGFBRUL          = 0x02
+	flowParamGFBRDL          = 0x03
+	flowParamMFBRUL          = 0x04
+	flowParamMFBRDL          = 0x05
+	flowParamAveragingWindow = 0x06
+	flowParamEBI             = 0x07
+)
+
+var flowParamStr = map[int]string{
+	flowParam5QI:             "5QI",
+	flowParamGFBRUL:          "GFBR uplink",
+	flowParamGFBRDL:          "GFBR downlink",
+	flowParamMFBRUL:          "MFBR uplink",
+	flowParamMFBRDL:          "MFBR downlink",
+	flowParamAveragingWindow: "Averaging window",
+	flowParamEBI:             "EPS bearer identity",
+}
+
+func (ue *UE) decQoSFlowDescriptions(pdu *[]byte) (flows []QoSFlowDescription) {
+
+	ue.indent++
+	length := int(readPduUint16(pdu))
+	ue.dprinti("Length: %d", length)
+	v := readPduByteSlice(pdu, length)
+
+	for i := 0; len(v) > 0; i++ {
+		ue.dprint("QoS flow description %d", i)
+		ue.indent++
+		flows = append(flows, ue.decQoSFlowDescription(&v))
+		ue.indent--
+	}
+	ue.indent--
+
+	return
+}
+
+func (ue *UE) decQoSFlowDescription(pdu *[]byte) (flow QoSFlowDescription) {
+
+	flow.QFI = readPduByte(pdu) & 0x3f
+	ue.dprinti("QoS flow identifier: QFI%d", flow.QFI)
+
+	flow.op = int(readPduByte(pdu) >> 5)
+	ue.dprinti("Operation code: %s(%d)", flowOpCodeStr[flow.op], flow.op)
+
+	num := int(readPduByte(pdu) & 0x3f)
+	ue.dprinti("Number of parameters: %d", num)
+
+	for i := 0; i < num; i++ {
+		id := int(readPduByte(pdu))
+		length := int(readPduByte(pdu))
+		v := readPduByteSlice(pdu, length)
+		ue.dprinti("%s(0x%02x): %x", flowParamStr[id], id, v)
+
+		switch {
+		case id == flowParam5QI && length == 1:
+			flow.FiveQI = v[0]
+		case id >= flowParamGFBRUL && id <= flowParamMFBRDL && length == 3:
+			rate := ambrRate(int(v[0]), binary.BigEndian.Uint16(v[1:]))
+			switch id {
+			case flowParamGFBRUL:
+				flow.GFBRUL = rate
+			case flowParamGFBRDL:
+				flow.GFBRDL = rate
+			case flowParamMFBRUL:
+				flow.MFBRUL = rate
+			case flowParamMFBRDL:
+				flow.MFBRDL = rate
+			}
+		case id == flowParamAveragingWindow && length == 2:
+			flow.AveragingWindow = binary.BigEndian.Uint16(v)
+		case id == flowParamEBI && length == 1:
+			flow.EBI = v[0] >> 4
+		}
+	}
+	return
+}
+
+// applyQoSFlowDescription creates, modifies or deletes the QoS flow
+// description of the PDU session. the parameters are replaced with the
+// new ones by the modification.
+func (s *PDUSession) applyQoSFlowDescription(flow QoSFlowDescription) {
+	op := flow.op
+	flow.op = 0
+	for i, f := range s.QoSFlows {
+		if f.QFI != flow.QFI {
+			continue
+		}
+		if op == flowOpCodeDelete {
+			s.QoSFlows = append(s.QoSFlows[:i], s.QoSFlows[i+1:]...)
+			s.rqos.deleteRules(flow.QFI)
+		} else {
+			s.QoSFlows[i] = flow
+		}
+		return
+	}
+	if op != flowOpCodeDelete {
+		s.QoSFlows = append(s.QoSFlows, flow)
+	}
+	return
+}
+
 // 9.11.4.13 QoS rules
-func (ue *UE) decQoSRules(pdu *[]byte) {
+type QoSRule struct {
+	ID         uint8
+	Default    bool
+	Precedence uint8
+	QFI        uint8
+	Filters    []PacketFilter
+
+	op int // rule operation code.
+}
+
+func (ue *UE) decQoSRules(pdu *[]byte) (rules []QoSRule) {
 
 	ue.indent++
 	ue.dprint("QoS rules")
@@ -1739,7 +4346,9 @@ func (ue *UE) decQoSRules(pdu *[]byte) {
 	for i := 0; remain > 0; i++ {
 		ue.indent++
 		ue.dprint("Qos rule %d", i)
-		remain -= ue.decQoSRule(pdu)
+		rule, length := ue.decQoSRule(pdu)
+		rules = append(rules, rule)
+		remain -= length
 		ue.indent--
 	}
 	ue.indent--
@@ -1749,17 +4358,101 @@ func (ue *UE) decQoSRules(pdu *[]byte) {
 
 const (
 	ruleOpCodeCreateNewQoSRule = 1
+	ruleOpCodeDeleteQoSRule    = 2
+	ruleOpCodeAddFilters       = 3
+	ruleOpCodeReplaceFilters   = 4
+	ruleOpCodeDeleteFilters    = 5
+	ruleOpCodeModifyRule       = 6
 )
 
 var ruleOpCodeStr = map[int]string{
 	ruleOpCodeCreateNewQoSRule: "Create new QoS rule",
+	ruleOpCodeDeleteQoSRule:    "Delete existing QoS rule",
+	ruleOpCodeAddFilters:       "Modify existing QoS rule and add packet filters",
+	ruleOpCodeReplaceFilters:   "Modify existing QoS rule and replace all packet filters",
+	ruleOpCodeDeleteFilters:    "Modify existing QoS rule and delete packet filters",
+	ruleOpCodeModifyRule:       "Modify existing QoS rule without modifying packet filters",
 }
 
-func (ue *UE) decQoSRule(pdu *[]byte) (length int) {
+// applyQoSRule creates, modifies or deletes the QoS rule of the PDU session
+// according to the rule operation code.
+func (s *PDUSession) applyQoSRule(rule QoSRule) {
+	defer s.sortQoSRules()
 
-	id := int((*pdu)[0])
-	*pdu = (*pdu)[1:]
-	ue.dprinti("QoS rule identifier: %d", id)
+	op := rule.op
+	rule.op = 0
+	for i, r := range s.QoSRules {
+		if r.ID != rule.ID {
+			continue
+		}
+		switch op {
+		case ruleOpCodeDeleteQoSRule:
+			s.QoSRules = append(s.QoSRules[:i], s.QoSRules[i+1:]...)
+			return
+		case ruleOpCodeAddFilters:
+			rule.Filters = mergePacketFilters(r.Filters, rule.Filters)
+		case ruleOpCodeDeleteFilters:
+			rule.Filters = deletePacketFilters(r.Filters, rule.Filters)
+		case ruleOpCodeModifyRule:
+			rule.Filters = r.Filters
+		}
+		s.QoSRules[i] = rule
+		return
+	}
+	if op == ruleOpCodeCreateNewQoSRule {
+		s.QoSRules = append(s.QoSRules, rule)
+	}
+	return
+}
+
+// sortQoSRules caches the order of the QoS rules by the precedence, so that
+// the uplink is classified without sorting them.
+func (s *PDUSession) sortQoSRules() {
+	s.ruleOrder = qosRuleOrder(s.QoSRules)
+	return
+}
+
+func qosRuleOrder(rules []QoSRule) (order []int) {
+	order = make([]int, len(rules))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return rules[order[i]].Precedence < rules[order[j]].Precedence
+	})
+	return
+}
+
+// mergePacketFilters adds the packet filters replacing the ones having the
+// same identifier.
+func mergePacketFilters(filters, add []PacketFilter) (list []PacketFilter) {
+	list = deletePacketFilters(filters, add)
+	list = append(list, add...)
+	return
+}
+
+// deletePacketFilters returns the packet filters except the ones having the
+// identifiers in del.
+func deletePacketFilters(filters, del []PacketFilter) (list []PacketFilter) {
+	for _, f := range filters {
+		found := false
+		for _, d := range del {
+			if f.ID == d.ID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, f)
+		}
+	}
+	return
+}
+
+func (ue *UE) decQoSRule(pdu *[]byte) (rule QoSRule, length int) {
+
+	rule.ID = readPduByte(pdu)
+	ue.dprinti("QoS rule identifier: %d", rule.ID)
 	length = 1
 
 	ruleLen := binary.BigEndian.Uint16(*pdu)
@@ -1774,10 +4467,17 @@ func (ue *UE) decQoSRule(pdu *[]byte) (length int) {
 	ruleOpCode := tmp >> 5
 	ue.dprinti("Rule operation code: %s(%d)",
 		ruleOpCodeStr[ruleOpCode], ruleOpCode)
+	rule.op = ruleOpCode
+
+	// the length of QoS rule is one for the delete existing QoS rule.
+	if ruleLen == 1 {
+		return
+	}
 
 	not := "not "
 	if (tmp>>4)&0x1 != 0 {
 		not = ""
+		rule.Default = true
 	}
 	ue.dprinti("the QoS rule is %sthe default QoS rule", not)
 
@@ -1787,13 +4487,19 @@ func (ue *UE) decQoSRule(pdu *[]byte) (length int) {
 	for i := 0; i < filterNum; i++ {
 		ue.dprinti("packet filter %d", i)
 		ue.indent++
-		ue.decPacketFilter(pdu)
+		if ruleOpCode == ruleOpCodeDeleteFilters {
+			// packet filter identifier only.
+			id := readPduByte(pdu) & 0xf
+			ue.dprinti("Packet filter identifier: %d", id)
+			rule.Filters = append(rule.Filters, PacketFilter{ID: id})
+		} else {
+			rule.Filters = append(rule.Filters, ue.decPacketFilter(pdu))
+		}
 		ue.indent--
 	}
 
-	precedence := int((*pdu)[0])
-	*pdu = (*pdu)[1:]
-	ue.dprinti("QoS rule precedence: %d", precedence)
+	rule.Precedence = readPduByte(pdu)
+	ue.dprinti("QoS rule precedence: %d", rule.Precedence)
 
 	tmp = int((*pdu)[0])
 	*pdu = (*pdu)[1:]
@@ -1803,50 +4509,476 @@ func (ue *UE) decQoSRule(pdu *[]byte) (length int) {
 		not = ""
 	}
 	ue.dprinti("Segregation: Segregation %srequested", not)
-	ue.dprinti("QoS flow identifier: QFI%d", tmp&0x3f)
+	rule.QFI = uint8(tmp & 0x3f)
+	ue.dprinti("QoS flow identifier: QFI%d", rule.QFI)
 
 	return
 }
 
 const (
-	pktFilterDirDownlinkOnly  = 1
-	pktFilterDirUplinkOnly    = 2
-	pktFilterDirBidirectional = 3
+	PacketFilterDownlinkOnly  = 1
+	PacketFilterUplinkOnly    = 2
+	PacketFilterBidirectional = 3
 )
 
 var pktFilterDirStr = map[int]string{
-	pktFilterDirBidirectional: "Bidirectional",
+	PacketFilterDownlinkOnly:  "Downlink only",
+	PacketFilterUplinkOnly:    "Uplink only",
+	PacketFilterBidirectional: "Bidirectional",
 }
 
+// PacketFilter matches the packet if all of the components match.
+type PacketFilter struct {
+	ID         uint8
+	Direction  int
+	Components []PacketFilterComponent
+}
+
+// PacketFilterComponent has the address for the address types, and the
+// range of the value from Low to High for the others. the single value is
+// in both Low and High, and the type of service has the value in Low and
+// the mask in High.
+type PacketFilterComponent struct {
+	Type uint8
+	Addr *net.IPNet
+	Low  uint32
+	High uint32
+}
+
+// packet filter component type identifiers
 const (
-	pktFilterContentMatchAll = 1
+	pktFilterMatchAll        = 0x01
+	pktFilterIPv4RemoteAddr  = 0x10
+	pktFilterIPv4LocalAddr   = 0x11
+	pktFilterIPv6RemoteAddr  = 0x21
+	pktFilterIPv6LocalAddr   = 0x23
+	pktFilterProtocol        = 0x30
+	pktFilterLocalPort       = 0x40
+	pktFilterLocalPortRange  = 0x41
+	pktFilterRemotePort      = 0x50
+	pktFilterRemotePortRange = 0x51
+	pktFilterSPI             = 0x60
+	pktFilterTOS             = 0x70
+	pktFilterFlowLabel       = 0x80
 )
 
 var pktFilterContentStr = map[int]string{
-	pktFilterContentMatchAll: "Match-all type",
+	pktFilterMatchAll:        "Match-all type",
+	pktFilterIPv4RemoteAddr:  "IPv4 remote address type",
+	pktFilterIPv4LocalAddr:   "IPv4 local address type",
+	pktFilterIPv6RemoteAddr:  "IPv6 remote address/prefix length type",
+	pktFilterIPv6LocalAddr:   "IPv6 local address/prefix length type",
+	pktFilterProtocol:        "Protocol identifier/Next header type",
+	pktFilterLocalPort:       "Single local port type",
+	pktFilterLocalPortRange:  "Local port range type",
+	pktFilterRemotePort:      "Single remote port type",
+	pktFilterRemotePortRange: "Remote port range type",
+	pktFilterSPI:             "Security parameter index type",
+	pktFilterTOS:             "Type of service/Traffic class type",
+	pktFilterFlowLabel:       "Flow label type",
 }
 
-func (ue *UE) decPacketFilter(pdu *[]byte) {
+// the length of the value for the component types. the types not listed
+// here, e.g. the ethernet ones, are not supported.
+var pktFilterContentLen = map[int]int{
+	pktFilterMatchAll:        0,
+	pktFilterIPv4RemoteAddr:  8,
+	pktFilterIPv4LocalAddr:   8,
+	pktFilterIPv6RemoteAddr:  17,
+	pktFilterIPv6LocalAddr:   17,
+	pktFilterProtocol:        1,
+	pktFilterLocalPort:       2,
+	pktFilterLocalPortRange:  4,
+	pktFilterRemotePort:      2,
+	pktFilterRemotePortRange: 4,
+	pktFilterSPI:             4,
+	pktFilterTOS:             2,
+	pktFilterFlowLabel:       3,
+}
+
+func (ue *UE) decPacketFilter(pdu *[]byte) (filter PacketFilter) {
 	tmp := int((*pdu)[0])
 	*pdu = (*pdu)[1:]
 
 	tmp &= 0x3f
-	ue.dprinti("Packet filter identifier: %d", tmp&0xf)
+	filter.ID = uint8(tmp & 0xf)
+	filter.Direction = tmp >> 4
+	ue.dprinti("Packet filter identifier: %d", filter.ID)
 	ue.dprinti("Packet filter direction: %s", pktFilterDirStr[tmp>>4])
 
 	length := int((*pdu)[0])
 	*pdu = (*pdu)[1:]
 	ue.dprinti("Length of packet filter contents: %d", length)
+	contents := readPduByteSlice(pdu, length)
 
-	for i := 0; i < length; i++ {
-		content := int((*pdu)[0])
-		*pdu = (*pdu)[1:]
+	for i := 0; len(contents) > 0; i++ {
+		typ := int(readPduByte(&contents))
 		ue.dprinti("Packet filter content %d: %s(%d)",
-			i, pktFilterContentStr[content], content)
+			i, pktFilterContentStr[typ], typ)
+
+		vlen, ok := pktFilterContentLen[typ]
+		if !ok || vlen > len(contents) {
+			ue.dprinti("unsupported packet filter component: %d", typ)
+			filter.Components = append(filter.Components,
+				PacketFilterComponent{Type: uint8(typ)})
+			break
+		}
+		v := readPduByteSlice(&contents, vlen)
+
+		c := PacketFilterComponent{Type: uint8(typ)}
+		switch typ {
+		case pktFilterIPv4RemoteAddr, pktFilterIPv4LocalAddr:
+			c.Addr = &net.IPNet{IP: net.IP(v[:4]), Mask: net.IPMask(v[4:])}
+		case pktFilterIPv6RemoteAddr, pktFilterIPv6LocalAddr:
+			c.Addr = &net.IPNet{
+				IP:   net.IP(v[:16]),
+				Mask: net.CIDRMask(int(v[16]), 8*net.IPv6len),
+			}
+		case pktFilterProtocol:
+			c.Low, c.High = uint32(v[0]), uint32(v[0])
+		case pktFilterLocalPort, pktFilterRemotePort:
+			port := uint32(binary.BigEndian.Uint16(v))
+			c.Low, c.High = port, port
+		case pktFilterLocalPortRange, pktFilterRemotePortRange:
+			c.Low = uint32(binary.BigEndian.Uint16(v))
+			c.High = uint32(binary.BigEndian.Uint16(v[2:]))
+		case pktFilterSPI:
+			c.Low = binary.BigEndian.Uint32(v)
+			c.High = c.Low
+		case pktFilterTOS:
+			c.Low, c.High = uint32(v[0]), uint32(v[1])
+		case pktFilterFlowLabel:
+			c.Low = (uint32(v[0]&0xf) << 16) | uint32(v[1])<<8 | uint32(v[2])
+			c.High = c.Low
+		}
+		if c.Addr != nil {
+			ue.dprinti("address: %v", c.Addr)
+		} else if vlen > 0 {
+			ue.dprinti("value: %d-%d", c.Low, c.High)
+		}
+		filter.Components = append(filter.Components, c)
 	}
 	return
 }
 
+// packet classification
+// see 5.7.1.1 QoS Flow in TS 23.501 and 6.2.5.1.1.2 in TS 24.501.
+
+// ipPacket is the fields of the IP packet for the packet filters.
+type ipPacket struct {
+	src, dst  net.IP
+	protocol  uint8
+	srcPort   uint16
+	dstPort   uint16
+	spi       uint32
+	tos       uint8
+	flowLabel uint32
+	hasPort   bool
+	hasSPI    bool
+}
+
+const (
+	ipProtoTCP  = 6
+	ipProtoUDP  = 17
+	ipProtoESP  = 50
+	ipProtoSCTP = 132
+)
+
+func parseIPPacket(pkt []byte) (p ipPacket, ok bool) {
+
+	var payload []byte
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		hlen := int(pkt[0]&0xf) * 4
+		if hlen < 20 || len(pkt) < hlen {
+			return
+		}
+		p.tos = pkt[1]
+		p.protocol = pkt[9]
+		p.src = net.IP(pkt[12:16])
+		p.dst = net.IP(pkt[16:20])
+		// the ports are in the first fragment only.
+		if binary.BigEndian.Uint16(pkt[6:])&0x1fff == 0 {
+			payload = pkt[hlen:]
+		}
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		head := binary.BigEndian.Uint32(pkt)
+		p.tos = uint8(head >> 20)
+		p.flowLabel = head & 0xfffff
+		p.protocol = pkt[6] // extension headers are not followed.
+		p.src = net.IP(pkt[8:24])
+		p.dst = net.IP(pkt[24:40])
+		payload = pkt[40:]
+	default:
+		return
+	}
+
+	switch p.protocol {
+	case ipProtoTCP, ipProtoUDP, ipProtoSCTP:
+		if len(payload) >= 4 {
+			p.srcPort = binary.BigEndian.Uint16(payload)
+			p.dstPort = binary.BigEndian.Uint16(payload[2:])
+			p.hasPort = true
+		}
+	case ipProtoESP:
+		if len(payload) >= 4 {
+			p.spi = binary.BigEndian.Uint32(payload)
+			p.hasSPI = true
+		}
+	}
+	ok = true
+	return
+}
+
+// matchUplink returns true if the uplink packet matches all of the
+// components. the local address is the source in the uplink.
+func (c *PacketFilterComponent) matchUplink(p *ipPacket) bool {
+	inRange := func(v uint32) bool { return c.Low <= v && v <= c.High }
+
+	switch c.Type {
+	case pktFilterMatchAll:
+		return true
+	case pktFilterIPv4RemoteAddr, pktFilterIPv6RemoteAddr:
+		return c.Addr.Contains(p.dst)
+	case pktFilterIPv4LocalAddr, pktFilterIPv6LocalAddr:
+		return c.Addr.Contains(p.src)
+	case pktFilterProtocol:
+		return inRange(uint32(p.protocol))
+	case pktFilterLocalPort, pktFilterLocalPortRange:
+		return p.hasPort && inRange(uint32(p.srcPort))
+	case pktFilterRemotePort, pktFilterRemotePortRange:
+		return p.hasPort && inRange(uint32(p.dstPort))
+	case pktFilterSPI:
+		return p.hasSPI && inRange(p.spi)
+	case pktFilterTOS:
+		return uint32(p.tos)&c.High == c.Low&c.High
+	case pktFilterFlowLabel:
+		return p.src.To4() == nil && inRange(p.flowLabel)
+	}
+	return false
+}
+
+func (f *PacketFilter) matchUplink(p *ipPacket) bool {
+	if f.Direction != PacketFilterUplinkOnly &&
+		f.Direction != PacketFilterBidirectional {
+		return false
+	}
+	for i := range f.Components {
+		if !f.Components[i].matchUplink(p) {
+			return false
+		}
+	}
+	return len(f.Components) > 0
+}
+
+// ClassifyUplink returns the QFI of the QoS rule matching the uplink packet
+// evaluated in the order of the precedence, including the UE-derived QoS
+// rules. the default QoS rule is used if no packet filter matches.
+func (s *PDUSession) ClassifyUplink(pkt []byte) (qfi uint8, ok bool) {
+
+	p, ok := parseIPPacket(pkt)
+	if !ok {
+		return
+	}
+
+	// the order is sorted here only if the rules are given directly.
+	order := s.ruleOrder
+	if len(order) != len(s.QoSRules) {
+		order = qosRuleOrder(s.QoSRules)
+	}
+
+	// the UE-derived QoS rules follow the signalled ones of the same
+	// precedence.
+	derived := false
+	var def *QoSRule
+	for _, i := range order {
+		r := &s.QoSRules[i]
+		if !derived && r.Precedence > derivedQoSRulePrecedence {
+			derived = true
+			if qfi, ok = s.rqos.classify(&p); ok {
+				return
+			}
+		}
+		if r.Default && def == nil {
+			def = r
+		}
+		for i := range r.Filters {
+			if r.Filters[i].matchUplink(&p) {
+				return r.QFI, true
+			}
+		}
+	}
+	if !derived {
+		if qfi, ok = s.rqos.classify(&p); ok {
+			return
+		}
+	}
+	if def != nil {
+		return def.QFI, true
+	}
+	return 0, false
+}
+
+// reflective QoS
+// see 5.7.5 Reflective QoS in TS 23.501.
+
+// the precedence value of the UE-derived QoS rules.
+const derivedQoSRulePrecedence = 80
+
+// the RQ timer value used if the network does not provide it.
+const defaultRQTimer = 60 * time.Second
+
+type derivedQoSRule struct {
+	rule   QoSRule
+	expiry time.Time // RQ timer
+}
+
+// reflectiveQoS has the UE-derived QoS rules of the PDU session. the rules
+// are derived from the downlink and used for the uplink concurrently.
+type reflectiveQoS struct {
+	mu    sync.Mutex
+	rules []derivedQoSRule
+}
+
+// deleteRules deletes the UE-derived QoS rules of the QFI, or all of the
+// rules if qfi is 0.
+func (r *reflectiveQoS) deleteRules(qfi uint8) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rules := r.rules[:0]
+	for _, dr := range r.rules {
+		if qfi != 0 && dr.rule.QFI != qfi {
+			rules = append(rules, dr)
+		}
+	}
+	r.rules = rules
+	return
+}
+
+// classify returns the QFI of the UE-derived QoS rule matching the uplink
+// packet. the rules expired are skipped.
+func (r *reflectiveQoS) classify(p *ipPacket) (qfi uint8, ok bool) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for i := range r.rules {
+		dr := &r.rules[i]
+		if now.Before(dr.expiry) && dr.rule.Filters[0].matchUplink(p) {
+			return dr.rule.QFI, true
+		}
+	}
+	return
+}
+
+// deriveUplinkFilter returns the uplink packet filter of the downlink
+// packet, in which the source and the destination are swapped.
+func deriveUplinkFilter(p *ipPacket) (filter PacketFilter) {
+
+	remote, local := pktFilterIPv4RemoteAddr, pktFilterIPv4LocalAddr
+	if p.src.To4() == nil {
+		remote, local = pktFilterIPv6RemoteAddr, pktFilterIPv6LocalAddr
+	}
+	host := func(ip net.IP) *net.IPNet {
+		bits := 8 * len(ip)
+		return &net.IPNet{
+			IP:   append(net.IP{}, ip...),
+			Mask: net.CIDRMask(bits, bits),
+		}
+	}
+	proto := uint32(p.protocol)
+
+	filter.Direction = PacketFilterUplinkOnly
+	filter.Components = []PacketFilterComponent{
+		{Type: uint8(remote), Addr: host(p.src)},
+		{Type: uint8(local), Addr: host(p.dst)},
+		{Type: pktFilterProtocol, Low: proto, High: proto},
+	}
+	if p.hasPort {
+		lport, rport := uint32(p.dstPort), uint32(p.srcPort)
+		filter.Components = append(filter.Components,
+			PacketFilterComponent{
+				Type: pktFilterLocalPort, Low: lport, High: lport},
+			PacketFilterComponent{
+				Type: pktFilterRemotePort, Low: rport, High: rport})
+	}
+	return
+}
+
+// ReflectDownlink derives the QoS rule from the downlink packet received
+// with the RQI, and returns true if the rule is new. the RQ timer of the
+// rule is restarted and the QFI is updated if the rule already exists.
+func (s *PDUSession) ReflectDownlink(pkt []byte, qfi uint8) (created bool) {
+
+	r := s.rqos
+	if r == nil {
+		return
+	}
+	p, ok := parseIPPacket(pkt)
+	if !ok {
+		return
+	}
+	filter := deriveUplinkFilter(&p)
+
+	d := s.RQTimer
+	if d == 0 {
+		d = defaultRQTimer
+	}
+	expiry := time.Now().Add(d)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.rules {
+		dr := &r.rules[i]
+		if reflect.DeepEqual(dr.rule.Filters[0], filter) {
+			dr.rule.QFI = qfi
+			dr.expiry = expiry
+			return
+		}
+	}
+	r.rules = append(r.rules, derivedQoSRule{
+		rule: QoSRule{
+			Precedence: derivedQoSRulePrecedence,
+			QFI:        qfi,
+			Filters:    []PacketFilter{filter},
+		},
+		expiry: expiry,
+	})
+	created = true
+	return
+}
+
+// DerivedQoSRules returns the UE-derived QoS rules whose RQ timer is
+// running. the rules are deleted on the expiry of the timer.
+func (s *PDUSession) DerivedQoSRules() (rules []QoSRule) {
+
+	r := s.rqos
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	live := r.rules[:0]
+	for _, dr := range r.rules {
+		if now.Before(dr.expiry) {
+			live = append(live, dr)
+			rules = append(rules, dr.rule)
+		}
+	}
+	r.rules = live
+	return
+}
+
 // 9.11.4.14 Session-AMBR
 const (
 	unitAMBRnotUsed = 0
@@ -1860,7 +4992,37 @@ var unitAMBRStr = map[int]string{
 	unitAMBR4Kbps:   "4Kbps",
 }
 
-func (ue *UE) decSessionAMBR(pdu *[]byte) {
+// SessionAMBR is the session AMBR in bits per second.
+type SessionAMBR struct {
+	DL uint64
+	UL uint64
+}
+
+// ambrRate converts the unit and the value of the session AMBR to bps.
+// the unit 1Kbps is 1, 4Kbps is 2, ..., 256Kbps is 5, 1Mbps is 6, and so on
+// up to 256Pbps(25). the rate over uint64 in the Pbps units is saturated.
+func ambrRate(unit int, value uint16) (rate uint64) {
+	if unit == unitAMBRnotUsed || unit > 25 {
+		return
+	}
+	mul := func(m uint64) {
+		if rate > math.MaxUint64/m {
+			rate = math.MaxUint64
+			return
+		}
+		rate *= m
+	}
+	rate = uint64(value)
+	for i := 0; i <= (unit-1)/5; i++ {
+		mul(1000)
+	}
+	for i := 0; i < (unit-1)%5; i++ {
+		mul(4)
+	}
+	return
+}
+
+func (ue *UE) decSessionAMBR(pdu *[]byte) (ambr SessionAMBR) {
 	length := readPduByte(pdu)
 	ue.dprinti("Length of Session-AMBR contents: %d", length)
 
@@ -1877,6 +5039,9 @@ func (ue *UE) decSessionAMBR(pdu *[]byte) {
 
 	ambrUL := readPduUint16(pdu)
 	ue.dprinti("Session-AMBR for uplink: %d", ambrUL)
+
+	ambr.DL = ambrRate(unitDL, ambrDL)
+	ambr.UL = ambrRate(unitUL, ambrUL)
 	return
 }
 
@@ -1888,6 +5053,243 @@ func (ue *UE) decSSCMode(iei bool, pdu *[]byte) {
 	return
 }
 
+// activePDUSessions returns PSI bitmap of the PDU sessions in the 5GSM
+// state PDU SESSION ACTIVE. bit N indicates PSI(N).
+func (ue *UE) activePDUSessions() (status uint16) {
+	for psi, s := range ue.sm.session {
+		if s.State == SMActive {
+			status |= 1 << psi
+		}
+	}
+	return
+}
+
+// PSI bitmap used by 9.11.3.42, 9.11.3.44 and 9.11.3.57.
+// octet 3 is PSI(7)-PSI(0) and octet 4 is PSI(15)-PSI(8).
+func encPSIBitmap(status uint16) (pdu []byte) {
+	status &^= 1 // PSI(0) is spare.
+	pdu = append(pdu, 2)
+	pdu = append(pdu, byte(status))
+	pdu = append(pdu, byte(status>>8))
+	return
+}
+
+func (ue *UE) decPSIBitmap(pdu *[]byte) (status uint16) {
+	length := int(readPduByte(pdu))
+	val := readPduByteSlice(pdu, length)
+	if length >= 1 {
+		status = uint16(val[0])
+	}
+	if length >= 2 {
+		status |= uint16(val[1]) << 8
+	}
+	return
+}
+
+// 10.2 Timers of 5GS mobility management
+// actual value is not defined in the standard.
+const (
+	TimerT3346 = iota
+	TimerT3502
+	TimerT3510
+	TimerT3511
+	TimerT3517
+	TimerT3521
+	timerMax
+)
+
+var timerStr = map[int]string{
+	TimerT3346: "T3346",
+	TimerT3502: "T3502",
+	TimerT3510: "T3510",
+	TimerT3511: "T3511",
+	TimerT3517: "T3517",
+	TimerT3521: "T3521",
+}
+
+// table 10.2.1: Timers of 5GS mobility management - UE side
+var timerDefault = map[int]time.Duration{
+	TimerT3502: 12 * time.Minute,
+	TimerT3510: 15 * time.Second,
+	TimerT3511: 10 * time.Second,
+	TimerT3517: 15 * time.Second,
+	TimerT3521: 15 * time.Second,
+}
+
+// actions to be taken by the caller on the timer expiry.
+const (
+	TimerActionNone = iota
+	TimerActionAbort
+	TimerActionRetransmit
+	TimerActionRegister
+)
+
+var TimerActionStr = map[int]string{
+	TimerActionNone:       "none",
+	TimerActionAbort:      "procedure aborted",
+	TimerActionRetransmit: "retransmission",
+	TimerActionRegister:   "registration",
+}
+
+type nasTimer struct {
+	timer  *time.Timer
+	expiry time.Time
+	gen    int // to discard the expiry of the stopped timer.
+	count  int // number of the expiry.
+}
+
+// TimerEvent is notified by the channel returned by TimerEvent() when a
+// 5GMM timer expired. the caller passes it to HandleTimerExpiry().
+type TimerEvent struct {
+	Timer int
+	gen   int
+}
+
+// TimerEvent returns the channel to receive the expiry of the 5GMM timers.
+// the timers run in their own goroutines, and only send the event to the
+// channel. the UE is updated when the caller handles the event.
+func (ue *UE) TimerEvent() <-chan TimerEvent {
+	return ue.timerEvent
+}
+
+func (ue *UE) timerDuration(id int) (d time.Duration) {
+
+	if str, ok := ue.TimerValue[timerStr[id]]; ok {
+		v, err := time.ParseDuration(str)
+		if err == nil {
+			return v
+		}
+		ue.dprint("invalid timer value for %s: %v", timerStr[id], err)
+	}
+
+	switch id {
+	case TimerT3346:
+		d = time.Duration(ue.Recv.t3346) * time.Second
+		return
+	case TimerT3502:
+		if ue.Recv.t3502 != 0 {
+			d = time.Duration(ue.Recv.t3502) * time.Second
+			return
+		}
+	}
+	d = timerDefault[id]
+
+	return
+}
+
+func (ue *UE) startTimer(id int) {
+
+	ue.stopTimer(id)
+	ue.armTimer(id)
+
+	return
+}
+
+// armTimer starts the timer keeping the number of the expiry, e.g. to
+// retransmit the message.
+func (ue *UE) armTimer(id int) {
+
+	if ue.timerEvent == nil {
+		ue.timerEvent = make(chan TimerEvent, timerMax)
+	}
+
+	t := &ue.timer[id]
+	d := ue.timerDuration(id)
+	t.gen++
+	t.expiry = time.Now().Add(d)
+
+	ev := TimerEvent{Timer: id, gen: t.gen}
+	ch := ue.timerEvent
+	t.timer = time.AfterFunc(d, func() {
+		select {
+		case ch <- ev:
+		default:
+		}
+	})
+	ue.dprint("start %s: %s", timerStr[id], d)
+
+	return
+}
+
+func (ue *UE) stopTimer(id int) {
+
+	t := &ue.timer[id]
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	t.count = 0
+
+	return
+}
+
+// TimerRunning returns true if the timer is running.
+func (ue *UE) TimerRunning(id int) bool {
+	return ue.timer[id].timer != nil
+}
+
+// HandleTimerExpiry takes the action on the expiry of the timer and
+// returns what the caller has to do. pdu is the NAS message to be
+// retransmitted for TimerActionRetransmit.
+func (ue *UE) HandleTimerExpiry(ev TimerEvent) (action int, pdu []byte) {
+
+	t := &ue.timer[ev.Timer]
+	if t.timer == nil || t.gen != ev.gen {
+		// the timer was stopped or restarted after the expiry.
+		return
+	}
+	t.timer = nil
+	t.count++
+	ue.dprint("%s expired: %d", timerStr[ev.Timer], t.count)
+
+	switch ev.Timer {
+	case TimerT3510:
+		// 5.5.1.2.7 Abnormal cases in the UE, c) T3510 timeout.
+		// the UE aborts the procedure and the NAS signalling connection
+		// is released.
+		ue.MMstate = MMDeregistared
+		ue.CMstate = CMIdle
+		ue.registrationAttemptFailed()
+		action = TimerActionAbort
+
+	case TimerT3511, TimerT3502:
+		if ue.MMstate == MMDeregistared {
+			action = TimerActionRegister
+		}
+
+	case TimerT3346:
+		// the UE may initiate the procedure rejected by the congestion.
+		if ue.MMstate == MMDeregistared {
+			action = TimerActionRegister
+		}
+
+	case TimerT3517:
+		// 5.6.1.7 Abnormal cases in the UE, c) T3517 expired.
+		ue.MMstate = MMRegistered
+		ue.CMstate = CMIdle
+		action = TimerActionAbort
+
+	case TimerT3521:
+		// 5.5.2.2.6 Abnormal cases in the UE, a) T3521 timeout.
+		// the de-registration request is retransmitted four times, and on
+		// the fifth expiry the procedure is aborted.
+		const maxRetransmission = 4
+		if t.count > maxRetransmission {
+			t.count = 0
+			ue.MMstate = MMDeregistared
+			ue.releasePDUSessions()
+			action = TimerActionAbort
+			break
+		}
+		pdu = ue.encDeregistrationRequest()
+		ue.armTimer(TimerT3521)
+		action = TimerActionRetransmit
+	}
+	ue.dprint("GNBSIM: %s: %s", timerStr[ev.Timer], TimerActionStr[action])
+
+	return
+}
+
 //-----
 func Str2BCD(str string) (bcd []byte) {
 
@@ -1923,6 +5325,361 @@ func ShiftType1IE(iei bool, pdu *[]byte) {
 	return
 }
 
+// TS 33.102
+// C.1 Profile of the sequence number scheme: SQN = SEQ || IND
+const (
+	sqnIndBits = 5
+	sqnIndSize = 1 << sqnIndBits
+	sqnDelta   = 1 << 28 // the limit on the difference from SEQMS.
+)
+
+func (ue *UE) loadSQN() {
+
+	p := &ue.AuthParam
+	if p.sqn.loaded {
+		return
+	}
+	p.sqn.loaded = true
+
+	if p.SQN == "" {
+		return
+	}
+	sqn, err := strconv.ParseUint(p.SQN, 16, 48)
+	if err != nil {
+		ue.dprint("invalid SQN: %s", p.SQN)
+		return
+	}
+	p.sqn.known = true
+	p.sqn.max = sqn
+	for i := range p.sqn.seq {
+		p.sqn.seq[i] = sqn >> sqnIndBits
+	}
+	return
+}
+
+// C.2.2 Protection against wrap around of counter in the USIM
+// C.3.2 Verification of sequence number freshness in the USIM
+func (ue *UE) verifySQN(b []byte) (ok bool) {
+
+	ue.loadSQN()
+
+	var sqn uint64
+	for _, v := range b {
+		sqn = sqn<<8 | uint64(v)
+	}
+
+	p := &ue.AuthParam.sqn
+	seq := sqn >> sqnIndBits
+	ind := sqn & (sqnIndSize - 1)
+	seqMax := p.max >> sqnIndBits
+
+	// a USIM without the initial SQN accepts any SQN for the first time.
+	if p.known {
+		if seq <= p.seq[ind] {
+			return
+		}
+		if seq > seqMax && seq-seqMax > sqnDelta {
+			return
+		}
+	}
+
+	p.seq[ind] = seq
+	if p.known == false || seq > seqMax {
+		p.max = sqn
+	}
+	p.known = true
+	ok = true
+	return
+}
+
+// TS 33.102 6.3.5 Re-synchronisation procedure
+// AUTS = SQNMS xor AK* || MAC-S
+func (ue *UE) computeAUTS(k, opc []byte) (auts []byte) {
+
+	// the AMF used to calculate MAC-S is a dummy value of all zeros.
+	m := milenage.NewWithOPc(k, opc, ue.AuthParam.rand, ue.AuthParam.sqn.max, 0)
+	m.F1()
+	m.F2345()
+
+	for n, v := range m.SQN {
+		auts = append(auts, v^m.AKS[n])
+	}
+	auts = append(auts, m.MACS...)
+
+	return
+}
+
+// RFC 9048 EAP-AKA'
+const (
+	AuthMethod5GAKA       = "5G-AKA"
+	AuthMethodEAPAKAPrime = "EAP-AKA'"
+)
+
+const (
+	eapTypeAKAPrime = 50
+)
+
+// RFC 4187 11. IANA Considerations
+const (
+	eapAKASubtypeChallenge              = 1
+	eapAKASubtypeAuthenticationReject   = 2
+	eapAKASubtypeSynchronizationFailure = 4
+	eapAKASubtypeClientError            = 14
+)
+
+const (
+	eapAKAAttrRAND            = 1
+	eapAKAAttrAUTN            = 2
+	eapAKAAttrRES             = 3
+	eapAKAAttrAUTS            = 4
+	eapAKAAttrMAC             = 11
+	eapAKAAttrClientErrorCode = 22
+	eapAKAAttrKDFInput        = 23
+	eapAKAAttrKDF             = 24
+)
+
+const (
+	eapAKAKDFDefault = 1 // the default key derivation function.
+	eapAKAMACLen     = 16
+)
+
+// 3.1 EAP-Request/AKA'-Challenge
+func (ue *UE) decEAPAKAPrimeRequest() {
+
+	p := &ue.AuthParam
+	eap := p.eap
+
+	ue.dprint("EAP-AKA'")
+	if p.Method != AuthMethodEAPAKAPrime {
+		ue.dprinti("EAP-AKA' is not enabled for this UE.")
+		p.eapResp = ue.encEAPAKAPrime(eapAKASubtypeClientError,
+			encEAPAKAAttribute(eapAKAAttrClientErrorCode, []byte{0, 0}),
+			nil)
+		return
+	}
+
+	if len(eap) < 8 || eap[0] != EAPCodeRequest ||
+		eap[4] != eapTypeAKAPrime || eap[5] != eapAKASubtypeChallenge {
+		ue.dprinti("unsupported EAP request: %x", eap)
+		p.eapResp = ue.encEAPAKAPrime(eapAKASubtypeClientError,
+			encEAPAKAAttribute(eapAKAAttrClientErrorCode, []byte{0, 0}),
+			nil)
+		return
+	}
+
+	attr, offset := ue.decEAPAKAAttributes(eap[8:])
+	if len(attr[eapAKAAttrRAND]) != 18 || len(attr[eapAKAAttrAUTN]) != 18 ||
+		len(attr[eapAKAAttrMAC]) != 18 || len(attr[eapAKAAttrKDF]) < 2 ||
+		len(attr[eapAKAAttrKDFInput]) < 2 {
+		ue.dprinti("mandatory attribute is missing.")
+		p.eapResp = ue.encEAPAKAPrime(eapAKASubtypeClientError,
+			encEAPAKAAttribute(eapAKAAttrClientErrorCode, []byte{0, 0}),
+			nil)
+		return
+	}
+
+	if kdf := binary.BigEndian.Uint16(attr[eapAKAAttrKDF]); kdf != eapAKAKDFDefault {
+		ue.dprinti("unsupported KDF: %d", kdf)
+		p.eapResp = ue.encEAPAKAPrime(eapAKASubtypeClientError,
+			encEAPAKAAttribute(eapAKAAttrClientErrorCode, []byte{0, 0}),
+			nil)
+		return
+	}
+
+	kdfInput := attr[eapAKAAttrKDFInput]
+	nameLen := int(binary.BigEndian.Uint16(kdfInput))
+	if len(kdfInput) < 2+nameLen {
+		nameLen = len(kdfInput) - 2
+	}
+	netName := kdfInput[2 : 2+nameLen]
+	ue.dprinti("network name: %s", netName)
+
+	p.rand = attr[eapAKAAttrRAND][2:]
+	ue.dprinti("RAND: 0x%02x", p.rand)
+	ue.setAUTN(attr[eapAKAAttrAUTN][2:])
+
+	m, cause := ue.runAKA()
+	switch cause {
+	case 0:
+	case mmCauseSynchFailure:
+		p.eapResp = ue.encEAPAKAPrime(eapAKASubtypeSynchronizationFailure,
+			encEAPAKAAttribute(eapAKAAttrAUTS, p.auts), nil)
+		return
+	default:
+		p.eapResp = ue.encEAPAKAPrime(eapAKASubtypeAuthenticationReject,
+			nil, nil)
+		return
+	}
+
+	ckp, ikp := ue.ComputeCKIKPrime(m.CK, m.IK, netName)
+	kaut, emsk := ue.ComputeEAPAKAPrimeKeys(ckp, ikp)
+
+	mac := make([]byte, len(eap))
+	copy(mac, eap)
+	// the MAC follows the 2 reserved octets of the AT_MAC value.
+	macAttr := 8 + offset[eapAKAAttrMAC] + 2
+	copy(mac[macAttr:macAttr+eapAKAMACLen], make([]byte, eapAKAMACLen))
+	if reflect.DeepEqual(attr[eapAKAAttrMAC][2:], computeEAPAKAMAC(kaut, mac)) == false {
+		ue.dprinti("AT_MAC does not match.")
+		p.eapResp = ue.encEAPAKAPrime(eapAKASubtypeClientError,
+			encEAPAKAAttribute(eapAKAAttrClientErrorCode, []byte{0, 0}),
+			nil)
+		return
+	}
+	ue.dprinti("AT_MAC matches.")
+
+	// the most significant 256 bits of EMSK is used as Kausf.
+	// see 6.1.3.1 in TS 33.501.
+	p.Kausf = emsk[:32]
+	ue.ComputeKseaf()
+	ue.ComputeKamf()
+	ue.ComputeAlgKey()
+
+	res := make([]byte, 2)
+	binary.BigEndian.PutUint16(res, uint16(len(m.RES)*8))
+	res = append(res, m.RES...)
+	p.eapResp = ue.encEAPAKAPrime(eapAKASubtypeChallenge,
+		encEAPAKAAttribute(eapAKAAttrRES, res), kaut)
+
+	return
+}
+
+// decEAPAKAAttributes returns the attribute values keyed by the type, and
+// the offsets of the values in v.
+// see 8.1 Message Format in RFC 4187.
+func (ue *UE) decEAPAKAAttributes(v []byte) (
+	attr map[int][]byte, offset map[int]int) {
+
+	attr = map[int][]byte{}
+	offset = map[int]int{}
+	pos := 0
+	for len(v) >= 4 {
+		t := int(v[0])
+		length := int(v[1]) * 4
+		if length < 4 || length > len(v) {
+			ue.dprinti("invalid attribute length: %d", length)
+			return
+		}
+		attr[t] = v[2:length]
+		offset[t] = pos + 2
+		v = v[length:]
+		pos += length
+	}
+	return
+}
+
+func encEAPAKAAttribute(t uint8, value []byte) (v []byte) {
+
+	length := 2 + len(value)
+	if length%4 != 0 {
+		length += 4 - length%4
+	}
+	v = make([]byte, length)
+	v[0] = t
+	v[1] = uint8(length / 4)
+	copy(v[2:], value)
+
+	return
+}
+
+// encEAPAKAPrime returns the EAP-Response/AKA' packet. AT_MAC is appended
+// and calculated if kaut is given.
+func (ue *UE) encEAPAKAPrime(subtype uint8, attr []byte, kaut []byte) (eap []byte) {
+
+	eap = []byte{EAPCodeResponse, ue.AuthParam.eap[1], 0, 0,
+		eapTypeAKAPrime, subtype, 0, 0}
+	eap = append(eap, attr...)
+
+	macAttr := len(eap) + 4
+	if kaut != nil {
+		eap = append(eap, encEAPAKAAttribute(eapAKAAttrMAC,
+			make([]byte, 2+eapAKAMACLen))...)
+	}
+	binary.BigEndian.PutUint16(eap[2:], uint16(len(eap)))
+
+	if kaut != nil {
+		copy(eap[macAttr:], computeEAPAKAMAC(kaut, eap))
+	}
+
+	return
+}
+
+// 3.2 Key derivation. AT_MAC is calculated with HMAC-SHA-256-128.
+func computeEAPAKAMAC(kaut, eap []byte) (mac []byte) {
+
+	h := hmac.New(sha256.New, kaut)
+	h.Write(eap)
+	mac = h.Sum(nil)[:eapAKAMACLen]
+
+	return
+}
+
+// TS 33.402
+// A.2 Function for the derivation of CK', IK' from CK, IK
+func (ue *UE) ComputeCKIKPrime(ck, ik, netName []byte) (ckp, ikp []byte) {
+
+	s := []byte{0x20}
+	s = append(s, netName...)
+
+	l0 := make([]byte, 2)
+	binary.BigEndian.PutUint16(l0, uint16(len(netName)))
+	s = append(s, l0...)
+
+	p1 := ue.AuthParam.seqxorak
+	s = append(s, p1...)
+
+	l1 := make([]byte, 2)
+	binary.BigEndian.PutUint16(l1, uint16(len(p1)))
+	s = append(s, l1...)
+
+	k := append(append([]byte{}, ck...), ik...)
+	mac := hmac.New(sha256.New, k)
+	mac.Write(s)
+	out := mac.Sum(nil)
+
+	ckp = out[:16]
+	ikp = out[16:]
+
+	return
+}
+
+// RFC 9048
+// 3.3 Key Generation
+// MK = PRF'(IK'|CK',"EAP-AKA'"|Identity)
+// K_encr(128) | K_aut(256) | K_re(256) | MSK(512) | EMSK(512)
+func (ue *UE) ComputeEAPAKAPrimeKeys(ckp, ikp []byte) (kaut, emsk []byte) {
+
+	// the SUPI is used as the identity. see 6.1.3.1 in TS 33.501.
+	s := []byte("EAP-AKA'" + ue.SUPI)
+	k := append(append([]byte{}, ikp...), ckp...)
+
+	mk := prfPrime(k, s, 208)
+	kaut = mk[16:48]
+	emsk = mk[144:208]
+
+	return
+}
+
+// 3.4 Hash Functions
+// PRF'(K,S) = T1 | T2 | T3 | T4 | ...
+// T1 = HMAC-SHA-256 (K, S | 0x01)
+// Tn = HMAC-SHA-256 (K, Tn-1 | S | n)
+func prfPrime(k, s []byte, length int) (out []byte) {
+
+	var t []byte
+	for n := 1; len(out) < length; n++ {
+		mac := hmac.New(sha256.New, k)
+		mac.Write(t)
+		mac.Write(s)
+		mac.Write([]byte{byte(n)})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+	out = out[:length]
+
+	return
+}
+
 // TS 33.401
 // A.2 KASME derivation function
 /*
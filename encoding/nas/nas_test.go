@@ -1,10 +1,15 @@
 package nas
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"math"
+	"net"
 	"reflect"
 	"testing"
+	"time"
 )
 
 // send
@@ -19,13 +24,56 @@ var TestSecurityModeComplete []string = []string{
 var TestRegistrationComplete string = "7e04006d1298007e0043"
 var TestPDUSessionEstablishmentRequest string = "7e020d7a1457007e00670100072e0101c1ffff91120181220401010203250908696e7465726e6574"
 var TestDeregistrationRequest string = "7e04d733af71007e004571000bf202f839cafe0000000001"
+var TestDeregistrationAcceptUETerm string = "7e0201073b9a007e0048"
+var TestServiceRequest string = "7e017afe0d74017e004c100007f4fe00000000017100157e004c100007f4fe00000000014002020050020200"
+var TestEAPAuthenticationResponse []string = []string{
+	"7e0057780028022a00283201000003030040f35e5f8ea2dd2d710b050000fc219729ab254c08e45ec1279424bc6e",
+	"7e005778000c022a000c320e000016010000",
+}
+var TestAuthenticationFailure []string = []string{
+	"7e005914",
+	"7e005915300eced5d2b7c6ec9da3cf0e8d46f2b8",
+}
+var TestConfigurationUpdateComplete string = "7e02a791f1cd007e0055"
+var TestIdentityResponse []string = []string{
+	"7e005c000d0102f839214300001032547698",
+	"7e005c00080b00000001000061",
+	"7e005c000706020000000001",
+	"7e005c000100",
+	"7e02e11d3745007e005c0007f4fe0000000001",
+}
 
 // receive
 var TestAuthenticationRequest string = "7e00560002000021fc64081953bb33c0682edf1690b25821201094bbaf40940a8000c6a72c4efbaf0337"
 var TestSecurityModeCommand string = "7e03937711bc007e035d02000480a00000e1360100"
 var TestRegistrationAccept string = "7e02930d75cf017e0242010177000b0202f839cafe000000000154070002f839000001150a040101020304011122335e010616012c"
+var TestPDUSessionEstablishmentAcceptIPv4v6 string = "7e00680100282e0100c21300090100063131010100000601e80301e8035932290d0300000000000000013c3c00011201"
 var TestPDUSessionEstablishmentAccept string = "7e0222994e9f027e00680100202e0100c21100090100063131010100000601e80301e80359322905013c3c00011201"
 var TestDeregistrationAccept string = "7e0046"
+var TestDeregistrationRequestUETerm []string = []string{
+	"7e004705",
+	"7e004701580b5f0121",
+}
+var TestServiceAccept string = "7e004e5002020026020000"
+var TestServiceReject string = "7e004d0a"
+var TestEAPAuthenticationRequest string = "7e00560002000078006c012a006c3201000001050000fc64081953bb33c0682edf1690b258210205000094bbaf40940a8000c6a72c4efbaf0337180100011709002035473a6d6e633039332e6d63633230382e336770706e6574776f726b2e6f72670b050000a51525d21cda486d4037a7bd73a5b5d8"
+var TestAuthenticationReject string = "7e0058"
+var TestAuthenticationResult string = "7e005a0200040301000438020000"
+var TestConfigurationUpdateCommand string = "7e0054d1430f90004f00700065006e0035004700534508874f78d95d3b4e0146634702010151114563490101"
+var TestRegistrationReject []string = []string{
+	"7e004403",       // illegal UE
+	"7e0044165f0121", // congestion with T3346 value 1 min
+	"7e00446f160122", // protocol error with T3502 value 2 min
+}
+var TestRegistrationAcceptNSSAI string = "7e0042010115020102110540010102033107040101020301025e0106"
+var Test5GMMStatus string = "7e006462"
+var TestIdentityRequest []string = []string{
+	"7e005b01",
+	"7e005b03",
+	"7e005b06",
+	"7e005b07",
+	"7e005b04",
+}
 
 func receive(ue *UE, msg string) {
 	in, _ := hex.DecodeString(msg)
@@ -59,6 +107,102 @@ func TestMakeAuthenticationResponse(t *testing.T) {
 	}
 }
 
+func TestMakeAuthenticationFailure(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	// MAC failure
+	in, _ := hex.DecodeString(TestAuthenticationRequest)
+	in[len(in)-1] ^= 0xff
+	ue.Decode(&in)
+	v := ue.MakeNasPdu()
+	expect, _ := hex.DecodeString(TestAuthenticationFailure[0])
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("Authentication Failure (MAC failure)\nexpect: %x\nactual: %x",
+			expect, v)
+	}
+
+	// synch failure by the replayed SQN
+	receive(ue, TestAuthenticationRequest)
+	if ue.Recv.state != rcvdAuthenticationRequest {
+		t.Errorf("Authentication Request is not accepted: %s",
+			rcvdStateStr[ue.Recv.state])
+	}
+	receive(ue, TestAuthenticationRequest)
+	v = ue.MakeNasPdu()
+	expect, _ = hex.DecodeString(TestAuthenticationFailure[1])
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("Authentication Failure (synch failure)\nexpect: %x\nactual: %x",
+			expect, v)
+	}
+
+	// synch failure by the SQN stored in the USIM
+	ue = NewNAS("nas_test.json")
+	ue.AuthParam.SQN = "ffffffffffe0"
+	receive(ue, TestAuthenticationRequest)
+	if ue.Recv.state != rcvdAuthRequestFailed ||
+		ue.Recv.authFailureCause != mmCauseSynchFailure {
+		t.Errorf("synch failure is not detected: %s",
+			rcvdStateStr[ue.Recv.state])
+	}
+
+	receive(ue, TestAuthenticationReject)
+	if ue.MMstate != MMDeregistared {
+		t.Errorf("unexpected state after Authentication Reject: %s",
+			MMstateStr[ue.MMstate])
+	}
+}
+
+func TestMakeEAPAuthenticationResponse(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+	ue.AuthParam.Method = AuthMethodEAPAKAPrime
+
+	receive(ue, TestEAPAuthenticationRequest)
+	v := ue.MakeNasPdu()
+	expect, _ := hex.DecodeString(TestEAPAuthenticationResponse[0])
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("Authentication Response (EAP-AKA')\nexpect: %x\nactual: %x",
+			expect, v)
+	}
+	if ue.AuthParam.Kamf == nil {
+		t.Errorf("Kamf is not derived by EAP-AKA'")
+	}
+
+	// EAP-AKA' is not enabled.
+	ue = NewNAS("nas_test.json")
+	receive(ue, TestEAPAuthenticationRequest)
+	v = ue.MakeNasPdu()
+	expect, _ = hex.DecodeString(TestEAPAuthenticationResponse[1])
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("Authentication Response (Client-Error)\nexpect: %x\nactual: %x",
+			expect, v)
+	}
+}
+
+// Test case 1 in Appendix C of RFC 5448.
+func TestComputeEAPAKAPrimeKeys(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+	ue.SUPI = "0555444333222111"
+	ue.AuthParam.seqxorak, _ = hex.DecodeString("bb52e91c747a")
+	ck, _ := hex.DecodeString("5349fbe098649f948f5d2e973a81c00f")
+	ik, _ := hex.DecodeString("9744871ad32bf9bbd1dd5ce54e3e2e5a")
+
+	ckp, ikp := ue.ComputeCKIKPrime(ck, ik, []byte("WLAN"))
+	expect, _ := hex.DecodeString("0093962d0dd84aa5684b045c9edffa04")
+	if reflect.DeepEqual(expect, ckp) == false {
+		t.Errorf("CK'\nexpect: %x\nactual: %x", expect, ckp)
+	}
+	expect, _ = hex.DecodeString("ccfc230ca74fcc96c0a5d61164f5a76c")
+	if reflect.DeepEqual(expect, ikp) == false {
+		t.Errorf("IK'\nexpect: %x\nactual: %x", expect, ikp)
+	}
+
+	kaut, _ := ue.ComputeEAPAKAPrimeKeys(ckp, ikp)
+	expect, _ = hex.DecodeString("0842ea722ff6835bfa20")
+	if reflect.DeepEqual(expect, kaut[:len(expect)]) == false {
+		t.Errorf("K_aut\nexpect: %x\nactual: %x", expect, kaut)
+	}
+}
+
 func TestMakeRegistrationRequest(t *testing.T) {
 	ue := NewNAS("nas_test.json")
 	v := ue.MakeRegistrationRequest()
@@ -152,6 +296,390 @@ func TestMakeDeregistrationRequest(t *testing.T) {
 	if reflect.DeepEqual(expect, v) == false {
 		t.Errorf("Deregistration Request\nexpect: %x\nactual: %x", expect, v)
 	}
+	if ue.MMstate != MMDeregistaredInitiated {
+		t.Errorf("unexpected state after Deregistration Request: %s",
+			MMstateStr[ue.MMstate])
+	}
+
+	receive(ue, TestDeregistrationAccept)
+	if ue.MMstate != MMDeregistared {
+		t.Errorf("unexpected state after Deregistration Accept: %s",
+			MMstateStr[ue.MMstate])
+	}
+}
+
+func TestMakeDeregistrationAccept(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+	ue.AutoReRegistration = true
+
+	ue.MakeRegistrationRequest()
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+
+	receive(ue, TestDeregistrationRequestUETerm[0])
+	if ue.DeregistrationRequested() == false {
+		t.Errorf("De-registration Request is not received")
+	}
+	v := ue.MakeNasPdu()
+	expect, _ := hex.DecodeString(TestDeregistrationAcceptUETerm)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("Deregistration Accept\nexpect: %x\nactual: %x", expect, v)
+	}
+	if ue.MMstate != MMDeregistared || ue.NeedReRegistration() == false ||
+		ue.DeregistrationRequested() {
+		t.Errorf("re-registration is not required: %s",
+			MMstateStr[ue.MMstate])
+	}
+
+	// the UE registers again.
+	ue.MakeRegistrationRequest()
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+	if ue.MMstate != MMRegistered || ue.NeedReRegistration() {
+		t.Errorf("unexpected state after re-registration: %s",
+			MMstateStr[ue.MMstate])
+	}
+
+	ue.MakeRegistrationRequest()
+	receive(ue, TestDeregistrationRequestUETerm[1])
+	ue.MakeNasPdu()
+	if ue.NeedReRegistration() || ue.Recv.mmCause != mmCausePLMNNotAllowed ||
+		ue.Recv.t3346 != 60 {
+		t.Errorf("unexpected result: cause %d, T3346 %d sec",
+			ue.Recv.mmCause, ue.Recv.t3346)
+	}
+}
+
+func TestMakeServiceRequest(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+	ue.MakePDUSessionEstablishmentRequest()
+	receive(ue, TestPDUSessionEstablishmentAccept)
+
+	ue.ReleaseNASSignallingConnection()
+	if ue.CMstate != CMIdle {
+		t.Errorf("CM state expect: %s, actual: %s",
+			CMstateStr[CMIdle], CMstateStr[ue.CMstate])
+	}
+
+	v := ue.MakeServiceRequest(ServiceTypeData)
+	expect, _ := hex.DecodeString(TestServiceRequest)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("Service Request\nexpect: %x\nactual: %x", expect, v)
+	}
+	if ue.MMstate != MMServiceRequestInitiated || ue.CMstate != CMConnected {
+		t.Errorf("unexpected state after Service Request: %s, %s",
+			MMstateStr[ue.MMstate], CMstateStr[ue.CMstate])
+	}
+
+	receive(ue, TestServiceAccept)
+	if ue.MMstate != MMRegistered || len(ue.ActivePDUSessions()) != 1 {
+		t.Errorf("unexpected state after Service Accept: %s, %d sessions",
+			MMstateStr[ue.MMstate], len(ue.ActivePDUSessions()))
+	}
+
+	ue.MakeServiceRequest(ServiceTypeSignalling)
+	receive(ue, TestServiceReject)
+	if ue.MMstate != MMDeregistared {
+		t.Errorf("unexpected state after Service Reject: %s",
+			MMstateStr[ue.MMstate])
+	}
+}
+
+func TestMakeConfigurationUpdateComplete(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+
+	receive(ue, TestConfigurationUpdateCommand)
+	if ue.Recv.NetworkFullName != "Open5GS" ||
+		ue.Recv.NetworkShortName != "Open5GS" {
+		t.Errorf("unexpected network name: full %q, short %q",
+			ue.Recv.NetworkFullName, ue.Recv.NetworkShortName)
+	}
+	expectTime := time.Date(2020, 10, 10, 15, 11, 54, 0, time.UTC)
+	if ue.Recv.NetworkTime.Equal(expectTime) == false ||
+		ue.Recv.TimeZone != 540 || ue.Recv.DaylightSaving != 1 {
+		t.Errorf("unexpected time: %s, zone %d min, DST %d hour",
+			ue.Recv.NetworkTime, ue.Recv.TimeZone, ue.Recv.DaylightSaving)
+	}
+	if ue.NeedConfigurationUpdateComplete() == false {
+		t.Errorf("acknowledgement is not requested")
+	}
+
+	v := ue.MakeNasPdu()
+	expect, _ := hex.DecodeString(TestConfigurationUpdateComplete)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("Configuration Update Complete\nexpect: %x\nactual: %x",
+			expect, v)
+	}
+}
+
+// the IEs not decoded are skipped, and the IEs after them are decoded.
+func TestConfigurationUpdateCommandSkipIE(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+
+	msg := "7e0054" + "d1" +
+		"27" + "0401020304" + // service area list
+		"b1" + "91" + "f1" + // MICO, network slicing and SMS indication
+		"76" + "00020102" + // operator-defined access category
+		"3c" + "02aabb" + // unknown TLV
+		"430f90004f00700065006e0035004700534508874f78d95d3b4e01" +
+		"46634702010151114563490101"
+	receive(ue, msg)
+	if ue.Recv.NetworkFullName != "Open5GS" ||
+		ue.Recv.NetworkShortName != "Open5GS" {
+		t.Errorf("unexpected network name: full %q, short %q",
+			ue.Recv.NetworkFullName, ue.Recv.NetworkShortName)
+	}
+	expectTime := time.Date(2020, 10, 10, 15, 11, 54, 0, time.UTC)
+	if ue.Recv.NetworkTime.Equal(expectTime) == false ||
+		ue.Recv.TimeZone != 540 || ue.Recv.DaylightSaving != 1 {
+		t.Errorf("unexpected time: %s, zone %d min, DST %d hour",
+			ue.Recv.NetworkTime, ue.Recv.TimeZone, ue.Recv.DaylightSaving)
+	}
+	if ue.NeedConfigurationUpdateComplete() == false {
+		t.Errorf("acknowledgement is not requested")
+	}
+}
+
+func TestRegistrationRejectCause(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+
+	receive(ue, TestRegistrationReject[0])
+	if ue.MMstate != MMDeregistared || ue.USIMInvalid == false ||
+		ue.UpdateStatus != UpdateStatusRoamingNotAllowed ||
+		ue.Recv.fiveGGUTI != nil {
+		t.Errorf("unexpected state: %s, %s, USIM invalid %t",
+			MMstateStr[ue.MMstate], UpdateStatusStr[ue.UpdateStatus],
+			ue.USIMInvalid)
+	}
+
+	ue = NewNAS("nas_test.json")
+	receive(ue, TestRegistrationReject[1])
+	if wait := ue.Backoff(); wait <= 59*time.Second ||
+		wait > 60*time.Second ||
+		ue.UpdateStatus != UpdateStatusNotUpdated {
+		t.Errorf("unexpected T3346 back-off: %s, %s", wait,
+			UpdateStatusStr[ue.UpdateStatus])
+	}
+
+	ue = NewNAS("nas_test.json")
+	for i := 1; i < 5; i++ {
+		receive(ue, TestRegistrationReject[2])
+		if wait := ue.Backoff(); wait > 10*time.Second ||
+			ue.attemptCounter != i {
+			t.Errorf("unexpected T3511 back-off: %s, attempt %d", wait,
+				ue.attemptCounter)
+		}
+	}
+	receive(ue, TestRegistrationReject[2])
+	if wait := ue.Backoff(); wait <= 119*time.Second ||
+		wait > 120*time.Second {
+		t.Errorf("unexpected T3502 back-off: %s", wait)
+	}
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+	if ue.attemptCounter != 0 ||
+		ue.UpdateStatus != UpdateStatusUpdated {
+		t.Errorf("registration attempt counter is not reset: %d",
+			ue.attemptCounter)
+	}
+}
+
+func TestTimerExpiry(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+	ue.TimerValue = map[string]string{
+		"T3502": "1h",
+		"T3510": "1ms",
+		"T3511": "1ms",
+		"T3521": "1ms",
+	}
+
+	expire := func(id, expect int) (pdu []byte) {
+		ev := <-ue.TimerEvent()
+		action, pdu := ue.HandleTimerExpiry(ev)
+		if ev.Timer != id || action != expect {
+			t.Fatalf("unexpected expiry: %s, action %s",
+				timerStr[ev.Timer], TimerActionStr[action])
+		}
+		return
+	}
+
+	// five T3510 expiries, and then T3502 is started.
+	for i := 1; i <= 5; i++ {
+		ue.MakeRegistrationRequest()
+		expire(TimerT3510, TimerActionAbort)
+		if ue.attemptCounter != i || ue.MMstate != MMDeregistared {
+			t.Errorf("unexpected attempt counter: %d, %s",
+				ue.attemptCounter, MMstateStr[ue.MMstate])
+		}
+		if i < 5 {
+			expire(TimerT3511, TimerActionRegister)
+		}
+	}
+	if ue.TimerRunning(TimerT3502) == false ||
+		ue.Backoff() <= 59*time.Minute {
+		t.Errorf("T3502 is not started: %s", ue.Backoff())
+	}
+
+	ue.MakeRegistrationRequest()
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+	if ue.TimerRunning(TimerT3510) || ue.TimerRunning(TimerT3502) {
+		t.Errorf("timers are not stopped by Registration Accept")
+	}
+
+	// four retransmissions of the de-registration request, each of which
+	// has the next sequence number.
+	expect := ue.MakeDeregistrationRequest()
+	for i := 1; i <= 4; i++ {
+		pdu := expire(TimerT3521, TimerActionRetransmit)
+		if len(pdu) != len(expect) || pdu[6] != expect[6]+uint8(i) {
+			t.Errorf("unexpected retransmission: %x", pdu)
+		}
+	}
+	expire(TimerT3521, TimerActionAbort)
+	if ue.MMstate != MMDeregistared || ue.TimerRunning(TimerT3521) {
+		t.Errorf("de-registration is not aborted: %s",
+			MMstateStr[ue.MMstate])
+	}
+
+	// T3521 is not started at switch off.
+	ue.MMstate = MMRegistered
+	ue.SwitchOff = true
+	pdu := ue.MakeDeregistrationRequest()
+	if pdu[10]&deregTypeSwitchOff == 0 || ue.MMstate != MMDeregistared ||
+		ue.TimerRunning(TimerT3521) {
+		t.Errorf("unexpected switch off: %x, %s", pdu,
+			MMstateStr[ue.MMstate])
+	}
+}
+
+func TestNSSAI(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+	ue.RequestedNSSAI = []SNSSAI{{SST: 1, SD: "010203"}, {SST: 2}}
+
+	v := ue.encRegistrationRequest(true)
+	expect, _ := hex.DecodeString("2f0704010102030102")
+	if bytes.HasSuffix(v, expect) == false {
+		t.Errorf("Requested NSSAI\nexpect: %x\nactual: %x", expect, v)
+	}
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAcceptNSSAI)
+	allowed := []SNSSAI{{SST: 2}}
+	rejected := []RejectedSNSSAI{{SNSSAI{SST: 1, SD: "010203"},
+		RejectedNSSAICausePLMN}}
+	if reflect.DeepEqual(ue.AllowedNSSAI(), allowed) == false ||
+		reflect.DeepEqual(ue.Recv.rejectNSSAI, rejected) == false ||
+		len(ue.Recv.configNSSAI) != 2 {
+		t.Errorf("unexpected NSSAI: allowed %v, rejected %v, configured %v",
+			ue.AllowedNSSAI(), ue.Recv.rejectNSSAI, ue.Recv.configNSSAI)
+	}
+
+	// the rejected S-NSSAI is not requested any more.
+	v = ue.encRegistrationRequest(true)
+	expect, _ = hex.DecodeString("2f020102")
+	if bytes.HasSuffix(v, expect) == false {
+		t.Errorf("Requested NSSAI\nexpect: %x\nactual: %x", expect, v)
+	}
+
+	_, psi := ue.MakePDUSessionEstablishmentRequestFor(
+		PDUSessionParam{DNN: ue.DNN})
+	if snssai := ue.PDUSession(psi).SNSSAI; snssai.equal(allowed[0]) == false {
+		t.Errorf("unexpected S-NSSAI for the PDU session: %v", snssai)
+	}
+}
+
+func TestRejectedNSSAIInRegistrationArea(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+	ue.SubscribedNSSAI = []SNSSAI{{SST: 1, SD: "010203"}, {SST: 2}}
+
+	// the subscribed S-NSSAIs are requested if not configured.
+	v := ue.encRegistrationRequest(true)
+	expect, _ := hex.DecodeString("2f0704010102030102")
+	if bytes.HasSuffix(v, expect) == false {
+		t.Errorf("Requested NSSAI\nexpect: %x\nactual: %x", expect, v)
+	}
+
+	area := []TAI{{mcc: 208, mnc: 93, tac: []byte{0, 0, 1}}}
+	ue.setTAIList(area)
+	ue.Recv.rejectNSSAI = []RejectedSNSSAI{
+		{SNSSAI{SST: 1, SD: "010203"}, RejectedNSSAICauseRegistrationArea},
+		{SNSSAI{SST: 2}, RejectedNSSAICausePLMN},
+	}
+
+	ue.setTAIList([]TAI{{mcc: 208, mnc: 93, tac: []byte{0, 0, 1}}})
+	if len(ue.Recv.rejectNSSAI) != 2 {
+		t.Errorf("rejected NSSAI is cleared in the same area: %v",
+			ue.Recv.rejectNSSAI)
+	}
+
+	// only the S-NSSAI rejected in the PLMN is kept in the new area.
+	ue.setTAIList([]TAI{{mcc: 208, mnc: 93, tac: []byte{0, 0, 2}}})
+	rejected := []RejectedSNSSAI{{SNSSAI{SST: 2}, RejectedNSSAICausePLMN}}
+	if reflect.DeepEqual(ue.Recv.rejectNSSAI, rejected) == false {
+		t.Errorf("unexpected rejected NSSAI: %v", ue.Recv.rejectNSSAI)
+	}
+	v = ue.encRegistrationRequest(true)
+	expect, _ = hex.DecodeString("2f050401010203")
+	if bytes.HasSuffix(v, expect) == false {
+		t.Errorf("Requested NSSAI\nexpect: %x\nactual: %x", expect, v)
+	}
+}
+
+func TestMakeIdentityResponse(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+	ue.MACAddress = "02:00:00:00:00:01"
+
+	for i := 0; i < 4; i++ {
+		receive(ue, TestIdentityRequest[i])
+		v := ue.MakeNasPdu()
+		expect, _ := hex.DecodeString(TestIdentityResponse[i])
+		if reflect.DeepEqual(expect, v) == false {
+			t.Errorf("Identity Response[%d]\nexpect: %x\nactual: %x",
+				i, expect, v)
+		}
+	}
+
+	// after registration the response is protected by the security context.
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+	receive(ue, TestIdentityRequest[4])
+	v := ue.MakeNasPdu()
+	expect, _ := hex.DecodeString(TestIdentityResponse[4])
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("Identity Response[4]\nexpect: %x\nactual: %x", expect, v)
+	}
+}
+
+func TestIMEISV2IMEI(t *testing.T) {
+	imei := IMEISV2IMEI("4901542032375101")
+	expect := "490154203237518"
+	if imei != expect {
+		t.Errorf("IMEI expect: %s, actual: %s", expect, imei)
+	}
 }
 
 func TestDecode(t *testing.T) {
@@ -173,8 +701,29 @@ func TestDecode(t *testing.T) {
 			"PDU Session Establishemtn Accept"},
 		{TestDeregistrationAccept,
 			"Deregistration Accept"},
+		{TestDeregistrationRequestUETerm[1],
+			"Deregistration Request (UE terminated)"},
+		{TestServiceAccept,
+			"Service Accept"},
+		{TestServiceReject,
+			"Service Reject"},
+		{TestIdentityRequest[0],
+			"Identity Request"},
+		{TestAuthenticationResult,
+			"Authentication Result"},
+		{TestAuthenticationReject,
+			"Authentication Reject"},
+		{TestConfigurationUpdateCommand,
+			"Configuration Update Command"},
+		{TestRegistrationReject[1],
+			"Registration Reject"},
+		{Test5GMMStatus,
+			"5GMM Status"},
 	}
 
+	// the PDU session for the PDU Session Establishment Accept.
+	ue.sm.session[1] = &PDUSession{PSI: 1, PTI: 1, State: SMActivePending}
+
 	for _, p := range pattern {
 		fmt.Printf("---------- test decode: %s\n", p.desc)
 		receive(ue, p.in_str)
@@ -183,3 +732,413 @@ func TestDecode(t *testing.T) {
 		}
 	}
 }
+
+func TestULNasTransportUnknownPSI(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+
+	sm := []byte{0x2e, 0x05, 0x01, 0xc1}
+	pdu := ue.MakeULNasTransport(PayloadContainerN1SMInformation, 5,
+		MessageTypePDUSessionEstablishmentRequest, &sm)
+	if pdu != nil {
+		t.Errorf("UL NAS transport for unknown PSI: %x", pdu)
+	}
+	pdu = ue.MakeULNasTransport(PayloadContainerN1SMInformation, 5,
+		MessageTypePDUSessionReleaseRequest, &sm)
+	if len(pdu) == 0 {
+		t.Errorf("UL NAS transport for release is not encoded")
+	}
+}
+
+func TestMultiplePDUSessions(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+
+	_, psi1 := ue.MakePDUSessionEstablishmentRequestFor(
+		PDUSessionParam{DNN: "internet"})
+	_, psi2 := ue.MakePDUSessionEstablishmentRequestFor(
+		PDUSessionParam{DNN: "ims", SNSSAI: &SNSSAI{SST: 2}})
+	if psi1 != 1 || psi2 != 2 {
+		t.Fatalf("unexpected PSI: %d, %d", psi1, psi2)
+	}
+	s1, s2 := ue.PDUSession(psi1), ue.PDUSession(psi2)
+	if s1.PTI == s2.PTI || s2.DNN != "ims" || s2.SNSSAI.SST != 2 {
+		t.Errorf("unexpected PDU session: %+v, %+v", *s1, *s2)
+	}
+
+	receive(ue, TestPDUSessionEstablishmentAccept)
+	if ue.DecodeError != nil {
+		t.Fatalf("PDU Session Establishment Accept: %v", ue.DecodeError)
+	}
+
+	active := ue.ActivePDUSessions()
+	if len(active) != 1 || active[0] != s1 || s2.State != SMActivePending {
+		t.Errorf("unexpected active PDU sessions: %v", active)
+	}
+	if s1.Address.Equal(net.IPv4(60, 60, 0, 1)) == false ||
+		s1.Type != PDUSessionIPv4 {
+		t.Errorf("unexpected PDU address: %v", s1.Address)
+	}
+	if len(s1.QoSRules) != 1 || s1.QoSRules[0].Default == false {
+		t.Errorf("unexpected QoS rules: %+v", s1.QoSRules)
+	}
+	ambr := SessionAMBR{DL: 59395 * 1000, UL: 59395 * 1000}
+	if s1.AMBR != ambr {
+		t.Errorf("Session AMBR expect: %+v, actual: %+v", ambr, s1.AMBR)
+	}
+
+	// the deprecated fields follow the first PDU session.
+	if ue.SMstate != SMActive || ue.Recv.PDUAddress.Equal(s1.Address) == false {
+		t.Errorf("unexpected SMstate %s, PDUAddress %v",
+			SMstateStr[ue.SMstate], ue.Recv.PDUAddress)
+	}
+
+	// the lowest free PSI is allocated again.
+	delete(ue.sm.session, psi1)
+	if _, psi := ue.MakePDUSessionEstablishmentRequestFor(
+		PDUSessionParam{DNN: "internet"}); psi != psi1 {
+		t.Errorf("PSI expect: %d, actual: %d", psi1, psi)
+	}
+}
+
+func TestAMBRRate(t *testing.T) {
+	for _, c := range []struct {
+		unit  int
+		value uint16
+		rate  uint64
+	}{
+		{unitAMBR1Kbps, 1, 1000},
+		{unitAMBR4Kbps, 1, 4000},
+		{6, 2, 2000000},     // 1Mbps
+		{21, 1, 1e15},       // 1Pbps
+		{25, 1, 256 * 1e15}, // 256Pbps
+		{25, 0xffff, math.MaxUint64},
+		{26, 1, 0},
+	} {
+		if rate := ambrRate(c.unit, c.value); rate != c.rate {
+			t.Errorf("unit %d, value %d: expect %d, actual %d",
+				c.unit, c.value, c.rate, rate)
+		}
+	}
+}
+
+func TestIPv4v6PDUSession(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+
+	ue.MakePDUSessionEstablishmentRequestFor(
+		PDUSessionParam{DNN: "internet", Type: "IPv4v6"})
+	s := ue.PDUSession(1)
+	if s.Type != PDUSessionIPv4v6 {
+		t.Errorf("PDU session type expect: %d, actual: %d",
+			PDUSessionIPv4v6, s.Type)
+	}
+
+	receive(ue, TestPDUSessionEstablishmentAcceptIPv4v6)
+	if ue.DecodeError != nil {
+		t.Fatalf("PDU Session Establishment Accept: %v", ue.DecodeError)
+	}
+	if s.Type != PDUSessionIPv4v6 ||
+		s.Address.Equal(net.IPv4(60, 60, 0, 1)) == false {
+		t.Errorf("unexpected PDU address: type %d, %v", s.Type, s.Address)
+	}
+
+	lla := net.ParseIP("fe80::1")
+	if s.LinkLocalAddress().Equal(lla) == false {
+		t.Errorf("link local address expect: %v, actual: %v",
+			lla, s.LinkLocalAddress())
+	}
+
+	_, prefix, _ := net.ParseCIDR("2001:db8:1:2::/64")
+	if err := s.SetIPv6Prefix(prefix); err != nil {
+		t.Fatalf("SetIPv6Prefix: %v", err)
+	}
+	addr := net.ParseIP("2001:db8:1:2::1")
+	if s.AddressV6.Equal(addr) == false {
+		t.Errorf("IPv6 address expect: %v, actual: %v", addr, s.AddressV6)
+	}
+
+	_, prefix, _ = net.ParseCIDR("2001:db8::/48")
+	if err := s.SetIPv6Prefix(prefix); err == nil {
+		t.Errorf("SetIPv6Prefix accepted the prefix: %v", prefix)
+	}
+}
+
+func dlNasTransport(sm string) string {
+	return fmt.Sprintf("7e00680100%02x%s1201", len(sm)/2, sm)
+}
+
+func TestPDUSessionModificationAndRelease(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+	ue.MakePDUSessionEstablishmentRequest()
+	receive(ue, TestPDUSessionEstablishmentAccept)
+	s := ue.PDUSession(1)
+
+	// UE-requested modification
+	v := ue.MakePDUSessionModificationRequest(1)
+	pti := s.PTI
+	if bytes.Contains(v, []byte{0x2e, 1, pti, 0xc9}) == false ||
+		s.State != SMModificationPending {
+		t.Errorf("PDU Session Modification Request: %s, %x",
+			SMstateStr[s.State], v)
+	}
+
+	// delete QoS rule 1, create QoS rule 2 and modify the session AMBR.
+	receive(ue, dlNasTransport(fmt.Sprintf("2e01%02xcb"+
+		"2a06060001060001"+
+		"7a000d"+"01000140"+"020006213101010a05", pti)))
+	expect := []QoSRule{{ID: 2, Precedence: 10, QFI: 5,
+		Filters: []PacketFilter{{ID: 1, Direction: PacketFilterBidirectional,
+			Components: []PacketFilterComponent{{Type: pktFilterMatchAll}}}}}}
+	if reflect.DeepEqual(expect, s.QoSRules) == false {
+		t.Errorf("QoS rules expect: %+v, actual: %+v", expect, s.QoSRules)
+	}
+	ambr := SessionAMBR{DL: 1000000, UL: 1000000}
+	if s.AMBR != ambr || s.State != SMActive {
+		t.Errorf("unexpected PDU session after Modification Command: %+v", *s)
+	}
+
+	v = ue.MakePDUSessionModificationComplete(1)
+	if bytes.Contains(v, []byte{0x2e, 1, pti, 0xcc}) == false || s.PTI != 0 {
+		t.Errorf("PDU Session Modification Complete: %x", v)
+	}
+
+	// UE-requested release rejected by the network.
+	ue.MakePDUSessionReleaseRequest(1, SMCauseRegularDeactivation)
+	if s.State != SMInactivePending {
+		t.Errorf("unexpected state after Release Request: %s",
+			SMstateStr[s.State])
+	}
+	receive(ue, dlNasTransport(fmt.Sprintf("2e01%02xd21f", s.PTI)))
+	if s.State != SMActive || s.Cause != SMCauseRequestRejected {
+		t.Errorf("unexpected state after Release Reject: %s, cause %d",
+			SMstateStr[s.State], s.Cause)
+	}
+
+	// network-initiated release with back-off timer 10 sec.
+	receive(ue, dlNasTransport("2e0100d324370165"))
+	if s.State != SMInactive || s.Cause != SMCauseRegularDeactivation ||
+		s.Backoff != 10*time.Second {
+		t.Errorf("unexpected state after Release Command: %s, cause %d, %v",
+			SMstateStr[s.State], s.Cause, s.Backoff)
+	}
+	v = ue.MakePDUSessionReleaseComplete(1)
+	if bytes.Contains(v, []byte{0x2e, 1, 0, 0xd4}) == false {
+		t.Errorf("PDU Session Release Complete: %x", v)
+	}
+	if len(ue.ActivePDUSessions()) != 0 {
+		t.Errorf("PDU sessions remain active: %d",
+			len(ue.ActivePDUSessions()))
+	}
+
+	// the PSI is allocated again and the establishment is rejected.
+	_, psi := ue.MakePDUSessionEstablishmentRequestFor(
+		PDUSessionParam{DNN: "unknown"})
+	s = ue.PDUSession(psi)
+	if psi != 1 || s.State != SMActivePending {
+		t.Fatalf("unexpected PSI %d or state %s", psi, SMstateStr[s.State])
+	}
+	receive(ue, dlNasTransport(fmt.Sprintf("2e01%02xc31b", s.PTI)))
+	if s.State != SMInactive || s.Cause != SMCauseUnknownDNN {
+		t.Errorf("unexpected state after Establishment Reject: %s, cause %d",
+			SMstateStr[s.State], s.Cause)
+	}
+}
+
+func testPacket(src, dst string, proto uint8, sport, dport uint16) (pkt []byte) {
+	s, d := net.ParseIP(src), net.ParseIP(dst)
+	if s.To4() != nil {
+		pkt = []byte{0x45, 0, 0, 24, 0, 0, 0, 0, 64, proto, 0, 0}
+		pkt = append(append(pkt, s.To4()...), d.To4()...)
+	} else {
+		pkt = []byte{0x60, 0, 0, 0, 0, 4, proto, 64}
+		pkt = append(append(pkt, s...), d...)
+	}
+	port := make([]byte, 4)
+	binary.BigEndian.PutUint16(port, sport)
+	binary.BigEndian.PutUint16(port[2:], dport)
+	return append(pkt, port...)
+}
+
+func TestQoSRulesAndFlows(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+	ue.MakePDUSessionEstablishmentRequest()
+	receive(ue, TestPDUSessionEstablishmentAccept)
+	s := ue.PDUSession(1)
+
+	// rule 3: UDP to 10.0.0.0/8 port 5000 uplink only to QFI 6.
+	// rule 4: IPv6 2001:db8::/32 local port 1000-2000 to QFI 7.
+	// rule 1: the default rule modified to precedence 255 and QFI 1.
+	receive(ue, dlNasTransport("2e0100cb"+
+		"7a003b"+
+		"03001321220e100a000000ff0000003011501388"+"0506"+
+		"04001c3133172120010db8000000000000000000000000"+
+		"204103e807d0"+"0307"+
+		"010003d0ff01"+
+		"790010"+"062043"+"010101"+"0203060001"+"0403060002"))
+
+	if len(s.QoSRules) != 3 {
+		t.Fatalf("unexpected QoS rules: %+v", s.QoSRules)
+	}
+	_, remote, _ := net.ParseCIDR("10.0.0.0/8")
+	filter := PacketFilter{ID: 2, Direction: PacketFilterUplinkOnly,
+		Components: []PacketFilterComponent{
+			{Type: pktFilterIPv4RemoteAddr, Addr: remote},
+			{Type: pktFilterProtocol, Low: 17, High: 17},
+			{Type: pktFilterRemotePort, Low: 5000, High: 5000},
+		}}
+	if reflect.DeepEqual(filter, s.QoSRules[1].Filters[0]) == false {
+		t.Errorf("packet filter expect: %+v, actual: %+v",
+			filter, s.QoSRules[1].Filters[0])
+	}
+	flows := []QoSFlowDescription{
+		{QFI: 6, FiveQI: 1, GFBRUL: 1000000, MFBRUL: 2000000}}
+	if reflect.DeepEqual(flows, s.QoSFlows) == false {
+		t.Errorf("QoS flows expect: %+v, actual: %+v", flows, s.QoSFlows)
+	}
+
+	var tests = []struct {
+		pkt []byte
+		qfi uint8
+	}{
+		{testPacket("60.60.0.1", "10.1.2.3", 17, 1234, 5000), 6},
+		{testPacket("60.60.0.1", "10.1.2.3", 6, 1234, 5000), 1},
+		{testPacket("60.60.0.1", "192.168.0.1", 17, 1234, 5000), 1},
+		{testPacket("2001:db8:1::1", "2001:db8::1", 6, 1500, 80), 7},
+		{testPacket("2001:db8:1::1", "2001:db8::1", 6, 3000, 80), 1},
+	}
+	for _, test := range tests {
+		qfi, ok := s.ClassifyUplink(test.pkt)
+		if !ok || qfi != test.qfi {
+			t.Errorf("QFI expect: %d, actual: %d for %x",
+				test.qfi, qfi, test.pkt)
+		}
+	}
+	if _, ok := s.ClassifyUplink([]byte{0x45}); ok {
+		t.Errorf("ClassifyUplink accepted a short packet")
+	}
+
+	// the rules are classified in the cached order without allocation.
+	if n := testing.AllocsPerRun(100, func() {
+		s.ClassifyUplink(tests[0].pkt)
+	}); n != 0 {
+		t.Errorf("ClassifyUplink allocates %.0f objects", n)
+	}
+
+	// delete the QoS flow description.
+	receive(ue, dlNasTransport("2e0100cb"+"790003"+"064000"))
+	if len(s.QoSFlows) != 0 {
+		t.Errorf("QoS flow description remains: %+v", s.QoSFlows)
+	}
+}
+
+func TestReflectiveQoS(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+	ue.ReflectiveQoS = true
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+	v := ue.MakePDUSessionEstablishmentRequest()
+	if bytes.Contains(v, []byte{0x28, 0x01, smCapabilityRqoS}) == false {
+		t.Errorf("5GSM capability is not included: %x", v)
+	}
+	receive(ue, TestPDUSessionEstablishmentAccept)
+	s := ue.PDUSession(1)
+
+	// the default rule modified to precedence 255 and QFI 1, and the RQ
+	// timer value of 10 sec.
+	receive(ue, dlNasTransport("2e0100cb"+"7a0006"+"010003d0ff01"+"5605"))
+	if s.RQTimer != 10*time.Second {
+		t.Errorf("RQ timer expect: 10s, actual: %v", s.RQTimer)
+	}
+
+	dl := testPacket("10.1.2.3", "60.60.0.1", 17, 5000, 1234)
+	if s.ReflectDownlink(dl, 9) == false || s.ReflectDownlink(dl, 9) {
+		t.Errorf("the QoS rule is not derived only once")
+	}
+	rules := s.DerivedQoSRules()
+	if len(rules) != 1 || rules[0].QFI != 9 ||
+		rules[0].Precedence != derivedQoSRulePrecedence {
+		t.Fatalf("unexpected UE-derived QoS rules: %+v", rules)
+	}
+
+	ul := testPacket("60.60.0.1", "10.1.2.3", 17, 1234, 5000)
+	other := testPacket("60.60.0.1", "10.1.2.3", 17, 1235, 5000)
+	if qfi, _ := s.ClassifyUplink(ul); qfi != 9 {
+		t.Errorf("QFI expect: 9, actual: %d", qfi)
+	}
+	if qfi, _ := s.ClassifyUplink(other); qfi != 1 {
+		t.Errorf("QFI expect: 1, actual: %d", qfi)
+	}
+
+	// the QFI is updated and the rule expires with the RQ timer.
+	s.RQTimer = 10 * time.Millisecond
+	s.ReflectDownlink(dl, 10)
+	if qfi, _ := s.ClassifyUplink(ul); qfi != 10 {
+		t.Errorf("QFI expect: 10, actual: %d", qfi)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if qfi, _ := s.ClassifyUplink(ul); qfi != 1 ||
+		len(s.DerivedQoSRules()) != 0 {
+		t.Errorf("the UE-derived QoS rule remains: QFI %d", qfi)
+	}
+
+	// no QoS rule is derived without the support of reflective QoS.
+	ue = NewNAS("nas_test.json")
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+	ue.MakePDUSessionEstablishmentRequest()
+	receive(ue, TestPDUSessionEstablishmentAccept)
+	s = ue.PDUSession(1)
+	if s.ReflectDownlink(dl, 9) || len(s.DerivedQoSRules()) != 0 {
+		t.Errorf("the QoS rule is derived without reflective QoS")
+	}
+}
+
+func TestExtendedPCO(t *testing.T) {
+	ue := NewNAS("nas_test.json")
+	ue.RequestDNS = true
+
+	receive(ue, TestAuthenticationRequest)
+	receive(ue, TestSecurityModeCommand)
+	receive(ue, TestRegistrationAccept)
+	v, _ := ue.MakePDUSessionEstablishmentRequestFor(
+		PDUSessionParam{DNN: "internet", Type: "IPv4v6"})
+	epco, _ := hex.DecodeString("7b0007" + "80" + "000d00" + "000300")
+	if bytes.Contains(v, epco) == false {
+		t.Errorf("DNS server addresses are not requested: %x", v)
+	}
+	receive(ue, TestPDUSessionEstablishmentAcceptIPv4v6)
+	s := ue.PDUSession(1)
+
+	// the DNS server addresses with the IPCP container to be skipped.
+	receive(ue, dlNasTransport("2e0100cb"+"7b0028"+"80"+
+		"80210a"+"0301000a810608080808"+
+		"000d04"+"08080404"+
+		"000310"+"20014860486000000000000000008888"))
+	dns := []net.IP{net.ParseIP("8.8.4.4"),
+		net.ParseIP("2001:4860:4860::8888")}
+	if len(s.DNS) != len(dns) ||
+		s.DNS[0].Equal(dns[0]) == false || s.DNS[1].Equal(dns[1]) == false {
+		t.Errorf("DNS server addresses expect: %v, actual: %v", dns, s.DNS)
+	}
+}
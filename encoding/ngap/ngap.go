@@ -38,6 +38,7 @@ const (
 	idAllowedNSSAI              = 0
 	idAMFName                   = 1
 	idAMFUENGAPID               = 10
+	idCause                     = 15
 	idDefaultPagingDRX          = 21
 	idGlobalRANNodeID           = 27
 	idGUAMI                     = 28
@@ -45,6 +46,7 @@ const (
 	idMobilityRestrictionList   = 36
 	idNASPDU                    = 38
 	idPDUSessResSetupListCxtReq = 71
+	idPDUSessResSetupListCxtRes = 72
 	idPDUSessResSetupListSUReq  = 74
 	idPDUSessResSetupListSURes  = 75
 	idPLMNSupportList           = 80
@@ -54,9 +56,12 @@ const (
 	idSecurityKey               = 94
 	idServedGUAMIList           = 96
 	idSupportedTAList           = 102
+	idUEAMBR                    = 110
 	idUEContextRequest          = 112
+	idUENGAPIDs                 = 114
 	idUESecurityCapabilities    = 119
 	idUserLocationInformation   = 121
+	idPDUSessionAMBR            = 130
 	idPDUSessionType            = 134
 	idQosFlowSetupRequestList   = 136
 	idULNGUUPTNLInformation     = 139
@@ -66,6 +71,7 @@ var ieID = map[int]string{
 	idAllowedNSSAI:              "id-AllowedNSSAI",
 	idAMFName:                   "id-AMFName",
 	idAMFUENGAPID:               "id-AMF-UE-NGAP-ID",
+	idCause:                     "id-Cause",
 	idDefaultPagingDRX:          "",
 	idGlobalRANNodeID:           "",
 	idGUAMI:                     "id-GUAMI",
@@ -73,6 +79,7 @@ var ieID = map[int]string{
 	idMobilityRestrictionList:   "id-MobilityRestrictionList",
 	idNASPDU:                    "id-NAS-PDU",
 	idPDUSessResSetupListCxtReq: "id-PDUSessionResourceSetupListCxtReq",
+	idPDUSessResSetupListCxtRes: "id-PDUSessionResourceSetupListCxtRes",
 	idPDUSessResSetupListSUReq:  "id-PDUSessionResourceSetupListSUReq",
 	idPDUSessResSetupListSURes:  "id-PDUSessionResourceSetupListSURes",
 	idPLMNSupportList:           "id-PLMNSupportList",
@@ -82,9 +89,12 @@ var ieID = map[int]string{
 	idSecurityKey:               "id-SecurityKey",
 	idServedGUAMIList:           "id-ServedGUAMIList",
 	idSupportedTAList:           "",
+	idUEAMBR:                    "id-UEAggregateMaximumBitRate",
 	idUEContextRequest:          "",
+	idUENGAPIDs:                 "id-UE-NGAP-IDs",
 	idUESecurityCapabilities:    "id-UESecurityCapabilities",
 	idUserLocationInformation:   "",
+	idPDUSessionAMBR:            "id-PDUSessionAggregateMaximumBitRate",
 	idPDUSessionType:            "id-PDUSessionType",
 	idQosFlowSetupRequestList:   "id-QosFlowSetupRequestList",
 	idULNGUUPTNLInformation:     "id-UL-NGU-UP-TNLInformation",
@@ -102,32 +112,111 @@ type GNB struct {
 	GTPuTEID        uint32
 	UE              nas.UE // base parameter to be used for each UE
 
-	Recv struct {
-		GTPuPeerAddr net.IP
-		GTPuPeerTEID uint32
-	}
+	// the IPv6 address for GTP-U given to the network along with the IPv4
+	// GTPuLocalAddr. GTP-U is still sent over the family of GTPuLocalAddr.
+	GTPuLocalAddrV6 string
+
+	// interval of the GTP-U Echo Request to the UPFs, e.g. "10s". the
+	// echo is not sent if not given.
+	GTPuEchoInterval string
+
+	// the user plane of each UE in its own network namespace instead of
+	// the TUN device shared by the UEs. see UPlaneNetns.
+	UPlaneNetns *UPlaneNetns
+
+	// the traffic generated by each UE directly over the GTP-U tunnel.
+	Traffic []Traffic
+
+	// the user plane in the userspace TCP/IP stack of gnbsim instead of
+	// the TUN devices, so that neither the root privilege nor netlink is
+	// required. it is exclusive with UPlaneNetns.
+	UserspaceStack bool
+
+	// the data path of the user plane for the throughput testing. the N3
+	// messages are read and written in batches of UPlaneBatch, and the
+	// TUN device has UPlaneQueues queues each read by its own goroutine.
+	// one message at a time and a single queue if not given.
+	UPlaneBatch  int
+	UPlaneQueues int
 
 	Camper []*Camper
 
+	nextTEID uint32 // local TEID to be allocated next.
+
 	DecodeError error
 	dbgLevel    int
 	indent      int // indent for debug print.
 }
 
+// UPlaneNetns configures the network namespace created for each UE, or for
+// each PDU session if PerPDUSession, which is named "<Prefix>-<SUPI>" or
+// "<Prefix>-<SUPI>-<PSI>". the prefix is "ue" if not given. DNS is used
+// if the network does not give the DNS server addresses.
+type UPlaneNetns struct {
+	Prefix        string
+	PerPDUSession bool
+	DNS           []string
+}
+
+// Traffic is the flow generated by the UE. Type is "icmp" for the ICMP
+// echo, "udp" for the constant bit rate to the UDP echo server or "tcp" for
+// the bulk transfer to the TCP sink. Dst is the destination address with
+// the port for UDP and TCP, e.g. "172.16.1.2:5001". Rate is in bits per
+// second for UDP, Size is the payload size of each packet, and Interval is
+// of the ICMP echo. the PDU session of DNN, or the first one having the
+// address of the family, is used.
+type Traffic struct {
+	Type     string
+	Dst      string
+	Rate     uint64
+	Size     int
+	Interval string
+	Duration string
+	DNN      string
+}
+
 type Camper struct {
-	GNB          *GNB // camped in this gNB
-	UE           *nas.UE
-	GTPu	     *gtp.GTP
-	AmfId        uint32
-	RanId        uint32
-	RRCstate     int
+	GNB        *GNB // camped in this gNB
+	UE         *nas.UE
+	AmfId      uint32
+	RanId      uint32
+	RRCstate   int
+	PDUSession map[uint8]*PDUSession // keyed by PDU session ID.
+	UEAMBR     AMBR
+
+	// Deprecated: the fields of the first PDU session for the users of the
+	// single PDU session. use PDUSession instead.
+	Recv struct {
+		GTPuPeerAddr net.IP
+		GTPuPeerTEID uint32
+	}
+	GTPu         *gtp.GTP
 	PDUSessionID uint8
 	QosFlowID    uint8
 
 	SendMsg *[]byte
 	RecvMsg *[]byte
 
-	camperType int
+	camperType       int
+	pduSession       *PDUSession   // the PDU session being decoded.
+	setupPDUSessions []*PDUSession // PDU sessions set up by the last request.
+}
+
+// PDUSession is the PDU session resource in the gNB.
+type PDUSession struct {
+	ID        uint8
+	QosFlowID uint8
+	LocalTEID uint32
+	PeerAddr  net.IP
+	PeerTEID  uint32
+	GTPu      *gtp.GTP
+	AMBR      AMBR
+}
+
+// AMBR is the aggregate maximum bit rate in bits per second.
+type AMBR struct {
+	DL uint64
+	UL uint64
 }
 
 const (
@@ -175,6 +264,17 @@ func (gnb *GNB) LookupCamperByUE(ue *nas.UE) (c *Camper) {
 	return
 }
 
+func (gnb *GNB) LookupCamperByAmfId(id uint32) (c *Camper) {
+
+	for _, c = range gnb.Camper {
+		if c.AmfId == id {
+			return
+		}
+	}
+	c = nil
+	return
+}
+
 func (gnb *GNB) LookupCamperByRanId(id uint32) (c *Camper) {
 
 	for _, c = range gnb.Camper {
@@ -186,6 +286,36 @@ func (gnb *GNB) LookupCamperByRanId(id uint32) (c *Camper) {
 	return
 }
 
+// LookupPDUSessionByTEID returns the camper and the PDU session resource
+// having the local TEID.
+func (gnb *GNB) LookupPDUSessionByTEID(teid uint32) (
+	c *Camper, s *PDUSession) {
+
+	for _, c = range gnb.Camper {
+		for _, s = range c.PDUSession {
+			if s.LocalTEID == teid {
+				return
+			}
+		}
+	}
+	return nil, nil
+}
+
+// LookupPDUSessionByPeerTEID returns the camper and the PDU session
+// resource having the tunnel to the TEID of the peer.
+func (gnb *GNB) LookupPDUSessionByPeerTEID(addr net.IP, teid uint32) (
+	c *Camper, s *PDUSession) {
+
+	for _, c = range gnb.Camper {
+		for _, s = range c.PDUSession {
+			if s.PeerTEID == teid && s.PeerAddr.Equal(addr) {
+				return
+			}
+		}
+	}
+	return nil, nil
+}
+
 func (gnb *GNB) SendtoUE(c *Camper, pdu *[]byte) {
 
 	if pdu != nil {
@@ -222,6 +352,18 @@ func (gnb *GNB) Decode(pdu *[]byte) {
 	if c != nil && c.UE.DecodeError != nil {
 		gnb.DecodeError = c.UE.DecodeError
 	}
+	if c != nil {
+		c.updateFirstPDUSession()
+	}
+
+	switch procCode {
+	case idUEContextRelease:
+		// The UE-associated logical NG-connection is released and then
+		// the UE enters 5GMM-IDLE mode.
+		if c != nil && c.camperType == CAMPER_TYPE_NORMAL {
+			c.UE.ReleaseNASSignallingConnection()
+		}
+	}
 
 	return
 }
@@ -264,6 +406,7 @@ func (gnb *GNB) decPDUSessionResourceSetupListSUReq(
 
 	seqNum := int(readPduByte(pdu)) + 1
 	gnb.dprint("number of sequence: %d", seqNum)
+	c.setupPDUSessions = nil
 
 	for i := 0; i < seqNum; i++ {
 		seq := readPduByte(pdu)
@@ -278,6 +421,7 @@ func (gnb *GNB) decPDUSessionResourceSetupListSUReq(
 		}
 		gnb.decSNSSAI(pdu)
 		gnb.decPDUSessionResourceSetupRequestTransfer(c, pdu)
+		gnb.setupGTPu(c)
 	}
 
 	return
@@ -342,19 +486,60 @@ func (gnb *GNB) encPDUSessionResourceSetupListSURes(c *Camper) (v []byte) {
 
 	head, _ := encProtocolIE(idPDUSessResSetupListSURes, ignore)
 
-	_, v, _ = per.EncSequenceOf(1, 1, 256, false)
-	bf, _ := per.EncSequence(true, 1, 0)
-	v = append(v, bf.Value...)
+	_, v, _ = per.EncSequenceOf(uint(len(c.setupPDUSessions)), 1, 256, false)
+	for _, s := range c.setupPDUSessions {
+		bf, _ := per.EncSequence(true, 1, 0)
+		v = append(v, bf.Value...)
 
-	tmp := gnb.encPDUSessionID(c)
-	v = append(v, tmp...)
+		tmp := gnb.encPDUSessionID(s)
+		v = append(v, tmp...)
 
-	tmp = gnb.encPDUSessionResourceSetupResponseTransfer(c)
-	bf, tmp, _ = per.EncOctetString(tmp, 0, 0, false)
-	v = append(v, bf.Value...)
-	v = append(v, tmp...)
+		tmp = gnb.encPDUSessionResourceSetupResponseTransfer(s)
+		bf, tmp, _ = per.EncOctetString(tmp, 0, 0, false)
+		v = append(v, bf.Value...)
+		v = append(v, tmp...)
+	}
+	c.setupPDUSessions = nil
+
+	bf, _ := per.EncLengthDeterminant(len(v), 0, 0)
+	head = append(head, bf.Value...)
+	v = append(head, v...)
+
+	return
+}
+
+// PDU Session Resource Setup Response List is defined in
+// 9.2.2.2 INITIAL CONTEXT SETUP RESPONSE
+/*
+PDUSessionResourceSetupListCxtRes ::= SEQUENCE (SIZE(1..maxnoofPDUSessions)) OF PDUSessionResourceSetupItemCxtRes
+
+PDUSessionResourceSetupItemCxtRes ::= SEQUENCE {
+    pDUSessionID                                PDUSessionID,
+    pDUSessionResourceSetupResponseTransfer     OCTET STRING (CONTAINING PDUSessionResourceSetupResponseTransfer),
+    iE-Extensions       ProtocolExtensionContainer { {PDUSessionResourceSetupItemCxtRes-ExtIEs} }   OPTIONAL,
+    ...
+}
+*/
+func (gnb *GNB) encPDUSessionResourceSetupListCxtRes(c *Camper) (v []byte) {
+
+	head, _ := encProtocolIE(idPDUSessResSetupListCxtRes, ignore)
+
+	_, v, _ = per.EncSequenceOf(uint(len(c.setupPDUSessions)), 1, 256, false)
+	for _, s := range c.setupPDUSessions {
+		bf, _ := per.EncSequence(true, 1, 0)
+		v = append(v, bf.Value...)
 
-	bf, _ = per.EncLengthDeterminant(len(v), 0, 0)
+		tmp := gnb.encPDUSessionID(s)
+		v = append(v, tmp...)
+
+		tmp = gnb.encPDUSessionResourceSetupResponseTransfer(s)
+		bf, tmp, _ = per.EncOctetString(tmp, 0, 0, false)
+		v = append(v, bf.Value...)
+		v = append(v, tmp...)
+	}
+	c.setupPDUSessions = nil
+
+	bf, _ := per.EncLengthDeterminant(len(v), 0, 0)
 	head = append(head, bf.Value...)
 	v = append(head, v...)
 
@@ -383,6 +568,173 @@ func (gnb *GNB) MakeInitialContextSetupResponse(ue *nas.UE) (pdu []byte) {
 
 	pdu = encNgapPdu(successfulOutcome, idInitialContextSetup, reject)
 
+	var num uint = 2
+	setup := len(c.setupPDUSessions) != 0
+	if setup {
+		num++
+	}
+	v := encProtocolIEContainer(num)
+
+	tmp := gnb.encAMFUENGAPID(c, ignore)
+	v = append(v, tmp...)
+
+	tmp = gnb.encRANUENGAPID(ignore)
+	v = append(v, tmp...)
+
+	if setup {
+		tmp = gnb.encPDUSessionResourceSetupListCxtRes(c)
+		v = append(v, tmp...)
+	}
+
+	bf, _ := per.EncLengthDeterminant(len(v), 0, 0)
+
+	pdu = append(pdu, bf.Value...)
+	pdu = append(pdu, v...)
+
+	return
+}
+
+// 9.2.2.5 UE CONTEXT RELEASE REQUEST
+/*
+UEContextReleaseRequest ::= SEQUENCE {
+    protocolIEs     ProtocolIE-Container        { {UEContextReleaseRequest-IEs} },
+    ...
+}
+
+UEContextReleaseRequest-IEs NGAP-PROTOCOL-IES ::= {
+    { ID id-AMF-UE-NGAP-ID                      CRITICALITY reject  TYPE AMF-UE-NGAP-ID                         PRESENCE mandatory  }|
+    { ID id-RAN-UE-NGAP-ID                      CRITICALITY reject  TYPE RAN-UE-NGAP-ID                         PRESENCE mandatory  }|
+    { ID id-PDUSessionResourceListCxtRelReq     CRITICALITY reject  TYPE PDUSessionResourceListCxtRelReq        PRESENCE optional       }|
+    { ID id-Cause                               CRITICALITY ignore  TYPE Cause                                  PRESENCE mandatory  },
+    ...
+}
+*/
+func (gnb *GNB) MakeUEContextReleaseRequest(ue *nas.UE) (pdu []byte) {
+
+	c := gnb.LookupCamperByUE(ue)
+
+	pdu = encNgapPdu(initiatingMessage, idUEContextReleaseReq, ignore)
+
+	v := encProtocolIEContainer(3)
+
+	tmp := gnb.encAMFUENGAPID(c, reject)
+	v = append(v, tmp...)
+
+	tmp = gnb.encRANUENGAPID(reject)
+	v = append(v, tmp...)
+
+	tmp = gnb.encCause(causeRadioNetwork, causeRadioNetworkUserInactivity)
+	v = append(v, tmp...)
+
+	bf, _ := per.EncLengthDeterminant(len(v), 0, 0)
+
+	pdu = append(pdu, bf.Value...)
+	pdu = append(pdu, v...)
+
+	return
+}
+
+// 9.2.2.6 UE CONTEXT RELEASE COMMAND
+/*
+UEContextReleaseCommand ::= SEQUENCE {
+    protocolIEs     ProtocolIE-Container        { {UEContextReleaseCommand-IEs} },
+    ...
+}
+
+UEContextReleaseCommand-IEs NGAP-PROTOCOL-IES ::= {
+    { ID id-UE-NGAP-IDs                 CRITICALITY reject  TYPE UE-NGAP-IDs                PRESENCE mandatory  }|
+    { ID id-Cause                       CRITICALITY ignore  TYPE Cause                      PRESENCE mandatory  },
+    ...
+}
+
+UE-NGAP-IDs ::= CHOICE {
+    uE-NGAP-ID-pair     UE-NGAP-ID-pair,
+    aMF-UE-NGAP-ID      AMF-UE-NGAP-ID,
+    choice-Extensions       ProtocolIE-SingleContainer { {UE-NGAP-IDs-ExtIEs} }
+}
+
+UE-NGAP-ID-pair ::= SEQUENCE{
+    aMF-UE-NGAP-ID      AMF-UE-NGAP-ID,
+    rAN-UE-NGAP-ID      RAN-UE-NGAP-ID,
+    iE-Extensions       ProtocolExtensionContainer { {UE-NGAP-ID-pair-ExtIEs} } OPTIONAL,
+    ...
+}
+*/
+const (
+	ueNGAPIDpair = iota
+	ueNGAPIDamf
+)
+
+func (gnb *GNB) decUENGAPIDs(pdu *[]byte, length int) (c *Camper, err error) {
+
+	ids := readPduByteSlice(pdu, length)
+
+	// TODO: generic per decoder.
+	// 0000 000x
+	// ^^        choice
+	//   ^       extension marker of UE-NGAP-ID-pair
+	//    ^      option of UE-NGAP-ID-pair
+	//      ^^^  length of AMF-UE-NGAP-ID
+	choice := ids[0] >> 6
+	switch choice {
+	case ueNGAPIDpair:
+		amfLen := int((ids[0]>>1)&0x7) + 1
+		ids = ids[1:]
+		amfId := decUnsignedInteger(readPduByteSlice(&ids, amfLen))
+
+		ranLen := int(readPduByte(&ids)>>6) + 1
+		ranId := decUnsignedInteger(readPduByteSlice(&ids, ranLen))
+		gnb.dprint("AMF UE NGAP ID: %d", amfId)
+		gnb.dprint("RAN UE NGAP ID: %d", ranId)
+
+		c = gnb.LookupCamperByRanId(uint32(ranId))
+		if c == nil {
+			err = fmt.Errorf("cannot find camper for RanId=%d", ranId)
+			return
+		}
+		c.AmfId = uint32(amfId)
+
+	case ueNGAPIDamf:
+		amfLen := int((ids[0]>>3)&0x7) + 1
+		ids = ids[1:]
+		amfId := decUnsignedInteger(readPduByteSlice(&ids, amfLen))
+		gnb.dprint("AMF UE NGAP ID: %d", amfId)
+
+		c = gnb.LookupCamperByAmfId(uint32(amfId))
+		if c == nil {
+			err = fmt.Errorf("cannot find camper for AmfId=%d", amfId)
+			return
+		}
+	default:
+		err = fmt.Errorf("unsupported UE-NGAP-IDs choice: %d", choice)
+	}
+
+	return
+}
+
+// 9.2.2.7 UE CONTEXT RELEASE COMPLETE
+/*
+UEContextReleaseComplete ::= SEQUENCE {
+    protocolIEs     ProtocolIE-Container        { {UEContextReleaseComplete-IEs} },
+    ...
+}
+
+UEContextReleaseComplete-IEs NGAP-PROTOCOL-IES ::= {
+    { ID id-AMF-UE-NGAP-ID                          CRITICALITY ignore  TYPE AMF-UE-NGAP-ID                             PRESENCE mandatory  }|
+    { ID id-RAN-UE-NGAP-ID                          CRITICALITY ignore  TYPE RAN-UE-NGAP-ID                             PRESENCE mandatory  }|
+    { ID id-UserLocationInformation                 CRITICALITY ignore  TYPE UserLocationInformation                    PRESENCE optional       }|
+    { ID id-InfoOnRecommendedCellsAndRANNodesForPaging  CRITICALITY ignore  TYPE InfoOnRecommendedCellsAndRANNodesForPaging PRESENCE optional       }|
+    { ID id-PDUSessionResourceListCxtRelCpl         CRITICALITY reject  TYPE PDUSessionResourceListCxtRelCpl            PRESENCE optional       }|
+    { ID id-CriticalityDiagnostics                  CRITICALITY ignore  TYPE CriticalityDiagnostics                     PRESENCE optional       },
+    ...
+}
+*/
+func (gnb *GNB) MakeUEContextReleaseComplete(ue *nas.UE) (pdu []byte) {
+
+	c := gnb.LookupCamperByUE(ue)
+
+	pdu = encNgapPdu(successfulOutcome, idUEContextRelease, reject)
+
 	v := encProtocolIEContainer(2)
 
 	tmp := gnb.encAMFUENGAPID(c, ignore)
@@ -590,6 +942,8 @@ const (
 	idInitialUEMessage     = 15
 	idNGSetup              = 21
 	idPDUSessResSetup      = 29
+	idUEContextRelease     = 41
+	idUEContextReleaseReq  = 42
 	idUplinkNASTransport   = 46
 )
 
@@ -599,6 +953,8 @@ var procCodeStr = map[int]string{
 	idInitialUEMessage:     "id-InitialUEMessage",
 	idNGSetup:              "id-NGSetup",
 	idPDUSessResSetup:      "id-PDUSessionResourceSetup",
+	idUEContextRelease:     "id-UEContextRelease",
+	idUEContextReleaseReq:  "id-UEContextReleaseRequest",
 	idUplinkNASTransport:   "id-UplinkNASTransport",
 }
 
@@ -730,6 +1086,8 @@ func (gnb *GNB) decProtocolIE(c *Camper, pdu *[]byte) (c2 *Camper, err error) {
 	switch id {
 	case idAMFUENGAPID: //10
 		c2, err = gnb.decAMFUENGAPID(pdu, length)
+	case idCause: // 15
+		gnb.decCause(pdu, length)
 	case idNASPDU: // 38
 		gnb.decNASPDU(c, pdu)
 	case idPDUSessResSetupListCxtReq: // 71
@@ -738,12 +1096,21 @@ func (gnb *GNB) decProtocolIE(c *Camper, pdu *[]byte) (c2 *Camper, err error) {
 		gnb.decPDUSessionResourceSetupListSUReq(c, pdu, length)
 	case idRANUENGAPID: // 85
 		c2, err = gnb.decRANUENGAPID(c, pdu, length)
+	case idUENGAPIDs: // 114
+		c2, err = gnb.decUENGAPIDs(pdu, length)
 	case idPDUSessionType: // 134
 		gnb.decPDUSessionType(pdu, length)
 	case idQosFlowSetupRequestList: // 136
 		gnb.decQosFlowSetupRequestList(c, pdu, length)
 	case idULNGUUPTNLInformation: // 139
-		gnb.decUPTransportLayerInformation(pdu, length)
+		gnb.decUPTransportLayerInformation(c, pdu, length)
+	case idUEAMBR: // 110
+		c.UEAMBR = gnb.decAggregateMaximumBitRate(pdu, length)
+	case idPDUSessionAMBR: // 130
+		ambr := gnb.decAggregateMaximumBitRate(pdu, length)
+		if c.pduSession != nil {
+			c.pduSession.AMBR = ambr
+		}
 	default:
 		dump := readPduByteSlice(pdu, length)
 		// gnb.DecodeError = fmt.Errorf("ngap: docoding id(%d) not supported yet.", id)
@@ -754,6 +1121,83 @@ func (gnb *GNB) decProtocolIE(c *Camper, pdu *[]byte) (c2 *Camper, err error) {
 	return
 }
 
+// 9.3.1.2 Cause
+/*
+Cause ::= CHOICE {
+    radioNetwork        CauseRadioNetwork,
+    transport           CauseTransport,
+    nas                 CauseNas,
+    protocol            CauseProtocol,
+    misc                CauseMisc,
+    choice-Extensions   ProtocolIE-SingleContainer { {Cause-ExtIEs} }
+}
+*/
+const (
+	causeRadioNetwork = iota
+	causeTransport
+	causeNas
+	causeProtocol
+	causeMisc
+)
+
+var causeStr = map[int]string{
+	causeRadioNetwork: "radioNetwork",
+	causeTransport:    "transport",
+	causeNas:          "nas",
+	causeProtocol:     "protocol",
+	causeMisc:         "misc",
+}
+
+// the largest value in the extension root of each cause.
+var causeRootMax = map[int]uint{
+	causeRadioNetwork: 44,
+	causeTransport:    1,
+	causeNas:          3,
+	causeProtocol:     6,
+	causeMisc:         5,
+}
+
+const (
+	causeRadioNetworkUserInactivity = 20
+)
+
+func (gnb *GNB) encCause(group int, value uint) (v []byte) {
+
+	head, _ := encProtocolIE(idCause, ignore)
+
+	b, _, _ := per.EncChoice(group, 0, 5, false)
+	b2, _, _ := per.EncEnumerated(value, 0, causeRootMax[group], true)
+	b = per.MergeBitField(b, b2)
+	v = b.Value
+
+	bf, _ := per.EncLengthDeterminant(len(v), 0, 0)
+	head = append(head, bf.Value...)
+	v = append(head, v...)
+
+	return
+}
+
+func (gnb *GNB) decCause(pdu *[]byte, length int) {
+
+	var cause per.BitField
+	cause.Value = readPduByteSlice(pdu, length)
+	cause.Len = len(cause.Value) * 8
+
+	// TODO: generic per decoder.
+	// 000 0 0000 00
+	// ^^^           choice
+	//     ^         extension marker
+	//       ^^^^ ^^ cause value (the width depends on the choice)
+	group := int(cause.Value[0] >> 5)
+	width := bits.Len(causeRootMax[group])
+	cause = per.ShiftLeft(cause, 4)
+
+	value := int(cause.Value[0] >> (8 - width))
+	gnb.dprint("Cause: %s (%d)", causeStr[group], value)
+
+	return
+}
+
 // 9.3.1.5 Global RAN Node ID
 /*
   It returns only GNB-ID for now.
@@ -1071,7 +1515,8 @@ GTPTunnel ::= SEQUENCE {
     ...
 }
 */
-func (gnb *GNB) encUPTransportLayerInformation(pre *per.BitField) (pdu []byte) {
+func (gnb *GNB) encUPTransportLayerInformation(
+	s *PDUSession, pre *per.BitField) (pdu []byte) {
 
 	const gTPTunnel = 0
 	bf, _, _ := per.EncChoice(gTPTunnel, 0, 1, false)
@@ -1087,13 +1532,14 @@ func (gnb *GNB) encUPTransportLayerInformation(pre *per.BitField) (pdu []byte) {
 	tmp := gnb.encTransportLayerAddress(pre)
 	pdu = append(pdu, tmp...)
 
-	tmp = gnb.encGTPTEID()
+	tmp = gnb.encGTPTEID(s.LocalTEID)
 	pdu = append(pdu, tmp...)
 
 	return
 }
 
-func (gnb *GNB) decUPTransportLayerInformation(pdu *[]byte, length int) {
+func (gnb *GNB) decUPTransportLayerInformation(
+	c *Camper, pdu *[]byte, length int) {
 
 	var tli per.BitField
 	tli.Value = readPduByteSlice(pdu, length)
@@ -1108,13 +1554,20 @@ func (gnb *GNB) decUPTransportLayerInformation(pdu *[]byte, length int) {
 	tli = per.ShiftLeft(tli, 3) // skip the above bits
 	tli.Len -= 3
 
-	gnb.decTransportLayerAddress(&tli)
-	gnb.decGTPTEID(&tli.Value)
+	addr := gnb.decTransportLayerAddress(&tli)
+	teid := gnb.decGTPTEID(&tli.Value)
+
+	if s := c.pduSession; s != nil {
+		s.PeerAddr = addr
+		s.PeerTEID = teid
+	}
 
 	return
 }
 
 // 9.3.2.4 Transport Layer Address
+// the address is IPv4 in 32 bits, IPv6 in 128 bits, or both of them in 160
+// bits with IPv4 first. see 5.1 in TS 38.414.
 /*
 TransportLayerAddress ::= BIT STRING (SIZE(1..160, ...))
 */
@@ -1125,9 +1578,16 @@ func (gnb *GNB) encTransportLayerAddress(pre *per.BitField) (pdu []byte) {
 	const extmark = true
 
 	addr := net.ParseIP(gnb.GTPuLocalAddr)
-	ipv4addr := addr.To4()
-	bitlen := net.IPv4len * 8
-	bf, v, _ := per.EncBitString(ipv4addr, bitlen, min, max, extmark)
+	ipaddr := addr.To4()
+	if ipaddr == nil {
+		ipaddr = addr.To16()
+	} else if v6 := net.ParseIP(gnb.GTPuLocalAddrV6); v6 != nil &&
+		v6.To4() == nil {
+		// both of IPv4 and IPv6 in 160 bits.
+		ipaddr = append(append([]byte{}, ipaddr...), v6...)
+	}
+	bitlen := len(ipaddr) * 8
+	bf, v, _ := per.EncBitString(ipaddr, bitlen, min, max, extmark)
 
 	if pre != nil { // has inherited preamble
 		bf = per.MergeBitField(*pre, bf)
@@ -1137,7 +1597,7 @@ func (gnb *GNB) encTransportLayerAddress(pre *per.BitField) (pdu []byte) {
 	return
 }
 
-func (gnb *GNB) decTransportLayerAddress(tla *per.BitField) {
+func (gnb *GNB) decTransportLayerAddress(tla *per.BitField) (addr net.IP) {
 
 	gnb.dprint("Transport Layer Address")
 
@@ -1152,11 +1612,21 @@ func (gnb *GNB) decTransportLayerAddress(tla *per.BitField) {
 
 	*tla = per.ShiftLeft(*tla, tla.Len%8) // skip remaining preamble
 
-	var addr net.IP
 	octLen := int((length-1)/8 + 1)
 	addr = readPduByteSlice(&tla.Value, octLen)
+
+	// the address of the family of the local address is used if both of
+	// IPv4 and IPv6 are given.
+	if len(addr) == net.IPv4len+net.IPv6len {
+		gnb.dprinti("IPv4 address: %v", addr[:net.IPv4len])
+		gnb.dprinti("IPv6 address: %v", addr[net.IPv4len:])
+		if net.ParseIP(gnb.GTPuLocalAddr).To4() != nil {
+			addr = addr[:net.IPv4len]
+		} else {
+			addr = addr[net.IPv4len:]
+		}
+	}
 	gnb.dprinti("address: %v", addr)
-	gnb.Recv.GTPuPeerAddr = addr
 
 	return
 }
@@ -1165,32 +1635,42 @@ func (gnb *GNB) decTransportLayerAddress(tla *per.BitField) {
 /*
 GTP-TEID ::= OCTET STRING (SIZE(4))
 */
-func (gnb *GNB) encGTPTEID() (pdu []byte) {
+func (gnb *GNB) encGTPTEID(id uint32) (pdu []byte) {
 
 	const min = 4
 	const max = 4
 	const extmark = false
 
 	teid := make([]byte, 4)
-	// 999 for now, should be a random value.
-	if gnb.GTPuTEID == 0 {
-		gnb.GTPuTEID = rand.Uint32()
-	}
-	binary.BigEndian.PutUint32(teid, gnb.GTPuTEID)
+	binary.BigEndian.PutUint32(teid, id)
 	_, pdu, _ = per.EncOctetString(teid, min, max, extmark)
 
 	return
 }
 
-func (gnb *GNB) decGTPTEID(pdu *[]byte) {
+func (gnb *GNB) decGTPTEID(pdu *[]byte) (id uint32) {
 
-	id := readPduUint32(pdu)
+	id = readPduUint32(pdu)
 	gnb.dprint("GTP TEID: %d", id)
-	gnb.Recv.GTPuPeerTEID = id
 
 	return
 }
 
+// allocateTEID returns the local TEID for a new PDU session. TEIDs are
+// allocated in sequence from GTPuTEID, which is chosen randomly if not
+// configured.
+func (gnb *GNB) allocateTEID() (id uint32) {
+	if gnb.GTPuTEID == 0 {
+		gnb.GTPuTEID = rand.Uint32()
+	}
+	if gnb.nextTEID == 0 {
+		gnb.nextTEID = gnb.GTPuTEID
+	}
+	id = gnb.nextTEID
+	gnb.nextTEID++
+	return
+}
+
 // 9.3.2.8 QoS Flow per TNL Information
 /*
 QosFlowPerTNLInformation ::= SEQUENCE {
@@ -1201,7 +1681,7 @@ QosFlowPerTNLInformation ::= SEQUENCE {
 }
 */
 func (gnb *GNB) encQosFlowPerTNLInformation(
-	c *Camper, pre *per.BitField) (pdu []byte) {
+	s *PDUSession, pre *per.BitField) (pdu []byte) {
 
 	bf, _ := per.EncSequence(true, 1, 0)
 	if pre != nil { // has inherited preamble
@@ -1209,10 +1689,10 @@ func (gnb *GNB) encQosFlowPerTNLInformation(
 	}
 	pre = &bf
 
-	tmp := gnb.encUPTransportLayerInformation(pre)
+	tmp := gnb.encUPTransportLayerInformation(s, pre)
 	pdu = append(pdu, tmp...)
 
-	tmp = gnb.encAssociatedQosFlowList(c)
+	tmp = gnb.encAssociatedQosFlowList(s)
 	pdu = append(pdu, tmp...)
 
 	return
@@ -1350,15 +1830,64 @@ func (gnb *GNB) decSNSSAI(pdu *[]byte) {
 /*
 PDUSessionID ::= INTEGER (0..255)
 */
-func (gnb *GNB) encPDUSessionID(c *Camper) (pdu []byte) {
-	_, pdu, _ = per.EncInteger(int64(c.PDUSessionID), 0, 255, false)
+func (gnb *GNB) encPDUSessionID(s *PDUSession) (pdu []byte) {
+	_, pdu, _ = per.EncInteger(int64(s.ID), 0, 255, false)
 	return
 }
 
+// decPDUSessionID looks up the PDU session resource of the ID, or creates
+// it with a new local TEID, and adds it to the sessions to be set up.
 func (gnb *GNB) decPDUSessionID(c *Camper, pdu *[]byte) (val int) {
 	val = int(readPduByte(pdu))
 	gnb.dprinti("PDU Session ID: %d", val)
-	c.PDUSessionID = uint8(val)
+
+	id := uint8(val)
+	if c.PDUSession == nil {
+		c.PDUSession = map[uint8]*PDUSession{}
+	}
+	s := c.PDUSession[id]
+	if s == nil {
+		s = &PDUSession{ID: id, LocalTEID: gnb.allocateTEID()}
+		c.PDUSession[id] = s
+	}
+	c.pduSession = s
+	c.setupPDUSessions = append(c.setupPDUSessions, s)
+	return
+}
+
+// updateFirstPDUSession updates the deprecated fields by the PDU session of
+// the smallest ID.
+func (c *Camper) updateFirstPDUSession() {
+
+	var first *PDUSession
+	for id, s := range c.PDUSession {
+		if first == nil || id < first.ID {
+			first = s
+		}
+	}
+	if first == nil {
+		first = &PDUSession{}
+	}
+	c.Recv.GTPuPeerAddr = first.PeerAddr
+	c.Recv.GTPuPeerTEID = first.PeerTEID
+	c.GTPu = first.GTPu
+	c.PDUSessionID = first.ID
+	c.QosFlowID = first.QosFlowID
+	return
+}
+
+// setupGTPu builds the GTP-U tunnel of the PDU session decoded last.
+func (gnb *GNB) setupGTPu(c *Camper) {
+	s := c.pduSession
+	if s == nil {
+		return
+	}
+	s.GTPu = gtp.NewGTP(s.LocalTEID, s.PeerTEID)
+	s.GTPu.IFname = gnb.GTPuIFname
+	s.GTPu.LocalAddr = net.ParseIP(gnb.GTPuLocalAddr)
+	s.GTPu.PeerAddr = s.PeerAddr
+	s.GTPu.SetQosFlowID(s.QosFlowID)
+	c.pduSession = nil
 	return
 }
 
@@ -1366,12 +1895,12 @@ func (gnb *GNB) decPDUSessionID(c *Camper, pdu *[]byte) (val int) {
 /*
 QosFlowIdentifier ::= INTEGER (0..63, ...)
 */
-func (gnb *GNB) encQosFlowIdentifier(c *Camper) (bf per.BitField) {
+func (gnb *GNB) encQosFlowIdentifier(s *PDUSession) (bf per.BitField) {
 
 	const min = 0
 	const max = 63
 	const extmark = true
-	bf, _, _ = per.EncInteger(int64(c.QosFlowID), min, max, extmark)
+	bf, _, _ = per.EncInteger(int64(s.QosFlowID), min, max, extmark)
 
 	return
 }
@@ -1386,7 +1915,9 @@ func (gnb *GNB) decQosFlowIdentifier(c *Camper, item *per.BitField) {
 	id >>= 1
 	item.Len -= 7
 	gnb.dprinti("Qos Flow Identifier: %d", id)
-	c.QosFlowID = id
+	if c.pduSession != nil {
+		c.pduSession.QosFlowID = id
+	}
 	return
 }
 
@@ -1446,20 +1977,20 @@ AssociatedQosFlowItem ::= SEQUENCE {
     ...
 }
 */
-func (gnb *GNB) encAssociatedQosFlowList(c *Camper) (pdu []byte) {
+func (gnb *GNB) encAssociatedQosFlowList(s *PDUSession) (pdu []byte) {
 
 	const min = 1
 	const max = 64
 	const extmark = false
 
 	bf, _, _ := per.EncSequenceOf(1, min, max, extmark)
-	pdu = gnb.encAssociatedQosFlowItem(c, &bf)
+	pdu = gnb.encAssociatedQosFlowItem(s, &bf)
 
 	return
 }
 
 func (gnb *GNB) encAssociatedQosFlowItem(
-	c *Camper, pre *per.BitField) (pdu []byte) {
+	s *PDUSession, pre *per.BitField) (pdu []byte) {
 
 	const optnum = 2
 	const optflag = 0
@@ -1469,13 +2000,70 @@ func (gnb *GNB) encAssociatedQosFlowItem(
 	if pre != nil {
 		bf = per.MergeBitField(*pre, bf)
 	}
-	bf2 := gnb.encQosFlowIdentifier(c)
+	bf2 := gnb.encQosFlowIdentifier(s)
 	bf = per.MergeBitField(bf, bf2)
 	pdu = bf.Value
 
 	return
 }
 
+// 9.3.1.58 UE Aggregate Maximum Bit Rate
+/*
+UEAggregateMaximumBitRate ::= SEQUENCE {
+    uEAggregateMaximumBitRateDL     BitRate,
+    uEAggregateMaximumBitRateUL     BitRate,
+    iE-Extensions       ProtocolExtensionContainer { {UEAggregateMaximumBitRate-ExtIEs} }   OPTIONAL,
+    ...
+}
+*/
+// 9.3.1.102 PDU Session Aggregate Maximum Bit Rate
+/*
+PDUSessionAggregateMaximumBitRate ::= SEQUENCE {
+    pDUSessionAggregateMaximumBitRateDL     BitRate,
+    pDUSessionAggregateMaximumBitRateUL     BitRate,
+    iE-Extensions       ProtocolExtensionContainer { {PDUSessionAggregateMaximumBitRate-ExtIEs} }   OPTIONAL,
+    ...
+}
+*/
+// both have the same structure.
+func (gnb *GNB) decAggregateMaximumBitRate(
+	pdu *[]byte, length int) (ambr AMBR) {
+
+	v := readPduByteSlice(pdu, length)
+
+	// TODO: generic per decoder.
+	// 0000 0000
+	// ^         extension marker
+	//  ^        option
+	//   ^^ ^^   BitRate DL
+	ambr.DL = decBitRate(&v, 2)
+	ambr.UL = decBitRate(&v, 0)
+	gnb.dprinti("Aggregate Maximum Bit Rate DL: %d, UL: %d",
+		ambr.DL, ambr.UL)
+
+	return
+}
+
+// 9.3.1.4 Bit Rate
+/*
+BitRate ::= INTEGER (0..4000000000000,...)
+*/
+// decBitRate decodes the extensible integer having the length in 3 bits
+// after the offset bits in the first octet, followed by the octet aligned
+// value.
+func decBitRate(v *[]byte, offset uint) (rate uint64) {
+	if len(*v) == 0 {
+		return
+	}
+	head := readPduByte(v)
+	length := int((head<<offset)>>4)&0x7 + 1
+	if len(*v) < length {
+		return
+	}
+	rate = decUnsignedInteger(readPduByteSlice(v, length))
+	return
+}
+
 // 9.3.1.111 RRC Establishment Cause
 /*
 RRCEstablishmentCause ::= ENUMERATED {
@@ -1703,11 +2291,11 @@ PDUSessionResourceSetupResponseTransfer ::= SEQUENCE {
 }
 */
 func (gnb *GNB) encPDUSessionResourceSetupResponseTransfer(
-	c *Camper) (pdu []byte) {
+	s *PDUSession) (pdu []byte) {
 
 	bf, _ := per.EncSequence(true, 4, 0)
 	pre := &bf
-	pdu = gnb.encQosFlowPerTNLInformation(c, pre)
+	pdu = gnb.encQosFlowPerTNLInformation(s, pre)
 
 	return
 }
@@ -1726,6 +2314,7 @@ PDUSessionResourceSetupListCxtReq ::= SEQUENCE (SIZE(1..maxnoofPDUSessions)) OF
 func (gnb *GNB) decPDUSessionResourceSetupListCtxReq(c *Camper, pdu *[]byte, length int) {
 
 	gnb.dprint("PDU Session Resource Setup Request Request List")
+	c.setupPDUSessions = nil
 
 	var list per.BitField
 	list.Value = readPduByteSlice(pdu, length)
@@ -1776,6 +2365,7 @@ func (gnb *GNB) decPDUSessionResourceSetupItemCxtReq(
 	}
 	gnb.decSNSSAI(&item.Value)
 	gnb.decPDUSessionResourceSetupRequestTransfer(c, &item.Value)
+	gnb.setupGTPu(c)
 
 	return
 }
@@ -1979,6 +2569,13 @@ func readPduByteSlice(pdu *[]byte, length int) (val []byte) {
 	return
 }
 
+func decUnsignedInteger(v []byte) (val uint64) {
+	for _, b := range v {
+		val = val<<8 | uint64(b)
+	}
+	return
+}
+
 func (gnb *GNB) GetDebugLevel() int {
 	return gnb.dbgLevel
 }
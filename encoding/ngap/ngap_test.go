@@ -4,10 +4,13 @@ import (
 	"encoding/hex"
 	"fmt"
 	"log"
+	"net"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/hhorai/gnbsim/encoding/nas"
+	"github.com/hhorai/gnbsim/encoding/per"
 )
 
 // send message
@@ -18,6 +21,9 @@ var TestULSecurityModeComplete string = "002e403d000004000a000200010055000200000
 var TestInitialContextSetupResponse string = "200e000f000002000a40020001005540020000"
 var TestULRegistrationComplete string = "002e4031000004000a000200010055000200000026000b0a7e042cbd08cf017e00430079400f4002f839000004001002f839000001"
 var TestPDUSessionResourceSetupResponse string = "201d0024000003000a40020001005540020000004b40110000010d0003e0c0a80103000003e70001"
+var TestPDUSessionResourceSetupResponse2 string = "201d0034000003000a40020001005540020000004b40210100010d0003e0c0a80103000003e7000100020d0003e0c0a80103000003e80001"
+var TestUEContextReleaseRequest string = "002a4015000003000a00020001005500020000000f40020500"
+var TestUEContextReleaseComplete string = "2029000f000002000a40020001005540020000"
 
 // receive message
 var TestNGSetupResponse string = "20150031000004000100050100414d4600600008000002f839cafe0000564001ff005000100002f839000110080102031008112233"
@@ -25,6 +31,7 @@ var TestDLAuthenticationRequest string = "0004403e000003000a00020001005500020000
 var TestDLSecurityModeCommand string = "00044029000003000a0002000100550002000000260016157e036c2b24e2007e005d02000480a00000e1360100"
 var TestInitialContextSetupRequest string = "000e0080a7000009000a00020001005500020000001c00070002f839cafe000000000a2201010203100811223300770009000004000000000000005e002013663ab7286c9a6af7cba0b1fd9e6ed48045d4356d46ff3944c81c63324fd803002440040002f839002240080000000100ffff0100264036357e02930d75cf017e0242010177000b0202f839cafe000000000154070002f839000001150a040101020304011122335e010616012c"
 var TestInitialContextSetupRequest2 string = "000e0080f500000b000a00020001005500020000006e0008080f4240200f4240001c00070002f839cafe000047002a000001402001020321000003008b000a01f07f00000800000001008600010000880007000000000938000000000a2201010203100811223300770009000000100000000000005e0020473007e30d4d0d77a7073e5b43b909562b7a8c461fc7ef0b73ab4026edbb91aa002440040002f839002240080000000100ffff010026404a497e02809e40eb027e006801003a2e0101c211000901000631310101ff00060103e80103e859322905013c3c0001220401010203790006002041010109250908696e7465726e65741201"
+var TestUEContextReleaseCommand string = "002900100000020072000400010000000f400140"
 var TestDLPDUSessionEstablishmentAccept string = "001d006d000003000a00020001005500020000004a005a0040012f7e0222994e9f027e00680100202e0100c21100090100063131010100000601e80301e80359322905013c3c00011201402001020321000003008b000a01f0c0a801120000000100860001000088000700010000093800"
 
 var TestOpen5gsNGSetupResponse string = "201500320000040001000e05806f70656e3567732d616d663000600008000002f83901004000564001ff005000080002f83900000008"
@@ -76,6 +83,9 @@ func TestMakePDUSessionResourceSetupResponse(t *testing.T) {
 
 	for _, p := range pattern {
 		recvfromNW(gnb, p.in_str)
+		if p.in_str == TestDLSecurityModeCommand {
+			ue.MakePDUSessionEstablishmentRequest()
+		}
 	}
 
 	gnb.SetDebugLevel(1)
@@ -90,6 +100,51 @@ func TestMakePDUSessionResourceSetupResponse(t *testing.T) {
 
 }
 
+func TestMultiplePDUSessionResources(t *testing.T) {
+
+	gnb, ue := initEnv()
+	recvfromNW(gnb, TestDLAuthenticationRequest)
+
+	c := gnb.LookupCamperByUE(ue)
+	for _, id := range []uint8{1, 2} {
+		pdu := []byte{id}
+		gnb.decPDUSessionID(c, &pdu)
+		c.pduSession.QosFlowID = 1
+		gnb.setupGTPu(c)
+	}
+
+	s1, s2 := c.PDUSession[1], c.PDUSession[2]
+	if s1.LocalTEID == s2.LocalTEID || s2.GTPu.LocalTEID != s2.LocalTEID {
+		t.Errorf("unexpected local TEID: %d, %d", s1.LocalTEID, s2.LocalTEID)
+	}
+
+	c.PDUSession[2].PeerAddr = net.ParseIP("192.168.1.18")
+	c.PDUSession[2].PeerTEID = 100
+	if c2, s := gnb.LookupPDUSessionByTEID(s2.LocalTEID); c2 != c || s != s2 {
+		t.Errorf("LookupPDUSessionByTEID: %+v", s)
+	}
+	c2, s := gnb.LookupPDUSessionByPeerTEID(net.ParseIP("192.168.1.18"), 100)
+	if c2 != c || s != s2 {
+		t.Errorf("LookupPDUSessionByPeerTEID: %+v", s)
+	}
+
+	// the deprecated fields follow the first PDU session.
+	c.updateFirstPDUSession()
+	if c.PDUSessionID != 1 || c.GTPu != s1.GTPu || c.QosFlowID != 1 {
+		t.Errorf("unexpected first PDU session: %d", c.PDUSessionID)
+	}
+
+	v := gnb.MakePDUSessionResourceSetupResponse(ue)
+	expect, _ := hex.DecodeString(TestPDUSessionResourceSetupResponse2)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("PDUSessionResourceSetupResponse\nexpect: %x\nactual: %x", expect, v)
+	}
+	if len(c.setupPDUSessions) != 0 {
+		t.Errorf("PDU sessions remain after the response: %d",
+			len(c.setupPDUSessions))
+	}
+}
+
 func TestMakeInitialContextSetupResponse(t *testing.T) {
 
 	gnb, ue := initEnv()
@@ -103,6 +158,33 @@ func TestMakeInitialContextSetupResponse(t *testing.T) {
 	}
 }
 
+func TestUEContextRelease(t *testing.T) {
+
+	gnb, ue := initEnv()
+
+	recvfromNW(gnb, TestDLAuthenticationRequest)
+	v := gnb.MakeUEContextReleaseRequest(ue)
+	expect, _ := hex.DecodeString(TestUEContextReleaseRequest)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("UEContextReleaseRequest\nexpect: %x\nactual: %x", expect, v)
+	}
+
+	recvfromNW(gnb, TestUEContextReleaseCommand)
+	if gnb.DecodeError != nil {
+		t.Errorf("UEContextReleaseCommand: %v", gnb.DecodeError)
+	}
+	if ue.CMstate != nas.CMIdle {
+		t.Errorf("UEContextReleaseCommand: expect CM state: %s, actual: %s",
+			nas.CMstateStr[nas.CMIdle], nas.CMstateStr[ue.CMstate])
+	}
+
+	v = gnb.MakeUEContextReleaseComplete(ue)
+	expect, _ = hex.DecodeString(TestUEContextReleaseComplete)
+	if reflect.DeepEqual(expect, v) == false {
+		t.Errorf("UEContextReleaseComplete\nexpect: %x\nactual: %x", expect, v)
+	}
+}
+
 func TestMakeInitialUEMessage(t *testing.T) {
 
 	gnb, ue := initEnv()
@@ -242,6 +324,10 @@ func TestDecode(t *testing.T) {
 		if gnb.DecodeError != nil {
 			t.Errorf("%s: %v", p.desc, gnb.DecodeError)
 		}
+		if strings.HasSuffix(p.desc, "Security Mode Command") {
+			// the PDU session to be accepted.
+			ue.MakePDUSessionEstablishmentRequest()
+		}
 	}
 
 	gnb, ue = initEnv()
@@ -255,6 +341,10 @@ func TestDecode(t *testing.T) {
 		if gnb.DecodeError != nil {
 			t.Errorf("%s: %v", p.desc, gnb.DecodeError)
 		}
+		if strings.HasSuffix(p.desc, "Security Mode Command") {
+			// the PDU session to be accepted.
+			ue.MakePDUSessionEstablishmentRequest()
+		}
 	}
 
 	gnb, ue = initEnv()
@@ -268,6 +358,127 @@ func TestDecode(t *testing.T) {
 		if gnb.DecodeError != nil {
 			t.Errorf("%s: %v", p.desc, gnb.DecodeError)
 		}
+		if strings.HasSuffix(p.desc, "Security Mode Command") {
+			// the PDU session to be accepted.
+			ue.MakePDUSessionEstablishmentRequest()
+		}
+	}
+
+}
+
+func TestAggregateMaximumBitRate(t *testing.T) {
+
+	gnb, ue := initEnv()
+	for _, msg := range []string{
+		TestOpen5gsNGSetupResponse,
+		TestOpen5gsDLAuthenticationRequest,
+		TestOpen5gsDLSecurityModeCommand,
+		TestOpen5gsInitialContextSetupRequest,
+	} {
+		recvfromNW(gnb, msg)
+		if msg == TestOpen5gsDLSecurityModeCommand {
+			ue.MakePDUSessionEstablishmentRequest()
+		}
 	}
+	recvfromNW(gnb, TestOpen5gsDLPDUSessionEstablishmentAccept)
 
+	// 1 Gbps for both of the UE and the PDU session.
+	c := gnb.LookupCamperByUE(ue)
+	expect := AMBR{DL: 1048576000, UL: 1048576000}
+	if c.UEAMBR != expect {
+		t.Errorf("UE-AMBR expect: %+v, actual: %+v", expect, c.UEAMBR)
+	}
+	if s := c.PDUSession[1]; s == nil || s.AMBR != expect {
+		t.Errorf("PDU session AMBR expect: %+v, actual: %+v", expect, s)
+	}
+
+	gnb, ue = initEnv()
+	recvfromNW(gnb, TestDLAuthenticationRequest)
+	recvfromNW(gnb, TestInitialContextSetupRequest2)
+	c = gnb.LookupCamperByUE(ue)
+	expect = AMBR{DL: 1000000, UL: 1000000}
+	if c.UEAMBR != expect {
+		t.Errorf("UE-AMBR expect: %+v, actual: %+v", expect, c.UEAMBR)
+	}
+}
+
+func TestTransportLayerAddress(t *testing.T) {
+
+	gnb, ue := initEnv()
+	recvfromNW(gnb, TestDLAuthenticationRequest)
+
+	c := gnb.LookupCamperByUE(ue)
+	pdu := []byte{1}
+	gnb.decPDUSessionID(c, &pdu)
+
+	v4 := net.ParseIP("192.168.1.18").To4()
+	v6 := net.ParseIP("2001:db8::18")
+	teid := []byte{0, 0, 0, 100}
+
+	pattern := []struct {
+		local  string
+		length []byte // choice, extension and bit string length.
+		addr   []byte
+		expect net.IP
+	}{
+		{"192.168.1.3", []byte{0x01, 0xf0}, v4, v4},
+		{"2001:db8::3", []byte{0x07, 0xf0}, v6, v6},
+		{"192.168.1.3", []byte{0x09, 0xf0}, append(v4, v6...), v4},
+		{"2001:db8::3", []byte{0x09, 0xf0}, append(v4, v6...), v6},
+	}
+	for _, p := range pattern {
+		gnb.GTPuLocalAddr = p.local
+		in := append(append(p.length, p.addr...), teid...)
+		gnb.decUPTransportLayerInformation(c, &in, len(in))
+		s := c.pduSession
+		if !s.PeerAddr.Equal(p.expect) || s.PeerTEID != 100 {
+			t.Errorf("local %s: expect: %v, actual: %v, TEID %d",
+				p.local, p.expect, s.PeerAddr, s.PeerTEID)
+		}
+	}
+
+	// the IPv6 local address is sent in 128 bits.
+	gnb.GTPuLocalAddr = "2001:db8::3"
+	var pre per.BitField
+	v := gnb.encTransportLayerAddress(&pre)
+	expect := append([]byte{0x3f, 0x80}, net.ParseIP("2001:db8::3")...)
+	if !reflect.DeepEqual(expect, v) {
+		t.Errorf("TransportLayerAddress\nexpect: %x\nactual: %x", expect, v)
+	}
+
+	// the encoded address is decoded to the local address of the family.
+	v4local := net.ParseIP("192.168.1.3").To4()
+	v6local := net.ParseIP("2001:db8::3")
+	encoded := []struct {
+		local, localV6 string
+		length         byte // bit string length - 1.
+		addr           []byte
+		expect         net.IP
+	}{
+		{"192.168.1.3", "", 31, v4local, v4local},
+		{"2001:db8::3", "", 127, v6local, v6local},
+		{"192.168.1.3", "2001:db8::3", 159, append(v4local, v6local...),
+			v4local},
+		{"192.168.1.3", "192.168.1.4", 31, v4local, v4local},
+	}
+	for _, p := range encoded {
+		gnb.GTPuLocalAddr = p.local
+		gnb.GTPuLocalAddrV6 = p.localV6
+		var tla per.BitField
+		tla.Value = gnb.encTransportLayerAddress(&per.BitField{})
+		tla.Len = len(tla.Value) * 8
+		if l := tla.Value[0]<<1 | tla.Value[1]>>7; l != p.length {
+			t.Errorf("local %s %s: length expect: %d, actual: %d",
+				p.local, p.localV6, p.length, l)
+		}
+		if !reflect.DeepEqual(p.addr, tla.Value[2:]) {
+			t.Errorf("local %s %s: address expect: %x, actual: %x",
+				p.local, p.localV6, p.addr, tla.Value[2:])
+		}
+		if addr := gnb.decTransportLayerAddress(&tla); !addr.Equal(p.expect) {
+			t.Errorf("local %s %s: expect: %v, actual: %v",
+				p.local, p.localV6, p.expect, addr)
+		}
+	}
+	gnb.GTPuLocalAddrV6 = ""
 }
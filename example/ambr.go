@@ -0,0 +1,237 @@
+package main
+
+import (
+	"github.com/hhorai/gnbsim/encoding/nas"
+	"github.com/hhorai/gnbsim/encoding/ngap"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AMBR enforcement on the user plane.
+// the UE limits the uplink of each PDU session by the session-AMBR, and the
+// gNB limits the uplink of the UE by the UE-AMBR. the downlink is measured
+// to check if the UPF enforces the AMBRs.
+// see 5.7.2.6 and 5.7.2.7 in TS 23.501.
+
+const (
+	// the bucket size in time, and at least a packet of the maximum size.
+	burstDuration = 100 * time.Millisecond
+	maxPacketBits = 2048 * 8
+
+	// the window of the downlink rate, and the margin allowed for the
+	// peak rate over the AMBR.
+	meterWindow    = time.Second
+	meterTolerance = 0.1
+)
+
+// tokenBucket limits the rate in bits per second. nil has no limit.
+type tokenBucket struct {
+	rate   uint64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate uint64) *tokenBucket {
+	if rate == 0 {
+		return nil
+	}
+	burst := float64(rate) * burstDuration.Seconds()
+	if burst < maxPacketBits {
+		burst = maxPacketBits
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst}
+}
+
+// renew returns the bucket of the rate, which is b if the rate is not
+// changed.
+func (b *tokenBucket) renew(rate uint64) *tokenBucket {
+	if (b == nil && rate == 0) || (b != nil && b.rate == rate) {
+		return b
+	}
+	return newTokenBucket(rate)
+}
+
+func (b *tokenBucket) fill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// allow takes the tokens of the packet from all of the buckets, or nothing
+// if any of them does not have enough tokens.
+func allow(bits int, now time.Time, buckets ...*tokenBucket) bool {
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		b.fill(now)
+		if b.tokens < float64(bits) {
+			return false
+		}
+	}
+	for _, b := range buckets {
+		if b != nil {
+			b.tokens -= float64(bits)
+		}
+	}
+	return true
+}
+
+// ambrPolicer has the uplink token buckets of the UE, which are shared by
+// the encapsulation and the traffic generated by the UE.
+type ambrPolicer struct {
+	mu      sync.Mutex
+	c       *ngap.Camper
+	ue      *tokenBucket
+	session map[uint8]*tokenBucket // keyed by PSI.
+	dropped uint64                 // accessed atomically.
+}
+
+// ueAMBR returns the UE-AMBR enforced by the gNB, which is the sum of the
+// PDU session AMBRs of the PDU sessions up to the UE-AMBR received. the
+// UE-AMBR received is used if any of the PDU session AMBRs is not given.
+// see 5.7.2.6 in TS 23.501.
+func ueAMBR(c *ngap.Camper) (ambr ngap.AMBR) {
+
+	var sum ngap.AMBR
+	for _, r := range c.PDUSession {
+		if r.GTPu == nil || r.GTPu.Closed() {
+			continue
+		}
+		if r.AMBR.DL == 0 || r.AMBR.UL == 0 {
+			return c.UEAMBR
+		}
+		sum.DL += r.AMBR.DL
+		sum.UL += r.AMBR.UL
+	}
+	limit := func(sum, received uint64) uint64 {
+		if sum == 0 || (received != 0 && received < sum) {
+			return received
+		}
+		return sum
+	}
+	ambr.DL = limit(sum.DL, c.UEAMBR.DL)
+	ambr.UL = limit(sum.UL, c.UEAMBR.UL)
+	return
+}
+
+func newAMBRPolicer(c *ngap.Camper) *ambrPolicer {
+	return &ambrPolicer{
+		c:       c,
+		ue:      newTokenBucket(ueAMBR(c).UL),
+		session: map[uint8]*tokenBucket{},
+	}
+}
+
+// allow returns true if the uplink packet of the PDU session conforms to
+// both of the session-AMBR and the UE-AMBR. the buckets are renewed if the
+// session-AMBR or the UE-AMBR is modified, or the PDU sessions of the UE
+// are changed.
+func (p *ambrPolicer) allow(s *nas.PDUSession, n int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b := p.session[s.PSI].renew(s.AMBR.UL)
+	p.session[s.PSI] = b
+	p.ue = p.ue.renew(ueAMBR(p.c).UL)
+	if allow(n*8, time.Now(), b, p.ue) {
+		return true
+	}
+	atomic.AddUint64(&p.dropped, 1)
+	return false
+}
+
+// ambrMeter measures the peak rate of the downlink in the windows for each
+// PDU session and for the UE.
+type ambrMeter struct {
+	mu      sync.Mutex
+	start   time.Time
+	bytes   map[uint8]uint64 // in the current window.
+	peak    map[uint8]uint64 // bits per second.
+	total   uint64
+	peakAll uint64
+}
+
+func newAMBRMeter() *ambrMeter {
+	return &ambrMeter{
+		start: time.Now(),
+		bytes: map[uint8]uint64{},
+		peak:  map[uint8]uint64{},
+	}
+}
+
+func (m *ambrMeter) closeWindow() {
+	bps := func(n uint64) uint64 {
+		return uint64(float64(n*8) / meterWindow.Seconds())
+	}
+	for psi, n := range m.bytes {
+		if r := bps(n); r > m.peak[psi] {
+			m.peak[psi] = r
+		}
+	}
+	if r := bps(m.total); r > m.peakAll {
+		m.peakAll = r
+	}
+	m.bytes = map[uint8]uint64{}
+	m.total = 0
+}
+
+func (m *ambrMeter) add(psi uint8, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(m.start) >= meterWindow {
+		m.closeWindow()
+		m.start = now
+	}
+	m.bytes[psi] += uint64(n)
+	m.total += uint64(n)
+}
+
+func ambrVerdict(peak, ambr uint64) string {
+	switch {
+	case ambr == 0:
+		return "n/a"
+	case float64(peak) <= float64(ambr)*(1+meterTolerance):
+		return "pass"
+	}
+	return "fail"
+}
+
+// report logs the peak rate of the downlink against the AMBRs, and returns
+// false if the UPF does not enforce any of them.
+func (m *ambrMeter) report(c *ngap.Camper, p *ambrPolicer) (pass bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closeWindow()
+	pass = true
+
+	ue := c.UE
+	for _, s := range ue.ActivePDUSessions() {
+		v := ambrVerdict(m.peak[s.PSI], s.AMBR.DL)
+		log.Printf("[AMBR] UE %s PDU session %d: DL peak %d bps, "+
+			"session-AMBR %d bps: %s\n",
+			ue.SUPI, s.PSI, m.peak[s.PSI], s.AMBR.DL, v)
+		pass = pass && v != "fail"
+	}
+	dl := ueAMBR(c).DL
+	v := ambrVerdict(m.peakAll, dl)
+	log.Printf("[AMBR] UE %s: DL peak %d bps, UE-AMBR %d bps: %s\n",
+		ue.SUPI, m.peakAll, dl, v)
+	pass = pass && v != "fail"
+
+	if p != nil {
+		log.Printf("[AMBR] UE %s: %d uplink packets dropped\n",
+			ue.SUPI, atomic.LoadUint64(&p.dropped))
+	}
+	return
+}
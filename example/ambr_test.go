@@ -0,0 +1,126 @@
+package main
+
+import (
+	"github.com/hhorai/gnbsim/encoding/gtp"
+	"github.com/hhorai/gnbsim/encoding/nas"
+	"github.com/hhorai/gnbsim/encoding/ngap"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+
+	if b := newTokenBucket(0); b != nil {
+		t.Errorf("bucket without the rate: %+v", b)
+	}
+	// the burst is of the duration, and at least a packet.
+	for _, tc := range []struct {
+		rate  uint64
+		burst float64
+	}{
+		{1000000, 100000},
+		{1000, maxPacketBits},
+	} {
+		if b := newTokenBucket(tc.rate); b.burst != tc.burst ||
+			b.tokens != tc.burst {
+			t.Errorf("rate %d: burst expect: %v, actual: %v",
+				tc.rate, tc.burst, b.burst)
+		}
+	}
+
+	now := time.Now()
+	b := newTokenBucket(1000000)
+	if !allow(80000, now, b) || allow(80000, now, b) || b.tokens != 20000 {
+		t.Errorf("tokens expect: 20000, actual: %v", b.tokens)
+	}
+	// filled by the rate up to the burst.
+	if !allow(80000, now.Add(60*time.Millisecond), b) {
+		t.Errorf("not filled: %v", b.tokens)
+	}
+	b.fill(now.Add(time.Hour))
+	if b.tokens != b.burst {
+		t.Errorf("tokens expect: %v, actual: %v", b.burst, b.tokens)
+	}
+
+	// the tokens are taken from all of the buckets or from none of them.
+	b = newTokenBucket(1000000)
+	low := newTokenBucket(1000)
+	if allow(20000, now, b, nil, low) || b.tokens != b.burst {
+		t.Errorf("tokens taken from the bucket: %v", b.tokens)
+	}
+	if !allow(8000, now, b, nil, low) || b.tokens != b.burst-8000 ||
+		low.tokens != low.burst-8000 {
+		t.Errorf("tokens not taken: %v, %v", b.tokens, low.tokens)
+	}
+
+	// the bucket is renewed only if the rate is changed.
+	if b.renew(1000000) != b || b.renew(2000000).rate != 2000000 ||
+		b.renew(0) != nil {
+		t.Errorf("bucket is not renewed by the rate")
+	}
+	var none *tokenBucket
+	if none.renew(0) != nil || none.renew(1000).rate != 1000 {
+		t.Errorf("bucket is not created by the rate")
+	}
+}
+
+func TestAMBRVerdict(t *testing.T) {
+
+	for _, tc := range []struct {
+		peak, ambr uint64
+		expect     string
+	}{
+		{1000, 0, "n/a"},
+		{1000, 1000, "pass"},
+		{1100, 1000, "pass"},
+		{1101, 1000, "fail"},
+		{0, 1000, "pass"},
+	} {
+		if v := ambrVerdict(tc.peak, tc.ambr); v != tc.expect {
+			t.Errorf("peak %d, AMBR %d expect: %s, actual: %s",
+				tc.peak, tc.ambr, tc.expect, v)
+		}
+	}
+}
+
+// the bucket of the UE follows the UE-AMBR, which is changed by the PDU
+// sessions established later and by the UE-AMBR modified.
+func TestAMBRPolicerRenew(t *testing.T) {
+
+	session := func(id uint8, ul uint64) *ngap.PDUSession {
+		return &ngap.PDUSession{ID: id, GTPu: gtp.NewGTP(uint32(id), 1),
+			AMBR: ngap.AMBR{DL: ul, UL: ul}}
+	}
+	c := &ngap.Camper{
+		UEAMBR:     ngap.AMBR{DL: 3000000, UL: 3000000},
+		PDUSession: map[uint8]*ngap.PDUSession{1: session(1, 1000000)},
+	}
+	p := newAMBRPolicer(c)
+	s := &nas.PDUSession{PSI: 1, AMBR: nas.SessionAMBR{UL: 1000000}}
+	if p.ue.rate != 1000000 {
+		t.Errorf("UE-AMBR expect: 1000000, actual: %d", p.ue.rate)
+	}
+
+	for _, tc := range []struct {
+		desc   string
+		modify func()
+		ue     uint64
+		s      uint64
+	}{
+		{"PDU session established",
+			func() { c.PDUSession[2] = session(2, 1500000) }, 2500000, 1000000},
+		{"UE-AMBR modified",
+			func() { c.UEAMBR.UL = 2000000 }, 2000000, 1000000},
+		{"session-AMBR modified",
+			func() { s.AMBR.UL = 500000 }, 2000000, 500000},
+		{"PDU session released",
+			func() { c.PDUSession[2].GTPu.Close() }, 1000000, 500000},
+	} {
+		tc.modify()
+		p.allow(s, 100)
+		if p.ue.rate != tc.ue || p.session[s.PSI].rate != tc.s {
+			t.Errorf("%s: UE-AMBR %d, session-AMBR %d expect: %d, %d",
+				tc.desc, p.ue.rate, p.session[s.PSI].rate, tc.ue, tc.s)
+		}
+	}
+}
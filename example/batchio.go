@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/hhorai/gnbsim/encoding/gtp"
+	"golang.org/x/sys/unix"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Batched I/O of the N3 socket for the throughput testing.
+// the messages are read by recvmmsg(2) and written by sendmmsg(2) in the
+// buffers of the pool, so that a system call and no allocation is taken
+// for a batch of the messages.
+
+// mmsghdr is struct mmsghdr of recvmmsg(2), which is padded to the
+// alignment of msghdr.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// mmsgs is the message headers of a batch.
+type mmsgs struct {
+	hdrs  []mmsghdr
+	iovs  []unix.Iovec
+	names []unix.RawSockaddrInet6 // large enough for IPv4.
+}
+
+func (m *mmsgs) reset(n int) {
+	if len(m.hdrs) < n {
+		m.hdrs = make([]mmsghdr, n)
+		m.iovs = make([]unix.Iovec, n)
+		m.names = make([]unix.RawSockaddrInet6, n)
+	}
+	for i := 0; i < n; i++ {
+		h := &m.hdrs[i]
+		h.hdr.Name = (*byte)(unsafe.Pointer(&m.names[i]))
+		h.hdr.Namelen = unix.SizeofSockaddrInet6
+		h.hdr.Iov = &m.iovs[i]
+		h.hdr.SetIovlen(1)
+		h.len = 0
+	}
+}
+
+func (m *mmsgs) setBuffer(i int, b []byte) {
+	m.iovs[i].Base = &b[0]
+	m.iovs[i].SetLen(len(b))
+}
+
+// batchConn reads and writes the N3 socket in batches. the reader and the
+// writer may run concurrently, but each of them is not shared.
+type batchConn struct {
+	conn *net.UDPConn
+	rc   syscall.RawConn
+	v6   bool
+
+	r mmsgs
+	w mmsgs
+
+	// the address of the last message read, which is reused for the
+	// messages from the same UPF.
+	lastName []byte
+	lastAddr *net.UDPAddr
+}
+
+func newBatchConn(conn *net.UDPConn) (c *batchConn, err error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	c = &batchConn{
+		conn: conn,
+		rc:   rc,
+		v6:   conn.LocalAddr().(*net.UDPAddr).IP.To4() == nil,
+	}
+	return
+}
+
+// ReadBatch reads the messages available, at least one of them.
+func (c *batchConn) ReadBatch(msgs []gtp.Message) (n int, err error) {
+
+	c.r.reset(len(msgs))
+	for i := range msgs {
+		c.r.setBuffer(i, msgs[i].Buffer.B)
+	}
+
+	var errno syscall.Errno
+	err = c.rc.Read(func(fd uintptr) bool {
+		var r uintptr
+		r, _, errno = unix.Syscall6(unix.SYS_RECVMMSG, fd,
+			uintptr(unsafe.Pointer(&c.r.hdrs[0])), uintptr(len(msgs)),
+			0, 0, 0)
+		if errno == unix.EAGAIN {
+			return false // wait for the socket to be readable.
+		}
+		n = int(r)
+		return true
+	})
+	if err == nil && errno != 0 {
+		err = os.NewSyscallError("recvmmsg", errno)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < n; i++ {
+		h := &c.r.hdrs[i]
+		msgs[i].Payload = msgs[i].Buffer.B[:h.len]
+		msgs[i].Addr = c.addr(&c.r.names[i], int(h.hdr.Namelen))
+	}
+	return
+}
+
+// addr returns the source address of the message.
+func (c *batchConn) addr(name *unix.RawSockaddrInet6,
+	namelen int) *net.UDPAddr {
+
+	raw := (*[unix.SizeofSockaddrInet6]byte)(unsafe.Pointer(name))[:namelen]
+	if c.lastAddr != nil && bytes.Equal(raw, c.lastName) {
+		return c.lastAddr
+	}
+
+	var addr *net.UDPAddr
+	switch name.Family {
+	case unix.AF_INET:
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(name))
+		addr = &net.UDPAddr{
+			IP:   net.IP(append([]byte{}, sa.Addr[:]...)),
+			Port: int(ntohs(sa.Port)),
+		}
+	case unix.AF_INET6:
+		addr = &net.UDPAddr{
+			IP:   net.IP(append([]byte{}, name.Addr[:]...)),
+			Port: int(ntohs(name.Port)),
+		}
+	default:
+		return nil
+	}
+	c.lastName = append(c.lastName[:0], raw...)
+	c.lastAddr = addr
+	return addr
+}
+
+// WriteBatch writes all of the messages, or returns the number of them
+// written with the error.
+func (c *batchConn) WriteBatch(msgs []gtp.Message) (n int, err error) {
+
+	c.w.reset(len(msgs))
+	for i := range msgs {
+		c.w.setBuffer(i, msgs[i].Payload)
+		c.w.hdrs[i].hdr.Namelen = c.setName(&c.w.names[i], msgs[i].Addr)
+	}
+
+	var errno syscall.Errno
+	err = c.rc.Write(func(fd uintptr) bool {
+		for n < len(msgs) {
+			var r uintptr
+			r, _, errno = unix.Syscall6(unix.SYS_SENDMMSG, fd,
+				uintptr(unsafe.Pointer(&c.w.hdrs[n])), uintptr(len(msgs)-n),
+				0, 0, 0)
+			if errno == unix.EAGAIN {
+				return false // wait for the socket to be writable.
+			}
+			if errno != 0 {
+				return true
+			}
+			n += int(r)
+		}
+		return true
+	})
+	if err == nil && errno != 0 && errno != unix.EAGAIN {
+		err = os.NewSyscallError("sendmmsg", errno)
+	}
+	return
+}
+
+func (c *batchConn) setName(name *unix.RawSockaddrInet6,
+	addr *net.UDPAddr) uint32 {
+
+	if !c.v6 {
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(name))
+		*sa = unix.RawSockaddrInet4{Family: unix.AF_INET}
+		sa.Port = htons(uint16(addr.Port))
+		copy(sa.Addr[:], addr.IP.To4())
+		return unix.SizeofSockaddrInet4
+	}
+	*name = unix.RawSockaddrInet6{Family: unix.AF_INET6}
+	name.Port = htons(uint16(addr.Port))
+	copy(name.Addr[:], addr.IP.To16())
+	return unix.SizeofSockaddrInet6
+}
+
+// the port in the socket address is in the network byte order.
+func htons(v uint16) uint16 {
+	b := (*[2]byte)(unsafe.Pointer(&v))
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+func ntohs(v uint16) uint16 {
+	return htons(v)
+}
+
+// uplinkBatch sends the T-PDUs queued by the encapsulation in batches. the
+// T-PDUs queued while a batch is sent make the next batch.
+type uplinkBatch struct {
+	conn  *batchConn
+	queue chan gtp.Message
+	size  int
+}
+
+func newUplinkBatch(conn *batchConn, size int) *uplinkBatch {
+	return &uplinkBatch{
+		conn:  conn,
+		queue: make(chan gtp.Message, 4*size),
+		size:  size,
+	}
+}
+
+func (u *uplinkBatch) run() {
+
+	msgs := make([]gtp.Message, 0, u.size)
+	for m := range u.queue {
+		msgs = append(msgs[:0], m)
+	fill:
+		for len(msgs) < u.size {
+			select {
+			case m := <-u.queue:
+				msgs = append(msgs, m)
+			default:
+				break fill
+			}
+		}
+
+		u.send(msgs)
+		for i := range msgs {
+			msgs[i].Buffer.Release()
+			msgs[i] = gtp.Message{}
+		}
+	}
+}
+
+// the times to retry the batch for the transient error of the socket.
+const uplinkRetries = 3
+
+// send writes the batch. the transient error, e.g. the socket buffer is
+// full, is retried, and the message failed by the other errors is dropped,
+// so that an error does not stop the uplink of all of the UEs.
+func (u *uplinkBatch) send(msgs []gtp.Message) {
+
+	retry := 0
+	for len(msgs) > 0 {
+		n, err := u.conn.WriteBatch(msgs)
+		msgs = msgs[n:]
+		if err == nil || len(msgs) == 0 {
+			return
+		}
+		if errors.Is(err, net.ErrClosed) {
+			log.Printf("uplink: %d T-PDUs dropped: %v\n", len(msgs), err)
+			return
+		}
+		if (errors.Is(err, syscall.ENOBUFS) ||
+			errors.Is(err, syscall.EAGAIN)) && retry < uplinkRetries {
+			retry++
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		log.Printf("uplink: T-PDU to %v dropped: %v\n", msgs[0].Addr, err)
+		msgs = msgs[1:]
+		retry = 0
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/hhorai/gnbsim/encoding/gtp"
 	"github.com/hhorai/gnbsim/encoding/nas"
@@ -11,14 +12,27 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"sync"
 	"time"
 )
 
 type testSession struct {
 	conn *sctp.SCTPConn
 	info *sctp.SndRcvInfo
+	amf  chan amfMessage // the messages read from the AMF.
 	gnb  *ngap.GNB
 	//gtpu *gtp.GTP
+
+	paths  map[string]*gtp.Path // GTP-U paths keyed by the UPF address.
+	n3     *gtp.Dispatcher      // the N3 socket shared by all of the UEs.
+	planes []*userPlane
+
+	mu   sync.Mutex
+	lost map[*ngap.Camper]bool // the UEs of which the UPF lost a tunnel.
+
+	batch  *batchConn   // the N3 socket in batches, if configured.
+	uplink *uplinkBatch // the uplink T-PDUs sent in batches.
 }
 
 func newTest() (t *testSession) {
@@ -33,6 +47,20 @@ func validate(gnb *ngap.GNB) {
 	if gnb.GTPuLocalAddr == "" {
 		log.Fatalf("`GTPuLocalAddr' not found in configuration file.")
 	}
+	if net.ParseIP(gnb.GTPuLocalAddr) == nil {
+		log.Fatalf("`GTPuLocalAddr' is not an IPv4 or IPv6 address.")
+	}
+	if v6 := gnb.GTPuLocalAddrV6; v6 != "" {
+		if net.ParseIP(gnb.GTPuLocalAddr).To4() == nil {
+			log.Fatalf("`GTPuLocalAddrV6' is given with IPv6 `GTPuLocalAddr'.")
+		}
+		if ip := net.ParseIP(v6); ip == nil || ip.To4() != nil {
+			log.Fatalf("`GTPuLocalAddrV6' is not an IPv6 address.")
+		}
+	}
+	if gnb.UserspaceStack && gnb.UPlaneNetns != nil {
+		log.Fatalf("`UserspaceStack' and `UPlaneNetns' are exclusive.")
+	}
 	return
 }
 
@@ -83,31 +111,75 @@ func (t *testSession) recvfromAMF(timeout time.Duration) {
 		timeout = defaultTimer
 	}
 
-	c := make(chan bool, 1)
-	go func() {
+	select {
+	case m := <-t.amf:
+		t.decodeAMF(m)
+	case <-time.After(timeout * time.Second):
+		log.Printf("read: timeout")
+	}
+	return
+}
+
+// the messages from the AMF read ahead of the procedures.
+const amfQueueLen = 16
+
+// amfMessage is the message read from the AMF.
+type amfMessage struct {
+	buf  []byte
+	info *sctp.SndRcvInfo
+}
+
+// readAMF reads the messages from the AMF into the channel. it is the only
+// reader of the association, so that no message is taken by the wait which
+// has already given up, and the messages are decoded by the waits.
+func (t *testSession) readAMF() {
+	for {
 		buf := make([]byte, 1500)
 		n, info, err := t.conn.SCTPRead(buf)
-		t.info = info
-
 		if err != nil {
 			log.Fatalf("failed to read: %v", err)
 		}
-		log.Printf("read: len %d, info: %+v", n, t.info)
-
-		buf = buf[:n]
-		fmt.Printf("dump: %x\n", buf)
-		t.gnb.Decode(&buf)
-		c <- true
-	}()
-	select {
-	case <-c:
-		break
-	case <-time.After(timeout * time.Second):
-		log.Printf("read: timeout")
+		t.amf <- amfMessage{buf: buf[:n], info: info}
 	}
+}
+
+func (t *testSession) decodeAMF(m amfMessage) {
+
+	t.info = m.info
+	log.Printf("read: len %d, info: %+v", len(m.buf), t.info)
+
+	fmt.Printf("dump: %x\n", m.buf)
+	t.gnb.Decode(&m.buf)
 	return
 }
 
+// waitAMF waits for the message from the AMF in the procedure of the UE
+// guarded by the 5GMM timer. the NAS message is retransmitted on the expiry
+// of the timer, and false is returned if the procedure is aborted.
+func (t *testSession) waitAMF(ue *nas.UE) bool {
+
+	gnb := t.gnb
+
+	for {
+		select {
+		case m := <-t.amf:
+			t.decodeAMF(m)
+			return true
+		case ev := <-ue.TimerEvent():
+			action, pdu := ue.HandleTimerExpiry(ev)
+			switch action {
+			case nas.TimerActionRetransmit:
+				gnb.RecvfromUE(ue, &pdu)
+				buf := gnb.MakeUplinkNASTransport(ue)
+				t.sendtoAMF(buf)
+			case nas.TimerActionAbort:
+				log.Printf("the procedure is aborted.")
+				return false
+			}
+		}
+	}
+}
+
 func initRAN() (t *testSession) {
 
 	t = new(testSession)
@@ -120,6 +192,8 @@ func initRAN() (t *testSession) {
 	t.gnb = gnb
 	t.conn = conn
 	t.info = info
+	t.amf = make(chan amfMessage, amfQueueLen)
+	go t.readAMF()
 
 	pdu := gnb.MakeNGSetupRequest()
 	t.sendtoAMF(pdu)
@@ -155,32 +229,81 @@ func (t *testSession) registrteAll() {
 	gnb := t.gnb
 	for _, c := range gnb.Camper {
 		ue := c.UE
-		t.registrateUE(ue)
+		if !t.registrateUE(ue) {
+			log.Printf("UE %s: not registered.", ue.SUPI)
+		}
+	}
+}
+
+// registrateUE returns true if the UE is registered. the registration is
+// attempted again on the expiry of T3511, T3502 or T3346 after it fails.
+func (t *testSession) registrateUE(ue *nas.UE) bool {
+
+	t.waitBackoff(ue)
+	for {
+		if ue.USIMInvalid || ue.ServicesNotAllowed {
+			log.Printf("5GS services are not allowed for the UE.")
+			return false
+		}
+		if t.attemptRegistration(ue) {
+			return true
+		}
+		if !t.waitBackoff(ue) {
+			return false
+		}
+	}
+}
+
+// waitBackoff waits for the timer which allows the UE to attempt the
+// registration again, and returns false if no such timer is running.
+func (t *testSession) waitBackoff(ue *nas.UE) bool {
+
+	for ue.TimerRunning(nas.TimerT3511) || ue.TimerRunning(nas.TimerT3502) ||
+		ue.TimerRunning(nas.TimerT3346) {
+		log.Printf("wait %s before the registration.", ue.Backoff())
+		action, _ := ue.HandleTimerExpiry(<-ue.TimerEvent())
+		if action == nas.TimerActionRegister {
+			return true
+		}
 	}
+	return false
+}
+
+// waitRegistration waits for the message from the AMF in the registration,
+// and returns false if the registration is aborted or rejected.
+func (t *testSession) waitRegistration(ue *nas.UE) bool {
+	return t.waitAMF(ue) && ue.MMstate != nas.MMDeregistared
 }
 
-func (t *testSession) registrateUE(ue *nas.UE) {
+func (t *testSession) attemptRegistration(ue *nas.UE) bool {
 
 	gnb := t.gnb
 
+	// the registration is guarded by T3510 until the Registration Accept.
 	pdu := ue.MakeRegistrationRequest()
 	gnb.RecvfromUE(ue, &pdu)
 
 	buf := gnb.MakeInitialUEMessage(ue)
 	t.sendtoAMF(buf)
-	t.recvfromAMF(0)
+	if !t.waitRegistration(ue) {
+		return false
+	}
 
 	pdu = ue.MakeAuthenticationResponse()
 	gnb.RecvfromUE(ue, &pdu)
 	buf = gnb.MakeUplinkNASTransport(ue)
 	t.sendtoAMF(buf)
-	t.recvfromAMF(0)
+	if !t.waitRegistration(ue) {
+		return false
+	}
 
 	pdu = ue.MakeSecurityModeComplete()
 	gnb.RecvfromUE(ue, &pdu)
 	buf = gnb.MakeUplinkNASTransport(ue)
 	t.sendtoAMF(buf)
-	t.recvfromAMF(0)
+	if !t.waitRegistration(ue) {
+		return false
+	}
 
 	buf = gnb.MakeInitialContextSetupResponse(ue)
 	t.sendtoAMF(buf)
@@ -192,7 +315,26 @@ func (t *testSession) registrateUE(ue *nas.UE) {
 
 	// for Configuration Update Command from open5gs AMF.
 	t.recvfromAMF(3)
+	t.handleDownlinkNAS(ue)
+
+	return ue.MMstate == nas.MMRegistered
+}
+
+// handleDownlinkNAS answers the procedure initiated by the network in the
+// NAS message received for the UE.
+func (t *testSession) handleDownlinkNAS(ue *nas.UE) {
 
+	gnb := t.gnb
+
+	switch {
+	case ue.NeedConfigurationUpdateComplete():
+		pdu := ue.MakeConfigurationUpdateComplete()
+		gnb.RecvfromUE(ue, &pdu)
+		buf := gnb.MakeUplinkNASTransport(ue)
+		t.sendtoAMF(buf)
+	case ue.DeregistrationRequested():
+		t.acceptDeregistration(ue)
+	}
 	return
 }
 
@@ -200,6 +342,9 @@ func (t *testSession) deregistrateAll() {
 	gnb := t.gnb
 	for _, c := range gnb.Camper {
 		ue := c.UE
+		if ue.MMstate == nas.MMDeregistared {
+			continue // de-registered by the network.
+		}
 		t.deregistrateUE(ue)
 	}
 }
@@ -208,11 +353,90 @@ func (t *testSession) deregistrateUE(ue *nas.UE) {
 
 	gnb := t.gnb
 
+	// the De-registration Accept is waited for under T3521, or only the
+	// UE context is released at switch off.
 	pdu := ue.MakeDeregistrationRequest()
 	gnb.RecvfromUE(ue, &pdu)
 	buf := gnb.MakeUplinkNASTransport(ue)
 	t.sendtoAMF(buf)
+	if ue.SwitchOff {
+		t.recvfromAMF(0)
+		return
+	}
+	t.waitAMF(ue)
+
+	return
+}
+
+// network initiated de-registration. the UE registers again if the network
+// requires the re-registration and AutoReRegistration is configured.
+func (t *testSession) acceptDeregistration(ue *nas.UE) {
+
+	gnb := t.gnb
+
+	pdu := ue.MakeDeregistrationAccept()
+	gnb.RecvfromUE(ue, &pdu)
+	buf := gnb.MakeUplinkNASTransport(ue)
+	t.sendtoAMF(buf)
+
+	// UE Context Release Command
 	t.recvfromAMF(0)
+	buf = gnb.MakeUEContextReleaseComplete(ue)
+	t.sendtoAMF(buf)
+
+	if ue.NeedReRegistration() {
+		t.registrateUE(ue)
+	}
+
+	return
+}
+
+// idleResumeAll releases the UE contexts and brings the UEs back to
+// CM-CONNECTED by the service request, if configured.
+func (t *testSession) idleResumeAll() {
+	for _, c := range t.gnb.Camper {
+		ue := c.UE
+		if !ue.IdleResume || ue.MMstate != nas.MMRegistered {
+			continue
+		}
+		t.releaseUEContext(ue)
+		log.Printf("UE %s: %s\n", ue.SUPI, nas.CMstateStr[ue.CMstate])
+
+		t.serviceRequest(ue, nas.ServiceTypeData)
+		log.Printf("UE %s: %s\n", ue.SUPI, nas.CMstateStr[ue.CMstate])
+	}
+}
+
+func (t *testSession) releaseUEContext(ue *nas.UE) {
+
+	gnb := t.gnb
+
+	buf := gnb.MakeUEContextReleaseRequest(ue)
+	t.sendtoAMF(buf)
+	t.recvfromAMF(0)
+
+	buf = gnb.MakeUEContextReleaseComplete(ue)
+	t.sendtoAMF(buf)
+
+	return
+}
+
+func (t *testSession) serviceRequest(ue *nas.UE, serviceType uint8) {
+
+	gnb := t.gnb
+
+	// the service request is guarded by T3517.
+	pdu := ue.MakeServiceRequest(serviceType)
+	gnb.RecvfromUE(ue, &pdu)
+
+	buf := gnb.MakeInitialUEMessage(ue)
+	t.sendtoAMF(buf)
+	if !t.waitAMF(ue) {
+		return
+	}
+
+	buf = gnb.MakeInitialContextSetupResponse(ue)
+	t.sendtoAMF(buf)
 
 	return
 }
@@ -221,6 +445,9 @@ func (t *testSession) establishPDUSessionAll() {
 	gnb := t.gnb
 	for _, c := range gnb.Camper {
 		ue := c.UE
+		if ue.MMstate != nas.MMRegistered {
+			continue // not registered.
+		}
 		t.establishPDUSession(ue)
 	}
 }
@@ -229,14 +456,33 @@ func (t *testSession) establishPDUSession(ue *nas.UE) {
 
 	gnb := t.gnb
 
-	pdu := ue.MakePDUSessionEstablishmentRequest()
-	gnb.RecvfromUE(ue, &pdu)
-	buf := gnb.MakeUplinkNASTransport(ue)
-	t.sendtoAMF(buf)
-	t.recvfromAMF(0)
+	params := ue.PDUSessions
+	if len(params) == 0 {
+		params = []nas.PDUSessionParam{
+			{DNN: ue.DNN, Type: ue.PDUSessionType},
+		}
+	}
 
-	buf = gnb.MakePDUSessionResourceSetupResponse(ue)
-	t.sendtoAMF(buf)
+	for _, p := range params {
+		pdu, psi := ue.MakePDUSessionEstablishmentRequestFor(p)
+		if psi == 0 {
+			log.Printf("no more PDU session can be established.")
+			return
+		}
+		gnb.RecvfromUE(ue, &pdu)
+		buf := gnb.MakeUplinkNASTransport(ue)
+		t.sendtoAMF(buf)
+		t.recvfromAMF(0)
+
+		// the network may de-register the UE instead.
+		if ue.DeregistrationRequested() {
+			t.handleDownlinkNAS(ue)
+			return
+		}
+
+		buf = gnb.MakePDUSessionResourceSetupResponse(ue)
+		t.sendtoAMF(buf)
+	}
 
 	return
 }
@@ -246,26 +492,44 @@ func (t *testSession) setupN3Tunnel() (gtpConn *net.UDPConn, tun *netlink.Tuntap
 	gnb := t.gnb
 	log.Printf("GTP-U interface name: %s\n", gnb.GTPuIFname)
 	log.Printf("GTP-U local addr: %v\n", gnb.GTPuLocalAddr)
-	log.Printf("GTP-U peer addr : %v\n", gnb.Recv.GTPuPeerAddr)
 
 	laddr := &net.UDPAddr{
 		IP:   net.ParseIP(gnb.GTPuLocalAddr),
 		Port: gtp.Port,
 	}
 
-	gtpConn, err := net.ListenUDP("udp", laddr)
+	// the N3 socket is IPv4 or IPv6 by the local address, and is read only
+	// by the dispatcher.
+	n3, err := gtp.Listen(laddr)
 	if err != nil {
 		log.Fatalln(err)
 		return
 	}
+	t.n3 = n3
+	gtpConn = n3.Conn
 
-	tun, err = addTunnel("gtp-gnb")
+	if gnb.UPlaneBatch > 1 {
+		if t.batch, err = newBatchConn(gtpConn); err != nil {
+			log.Fatalln(err)
+			return
+		}
+		t.uplink = newUplinkBatch(t.batch, gnb.UPlaneBatch)
+		go t.uplink.run()
+	}
+
+	// the TUN device is created in the network namespace of each UE, or
+	// not at all in the userspace stack.
+	if gnb.UPlaneNetns != nil || gnb.UserspaceStack {
+		return
+	}
+
+	tun, err = addTunnel("gtp-gnb", gnb.UPlaneQueues)
 	if err != nil {
 		log.Fatalln(err)
 		return
 	}
 
-	if err = addRoute(tun); err != nil {
+	if err = addRoute(tun, routeTableID); err != nil {
 		log.Fatalf("failed to addRoute: %v", err)
 		return
 	}
@@ -273,7 +537,9 @@ func (t *testSession) setupN3Tunnel() (gtpConn *net.UDPConn, tun *netlink.Tuntap
 	return
 }
 
-func addTunnel(tunname string) (tun *netlink.Tuntap, err error) {
+// addTunnel adds the TUN device having the queues, each of which is read
+// and written by its own file.
+func addTunnel(tunname string, queues int) (tun *netlink.Tuntap, err error) {
 
 	link, _ := netlink.LinkByName(tunname)
 	if link != nil {
@@ -286,6 +552,10 @@ func addTunnel(tunname string) (tun *netlink.Tuntap, err error) {
 		Flags:     netlink.TUNTAP_DEFAULTS | netlink.TUNTAP_NO_PI,
 		Queues:    1,
 	}
+	if queues > 1 {
+		tun.Flags = netlink.TUNTAP_MULTI_QUEUE_DEFAULTS
+		tun.Queues = queues
+	}
 
 	if err = netlink.LinkAdd(tun); err != nil {
 		err = fmt.Errorf("failed to ADD tun device=gtp0: %s", err)
@@ -300,63 +570,274 @@ func addTunnel(tunname string) (tun *netlink.Tuntap, err error) {
 
 const routeTableID = 1001
 
-func addRoute(tun *netlink.Tuntap) (err error) {
+// addRoute adds the default routes through the TUN device to the table, or
+// to the main table if the table is 0.
+func addRoute(tun *netlink.Tuntap, table int) (err error) {
+
+	// default routes for IPv4 and IPv6.
+	for _, dst := range []*net.IPNet{
+		{IP: net.IPv4zero, Mask: net.CIDRMask(0, 8*net.IPv4len)},
+		{IP: net.IPv6zero, Mask: net.CIDRMask(0, 8*net.IPv6len)},
+	} {
+		route := &netlink.Route{
+			Dst:       dst,
+			LinkIndex: tun.Attrs().Index,  // dev gtp-<ECI>
+			Scope:     netlink.SCOPE_LINK, // scope link
+			Protocol:  4,                  // proto static
+			Priority:  1,                  // metric 1
+			Table:     table,              // table <ECI>
+		}
 
-	route := &netlink.Route{
-		Dst: &net.IPNet{
-			IP:   net.IPv4zero,
-			Mask: net.CIDRMask(0, 32),
-		}, // default route
-		LinkIndex: tun.Attrs().Index,  // dev gtp-<ECI>
-		Scope:     netlink.SCOPE_LINK, // scope link
-		Protocol:  4,                  // proto static
-		Priority:  1,                  // metric 1
-		Table:     routeTableID,       // table <ECI>
+		if err = netlink.RouteReplace(route); err != nil {
+			return
+		}
 	}
-
-	err = netlink.RouteReplace(route)
 	return
 }
 
 func (t *testSession) runUPlaneAll(
 	ctx context.Context, gtpConn *net.UDPConn, tun *netlink.Tuntap) {
 
+	// the T-PDUs are dispatched to the UEs by the TEID. all of the tunnels
+	// are registered before the dispatcher starts, or the packets to the
+	// UEs not yet registered are answered with the Error Indication.
+	t.n3.Handler = gtp.Handler{
+		EchoResponse:    t.handleEchoResponse,
+		ErrorIndication: t.handleErrorIndication,
+		EndMarker:       t.handleEndMarker,
+	}
+	planes := []*userPlane{}
 	for _, c := range t.gnb.Camper {
-		t.runUPlane(ctx, c, gtpConn, tun)
+		if p := t.newUserPlane(c); p != nil {
+			planes = append(planes, p)
+		}
+	}
+	t.planes = planes
+	go func() {
+		var err error
+		if t.batch != nil {
+			err = t.n3.ServeBatch(t.batch, t.gnb.UPlaneBatch)
+		} else {
+			err = t.n3.Serve()
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}()
+
+	// the router advertisements are read from the queue of the UE before
+	// the decapsulation starts.
+	for _, p := range planes {
+		t.setupUEAddress(p, gtpConn)
+	}
+	t.startPathProbe(ctx, gtpConn)
+	for _, p := range planes {
+		t.startUPlane(p, tun)
+	}
+	if tun != nil {
+		go t.encap(planes, gtpConn, tun)
 	}
+
+	for _, p := range planes {
+		t.runUPlane(ctx, p)
+	}
+	t.reportPaths()
 	return
 }
 
-func (t *testSession) runUPlane(ctx context.Context, c *ngap.Camper,
-	gtpConn *net.UDPConn, tun *netlink.Tuntap) {
+func (t *testSession) setupUEAddress(p *userPlane, gtpConn *net.UDPConn) {
 
 	gnb := t.gnb
+	c := p.c
 	ue := c.UE
-	c.GTPu = gtp.NewGTP(gnb.GTPuTEID, gnb.Recv.GTPuPeerTEID)
-	gtpu := c.GTPu
-	gtpu.SetExtensionHeader(true)
-	gtpu.SetQosFlowID(c.QosFlowID)
 
-	log.Printf("GTP-U Peer TEID: %v\n", gnb.Recv.GTPuPeerTEID)
-	log.Printf("GTP-U Local TEID: %v\n", gnb.GTPuTEID)
-	log.Printf("QoS Flow ID: %d\n", gtpu.QosFlowID)
+	for _, s := range ue.ActivePDUSessions() {
+		gtpu := c.PDUSession[s.PSI].GTPu
+		gtpu.SetExtensionHeader(true)
+
+		log.Printf("PDU session %d: DNN: %s\n", s.PSI, s.DNN)
+		log.Printf("GTP-U Peer addr: %v\n", gtpu.PeerAddr)
+		log.Printf("GTP-U Peer TEID: %v\n", gtpu.PeerTEID)
+		log.Printf("GTP-U Local TEID: %v\n", gtpu.LocalTEID)
+		log.Printf("QoS Flow ID: %d\n", gtpu.QosFlowID)
+
+		// the UPF is reached only in the family of the N3 socket.
+		local := net.ParseIP(gnb.GTPuLocalAddr)
+		if (gtpu.PeerAddr.To4() == nil) != (local.To4() == nil) {
+			log.Fatalf("GTP-U peer addr %v is not of the family of %v",
+				gtpu.PeerAddr, local)
+			return
+		}
 
-	log.Printf("UE address: %v\n", ue.Recv.PDUAddress)
-	err := addIP(gnb.GTPuIFname, ue.Recv.PDUAddress, 28)
-	if err != nil {
-		log.Fatalf("failed to addIP: %v", err)
-		return
+		addrs := []net.IP{}
+		if s.Address != nil {
+			addrs = append(addrs, s.Address)
+		}
+		if s.InterfaceID != nil {
+			prefix, err := solicitRouter(gtpConn, gtpu, s, p.queue)
+			if err != nil {
+				log.Fatalf("failed to get IPv6 prefix: %v", err)
+				return
+			}
+			if err = s.SetIPv6Prefix(prefix); err != nil {
+				log.Fatalf("failed to configure IPv6 address: %v", err)
+				return
+			}
+			addrs = append(addrs, s.AddressV6)
+		}
+
+		// the addresses are configured in the network namespace, or
+		// only used in the userspace stack.
+		if gnb.UPlaneNetns != nil || gnb.UserspaceStack {
+			continue
+		}
+		for _, addr := range addrs {
+			log.Printf("UE address: %v\n", addr)
+			masklen := 28
+			if addr.To4() == nil {
+				masklen = 128
+			}
+			err := addIP(gnb.GTPuIFname, addr, masklen)
+			if err != nil {
+				log.Fatalf("failed to addIP: %v", err)
+				return
+			}
+
+			err = addRuleLocal(addr)
+			if err != nil {
+				log.Fatalf("failed to addRuleLocal: %v", err)
+				return
+			}
+		}
 	}
+	return
+}
 
-	err = addRuleLocal(ue.Recv.PDUAddress)
-	if err != nil {
-		log.Fatalf("failed to addRuleLocal: %v", err)
+// the T-PDUs queued for each UE.
+const ueQueueLen = 256
+
+// userPlane is the user plane of the UE. the downlink is dispatched to the
+// queue of the UE.
+type userPlane struct {
+	c       *ngap.Camper
+	queue   chan gtp.Packet
+	meter   *ambrMeter
+	policer *ambrPolicer
+	monitor *qosMonitor
+
+	link     map[uint8]*netlink.Tuntap // keyed by PSI.
+	netns    map[uint8]*ueNetns        // keyed by PSI, if configured.
+	tunnels  map[*gtp.GTP]tunnelSession
+	downlink map[*gtp.GTP]*downlinkPath // used by the decapsulation only.
+
+	trafficMu sync.RWMutex
+	flows     []*trafficFlow // the traffic generated by the UE.
+}
+
+// tunnelSession is the PDU session of the tunnel registered to the
+// dispatcher, so that the packets are not looked up in the PDU sessions.
+type tunnelSession struct {
+	s *nas.PDUSession
+	r *ngap.PDUSession
+}
+
+// newUserPlane registers the tunnels of the UE to the dispatcher. the queue
+// of the UE is read for the address configuration until the user plane
+// starts.
+func (t *testSession) newUserPlane(c *ngap.Camper) (p *userPlane) {
+
+	sessions := c.UE.ActivePDUSessions()
+	if len(sessions) == 0 {
+		log.Printf("no active PDU session.")
 		return
 	}
 
-	go t.decap(c, gtpConn, tun)
-	go t.encap(c, gtpConn, tun)
-	t.doUPlane(ctx, c)
+	p = &userPlane{
+		c:        c,
+		queue:    make(chan gtp.Packet, ueQueueLen),
+		meter:    newAMBRMeter(),
+		policer:  newAMBRPolicer(c),
+		monitor:  newQoSMonitor(),
+		link:     map[uint8]*netlink.Tuntap{},
+		netns:    map[uint8]*ueNetns{},
+		tunnels:  map[*gtp.GTP]tunnelSession{},
+		downlink: map[*gtp.GTP]*downlinkPath{},
+	}
+	for _, s := range sessions {
+		r := c.PDUSession[s.PSI]
+		if r == nil || r.GTPu == nil {
+			continue
+		}
+		if err := t.n3.Register(r.GTPu, p.queue); err != nil {
+			log.Printf("PDU session %d: %v\n", s.PSI, err)
+			continue
+		}
+		p.tunnels[r.GTPu] = tunnelSession{s, r}
+	}
+	return
+}
+
+// startUPlane starts the decapsulation for the UE. the encapsulation is
+// also started for the TUN devices in the network namespaces of the UE.
+func (t *testSession) startUPlane(p *userPlane, tun *netlink.Tuntap) {
+
+	sessions := p.c.UE.ActivePDUSessions()
+	if conf := t.gnb.UPlaneNetns; conf != nil {
+		if err := p.setupNetns(conf, sessions); err != nil {
+			log.Fatalf("failed to set up netns: %v", err)
+			return
+		}
+	} else {
+		for _, s := range sessions {
+			p.link[s.PSI] = tun
+		}
+	}
+	go t.decap(p)
+	if t.gnb.UPlaneNetns != nil {
+		started := map[*netlink.Tuntap]bool{}
+		for _, link := range p.link {
+			if !started[link] {
+				go t.encap([]*userPlane{p}, t.n3.Conn, link)
+				started[link] = true
+			}
+		}
+	}
+	return
+}
+
+// stopUPlane deletes the network namespaces of the UEs.
+func (t *testSession) stopUPlane() {
+	for _, p := range t.planes {
+		deleted := map[*ueNetns]bool{}
+		for _, n := range p.netns {
+			if !deleted[n] {
+				n.delete()
+				deleted[n] = true
+			}
+		}
+	}
+	return
+}
+
+func (t *testSession) runUPlane(ctx context.Context, p *userPlane) {
+
+	c := p.c
+	ue := c.UE
+
+	for _, s := range ue.ActivePDUSessions() {
+		if s.Address != nil && ue.URL != "" {
+			t.doUPlane(ctx, c, s.Address, ue.URL, t.dialer(p, s, s.Address))
+		}
+		if s.AddressV6 != nil && ue.URLv6 != "" {
+			t.doUPlane(ctx, c, s.AddressV6, ue.URLv6,
+				t.dialer(p, s, s.AddressV6))
+		}
+	}
+	if len(t.gnb.Traffic) != 0 {
+		t.runTraffic(ctx, p)
+	}
+	p.meter.report(c, p.policer)
+	p.monitor.logDelay(c)
 
 	/*
 		select {
@@ -379,9 +860,13 @@ func addIP(ifname string, ip net.IP, masklen int) (err error) {
 		return err
 	}
 
+	bits := 8 * net.IPv4len
+	if ip.To4() == nil {
+		bits = 8 * net.IPv6len
+	}
 	netToAdd := &net.IPNet{
 		IP:   ip,
-		Mask: net.CIDRMask(masklen, 32),
+		Mask: net.CIDRMask(masklen, bits),
 	}
 
 	var addr netlink.Addr
@@ -405,6 +890,9 @@ func addIP(ifname string, ip net.IP, masklen int) (err error) {
 	}
 
 	addr.IPNet = netToAdd
+	if bits != 8*net.IPv4len {
+		addr.Label = "" // labels are for IPv4 addresses only.
+	}
 	if err := netlink.AddrAdd(link, &addr); err != nil {
 		return err
 	}
@@ -419,9 +907,13 @@ func addRuleLocal(ip net.IP) (err error) {
 		return err
 	}
 
+	bits := 8 * net.IPv4len
+	if ip.To4() == nil {
+		bits = 8 * net.IPv6len
+	}
 	mask32 := &net.IPNet{
 		IP:   ip,
-		Mask: net.CIDRMask(32, 32),
+		Mask: net.CIDRMask(bits, bits),
 	}
 
 	for _, r := range rules {
@@ -438,70 +930,299 @@ func addRuleLocal(ip net.IP) (err error) {
 	return
 }
 
-func (t *testSession) decap(c *ngap.Camper, gtpConn *net.UDPConn, tun *netlink.Tuntap) {
+func (t *testSession) decap(p *userPlane) {
+
+	var dl gtp.DLPduSessionInformation
+	for pkt := range p.queue {
+		s, r := p.tunnelSession(pkt.Tunnel)
+		if r == nil {
+			pkt.Release()
+			continue
+		}
+		if p.holdDownlink(pkt, r.GTPu) {
+			continue
+		}
+		if pkt.Header.MessageType != gtp.MessageTypeEndMarker {
+			p.deliver(pkt, s, r, &dl)
+			continue
+		}
+		// the downlink held follows the last packet of the old path.
+		for _, held := range p.switchPath(pkt.Tunnel, r.GTPu) {
+			p.deliver(held, s, r, &dl)
+		}
+	}
+}
+
+// deliver hands the downlink packet to the traffic of the UE or to the TUN
+// device, and releases the packet.
+func (p *userPlane) deliver(pkt gtp.Packet, s *nas.PDUSession,
+	r *ngap.PDUSession, dl *gtp.DLPduSessionInformation) {
+
+	payload := pkt.Payload
+	var info *gtp.DLPduSessionInformation
+	if pkt.Header.DecodeDLPduSessionInformation(dl) {
+		info = dl
+	}
+
+	// the gNB indicates the RQI to the UE, and the UE derives the
+	// QoS rule for the uplink of the reflected traffic.
+	if info != nil && info.RQI &&
+		s.ReflectDownlink(payload, info.QosFlowID) {
+		log.Printf("PDU session %d: UE-derived QoS rule for QFI %d\n",
+			s.PSI, info.QosFlowID)
+	}
+	p.meter.add(s.PSI, len(payload))
+	p.monitor.receive(s.PSI, info, time.Now())
+	//fmt.Printf("decap: %x\n", payload)
+
+	// the packets of the traffic generated by the UE do not go to
+	// the TUN device, and the buffer is released by the flow.
+	if p.deliverTraffic(pkt, info) {
+		return
+	}
+	link := p.link[s.PSI]
+	if link == nil {
+		pkt.Release()
+		return
+	}
+	// the queue of the TUN device is chosen by the tunnel, so that
+	// the packets of a PDU session are kept in order.
+	fd := link.Fds[int(r.LocalTEID%uint32(len(link.Fds)))]
+	_, err := fd.Write(payload)
+	pkt.Release()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return
+}
+
+// encap reads the uplink of all of the UEs from the TUN device, and sends
+// it in the tunnel of the PDU session having the source address. each of
+// the queues of the TUN device is read by its own goroutine.
+func (t *testSession) encap(planes []*userPlane, gtpConn *net.UDPConn,
+	tun *netlink.Tuntap) {
+
+	byAddr := map[string]*userPlane{}
+	for _, p := range planes {
+		for _, s := range p.c.UE.ActivePDUSessions() {
+			for _, addr := range []net.IP{s.Address, s.AddressV6,
+				s.LinkLocalAddress()} {
+				if addr != nil {
+					byAddr[string(addr.To16())] = p
+				}
+			}
+		}
+	}
+
+	for _, fd := range tun.Fds[1:] {
+		go t.encapQueue(byAddr, gtpConn, tun, fd)
+	}
+	t.encapQueue(byAddr, gtpConn, tun, tun.Fds[0])
+	return
+}
 
-	fd := tun.Fds[0]
+// encapQueue reads the packets from the queue of the TUN device into the
+// buffers from the pool, and encapsulates them in place.
+func (t *testSession) encapQueue(byAddr map[string]*userPlane,
+	gtpConn *net.UDPConn, tun *netlink.Tuntap, fd *os.File) {
 
-	buf := make([]byte, 2048)
+	peers := map[*gtp.GTP]*net.UDPAddr{}
+	buf := gtp.NewBuffer()
 	for {
-		n, _, err := gtpConn.ReadFromUDP(buf)
+		n, err := fd.Read(buf.B[gtp.HeaderRoom:])
 		if err != nil {
 			log.Fatalln(err)
 			return
 		}
-		payload := c.GTPu.Decap(buf[:n])
-		//fmt.Printf("decap: %x\n", payload)
-
-		_, err = fd.Write(payload)
-		if err != nil {
+		pkt := buf.B[gtp.HeaderRoom : gtp.HeaderRoom+n]
+		addr := srcAddr(pkt)
+		p := byAddr[string(addr.To16())]
+		if p == nil {
+			continue
+		}
+		s, r := p.lookupPDUSession(addr, tun)
+		if r == nil {
+			continue
+		}
+		payload, _, err := p.encapUplink(s, r, buf.B[:gtp.HeaderRoom+n])
+		if err == errPoliced || err == errTunnelClosed {
+			continue
+		}
+		paddr := peerAddr(peers, r.GTPu)
+
+		// the buffer is handed over to the batch, and released after
+		// it is sent.
+		if t.uplink != nil {
+			t.uplink.queue <- gtp.Message{
+				Buffer:  buf,
+				Payload: payload,
+				Addr:    paddr,
+			}
+			buf = gtp.NewBuffer()
+			continue
+		}
+		if _, err = gtpConn.WriteToUDP(payload, paddr); err != nil {
 			log.Fatalln(err)
 			return
 		}
 	}
 }
 
-func (t *testSession) encap(c *ngap.Camper, gtpConn *net.UDPConn, tun *netlink.Tuntap) {
+// peerAddr returns the address of the UPF of the tunnel, which is cached
+// not to be allocated for each packet.
+func peerAddr(peers map[*gtp.GTP]*net.UDPAddr,
+	gtpu *gtp.GTP) *net.UDPAddr {
+
+	if a := peers[gtpu]; a != nil && a.IP.Equal(gtpu.PeerAddr) {
+		return a
+	}
+	a := &net.UDPAddr{
+		IP:   gtpu.PeerAddr,
+		Port: gtp.Port,
+	}
+	peers[gtpu] = a
+	return a
+}
+
+var (
+	// errPoliced is returned if the uplink packet exceeds the AMBR.
+	errPoliced = errors.New("uplink exceeds the AMBR")
+
+	// errTunnelClosed is returned if the tunnel has been closed by the
+	// Error Indication.
+	errTunnelClosed = errors.New("tunnel closed")
+
+	// errTooLong is returned if the uplink packet does not fit in the
+	// buffer.
+	errTooLong = errors.New("uplink packet too long")
+)
+
+// sendUplink sends the packet in the tunnel of the PDU session, and returns
+// the QoS flow chosen by the packet filters of the QoS rules, or the one
+// given by the gNB if none matches.
+func (p *userPlane) sendUplink(gtpConn *net.UDPConn, s *nas.PDUSession,
+	r *ngap.PDUSession, pkt []byte) (qfi uint8, err error) {
+
+	if gtp.HeaderRoom+len(pkt) > gtp.BufferSize {
+		err = errTooLong
+		return
+	}
+	buf := gtp.NewBuffer()
+	defer buf.Release()
+
+	n := copy(buf.B[gtp.HeaderRoom:], pkt)
+	payload, qfi, err := p.encapUplink(s, r, buf.B[:gtp.HeaderRoom+n])
+	if err != nil {
+		return
+	}
 
-	fd := tun.Fds[0]
 	paddr := &net.UDPAddr{
-		IP:   t.gnb.Recv.GTPuPeerAddr,
+		IP:   r.GTPu.PeerAddr,
 		Port: gtp.Port,
 	}
+	_, err = gtpConn.WriteToUDP(payload, paddr)
+	return
+}
 
-	buf := make([]byte, 2048)
-	for {
-		n, err := fd.Read(buf)
-		if err != nil {
-			log.Fatalln(err)
-			return
-		}
-		payload := c.GTPu.Encap(buf[:n])
+// encapUplink encapsulates the packet at buf[gtp.HeaderRoom:] in place for
+// the tunnel of the PDU session, if it conforms to the AMBRs.
+func (p *userPlane) encapUplink(s *nas.PDUSession, r *ngap.PDUSession,
+	buf []byte) (payload []byte, qfi uint8, err error) {
 
-		_, err = gtpConn.WriteToUDP(payload, paddr)
-		if err != nil {
-			log.Fatalln(err)
-			return
-		}
+	pkt := buf[gtp.HeaderRoom:]
+	if !p.policer.allow(s, len(pkt)) {
+		err = errPoliced
+		return
+	}
+	qfi, ok := s.ClassifyUplink(pkt)
+	if !ok || qfi == 0 {
+		qfi = r.QosFlowID
+	}
+	// the QFI is given in the information instead of SetQosFlowID, as
+	// the tunnel is shared with the traffic generated by the UE.
+	gtpu := r.GTPu
+	ul := p.monitor.report(s.PSI, qfi, time.Now())
+	if ul == nil && gtpu.HasExtensionHeader {
+		ul = &gtp.ULPduSessionInformation{QosFlowID: qfi}
+	}
+	payload = gtpu.EncapInPlace(buf, ul)
+	if payload == nil {
+		err = errTunnelClosed
 	}
 	return
 }
 
-func (t *testSession) doUPlane(ctx context.Context, c *ngap.Camper) {
+// srcAddr returns the source address of the IPv4 or IPv6 packet.
+func srcAddr(pkt []byte) net.IP {
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		return net.IP(pkt[12:16])
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		return net.IP(pkt[8:24])
+	}
+	return nil
+}
 
-	fmt.Printf("doUPlane\n")
+// lookupPDUSession returns the PDU session having the UE address on the
+// TUN device and its resource on the gNB. the address may be of the other
+// PDU session in the other network namespace.
+func (p *userPlane) lookupPDUSession(addr net.IP, tun *netlink.Tuntap) (
+	*nas.PDUSession, *ngap.PDUSession) {
+	for tunnel, ts := range p.tunnels {
+		s, r := p.tunnelSession(tunnel)
+		if r == nil || p.link[s.PSI] != tun {
+			continue
+		}
+		if s.Address.Equal(addr) ||
+			s.AddressV6.Equal(addr) || s.LinkLocalAddress().Equal(addr) {
+			return ts.s, ts.r
+		}
+	}
+	return nil, nil
+}
 
-	ue := c.UE
+// tunnelSession returns the PDU session of the tunnel registered, or nil if
+// the tunnel is closed or the PDU session is no longer active.
+func (p *userPlane) tunnelSession(tunnel *gtp.GTP) (
+	*nas.PDUSession, *ngap.PDUSession) {
+	ts, ok := p.tunnels[tunnel]
+	if !ok || tunnel.Closed() || ts.r.GTPu.Closed() ||
+		ts.s.State != nas.SMActive ||
+		p.c.UE.PDUSession(ts.s.PSI) != ts.s {
+		return nil, nil
+	}
+	return ts.s, ts.r
+}
 
-	laddr, err := net.ResolveTCPAddr("tcp", ue.Recv.PDUAddress.String()+":0")
-	if err != nil {
-		return
+// dialer returns the dialer from the UE address of the PDU session, in the
+// network namespace or in the userspace stack if configured.
+func (t *testSession) dialer(p *userPlane, s *nas.PDUSession,
+	addr net.IP) func(network, address string) (net.Conn, error) {
+
+	if t.gnb.UserspaceStack {
+		return p.stackDialer(t.n3.Conn, s, p.c.PDUSession[s.PSI], addr)
 	}
+	laddr := &net.TCPAddr{IP: addr}
 
 	dialer := net.Dialer{LocalAddr: laddr}
+	if n := p.netns[s.PSI]; n != nil {
+		return n.dialer(&dialer)
+	}
+	return dialer.Dial
+}
+
+// doUPlane gets the URL from the UE address with the dialer.
+func (t *testSession) doUPlane(ctx context.Context, c *ngap.Camper,
+	addr net.IP, url string,
+	dial func(network, address string) (net.Conn, error)) {
+
+	fmt.Printf("doUPlane: %v\n", addr)
+
 	client := http.Client{
-		Transport: &http.Transport{Dial: dialer.Dial},
+		Transport: &http.Transport{Dial: dial},
 		Timeout:   3 * time.Second,
 	}
+	defer client.CloseIdleConnections()
 
 	for {
 		select {
@@ -511,15 +1232,15 @@ func (t *testSession) doUPlane(ctx context.Context, c *ngap.Camper) {
 			// do nothing here and go forward
 		}
 
-		rsp, err := client.Get(ue.URL)
+		rsp, err := client.Get(url)
 		if err != nil {
-			log.Fatalf("failed to GET %s: %s", ue.URL, err)
+			log.Fatalf("failed to GET %s: %s", url, err)
 			continue
 		}
 
 		if rsp.StatusCode == http.StatusOK {
 			log.Printf("[HTTP Probe] Successfully GET %s: "+
-				"Status: %s", ue.URL, rsp.Status)
+				"Status: %s", url, rsp.Status)
 			rsp.Body.Close()
 			return
 		}
@@ -553,8 +1274,16 @@ func main() {
 	t.runUPlaneAll(ctx, gtpConn, tun)
 	time.Sleep(time.Second * 1)
 
+	t.releaseLostAll()
+	time.Sleep(time.Second * 1)
+
+	t.idleResumeAll()
+	time.Sleep(time.Second * 1)
+
 	t.deregistrateAll()
 	time.Sleep(time.Second * 1)
 
+	t.stopUPlane()
+
 	return
 }
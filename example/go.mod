@@ -2,4 +2,6 @@ module example
 
 require (
 	github.com/vishvananda/netlink v1.1.1-0.20200603190747-5400e006d43d
+	github.com/vishvananda/netns v0.0.0-20211101163701-50045581ed74
+	golang.org/x/sys v0.0.0-20200217220822-9197077df867
 )
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"github.com/hhorai/gnbsim/encoding/gtp"
+	"github.com/hhorai/gnbsim/encoding/nas"
+	"github.com/hhorai/gnbsim/encoding/ngap"
+	"log"
+	"net"
+	"time"
+)
+
+// GTP-U path and tunnel management with the UPFs.
+// see 7.2 Path Management Messages and 7.3 Tunnel Management Messages in
+// TS 29.281.
+
+const (
+	// the Echo Requests lost in succession to detect the path failure.
+	maxEchoLost = 3
+)
+
+// startPathProbe sends the Echo Request to each UPF periodically if the
+// interval is configured.
+func (t *testSession) startPathProbe(
+	ctx context.Context, gtpConn *net.UDPConn) {
+
+	t.paths = map[string]*gtp.Path{}
+	for _, c := range t.gnb.Camper {
+		for _, r := range c.PDUSession {
+			if r.GTPu == nil || r.PeerAddr == nil {
+				continue
+			}
+			if _, ok := t.paths[r.PeerAddr.String()]; !ok {
+				t.paths[r.PeerAddr.String()] = gtp.NewPath(r.PeerAddr)
+			}
+		}
+	}
+
+	if t.gnb.GTPuEchoInterval == "" {
+		return
+	}
+	interval, err := time.ParseDuration(t.gnb.GTPuEchoInterval)
+	if err != nil || interval <= 0 {
+		log.Printf("invalid GTPuEchoInterval: %s\n", t.gnb.GTPuEchoInterval)
+		return
+	}
+	for _, p := range t.paths {
+		go probePath(ctx, gtpConn, p, interval)
+	}
+	return
+}
+
+func probePath(ctx context.Context, gtpConn *net.UDPConn,
+	p *gtp.Path, interval time.Duration) {
+
+	paddr := &net.UDPAddr{
+		IP:   p.PeerAddr,
+		Port: gtp.Port,
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		// the request is lost if no response is received in the interval.
+		if lost := p.Expire(now, interval); lost >= maxEchoLost {
+			log.Printf("[GTP-U] path failure to %v: %d echoes lost\n",
+				p.PeerAddr, lost)
+		}
+		_, err := gtpConn.WriteToUDP(p.MakeEchoRequest(now), paddr)
+		if err != nil {
+			log.Printf("[GTP-U] failed to send Echo Request: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleEchoResponse updates the path with the Echo Response. the Echo
+// Request is answered by the dispatcher.
+func (t *testSession) handleEchoResponse(e gtp.Echo, raddr *net.UDPAddr) {
+
+	p := t.paths[raddr.IP.String()]
+	if p == nil {
+		log.Printf("[GTP-U] Echo Response from unknown peer: %v\n", raddr)
+		return
+	}
+	restarted, err := p.HandleEchoResponse(e, time.Now())
+	if err != nil {
+		log.Printf("[GTP-U] %v from %v\n", err, raddr)
+		return
+	}
+	if restarted {
+		log.Printf("[GTP-U] UPF %v restarted: restart counter %d\n",
+			raddr.IP, e.RestartCounter)
+	}
+	return
+}
+
+func (t *testSession) reportPaths() {
+	for _, p := range t.paths {
+		st := p.Stats()
+		if st.Sent == 0 {
+			continue
+		}
+		log.Printf("[GTP-U] path to %v: sent %d, received %d, lost %d, "+
+			"RTT min/avg/max %v/%v/%v, restarts %d\n",
+			p.PeerAddr, st.Sent, st.Received, st.Lost,
+			st.RTTMin, st.RTTAvg, st.RTTMax, st.Restarts)
+	}
+	if t.n3 != nil {
+		st := t.n3.Stats()
+		log.Printf("[GTP-U] N3: received %d, dispatched %d, dropped %d, "+
+			"unknown TEID %d, invalid %d\n", st.Received, st.Dispatched,
+			st.Dropped, st.UnknownTEID, st.Invalid)
+	}
+	return
+}
+
+// handleErrorIndication releases the tunnel of the PDU session which the
+// UPF does not know any more. the tunnel is closed and unregistered from
+// the dispatcher, and the UE context is released later by releaseLostAll,
+// as no signalling is done in the dispatcher.
+func (t *testSession) handleErrorIndication(
+	e gtp.ErrorIndication, from *net.UDPAddr) {
+
+	c, r := t.gnb.LookupPDUSessionByPeerTEID(e.PeerAddr, e.TEID)
+	if r == nil || r.GTPu == nil {
+		log.Printf("[GTP-U] Error Indication from %v: unknown TEID %d\n",
+			from.IP, e.TEID)
+		return
+	}
+	r.GTPu.Close()
+	t.n3.Unregister(r.LocalTEID)
+
+	t.mu.Lock()
+	if t.lost == nil {
+		t.lost = map[*ngap.Camper]bool{}
+	}
+	t.lost[c] = true
+	t.mu.Unlock()
+
+	log.Printf("[GTP-U] Error Indication from %v: "+
+		"PDU session %d of UE %s is released\n", from.IP, r.ID, c.UE.SUPI)
+	return
+}
+
+// handleEndMarker is called with the last packet from the UPF before the
+// path is switched. the End Marker is queued to the UE behind the downlink
+// of the old path, and the downlink of the new path held is delivered.
+func (t *testSession) handleEndMarker(teid uint32, from *net.UDPAddr) {
+
+	c, r := t.gnb.LookupPDUSessionByTEID(teid)
+	tunnel := t.n3.Lookup(teid)
+	if r == nil || tunnel == nil {
+		log.Printf("[GTP-U] End Marker from %v: unknown TEID %d\n",
+			from.IP, teid)
+		return
+	}
+	log.Printf("[GTP-U] End Marker from %v: PDU session %d of UE %s\n",
+		from.IP, r.ID, c.UE.SUPI)
+
+	p := t.userPlaneOf(c)
+	if p == nil {
+		return
+	}
+	select {
+	case p.queue <- endMarker(tunnel, from):
+	default: // the downlink held is delivered after endMarkerWait.
+	}
+	return
+}
+
+// downlinkPath is the path of the downlink in a tunnel registered to the
+// dispatcher. the resources of the PDU session may be set up again to
+// another UPF, and the downlink from the new UPF is held until the End
+// Marker is received from the old one, so that the UE receives the
+// downlink in order.
+type downlinkPath struct {
+	tunnel *gtp.GTP     // the tunnel of which the downlink is delivered.
+	held   []gtp.Packet // the downlink from the new UPF.
+	timer  *time.Timer
+}
+
+const (
+	// the End Marker is waited for before the downlink held is delivered.
+	endMarkerWait = 500 * time.Millisecond
+)
+
+// endMarker returns the End Marker of the tunnel queued to the UE.
+func endMarker(tunnel *gtp.GTP, from *net.UDPAddr) gtp.Packet {
+	return gtp.Packet{
+		Tunnel: tunnel,
+		Header: gtp.Header{
+			MessageType: gtp.MessageTypeEndMarker,
+			TEID:        tunnel.LocalTEID,
+		},
+		From: from,
+	}
+}
+
+// holdDownlink tells whether the packet is held, or dropped, until the
+// path is switched to the tunnel set up last.
+func (p *userPlane) holdDownlink(pkt gtp.Packet, next *gtp.GTP) bool {
+
+	d := p.downlink[pkt.Tunnel]
+	if d == nil {
+		d = &downlinkPath{tunnel: pkt.Tunnel}
+		p.downlink[pkt.Tunnel] = d
+	}
+	if d.tunnel == next || pkt.Header.MessageType != gtp.MessageTypeTPDU {
+		return false
+	}
+	// the End Marker is not told from the downlink of the same UPF.
+	if next.PeerAddr.Equal(d.tunnel.PeerAddr) {
+		d.tunnel = next
+		return false
+	}
+	if pkt.From == nil || !pkt.From.IP.Equal(next.PeerAddr) {
+		return false // the downlink of the old path.
+	}
+	if len(d.held) >= ueQueueLen {
+		pkt.Release()
+		return true
+	}
+	if d.timer == nil {
+		tunnel, queue := pkt.Tunnel, p.queue
+		d.timer = time.AfterFunc(endMarkerWait, func() {
+			queue <- endMarker(tunnel, nil)
+		})
+	}
+	d.held = append(d.held, pkt)
+	return true
+}
+
+// switchPath switches the downlink of the tunnel to the tunnel set up last
+// at the End Marker, and returns the downlink held to be delivered.
+func (p *userPlane) switchPath(tunnel, next *gtp.GTP) (held []gtp.Packet) {
+
+	d := p.downlink[tunnel]
+	if d == nil || d.tunnel == next {
+		return // the End Marker after the timeout.
+	}
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	held, d.held = d.held, nil
+	d.tunnel = next
+	return
+}
+
+// userPlaneOf returns the user plane of the camper, or nil if not started.
+func (t *testSession) userPlaneOf(c *ngap.Camper) *userPlane {
+	for _, p := range t.planes {
+		if p.c == c {
+			return p
+		}
+	}
+	return nil
+}
+
+// releaseLostAll releases the UE contexts of the UEs of which the tunnel
+// is lost by the Error Indication, so that the core network also releases
+// the user plane of the PDU sessions of the UEs. the UEs are brought back
+// to CM-CONNECTED by the service request without the user plane.
+func (t *testSession) releaseLostAll() {
+
+	t.mu.Lock()
+	lost := t.lost
+	t.lost = nil
+	t.mu.Unlock()
+
+	for _, c := range t.gnb.Camper {
+		ue := c.UE
+		if !lost[c] || ue.CMstate != nas.CMConnected {
+			continue
+		}
+		t.releaseUEContext(ue)
+		log.Printf("UE %s: user plane released\n", ue.SUPI)
+
+		t.serviceRequest(ue, nas.ServiceTypeSignalling)
+		log.Printf("UE %s: %s\n", ue.SUPI, nas.CMstateStr[ue.CMstate])
+	}
+	return
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/hhorai/gnbsim/encoding/nas"
+	"github.com/hhorai/gnbsim/encoding/ngap"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// User plane in the network namespace of each UE or each PDU session.
+// the namespace has the TUN device with the addresses of the PDU sessions,
+// the default routes through the tunnel and the DNS servers, so any tool
+// can be run in the namespace by the name, e.g.
+//   ip netns exec ue-208930123456789 ping 8.8.8.8
+// the addresses of the UEs may overlap across the DNNs.
+
+const (
+	netnsPrefix  = "ue"
+	netnsTunName = "tun0"
+
+	// the resolv.conf in this directory is bind mounted by ip netns exec.
+	netnsEtcDir = "/etc/netns"
+)
+
+// ueNetns is the network namespace of the UE or of the PDU session.
+type ueNetns struct {
+	name string
+	ns   netns.NsHandle
+	tun  *netlink.Tuntap
+}
+
+func netnsName(conf *ngap.UPlaneNetns, c *ngap.Camper, psi uint8) string {
+	prefix := conf.Prefix
+	if prefix == "" {
+		prefix = netnsPrefix
+	}
+	name := fmt.Sprintf("%s-%s", prefix, c.UE.SUPI)
+	if psi != 0 {
+		name = fmt.Sprintf("%s-%d", name, psi)
+	}
+	return name
+}
+
+// setupNetns creates the network namespace of the PDU sessions. the one
+// left by the last run is replaced.
+func setupNetns(name string, sessions []*nas.PDUSession,
+	dns []net.IP) (n *ueNetns, err error) {
+
+	// the namespace is of the thread, and the thread must not be used by
+	// the other goroutines until it is restored.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	orig, err := netns.Get()
+	if err != nil {
+		return
+	}
+	defer orig.Close()
+	defer netns.Set(orig)
+
+	netns.DeleteNamed(name)
+	ns, err := netns.NewNamed(name)
+	if err != nil {
+		err = fmt.Errorf("failed to create netns %s: %v", name, err)
+		return
+	}
+	n = &ueNetns{name: name, ns: ns}
+
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		return
+	}
+	if err = netlink.LinkSetUp(lo); err != nil {
+		return
+	}
+
+	if n.tun, err = addTunnel(netnsTunName, 1); err != nil {
+		return
+	}
+	for _, s := range sessions {
+		for _, addr := range []net.IP{s.Address, s.AddressV6} {
+			if addr == nil {
+				continue
+			}
+			log.Printf("UE address: %v in netns %s\n", addr, name)
+			bits := 8 * net.IPv4len
+			if addr.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			a := &netlink.Addr{IPNet: &net.IPNet{
+				IP:   addr,
+				Mask: net.CIDRMask(bits, bits),
+			}}
+			if err = netlink.AddrAdd(n.tun, a); err != nil {
+				return
+			}
+		}
+	}
+	// the main table.
+	if err = addRoute(n.tun, 0); err != nil {
+		return
+	}
+
+	err = writeResolvConf(name, dns)
+	return
+}
+
+func writeResolvConf(name string, dns []net.IP) (err error) {
+
+	if len(dns) == 0 {
+		return
+	}
+	dir := filepath.Join(netnsEtcDir, name)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	var conf strings.Builder
+	for _, addr := range dns {
+		fmt.Fprintf(&conf, "nameserver %v\n", addr)
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "resolv.conf"),
+		[]byte(conf.String()), 0644)
+}
+
+// dialer returns the dial function which creates the socket in the
+// namespace. the socket stays in the namespace where it is created.
+func (n *ueNetns) dialer(d *net.Dialer) func(
+	network, address string) (net.Conn, error) {
+
+	return func(network, address string) (conn net.Conn, err error) {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		orig, err := netns.Get()
+		if err != nil {
+			return
+		}
+		defer orig.Close()
+		defer netns.Set(orig)
+
+		if err = netns.Set(n.ns); err != nil {
+			return
+		}
+		return d.DialContext(context.Background(), network, address)
+	}
+}
+
+func (n *ueNetns) delete() {
+	n.ns.Close()
+	if err := netns.DeleteNamed(n.name); err != nil {
+		log.Printf("failed to delete netns %s: %v\n", n.name, err)
+	}
+	os.RemoveAll(filepath.Join(netnsEtcDir, n.name))
+	return
+}
+
+// setupNetns creates the network namespaces of the UE, and the tunnels of
+// the PDU sessions are bound to them.
+func (p *userPlane) setupNetns(conf *ngap.UPlaneNetns,
+	sessions []*nas.PDUSession) (err error) {
+
+	groups := map[uint8][]*nas.PDUSession{}
+	for _, s := range sessions {
+		var psi uint8
+		if conf.PerPDUSession {
+			psi = s.PSI
+		}
+		groups[psi] = append(groups[psi], s)
+	}
+
+	for psi, group := range groups {
+		dns := []net.IP{}
+		for _, s := range group {
+			dns = append(dns, s.DNS...)
+		}
+		if len(dns) == 0 {
+			for _, str := range conf.DNS {
+				if addr := net.ParseIP(str); addr != nil {
+					dns = append(dns, addr)
+				}
+			}
+		}
+
+		var n *ueNetns
+		n, err = setupNetns(netnsName(conf, p.c, psi), group, dns)
+		if err != nil {
+			return
+		}
+		for _, s := range group {
+			p.netns[s.PSI] = n
+			p.link[s.PSI] = n.tun
+		}
+	}
+	return
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"github.com/hhorai/gnbsim/encoding/gtp"
+	"github.com/hhorai/gnbsim/encoding/ngap"
+	"log"
+	"sync"
+	"time"
+)
+
+// QoS monitoring of the packet delay between the UE and the UPF.
+// the UPF marks the downlink packet with QMP and the DL sending time stamp,
+// and the gNB reports the time stamps in the next uplink packet of the QoS
+// flow. the UPF calculates the round trip delay of N3 from them.
+// see 5.33.3 in TS 23.501 and 5.4.1.1 in TS 38.415.
+
+type qosFlowKey struct {
+	psi uint8
+	qfi uint8
+}
+
+// qosMonitor has the time stamps to be reported for each QoS flow, and
+// the one-way downlink delay, which is meaningful only if the clocks of
+// the gNB and the UPF are synchronized.
+type qosMonitor struct {
+	mu       sync.Mutex
+	pending  map[qosFlowKey]*gtp.ULPduSessionInformation
+	received uint64
+	reported uint64
+	minDelay time.Duration
+	maxDelay time.Duration
+}
+
+func newQoSMonitor() *qosMonitor {
+	return &qosMonitor{
+		pending: map[qosFlowKey]*gtp.ULPduSessionInformation{},
+	}
+}
+
+// receive keeps the time stamps of the downlink packet with QMP.
+func (m *qosMonitor) receive(psi uint8, info *gtp.DLPduSessionInformation,
+	now time.Time) {
+
+	if info == nil || !info.QMP {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pending[qosFlowKey{psi, info.QosFlowID}] = &gtp.ULPduSessionInformation{
+		QosFlowID:                  info.QosFlowID,
+		QMP:                        true,
+		DLSendingTimestampRepeated: info.DLSendingTimestamp,
+		DLReceivedTimestamp:        gtp.NTPTimestamp(now),
+	}
+
+	delay := now.Sub(gtp.NTPTime(info.DLSendingTimestamp))
+	if m.received == 0 || delay < m.minDelay {
+		m.minDelay = delay
+	}
+	if m.received == 0 || delay > m.maxDelay {
+		m.maxDelay = delay
+	}
+	m.received++
+	return
+}
+
+// report returns the UL PDU session information with the time stamps of
+// the QoS flow, or nil if nothing is to be reported.
+func (m *qosMonitor) report(psi, qfi uint8,
+	now time.Time) (info *gtp.ULPduSessionInformation) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := qosFlowKey{psi, qfi}
+	info, ok := m.pending[key]
+	if !ok {
+		return
+	}
+	delete(m.pending, key)
+	info.ULSendingTimestamp = gtp.NTPTimestamp(now)
+	m.reported++
+	return
+}
+
+func (m *qosMonitor) logDelay(c *ngap.Camper) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.received == 0 {
+		return
+	}
+	log.Printf("[QoS monitoring] UE %s: %d DL packets with QMP, "+
+		"%d reported, DL delay min %v max %v\n", c.UE.SUPI,
+		m.received, m.reported, m.minDelay, m.maxDelay)
+	return
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/hhorai/gnbsim/encoding/gtp"
+	"github.com/hhorai/gnbsim/encoding/nas"
+	"net"
+	"time"
+)
+
+// IPv6 stateless address autoconfiguration over the PDU session.
+// see 5.8.2.2 in TS 23.501, RFC 4861 and RFC 4862.
+
+const (
+	protoICMPv6 = 58
+
+	icmpv6RouterSolicitation  = 133
+	icmpv6RouterAdvertisement = 134
+
+	ndOptPrefixInformation = 3
+	ndOptPrefixAutonomous  = 0x40
+
+	maxRtrSolicitations     = 3
+	rtrSolicitationInterval = 4 * time.Second
+)
+
+var allRoutersAddr = net.ParseIP("ff02::2")
+
+// solicitRouter sends the router solicitation from the link local address
+// of the PDU session and returns the prefix in the router advertisement,
+// which is dispatched to the queue of the UE. the other packets in the
+// queue are dropped, since the user plane of the UE is not yet started.
+func solicitRouter(gtpConn *net.UDPConn, gtpu *gtp.GTP,
+	s *nas.PDUSession, queue <-chan gtp.Packet) (prefix *net.IPNet, err error) {
+
+	paddr := &net.UDPAddr{
+		IP:   gtpu.PeerAddr,
+		Port: gtp.Port,
+	}
+	rs := makeRouterSolicitation(s.LinkLocalAddress())
+
+	for i := 0; i < maxRtrSolicitations; i++ {
+		_, err = gtpConn.WriteToUDP(gtpu.Encap(rs), paddr)
+		if err != nil {
+			return
+		}
+
+		timer := time.NewTimer(rtrSolicitationInterval)
+	wait:
+		for {
+			select {
+			case pkt := <-queue:
+				if pkt.Tunnel == gtpu {
+					prefix = decRouterAdvertisement(pkt.Payload)
+				}
+				pkt.Release()
+				if prefix != nil {
+					timer.Stop()
+					return prefix, nil
+				}
+			case <-timer.C:
+				break wait // solicit again.
+			}
+		}
+	}
+	err = fmt.Errorf("no router advertisement for PDU session %d", s.PSI)
+	return
+}
+
+func makeRouterSolicitation(src net.IP) (pkt []byte) {
+
+	// reserved field only, no source link-layer address option since
+	// there is no link-layer address on the PDU session.
+	icmp := make([]byte, 8)
+	icmp[0] = icmpv6RouterSolicitation
+	binary.BigEndian.PutUint16(icmp[2:],
+		icmpv6Checksum(src, allRoutersAddr, icmp))
+
+	pkt = make([]byte, 40)
+	pkt[0] = 0x60 // version 6
+	binary.BigEndian.PutUint16(pkt[4:], uint16(len(icmp)))
+	pkt[6] = protoICMPv6
+	pkt[7] = 255 // hop limit
+	copy(pkt[8:24], src.To16())
+	copy(pkt[24:40], allRoutersAddr)
+	pkt = append(pkt, icmp...)
+
+	return
+}
+
+// decRouterAdvertisement returns the prefix for the autonomous address
+// configuration in the router advertisement, or nil if pkt is not.
+func decRouterAdvertisement(pkt []byte) (prefix *net.IPNet) {
+
+	if len(pkt) < 40 || pkt[0]>>4 != 6 || pkt[6] != protoICMPv6 {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(pkt[4:]))
+	if len(pkt) < 40+length {
+		return
+	}
+	icmp := pkt[40 : 40+length]
+	if len(icmp) < 16 || icmp[0] != icmpv6RouterAdvertisement {
+		return
+	}
+
+	opts := icmp[16:]
+	for len(opts) >= 2 {
+		optLen := int(opts[1]) * 8
+		if optLen == 0 || optLen > len(opts) {
+			return
+		}
+		opt := opts[:optLen]
+		opts = opts[optLen:]
+
+		if opt[0] != ndOptPrefixInformation || optLen != 32 ||
+			opt[3]&ndOptPrefixAutonomous == 0 {
+			continue
+		}
+		prefix = &net.IPNet{
+			IP:   net.IP(append([]byte{}, opt[16:32]...)),
+			Mask: net.CIDRMask(int(opt[2]), 8*net.IPv6len),
+		}
+		return
+	}
+	return
+}
+
+func icmpv6Checksum(src, dst net.IP, msg []byte) uint16 {
+	return checksum(msg, pseudoHeaderSum(src, dst, protoICMPv6, len(msg)))
+}
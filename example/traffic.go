@@ -0,0 +1,943 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/hhorai/gnbsim/encoding/gtp"
+	"github.com/hhorai/gnbsim/encoding/nas"
+	"github.com/hhorai/gnbsim/encoding/ngap"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// User plane traffic generated by the UE directly over the GTP-U tunnel.
+// the packets are crafted in the userspace and sent in the tunnel of the
+// PDU session, and the downlink packets of the flows are taken before the
+// TUN device, so no TUN device is needed. the UDP flow expects the echo
+// server at the destination, e.g. the echo service on port 7, and the TCP
+// flow expects the sink, e.g. `socat TCP-LISTEN:5001,fork /dev/null`.
+
+const (
+	protoICMP = 1
+	protoTCP  = 6
+	protoUDP  = 17
+
+	icmpEchoReply     = 0
+	icmpEchoRequest   = 8
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+
+	defaultTrafficDuration = 10 * time.Second
+	defaultTrafficSize     = 1000
+	defaultICMPInterval    = time.Second
+	defaultUDPRate         = 1000000
+	defaultUDPPort         = 7
+	defaultTCPPort         = 5001
+
+	// the sequence number and the timestamp in the payload of the probe.
+	probeHeaderLen = 12
+
+	// the time to wait for the replies after the last packet.
+	trafficDrainTime = 2 * time.Second
+
+	// the downlink packets queued for each flow.
+	trafficQueueLen = 1024
+)
+
+// the source port of UDP and TCP, or the identifier of ICMP echo, in the
+// range from 40000. it starts by the clock not to collide with the
+// connections of the previous run left in the peer.
+const (
+	trafficPortBase  = 40000
+	trafficPortRange = 20000
+)
+
+var lastTrafficPort = uint32(time.Now().UnixNano() / int64(time.Millisecond))
+
+func nextTrafficPort() uint16 {
+	n := atomic.AddUint32(&lastTrafficPort, 1)
+	return uint16(trafficPortBase + n%trafficPortRange)
+}
+
+// trafficStats has the statistics of the flow. the RTT is of the echoed
+// packets or of the acknowledged segments, and the jitter is the variation
+// of the RTT smoothed as the interarrival jitter in RFC 3550.
+type trafficStats struct {
+	Sent          uint64
+	Received      uint64
+	SentBytes     uint64
+	ReceivedBytes uint64
+	AckedBytes    uint64 // TCP only.
+	Retransmits   uint64 // TCP only.
+	RTTMin        time.Duration
+	RTTMax        time.Duration
+	Jitter        time.Duration
+	Elapsed       time.Duration
+
+	rttSum   time.Duration
+	rttCount uint64
+	lastRTT  time.Duration
+}
+
+func (st *trafficStats) addRTT(rtt time.Duration) {
+	if st.rttCount == 0 || rtt < st.RTTMin {
+		st.RTTMin = rtt
+	}
+	if rtt > st.RTTMax {
+		st.RTTMax = rtt
+	}
+	if st.rttCount != 0 {
+		d := rtt - st.lastRTT
+		if d < 0 {
+			d = -d
+		}
+		st.Jitter += (d - st.Jitter) / 16
+	}
+	st.lastRTT = rtt
+	st.rttSum += rtt
+	st.rttCount++
+}
+
+func (st *trafficStats) RTTAvg() time.Duration {
+	if st.rttCount == 0 {
+		return 0
+	}
+	return st.rttSum / time.Duration(st.rttCount)
+}
+
+// add sums up the statistics of the flows. the jitter is averaged by the
+// number of the RTT samples.
+func (st *trafficStats) add(o *trafficStats) {
+	if o.rttCount != 0 {
+		if st.rttCount == 0 || o.RTTMin < st.RTTMin {
+			st.RTTMin = o.RTTMin
+		}
+		if o.RTTMax > st.RTTMax {
+			st.RTTMax = o.RTTMax
+		}
+		n := st.rttCount + o.rttCount
+		st.Jitter = (st.Jitter*time.Duration(st.rttCount) +
+			o.Jitter*time.Duration(o.rttCount)) / time.Duration(n)
+		st.rttSum += o.rttSum
+		st.rttCount = n
+	}
+	st.Sent += o.Sent
+	st.Received += o.Received
+	st.SentBytes += o.SentBytes
+	st.ReceivedBytes += o.ReceivedBytes
+	st.AckedBytes += o.AckedBytes
+	st.Retransmits += o.Retransmits
+	if o.Elapsed > st.Elapsed {
+		st.Elapsed = o.Elapsed
+	}
+}
+
+func (st *trafficStats) String() string {
+	var loss float64
+	if st.Sent != 0 && st.Received <= st.Sent {
+		loss = float64(st.Sent-st.Received) / float64(st.Sent) * 100
+	}
+	bps := func(n uint64) uint64 {
+		if st.Elapsed <= 0 {
+			return 0
+		}
+		return uint64(float64(n*8) / st.Elapsed.Seconds())
+	}
+	ul := st.SentBytes
+	if st.AckedBytes != 0 {
+		ul = st.AckedBytes
+	}
+	return fmt.Sprintf("sent %d, received %d, loss %.1f%%, "+
+		"RTT min/avg/max %v/%v/%v, jitter %v, UL %d bps, DL %d bps, "+
+		"retransmits %d", st.Sent, st.Received, loss,
+		st.RTTMin, st.RTTAvg(), st.RTTMax, st.Jitter,
+		bps(ul), bps(st.ReceivedBytes), st.Retransmits)
+}
+
+// trafficFlow is the flow generated by the UE in the PDU session.
+type trafficFlow struct {
+	param    ngap.Traffic
+	s        *nas.PDUSession
+	r        *ngap.PDUSession
+	src      net.IP
+	dst      net.IP
+	proto    uint8
+	sport    uint16 // the identifier of ICMP echo.
+	dport    uint16
+	duration time.Duration
+
+	qfi   uint8           // of the last uplink packet.
+	dlQFI uint32          // of the last downlink packet, accessed atomically.
+	rx    chan gtp.Packet // the downlink packets of the transport layer.
+	stats trafficStats
+}
+
+// newTrafficFlow chooses the PDU session and the addresses of the flow.
+func (p *userPlane) newTrafficFlow(param ngap.Traffic) (
+	f *trafficFlow, err error) {
+
+	f = &trafficFlow{
+		param:    param,
+		duration: defaultTrafficDuration,
+		rx:       make(chan gtp.Packet, trafficQueueLen),
+	}
+	if param.Duration != "" {
+		if f.duration, err = time.ParseDuration(param.Duration); err != nil {
+			return
+		}
+	}
+	if f.param.Size == 0 {
+		f.param.Size = defaultTrafficSize
+	}
+
+	host, port := param.Dst, ""
+	if h, p, serr := net.SplitHostPort(param.Dst); serr == nil {
+		host, port = h, p
+	}
+	if f.dst = net.ParseIP(host); f.dst == nil {
+		err = fmt.Errorf("invalid destination: %s", param.Dst)
+		return
+	}
+
+	switch param.Type {
+	case "icmp":
+		f.proto = protoICMP
+		if f.dst.To4() == nil {
+			f.proto = protoICMPv6
+		}
+	case "udp":
+		f.proto, f.dport = protoUDP, defaultUDPPort
+	case "tcp":
+		f.proto, f.dport = protoTCP, defaultTCPPort
+	default:
+		err = fmt.Errorf("unknown traffic type: %s", param.Type)
+		return
+	}
+	if port != "" && f.proto != protoICMP && f.proto != protoICMPv6 {
+		var n uint64
+		if n, err = strconv.ParseUint(port, 10, 16); err != nil {
+			return
+		}
+		f.dport = uint16(n)
+	}
+
+	for _, s := range p.c.UE.ActivePDUSessions() {
+		if param.DNN != "" && s.DNN != param.DNN {
+			continue
+		}
+		src := s.Address
+		if f.dst.To4() == nil {
+			src = s.AddressV6
+		}
+		r := p.c.PDUSession[s.PSI]
+		if src == nil || r == nil || r.GTPu == nil {
+			continue
+		}
+		f.s, f.r, f.src = s, r, src
+		break
+	}
+	if f.s == nil {
+		err = fmt.Errorf("no PDU session for %s traffic to %s",
+			param.Type, param.Dst)
+		return
+	}
+	f.sport = nextTrafficPort()
+	return
+}
+
+// matches returns true if the downlink packet is of the flow.
+func (f *trafficFlow) matches(src, dst net.IP, proto uint8,
+	l4 []byte) bool {
+
+	if proto != f.proto || !src.Equal(f.dst) || !dst.Equal(f.src) {
+		return false
+	}
+	switch proto {
+	case protoICMP, protoICMPv6:
+		return len(l4) >= 8 && binary.BigEndian.Uint16(l4[4:]) == f.sport
+	}
+	return len(l4) >= 4 &&
+		binary.BigEndian.Uint16(l4) == f.dport &&
+		binary.BigEndian.Uint16(l4[2:]) == f.sport
+}
+
+func (p *userPlane) addFlow(f *trafficFlow) {
+	p.trafficMu.Lock()
+	defer p.trafficMu.Unlock()
+
+	p.flows = append(p.flows, f)
+}
+
+// removeFlow removes the flow, and releases the packets left in it. the
+// packets are no longer delivered to the flow after that.
+func (p *userPlane) removeFlow(f *trafficFlow) {
+	p.trafficMu.Lock()
+	defer p.trafficMu.Unlock()
+
+	for i, g := range p.flows {
+		if g == f {
+			p.flows = append(p.flows[:i], p.flows[i+1:]...)
+			break
+		}
+	}
+	for {
+		select {
+		case pkt := <-f.rx:
+			pkt.Release()
+		default:
+			return
+		}
+	}
+}
+
+// deliverTraffic hands the downlink packet to the flow with the payload of
+// the transport layer, and returns false if the packet is not of any flow.
+// the flow releases the packet when it is processed.
+func (p *userPlane) deliverTraffic(pkt gtp.Packet,
+	info *gtp.DLPduSessionInformation) bool {
+
+	p.trafficMu.RLock()
+	defer p.trafficMu.RUnlock()
+
+	if len(p.flows) == 0 {
+		return false
+	}
+	src, dst, proto, l4, ok := splitIPPacket(pkt.Payload)
+	if !ok {
+		return false
+	}
+	for _, f := range p.flows {
+		if !f.matches(src, dst, proto, l4) {
+			continue
+		}
+		if info != nil {
+			atomic.StoreUint32(&f.dlQFI, uint32(info.QosFlowID))
+		}
+		pkt.Payload = l4
+		select {
+		case f.rx <- pkt:
+		default: // dropped as the UE does.
+			pkt.Release()
+		}
+		return true
+	}
+	return false
+}
+
+// send sends the transport layer of the flow in the tunnel.
+func (f *trafficFlow) send(p *userPlane, gtpConn *net.UDPConn,
+	l4 []byte) (err error) {
+
+	pkt := makeIPPacket(f.src, f.dst, f.proto, l4)
+	f.stats.Sent++
+	f.stats.SentBytes += uint64(len(pkt))
+
+	f.qfi, err = p.sendUplink(gtpConn, f.s, f.r, pkt)
+	if err == errPoliced {
+		err = nil // it is counted as the loss.
+	}
+	return
+}
+
+// runTraffic runs the flows of the UE concurrently, and reports the
+// statistics of each flow and of each QoS flow.
+func (t *testSession) runTraffic(ctx context.Context, p *userPlane) {
+
+	c := p.c
+	flows := []*trafficFlow{}
+	var wg sync.WaitGroup
+
+	for _, param := range t.gnb.Traffic {
+		f, err := p.newTrafficFlow(param)
+		if err != nil {
+			log.Printf("[Traffic] UE %s: %v\n", c.UE.SUPI, err)
+			continue
+		}
+		p.addFlow(f)
+		flows = append(flows, f)
+
+		wg.Add(1)
+		go func(f *trafficFlow) {
+			defer wg.Done()
+
+			var err error
+			switch f.proto {
+			case protoICMP, protoICMPv6:
+				err = f.runICMP(ctx, p, t.n3.Conn)
+			case protoUDP:
+				err = f.runUDP(ctx, p, t.n3.Conn)
+			case protoTCP:
+				err = f.runTCP(ctx, p, t.n3.Conn)
+			}
+			if err != nil {
+				log.Printf("[Traffic] UE %s %s to %s: %v\n",
+					c.UE.SUPI, f.param.Type, f.param.Dst, err)
+			}
+		}(f)
+	}
+	wg.Wait()
+
+	byQFI := map[uint8]*trafficStats{}
+	for _, f := range flows {
+		p.removeFlow(f)
+		log.Printf("[Traffic] UE %s PDU session %d QFI %d/%d %s to %s: "+
+			"%v\n", c.UE.SUPI, f.s.PSI, f.qfi, atomic.LoadUint32(&f.dlQFI),
+			f.param.Type, f.param.Dst, &f.stats)
+
+		st := byQFI[f.qfi]
+		if st == nil {
+			st = &trafficStats{}
+			byQFI[f.qfi] = st
+		}
+		st.add(&f.stats)
+	}
+	for qfi, st := range byQFI {
+		log.Printf("[Traffic] UE %s QFI %d: %v\n", c.UE.SUPI, qfi, st)
+	}
+	return
+}
+
+// makeProbe returns the payload with the sequence number and the timestamp
+// padded to the size.
+func makeProbe(seq uint32, now time.Time, size int) (data []byte) {
+	if size < probeHeaderLen {
+		size = probeHeaderLen
+	}
+	data = make([]byte, size)
+	binary.BigEndian.PutUint32(data, seq)
+	binary.BigEndian.PutUint64(data[4:], uint64(now.UnixNano()))
+	return
+}
+
+func decProbe(data []byte) (seq uint32, sent time.Time, ok bool) {
+	if len(data) < probeHeaderLen {
+		return
+	}
+	seq = binary.BigEndian.Uint32(data)
+	sent = time.Unix(0, int64(binary.BigEndian.Uint64(data[4:])))
+	ok = true
+	return
+}
+
+// echoed counts the echoed probe once.
+func (f *trafficFlow) echoed(data []byte, now time.Time,
+	seen map[uint32]bool) {
+
+	seq, sent, ok := decProbe(data)
+	if !ok || seen[seq] {
+		return
+	}
+	seen[seq] = true
+	f.stats.Received++
+	f.stats.addRTT(now.Sub(sent))
+}
+
+// runProbe sends the probe at the interval for the duration, and waits for
+// the replies until the drain time passes.
+func (f *trafficFlow) runProbe(ctx context.Context, interval time.Duration,
+	send func(seq uint32, now time.Time) error,
+	recv func(l4 []byte, now time.Time)) (err error) {
+
+	start := time.Now()
+	end := start.Add(f.duration)
+	drain := time.NewTimer(f.duration + trafficDrainTime)
+	defer drain.Stop()
+
+	var seq uint32
+	next := start
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-drain.C:
+			f.stats.Elapsed = f.duration
+			return
+		case pkt := <-f.rx:
+			recv(pkt.Payload, time.Now())
+			pkt.Release()
+		case now := <-timer.C:
+			// the packets behind the schedule are sent at once.
+			for !next.After(now) && next.Before(end) {
+				if err = send(seq, now); err != nil {
+					return
+				}
+				seq++
+				next = start.Add(time.Duration(seq) * interval)
+			}
+			if next.Before(end) {
+				timer.Reset(next.Sub(time.Now()))
+			}
+		}
+	}
+}
+
+// runICMP sends the ICMP echo requests and measures the RTT of the replies.
+func (f *trafficFlow) runICMP(ctx context.Context, p *userPlane,
+	gtpConn *net.UDPConn) (err error) {
+
+	interval := defaultICMPInterval
+	if f.param.Interval != "" {
+		if interval, err = time.ParseDuration(f.param.Interval); err != nil {
+			return
+		}
+	}
+	seen := map[uint32]bool{}
+
+	send := func(seq uint32, now time.Time) error {
+		data := makeProbe(seq, now, f.param.Size)
+		return f.send(p, gtpConn, f.makeEchoRequest(uint16(seq), data))
+	}
+	recv := func(l4 []byte, now time.Time) {
+		reply := uint8(icmpEchoReply)
+		if f.proto == protoICMPv6 {
+			reply = icmpv6EchoReply
+		}
+		if l4[0] != reply {
+			return
+		}
+		f.stats.ReceivedBytes += uint64(len(l4))
+		f.echoed(l4[8:], now, seen)
+	}
+	return f.runProbe(ctx, interval, send, recv)
+}
+
+func (f *trafficFlow) makeEchoRequest(seq uint16, data []byte) (msg []byte) {
+
+	msg = make([]byte, 8, 8+len(data))
+	msg[0] = icmpEchoRequest
+	binary.BigEndian.PutUint16(msg[4:], f.sport)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	msg = append(msg, data...)
+
+	var sum uint32
+	if f.proto == protoICMPv6 {
+		msg[0] = icmpv6EchoRequest
+		sum = pseudoHeaderSum(f.src, f.dst, protoICMPv6, len(msg))
+	}
+	binary.BigEndian.PutUint16(msg[2:], checksum(msg, sum))
+	return
+}
+
+// runUDP sends the UDP probes at the constant bit rate, and measures the
+// RTT of the ones echoed.
+func (f *trafficFlow) runUDP(ctx context.Context, p *userPlane,
+	gtpConn *net.UDPConn) (err error) {
+
+	rate := f.param.Rate
+	if rate == 0 {
+		rate = defaultUDPRate
+	}
+	size := len(f.makeUDP(makeProbe(0, time.Now(), f.param.Size)))
+	size += len(makeIPPacket(f.src, f.dst, f.proto, nil))
+	interval := time.Duration(float64(size*8) / float64(rate) *
+		float64(time.Second))
+	seen := map[uint32]bool{}
+
+	send := func(seq uint32, now time.Time) error {
+		data := makeProbe(seq, now, f.param.Size)
+		return f.send(p, gtpConn, f.makeUDP(data))
+	}
+	recv := func(l4 []byte, now time.Time) {
+		if len(l4) < 8 {
+			return
+		}
+		f.stats.ReceivedBytes += uint64(len(l4))
+		f.echoed(l4[8:], now, seen)
+	}
+	return f.runProbe(ctx, interval, send, recv)
+}
+
+func (f *trafficFlow) makeUDP(data []byte) (seg []byte) {
+
+	seg = make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint16(seg, f.sport)
+	binary.BigEndian.PutUint16(seg[2:], f.dport)
+	binary.BigEndian.PutUint16(seg[4:], uint16(8+len(data)))
+	seg = append(seg, data...)
+
+	sum := checksum(seg, pseudoHeaderSum(f.src, f.dst, protoUDP, len(seg)))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(seg[6:], sum)
+	return
+}
+
+// TCP of the userspace stack. the data in flight is limited by the
+// congestion window and by the window advertised by the peer. the first
+// unacknowledged segment is retransmitted on the third duplicate ACK with
+// the fast recovery, and the segments are sent again from the first
+// unacknowledged one on the timeout with the loss window.
+// see RFC 793, RFC 5681, RFC 6298 and RFC 6582.
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+
+	tcpOptionMSS = 2
+
+	tcpRecvWindow   = 65535 // the receive buffer.
+	tcpSYNRetries   = 3
+	tcpInitialRTO   = time.Second
+	tcpMinRTO       = 200 * time.Millisecond
+	tcpMaxRTO       = 8 * time.Second
+	tcpTickInterval = 10 * time.Millisecond
+)
+
+type tcpHeader struct {
+	seq   uint32
+	ack   uint32
+	flags uint8
+	win   uint16
+	mss   uint16
+	data  []byte
+}
+
+func decTCPHeader(seg []byte) (h tcpHeader, ok bool) {
+	if len(seg) < 20 {
+		return
+	}
+	hlen := int(seg[12]>>4) * 4
+	if hlen < 20 || hlen > len(seg) {
+		return
+	}
+	h.seq = binary.BigEndian.Uint32(seg[4:])
+	h.ack = binary.BigEndian.Uint32(seg[8:])
+	h.flags = seg[13]
+	h.win = binary.BigEndian.Uint16(seg[14:])
+	h.data = seg[hlen:]
+
+	opts := seg[20:hlen]
+	for len(opts) > 0 {
+		switch opts[0] {
+		case 0: // end of option list
+			opts = nil
+			continue
+		case 1: // no operation
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			break
+		}
+		if opts[0] == tcpOptionMSS && opts[1] == 4 {
+			h.mss = binary.BigEndian.Uint16(opts[2:])
+		}
+		opts = opts[opts[1]:]
+	}
+	ok = true
+	return
+}
+
+func (f *trafficFlow) makeTCP(seq, ack uint32, flags uint8, win uint16,
+	opts, data []byte) (seg []byte) {
+
+	hlen := 20 + len(opts)
+	seg = make([]byte, hlen, hlen+len(data))
+	binary.BigEndian.PutUint16(seg, f.sport)
+	binary.BigEndian.PutUint16(seg[2:], f.dport)
+	binary.BigEndian.PutUint32(seg[4:], seq)
+	binary.BigEndian.PutUint32(seg[8:], ack)
+	seg[12] = byte(hlen/4) << 4
+	seg[13] = flags
+	binary.BigEndian.PutUint16(seg[14:], win)
+	copy(seg[20:], opts)
+	seg = append(seg, data...)
+
+	sum := checksum(seg, pseudoHeaderSum(f.src, f.dst, protoTCP, len(seg)))
+	binary.BigEndian.PutUint16(seg[16:], sum)
+	return
+}
+
+// newISS returns the initial sequence number by the clock incremented every
+// 4 microseconds, so that the connection of the same ports is accepted by
+// the peer in TIME-WAIT of the previous one.
+func newISS() uint32 {
+	return uint32(time.Now().UnixNano() / 4000)
+}
+
+func seqLT(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// tcpConn is the state of the sender.
+type tcpConn struct {
+	una    uint32 // the first unacknowledged.
+	nxt    uint32 // the next to be sent.
+	high   uint32 // the highest sent.
+	rcvNxt uint32
+	wnd    uint32 // the window of the peer.
+	mss    int
+
+	cwnd     uint32
+	ssthresh uint32
+	recover  uint32 // the highest sent when the fast recovery started.
+	recovery bool
+	dupAcks  int
+
+	sentAt map[uint32]time.Time // keyed by the end of the segment.
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+}
+
+func (c *tcpConn) updateRTO(rtt time.Duration) {
+	if c.srtt == 0 {
+		c.srtt, c.rttvar = rtt, rtt/2
+	} else {
+		d := c.srtt - rtt
+		if d < 0 {
+			d = -d
+		}
+		c.rttvar = (3*c.rttvar + d) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	c.rto = c.srtt + 4*c.rttvar
+	if c.rto < tcpMinRTO {
+		c.rto = tcpMinRTO
+	}
+}
+
+// retransmit goes back to the first unacknowledged segment. the segments
+// retransmitted are not used for the RTT.
+func (c *tcpConn) retransmit() {
+	c.nxt = c.una
+	c.sentAt = map[uint32]time.Time{}
+}
+
+// initialWindow returns the initial congestion window by the MSS.
+// see 3.1 in RFC 5681.
+func initialWindow(mss int) uint32 {
+	switch {
+	case mss > 2190:
+		return uint32(2 * mss)
+	case mss > 1095:
+		return uint32(3 * mss)
+	}
+	return uint32(4 * mss)
+}
+
+// window returns the data allowed in flight.
+func (c *tcpConn) window() uint32 {
+	if c.wnd < c.cwnd {
+		return c.wnd
+	}
+	return c.cwnd
+}
+
+// halveWindow sets the slow start threshold to the half of the data in
+// flight. see (4) in RFC 5681.
+func (c *tcpConn) halveWindow() {
+	c.ssthresh = (c.high - c.una) / 2
+	if floor := uint32(2 * c.mss); c.ssthresh < floor {
+		c.ssthresh = floor
+	}
+}
+
+// ackNewData opens the congestion window by the data newly acknowledged
+// before una is advanced, and returns true if the ACK is partial in the
+// fast recovery, which retransmits the next unacknowledged segment.
+func (c *tcpConn) ackNewData(ack uint32) (partial bool) {
+
+	acked := ack - c.una
+	mss := uint32(c.mss)
+	c.dupAcks = 0
+
+	if c.recovery {
+		if seqLT(ack, c.recover) {
+			// deflate the window by the data acknowledged, and add back
+			// the segment retransmitted. see 3.2 in RFC 6582.
+			if acked < c.cwnd {
+				c.cwnd -= acked
+			} else {
+				c.cwnd = 0
+			}
+			if acked >= mss {
+				c.cwnd += mss
+			}
+			return true
+		}
+		c.recovery = false
+		c.cwnd = c.ssthresh
+		return false
+	}
+
+	if c.cwnd < c.ssthresh {
+		// slow start.
+		if acked > mss {
+			acked = mss
+		}
+		c.cwnd += acked
+		return false
+	}
+	// congestion avoidance.
+	inc := mss * mss / c.cwnd
+	if inc == 0 {
+		inc = 1
+	}
+	c.cwnd += inc
+	return false
+}
+
+// dupAck inflates the window in the fast recovery, and returns true if
+// the first unacknowledged segment is retransmitted on the third duplicate
+// ACK. see 3.2 in RFC 5681.
+func (c *tcpConn) dupAck() (fastRetransmit bool) {
+
+	c.dupAcks++
+	switch {
+	case c.recovery:
+		c.cwnd += uint32(c.mss)
+	case c.dupAcks == 3:
+		c.halveWindow()
+		c.cwnd = c.ssthresh + 3*uint32(c.mss)
+		c.recover = c.high
+		c.recovery = true
+		fastRetransmit = true
+	}
+	return
+}
+
+// timeout collapses the congestion window to the loss window, and goes
+// back to the first unacknowledged segment.
+func (c *tcpConn) timeout() {
+	c.halveWindow()
+	c.cwnd = uint32(c.mss)
+	c.recovery = false
+	c.dupAcks = 0
+	c.retransmit()
+}
+
+// runTCP connects to the sink in the userspace stack, and sends the data
+// as fast as the window allows for the duration.
+func (f *trafficFlow) runTCP(ctx context.Context, p *userPlane,
+	gtpConn *net.UDPConn) (err error) {
+
+	sc, err := p.dialStack(gtpConn, f, f.param.Size, stackSendBuffer)
+	if err != nil {
+		return
+	}
+	go io.Copy(ioutil.Discard, sc) // the data from the sink, if any.
+	go func() {
+		select {
+		case <-ctx.Done():
+			sc.SetWriteDeadline(time.Now())
+		case <-sc.done:
+		}
+	}()
+
+	start := time.Now()
+	sc.SetWriteDeadline(start.Add(f.duration))
+	data := make([]byte, f.param.Size)
+	for err == nil {
+		_, err = sc.Write(data)
+	}
+	f.stats.Elapsed = time.Since(start)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = nil
+	}
+
+	// the statistics are final after the connection is closed.
+	sc.Close()
+	<-sc.done
+	return
+}
+
+// makeIPPacket returns the IPv4 or IPv6 packet of the transport layer.
+func makeIPPacket(src, dst net.IP, proto uint8, l4 []byte) (pkt []byte) {
+
+	if src.To4() != nil {
+		pkt = make([]byte, 20, 20+len(l4))
+		pkt[0] = 0x45 // version 4, header length 20
+		binary.BigEndian.PutUint16(pkt[2:], uint16(20+len(l4)))
+		pkt[6] = 0x40 // don't fragment
+		pkt[8] = 64   // TTL
+		pkt[9] = proto
+		copy(pkt[12:16], src.To4())
+		copy(pkt[16:20], dst.To4())
+		binary.BigEndian.PutUint16(pkt[10:], checksum(pkt, 0))
+	} else {
+		pkt = make([]byte, 40, 40+len(l4))
+		pkt[0] = 0x60 // version 6
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(l4)))
+		pkt[6] = proto
+		pkt[7] = 64 // hop limit
+		copy(pkt[8:24], src.To16())
+		copy(pkt[24:40], dst.To16())
+	}
+	pkt = append(pkt, l4...)
+	return
+}
+
+// splitIPPacket returns the addresses, the protocol and the transport layer
+// of the IPv4 or IPv6 packet. the IPv6 extension headers are not supported.
+func splitIPPacket(pkt []byte) (src, dst net.IP, proto uint8, l4 []byte,
+	ok bool) {
+
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		hlen := int(pkt[0]&0x0f) * 4
+		length := int(binary.BigEndian.Uint16(pkt[2:]))
+		if hlen < 20 || length < hlen || length > len(pkt) {
+			return
+		}
+		return net.IP(pkt[12:16]), net.IP(pkt[16:20]), pkt[9],
+			pkt[hlen:length], true
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		length := int(binary.BigEndian.Uint16(pkt[4:]))
+		if 40+length > len(pkt) {
+			return
+		}
+		return net.IP(pkt[8:24]), net.IP(pkt[24:40]), pkt[6],
+			pkt[40 : 40+length], true
+	}
+	return
+}
+
+// pseudoHeaderSum returns the sum of the pseudo header for the checksum of
+// the transport layer.
+func pseudoHeaderSum(src, dst net.IP, proto uint8, length int) (sum uint32) {
+
+	var b []byte
+	if src.To4() != nil {
+		b = append(append(b, src.To4()...), dst.To4()...)
+		b = append(b, 0, proto, byte(length>>8), byte(length))
+	} else {
+		b = append(append(b, src.To16()...), dst.To16()...)
+		b = append(b, byte(length>>24), byte(length>>16),
+			byte(length>>8), byte(length), 0, 0, 0, proto)
+	}
+	for i := 0; i < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	return
+}
+
+// checksum returns the internet checksum of b with the initial sum.
+func checksum(b []byte, sum uint32) uint16 {
+
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 != 0 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
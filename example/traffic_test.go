@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testSrc4 = net.ParseIP("192.0.2.1")
+	testDst4 = net.ParseIP("198.51.100.1")
+	testSrc6 = net.ParseIP("2001:db8::1")
+	testDst6 = net.ParseIP("2001:db8::2")
+)
+
+func TestMakeIPPacket(t *testing.T) {
+
+	// the IPv4 header with the checksum 0xb861 of 95 octets of UDP.
+	expect, _ := hex.DecodeString("450000730000400040" + "11b861" +
+		"c0a80001c0a800c7")
+	pkt := makeIPPacket(net.IPv4(192, 168, 0, 1), net.IPv4(192, 168, 0, 199),
+		protoUDP, make([]byte, 95))
+	if !bytes.Equal(pkt[:20], expect) || len(pkt) != 115 {
+		t.Errorf("IPv4 header expect: %x, actual: %x", expect, pkt[:20])
+	}
+	if checksum(pkt[:20], 0) != 0 {
+		t.Errorf("IPv4 header checksum is not valid: %x", pkt[:20])
+	}
+
+	expect, _ = hex.DecodeString("6000000000041140" +
+		"20010db8000000000000000000000001" +
+		"20010db8000000000000000000000002" + "01020304")
+	pkt = makeIPPacket(testSrc6, testDst6, protoUDP, []byte{1, 2, 3, 4})
+	if !bytes.Equal(pkt, expect) {
+		t.Errorf("IPv6 packet expect: %x, actual: %x", expect, pkt)
+	}
+}
+
+func TestTransportChecksum(t *testing.T) {
+
+	flow := func(src, dst net.IP, proto uint8, dport uint16) *trafficFlow {
+		return &trafficFlow{src: src, dst: dst, proto: proto,
+			sport: 40000, dport: dport}
+	}
+	mss := []byte{tcpOptionMSS, 4, 0x05, 0x50}
+
+	for _, tc := range []struct {
+		name   string
+		f      *trafficFlow
+		make   func(f *trafficFlow) []byte
+		expect string
+	}{
+		{"UDP over IPv4", flow(testSrc4, testDst4, protoUDP, 7),
+			func(f *trafficFlow) []byte { return f.makeUDP([]byte("hello")) },
+			"9c400007000d338468656c6c6f"},
+		{"UDP over IPv6", flow(testSrc6, testDst6, protoUDP, 7),
+			func(f *trafficFlow) []byte { return f.makeUDP([]byte("hello")) },
+			"9c400007000dc44568656c6c6f"},
+		{"ICMP echo", flow(testSrc4, testDst4, protoICMP, 0),
+			func(f *trafficFlow) []byte {
+				return f.makeEchoRequest(1, []byte("ping"))
+			},
+			"08007ced9c40000170696e67"},
+		{"ICMPv6 echo", flow(testSrc6, testDst6, protoICMPv6, 0),
+			func(f *trafficFlow) []byte {
+				return f.makeEchoRequest(1, []byte("ping"))
+			},
+			"8000a9319c40000170696e67"},
+		{"TCP SYN over IPv4", flow(testSrc4, testDst4, protoTCP, 5001),
+			func(f *trafficFlow) []byte {
+				return f.makeTCP(1000, 0, tcpFlagSYN, 65535, mss, nil)
+			},
+			"9c401389000003e8000000006002fffff8a2000002040550"},
+		{"TCP over IPv6", flow(testSrc6, testDst6, protoTCP, 5001),
+			func(f *trafficFlow) []byte {
+				return f.makeTCP(1000, 2000, tcpFlagACK|tcpFlagPSH, 1000,
+					nil, []byte("data"))
+			},
+			"9c401389000003e8000007d0501803e8bc27000064617461"},
+	} {
+		expect, _ := hex.DecodeString(tc.expect)
+		seg := tc.make(tc.f)
+		if !bytes.Equal(seg, expect) {
+			t.Errorf("%s expect: %x, actual: %x", tc.name, expect, seg)
+		}
+
+		// the checksum of the segment received is verified to zero.
+		var sum uint32
+		if tc.f.proto != protoICMP {
+			sum = pseudoHeaderSum(tc.f.src, tc.f.dst, tc.f.proto, len(seg))
+		}
+		if checksum(seg, sum) != 0 {
+			t.Errorf("%s: checksum is not valid", tc.name)
+		}
+	}
+}
+
+func TestSplitIPPacket(t *testing.T) {
+
+	l4 := []byte("transport")
+	for _, tc := range []struct {
+		src, dst net.IP
+		proto    uint8
+	}{
+		{testSrc4, testDst4, protoTCP},
+		{testSrc6, testDst6, protoICMPv6},
+	} {
+		pkt := makeIPPacket(tc.src, tc.dst, tc.proto, l4)
+
+		// the padding after the packet is not of the transport layer.
+		src, dst, proto, payload, ok := splitIPPacket(append(pkt, 0, 0))
+		if !ok || !src.Equal(tc.src) || !dst.Equal(tc.dst) ||
+			proto != tc.proto || !bytes.Equal(payload, l4) {
+			t.Errorf("split %v: %v %v %d %q %v", tc.src, src, dst, proto,
+				payload, ok)
+		}
+		if _, _, _, _, ok = splitIPPacket(pkt[:len(pkt)-1]); ok {
+			t.Errorf("split %v: truncated packet is accepted", tc.src)
+		}
+	}
+
+	for _, in := range []string{
+		"",
+		"45000014000000004011", // short header.
+		"4f00000a00000000401100000000000000000000", // length < header.
+		"50000014000000004011000000000000000000000000000000000000" +
+			"00000000000000000000000000000000", // version 5.
+	} {
+		pkt, _ := hex.DecodeString(in)
+		if _, _, _, l4, ok := splitIPPacket(pkt); ok {
+			t.Errorf("split %s: %x is accepted", in, l4)
+		}
+	}
+}
+
+func TestTrafficStats(t *testing.T) {
+
+	ms := time.Millisecond
+	var a trafficStats
+	for _, rtt := range []time.Duration{10 * ms, 20 * ms, 10 * ms} {
+		a.addRTT(rtt)
+	}
+	// the jitter is smoothed by 1/16 of the difference.
+	jitter := 625*time.Microsecond + (10*ms-625*time.Microsecond)/16
+	if a.RTTMin != 10*ms || a.RTTMax != 20*ms ||
+		a.RTTAvg() != 40*ms/3 || a.Jitter != jitter {
+		t.Errorf("RTT min/avg/max %v/%v/%v, jitter %v expect: %v",
+			a.RTTMin, a.RTTAvg(), a.RTTMax, a.Jitter, jitter)
+	}
+	a.Sent, a.Received, a.SentBytes, a.Elapsed = 6, 5, 600, time.Second
+
+	var b trafficStats
+	b.addRTT(30 * ms)
+	b.Sent, b.Received, b.SentBytes, b.AckedBytes = 4, 4, 400, 300
+	b.Retransmits, b.Elapsed = 1, 2*time.Second
+
+	var sum trafficStats
+	sum.add(&a)
+	sum.add(&b)
+	sum.add(&trafficStats{}) // no RTT.
+
+	// the jitter is averaged by the number of the samples.
+	jitter = jitter * 3 / 4
+	if sum.RTTMin != 10*ms || sum.RTTMax != 30*ms ||
+		sum.RTTAvg() != 70*ms/4 || sum.Jitter != jitter {
+		t.Errorf("RTT min/avg/max %v/%v/%v, jitter %v expect: %v",
+			sum.RTTMin, sum.RTTAvg(), sum.RTTMax, sum.Jitter, jitter)
+	}
+	if sum.Sent != 10 || sum.Received != 9 || sum.SentBytes != 1000 ||
+		sum.AckedBytes != 300 || sum.Retransmits != 1 ||
+		sum.Elapsed != 2*time.Second {
+		t.Errorf("unexpected sum: %+v", sum)
+	}
+	// the uplink is of the data acknowledged if any.
+	for _, s := range []string{
+		"loss 10.0%", "UL 1200 bps", "retransmits 1"} {
+		if !strings.Contains(sum.String(), s) {
+			t.Errorf("%q not in %q", s, sum.String())
+		}
+	}
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hhorai/gnbsim/encoding/gtp"
+	"github.com/hhorai/gnbsim/encoding/nas"
+	"github.com/hhorai/gnbsim/encoding/ngap"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Userspace TCP/IP stack of the UE.
+// the TCP connections of the UE are terminated in gnbsim, and the segments
+// are sent in the tunnel of the PDU session in the same way as the traffic
+// generated by the UE. so the HTTP probe runs without the TUN device, the
+// UE address on the interface and the root privilege. the TCP flow of the
+// traffic generator runs on the connection of the stack as well. only the
+// active open is supported, which is enough for the HTTP client, and the
+// host must be given by the IP address as there is no resolver in the
+// stack.
+// see RFC 793, RFC 5681 and RFC 6298.
+
+const (
+	// the MSS fits in the MTU 1500 of N3 with the GTP-U header, the PDU
+	// session container and the IPv6 header.
+	stackMSS = 1360
+
+	// the data of the application buffered to be sent.
+	stackSendBuffer = 256 * 1024
+)
+
+// stackConn is the TCP connection of the UE in the userspace stack. the
+// segments are received from the flow registered to the user plane, and
+// the statistics of the connection are counted in the flow.
+type stackConn struct {
+	p       *userPlane
+	f       *trafficFlow
+	gtpConn *net.UDPConn
+	sndBuf  int // the data of the application buffered to be sent.
+
+	mu          sync.Mutex
+	c           tcpConn
+	iss         uint32
+	synSent     time.Time
+	synRetries  int
+	established bool
+	progress    time.Time
+
+	snd      []byte            // the data from una, sent or not yet.
+	rcv      []byte            // the data received in order, not yet read.
+	rcvWnd   uint16            // the window advertised last.
+	ooo      map[uint32][]byte // the data out of order keyed by seq.
+	closing  bool
+	closeBy  time.Time
+	finSent  bool
+	finAcked bool
+	finRcvd  bool
+	err      error
+
+	rdeadline time.Time
+	wdeadline time.Time
+	changed   chan struct{} // closed when the state is changed.
+	done      chan struct{} // closed when the connection is closed.
+}
+
+// stackDialer returns the dialer of the TCP connection from the address of
+// the PDU session in the userspace stack.
+func (p *userPlane) stackDialer(gtpConn *net.UDPConn, s *nas.PDUSession,
+	r *ngap.PDUSession, src net.IP) func(
+	network, address string) (net.Conn, error) {
+
+	return func(network, address string) (conn net.Conn, err error) {
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+		default:
+			err = fmt.Errorf("%s is not supported in the userspace stack",
+				network)
+			return
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return
+		}
+		dst := net.ParseIP(host)
+		if dst == nil || (dst.To4() == nil) != (src.To4() == nil) {
+			err = fmt.Errorf("%s is not the IP address of the family of %v",
+				host, src)
+			return
+		}
+		dport, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return
+		}
+
+		f := &trafficFlow{
+			param: ngap.Traffic{Type: "tcp", Dst: address},
+			s:     s,
+			r:     r,
+			src:   src,
+			dst:   dst,
+			proto: protoTCP,
+			sport: nextTrafficPort(),
+			dport: uint16(dport),
+			rx:    make(chan gtp.Packet, trafficQueueLen),
+		}
+		p.addFlow(f)
+
+		sc, err := p.dialStack(gtpConn, f, stackMSS, stackSendBuffer)
+		if err != nil {
+			return
+		}
+		conn = sc
+		return
+	}
+}
+
+// dialStack opens the TCP connection of the flow added to the user plane,
+// which advertises the MSS and buffers the data of the application up to
+// sndBuf. the flow is removed when the connection is closed.
+func (p *userPlane) dialStack(gtpConn *net.UDPConn, f *trafficFlow,
+	mss, sndBuf int) (sc *stackConn, err error) {
+
+	sc = &stackConn{
+		p:       p,
+		f:       f,
+		gtpConn: gtpConn,
+		sndBuf:  sndBuf,
+		iss:     newISS(),
+		changed: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	sc.c = tcpConn{
+		una:    sc.iss + 1,
+		nxt:    sc.iss + 1,
+		high:   sc.iss + 1,
+		mss:    mss,
+		sentAt: map[uint32]time.Time{},
+		rto:    tcpInitialRTO,
+
+		// the slow start threshold is as high as any window at first.
+		ssthresh: ^uint32(0),
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if err = sc.sendSYN(time.Now()); err != nil {
+		p.removeFlow(f)
+		return nil, err
+	}
+	go sc.run()
+
+	for !sc.established {
+		if sc.err != nil {
+			return nil, sc.err
+		}
+		sc.wait(time.Time{})
+	}
+	return
+}
+
+// sendSYN advertises the MSS, which is not changed before the SYN-ACK.
+func (sc *stackConn) sendSYN(now time.Time) error {
+	mss := []byte{tcpOptionMSS, 4, byte(sc.c.mss >> 8), byte(sc.c.mss)}
+	sc.synSent = now
+	return sc.f.send(sc.p, sc.gtpConn,
+		sc.f.makeTCP(sc.iss, 0, tcpFlagSYN, sc.recvWindow(), mss, nil))
+}
+
+// sendSegment sends the segment of seq with the ACK of the data received
+// and the window of the receive buffer.
+func (sc *stackConn) sendSegment(seq uint32, flags uint8,
+	data []byte) error {
+	sc.rcvWnd = sc.recvWindow()
+	return sc.f.send(sc.p, sc.gtpConn,
+		sc.f.makeTCP(seq, sc.c.rcvNxt, flags, sc.rcvWnd, nil, data))
+}
+
+func (sc *stackConn) sendACK() error {
+	return sc.sendSegment(sc.c.nxt, tcpFlagACK, nil)
+}
+
+// recvWindow returns the room of the receive buffer.
+func (sc *stackConn) recvWindow() uint16 {
+	if n := tcpRecvWindow - len(sc.rcv); n > 0 {
+		return uint16(n)
+	}
+	return 0
+}
+
+// notify wakes up the readers and the writers waiting for the change.
+func (sc *stackConn) notify() {
+	close(sc.changed)
+	sc.changed = make(chan struct{})
+}
+
+// wait waits for the change of the state until the deadline with sc.mu
+// held, which is released while waiting.
+func (sc *stackConn) wait(deadline time.Time) (err error) {
+	changed := sc.changed
+	sc.mu.Unlock()
+	defer sc.mu.Lock()
+
+	if deadline.IsZero() {
+		<-changed
+		return
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-changed:
+	case <-timer.C:
+		err = os.ErrDeadlineExceeded
+	}
+	return
+}
+
+// expired returns true if the deadline is set and has passed.
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// fail closes the connection with the error.
+func (sc *stackConn) fail(err error) {
+	if sc.err == nil {
+		sc.err = err
+		sc.notify()
+	}
+}
+
+// run processes the segments received and the retransmission timer until
+// the connection is closed.
+func (sc *stackConn) run() {
+
+	defer close(sc.done)
+	defer sc.p.removeFlow(sc.f)
+
+	tick := time.NewTicker(tcpTickInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case pkt := <-sc.f.rx:
+			sc.mu.Lock()
+			sc.input(pkt.Payload, time.Now())
+			pkt.Release()
+		case now := <-tick.C:
+			sc.mu.Lock()
+			sc.timeout(now)
+		}
+		done := sc.err != nil
+		sc.mu.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+func (sc *stackConn) input(l4 []byte, now time.Time) {
+
+	h, ok := decTCPHeader(l4)
+	if !ok {
+		return
+	}
+	c := &sc.c
+	if h.flags&tcpFlagRST != 0 {
+		if sc.established {
+			sc.fail(errors.New("connection reset by peer"))
+		} else {
+			sc.fail(errors.New("connection refused"))
+		}
+		return
+	}
+
+	// 3-way handshake.
+	if !sc.established {
+		want := uint8(tcpFlagSYN | tcpFlagACK)
+		if h.flags&want != want || h.ack != sc.iss+1 {
+			return
+		}
+		c.rcvNxt = h.seq + 1
+		c.wnd = uint32(h.win)
+		if h.mss != 0 && int(h.mss) < c.mss {
+			c.mss = int(h.mss)
+		}
+		c.cwnd = initialWindow(c.mss)
+		sc.f.stats.addRTT(now.Sub(sc.synSent))
+		sc.established = true
+		sc.progress = now
+		if err := sc.sendACK(); err != nil {
+			sc.fail(err)
+			return
+		}
+		sc.notify()
+		return
+	}
+
+	if h.flags&tcpFlagACK != 0 {
+		c.wnd = uint32(h.win)
+		switch {
+		case seqLT(c.una, h.ack) && !seqLT(c.high, h.ack):
+			if sent, ok := c.sentAt[h.ack]; ok {
+				c.updateRTO(now.Sub(sent))
+				sc.f.stats.addRTT(now.Sub(sent))
+			}
+			for seq := range c.sentAt {
+				if !seqLT(h.ack, seq) {
+					delete(c.sentAt, seq)
+				}
+			}
+			partial := c.ackNewData(h.ack)
+			acked := int(h.ack - c.una)
+			if acked > len(sc.snd) {
+				// the FIN is acknowledged.
+				acked = len(sc.snd)
+				sc.finAcked = true
+			}
+			sc.f.stats.AckedBytes += uint64(acked)
+			sc.f.stats.Received += uint64((acked + c.mss - 1) / c.mss)
+			sc.snd = sc.snd[acked:]
+			c.una = h.ack
+			if seqLT(c.nxt, c.una) {
+				c.nxt = c.una
+			}
+			sc.progress = now
+			sc.notify()
+			if partial {
+				sc.retransmitFirst()
+			}
+		case h.ack == c.una && len(h.data) == 0 && c.una != c.high:
+			if c.dupAck() {
+				sc.retransmitFirst()
+			}
+		}
+	}
+
+	// the data out of order is kept until the gap is filled, and the
+	// duplicate ACK makes the peer retransmit the one missing. the FIN
+	// out of order is dropped.
+	fin := h.flags&tcpFlagFIN != 0
+	if len(h.data) != 0 || fin {
+		if !sc.finRcvd {
+			if h.seq != c.rcvNxt {
+				fin = false
+			}
+			sc.reassemble(h.seq, h.data)
+			if fin && h.seq+uint32(len(h.data)) == c.rcvNxt {
+				sc.finRcvd = true
+				c.rcvNxt++
+			}
+			sc.notify()
+		}
+		if err := sc.sendACK(); err != nil {
+			sc.fail(err)
+			return
+		}
+	}
+
+	if sc.finAcked && sc.finRcvd {
+		sc.fail(net.ErrClosed)
+		return
+	}
+	if err := sc.output(); err != nil {
+		sc.fail(err)
+	}
+}
+
+// reassemble puts the segment in order, and appends the data in order to
+// the receive buffer. the data retransmitted may be partly received.
+func (sc *stackConn) reassemble(seq uint32, data []byte) {
+
+	c := &sc.c
+	limit := c.rcvNxt + uint32(sc.recvWindow())
+	if seqLT(limit, seq+uint32(len(data))) {
+		if !seqLT(seq, limit) {
+			return // out of the window.
+		}
+		data = data[:limit-seq]
+	}
+	end := seq + uint32(len(data))
+	if !seqLT(c.rcvNxt, end) {
+		return // received.
+	}
+	if sc.ooo == nil {
+		sc.ooo = map[uint32][]byte{}
+	}
+	if old, ok := sc.ooo[seq]; !ok || len(old) < len(data) {
+		sc.ooo[seq] = append([]byte{}, data...)
+	}
+
+	for progress := true; progress; {
+		progress = false
+		for seq, data := range sc.ooo {
+			if seqLT(c.rcvNxt, seq) {
+				continue
+			}
+			delete(sc.ooo, seq)
+			if off := c.rcvNxt - seq; int(off) < len(data) {
+				sc.rcv = append(sc.rcv, data[off:]...)
+				sc.f.stats.ReceivedBytes += uint64(len(data)) - uint64(off)
+				c.rcvNxt += uint32(len(data)) - off
+				progress = true
+			}
+		}
+	}
+}
+
+func (sc *stackConn) timeout(now time.Time) {
+
+	c := &sc.c
+	switch {
+	case sc.closing && now.After(sc.closeBy):
+		// the peer does not close the connection.
+		sc.sendSegment(c.nxt, tcpFlagRST, nil)
+		sc.fail(net.ErrClosed)
+	case !sc.established:
+		if now.Sub(sc.synSent) < tcpInitialRTO<<sc.synRetries {
+			return
+		}
+		if sc.synRetries++; sc.synRetries == tcpSYNRetries {
+			sc.fail(fmt.Errorf("connection to %v timed out", sc.f.dst))
+			return
+		}
+		if err := sc.sendSYN(now); err != nil {
+			sc.fail(err)
+		}
+	case c.una != c.high && now.Sub(sc.progress) >= c.rto:
+		sc.f.stats.Retransmits++
+		c.timeout()
+		if !sc.finAcked {
+			sc.finSent = false
+		}
+		if err := sc.output(); err != nil {
+			sc.fail(err)
+		}
+		c.rto *= 2
+		if c.rto > tcpMaxRTO {
+			c.rto = tcpMaxRTO
+		}
+		sc.progress = now
+	}
+}
+
+// retransmitFirst retransmits the first unacknowledged segment, or the
+// FIN, in the fast retransmit. the segment is not used for the RTT.
+func (sc *stackConn) retransmitFirst() {
+
+	c := &sc.c
+	sc.f.stats.Retransmits++
+	n := len(sc.snd)
+	if n > c.mss {
+		n = c.mss
+	}
+	delete(c.sentAt, c.una+uint32(n))
+
+	var err error
+	if n == 0 && sc.finSent {
+		err = sc.sendSegment(c.una, tcpFlagFIN|tcpFlagACK, nil)
+	} else {
+		err = sc.sendSegment(c.una, tcpFlagACK|tcpFlagPSH, sc.snd[:n])
+	}
+	if err != nil {
+		sc.fail(err)
+		return
+	}
+	if err = sc.output(); err != nil {
+		sc.fail(err)
+	}
+}
+
+// output sends the data in the window, and the FIN after all of the data
+// if the connection is closing. a segment is sent even if the window is
+// zero and nothing is in flight, to probe the window.
+func (sc *stackConn) output() (err error) {
+
+	c := &sc.c
+	wnd := c.window()
+	for {
+		off := int(c.nxt - c.una)
+		if off >= len(sc.snd) {
+			break
+		}
+		n := len(sc.snd) - off
+		if n > c.mss {
+			n = c.mss
+		}
+		if c.nxt != c.una && c.nxt-c.una+uint32(n) > wnd {
+			break
+		}
+		if !seqLT(c.nxt, c.high) {
+			c.sentAt[c.nxt+uint32(n)] = time.Now()
+		}
+		err = sc.sendSegment(c.nxt, tcpFlagACK|tcpFlagPSH,
+			sc.snd[off:off+n])
+		if err != nil {
+			return
+		}
+		c.nxt += uint32(n)
+		if seqLT(c.high, c.nxt) {
+			c.high = c.nxt
+		}
+	}
+
+	if sc.closing && !sc.finSent &&
+		c.nxt == c.una+uint32(len(sc.snd)) {
+		if err = sc.sendSegment(c.nxt, tcpFlagFIN|tcpFlagACK,
+			nil); err != nil {
+			return
+		}
+		sc.finSent = true
+		c.nxt++
+		if seqLT(c.high, c.nxt) {
+			c.high = c.nxt
+		}
+	}
+	return
+}
+
+func (sc *stackConn) Read(b []byte) (n int, err error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for len(sc.rcv) == 0 {
+		switch {
+		case sc.finRcvd:
+			return 0, io.EOF
+		case sc.closing:
+			return 0, net.ErrClosed
+		case sc.err != nil:
+			return 0, sc.err
+		case expired(sc.rdeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		if err = sc.wait(sc.rdeadline); err != nil {
+			return
+		}
+	}
+	n = copy(b, sc.rcv)
+	sc.rcv = sc.rcv[n:]
+
+	// the window is updated when it is opened by a segment, or by the half
+	// of the buffer. see 4.2.3.3 in RFC 1122.
+	opened := int(sc.recvWindow()) - int(sc.rcvWnd)
+	if sc.err == nil && !sc.finRcvd &&
+		(opened >= sc.c.mss || opened >= tcpRecvWindow/2) {
+		if err := sc.sendACK(); err != nil {
+			sc.fail(err)
+		}
+	}
+	return
+}
+
+func (sc *stackConn) Write(b []byte) (n int, err error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for n < len(b) {
+		switch {
+		case sc.closing:
+			return n, net.ErrClosed
+		case sc.err != nil:
+			return n, sc.err
+		case expired(sc.wdeadline):
+			return n, os.ErrDeadlineExceeded
+		}
+		room := sc.sndBuf - len(sc.snd)
+		if room <= 0 {
+			if err = sc.wait(sc.wdeadline); err != nil {
+				return
+			}
+			continue
+		}
+		m := len(b) - n
+		if m > room {
+			m = room
+		}
+		sc.snd = append(sc.snd, b[n:n+m]...)
+		n += m
+		if err = sc.output(); err != nil {
+			sc.fail(err)
+			return
+		}
+	}
+	return
+}
+
+// Close sends the FIN after the data buffered. the connection is reset if
+// the peer does not close it in the drain time.
+func (sc *stackConn) Close() (err error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.closing || sc.err != nil {
+		return
+	}
+	sc.closing = true
+	sc.closeBy = time.Now().Add(trafficDrainTime)
+	sc.notify()
+	if err = sc.output(); err != nil {
+		sc.fail(err)
+	}
+	return
+}
+
+func (sc *stackConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: sc.f.src, Port: int(sc.f.sport)}
+}
+
+func (sc *stackConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: sc.f.dst, Port: int(sc.f.dport)}
+}
+
+func (sc *stackConn) SetDeadline(t time.Time) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.rdeadline, sc.wdeadline = t, t
+	sc.notify()
+	return nil
+}
+
+func (sc *stackConn) SetReadDeadline(t time.Time) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.rdeadline = t
+	sc.notify()
+	return nil
+}
+
+func (sc *stackConn) SetWriteDeadline(t time.Time) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.wdeadline = t
+	sc.notify()
+	return nil
+}
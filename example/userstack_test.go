@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"github.com/hhorai/gnbsim/encoding/gtp"
+	"github.com/hhorai/gnbsim/encoding/nas"
+	"github.com/hhorai/gnbsim/encoding/ngap"
+	"github.com/vishvananda/netlink"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testUPF is the UPF on the loopback which forwards the uplink of the UE
+// to the kernel by the TUN device, and the downlink back to the user plane.
+// the TCP peers of the stack are the listeners of the kernel.
+type testUPF struct {
+	tun *netlink.Tuntap
+	n3  *net.UDPConn // the N3 of the UPF.
+	gnb *net.UDPConn // the N3 of the gNB.
+	p   *userPlane
+	s   *nas.PDUSession
+	r   *ngap.PDUSession
+
+	mu   sync.Mutex
+	drop func(h tcpHeader) bool // drops the uplink segment if true.
+}
+
+var (
+	testUPFAddr = net.IPv4(127, 0, 0, 2)
+	testDNAddr  = net.IPv4(10, 98, 0, 1)
+	testUEAddr  = net.IPv4(10, 98, 0, 2)
+)
+
+func newTestUPF(t *testing.T) (u *testUPF) {
+
+	tun, err := addTunnel("ustk0", 1)
+	if err != nil {
+		t.Skipf("TUN device is not available: %v", err)
+	}
+	link, err := netlink.LinkByName("ustk0")
+	if err != nil {
+		t.Skipf("TUN device is not available: %v", err)
+	}
+	addr, _ := netlink.ParseAddr(testDNAddr.String() + "/24")
+	if err = netlink.AddrAdd(link, addr); err != nil {
+		netlink.LinkDel(tun)
+		t.Skipf("failed to add the address: %v", err)
+	}
+	n3, err := net.ListenUDP("udp4",
+		&net.UDPAddr{IP: testUPFAddr, Port: gtp.Port})
+	if err != nil {
+		netlink.LinkDel(tun)
+		t.Skipf("failed to listen N3: %v", err)
+	}
+	gnb, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := gtp.NewGTP(1, 2)
+	g.PeerAddr = testUPFAddr
+	r := &ngap.PDUSession{ID: 1, QosFlowID: 9, LocalTEID: 1,
+		PeerAddr: testUPFAddr, PeerTEID: 2, GTPu: g}
+	c := &ngap.Camper{UE: &nas.UE{},
+		PDUSession: map[uint8]*ngap.PDUSession{1: r}}
+	u = &testUPF{
+		tun: tun,
+		n3:  n3,
+		gnb: gnb,
+		s:   &nas.PDUSession{PSI: 1, Address: testUEAddr},
+		r:   r,
+		p: &userPlane{
+			c:       c,
+			meter:   newAMBRMeter(),
+			policer: newAMBRPolicer(c),
+			monitor: newQoSMonitor(),
+		},
+	}
+	t.Cleanup(u.close)
+
+	go u.uplink()
+	go u.downlink()
+
+	// the address is ready in the kernel.
+	time.Sleep(100 * time.Millisecond)
+	return
+}
+
+func (u *testUPF) close() {
+	u.n3.Close()
+	u.gnb.Close()
+	netlink.LinkDel(u.tun)
+}
+
+func (u *testUPF) setDrop(drop func(h tcpHeader) bool) {
+	u.mu.Lock()
+	u.drop = drop
+	u.mu.Unlock()
+}
+
+func (u *testUPF) uplink() {
+	buf := make([]byte, gtp.BufferSize)
+	for {
+		n, _, err := u.n3.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		_, pkt, err := gtp.DecodeHeader(buf[:n])
+		if err != nil {
+			continue
+		}
+		_, _, _, l4, ok := splitIPPacket(pkt)
+		if !ok {
+			continue
+		}
+		h, ok := decTCPHeader(l4)
+		u.mu.Lock()
+		drop := ok && u.drop != nil && u.drop(h)
+		u.mu.Unlock()
+		if !drop {
+			u.tun.Fds[0].Write(pkt)
+		}
+	}
+}
+
+func (u *testUPF) downlink() {
+	for {
+		pkt := make([]byte, 9000)
+		n, err := u.tun.Fds[0].Read(pkt)
+		if err != nil {
+			return
+		}
+		u.p.deliverTraffic(gtp.Packet{Payload: pkt[:n]}, nil)
+	}
+}
+
+func (u *testUPF) dial(port int) (*stackConn, error) {
+	dial := u.p.stackDialer(u.gnb, u.s, u.r, testUEAddr)
+	conn, err := dial("tcp", net.JoinHostPort(testDNAddr.String(),
+		strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*stackConn), nil
+}
+
+func (u *testUPF) listen(t *testing.T) (ln net.Listener, port int) {
+	ln, err := net.Listen("tcp4", testDNAddr.String()+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln, ln.Addr().(*net.TCPAddr).Port
+}
+
+func testData(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+func TestStackHandshake(t *testing.T) {
+
+	u := newTestUPF(t)
+	ln, port := u.listen(t)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn) // echo.
+		conn.Close()
+	}()
+
+	sc, err := u.dial(port)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	sc.mu.Lock()
+	if sc.c.mss != stackMSS || sc.c.cwnd != initialWindow(stackMSS) {
+		t.Errorf("MSS %d, cwnd %d", sc.c.mss, sc.c.cwnd)
+	}
+	if sc.f.stats.rttCount == 0 {
+		t.Errorf("RTT of the handshake is not counted")
+	}
+	sc.mu.Unlock()
+	expect := &net.TCPAddr{IP: testUEAddr, Port: int(sc.f.sport)}
+	if sc.LocalAddr().String() != expect.String() {
+		t.Errorf("local address expect: %v, actual: %v",
+			expect, sc.LocalAddr())
+	}
+
+	data := []byte("hello")
+	if _, err = sc.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	sc.SetReadDeadline(time.Now().Add(3 * time.Second))
+	actual := make([]byte, len(data))
+	if _, err = io.ReadFull(sc, actual); err != nil ||
+		!bytes.Equal(actual, data) {
+		t.Errorf("echo expect: %q, actual: %q, %v", data, actual, err)
+	}
+	sc.Close()
+	select {
+	case <-sc.done:
+	case <-time.After(3 * time.Second):
+		t.Errorf("connection is not closed")
+	}
+}
+
+// the segments are lost in the uplink once. the fast retransmit recovers
+// the loss in the middle of the data, and the retransmission timeout the
+// loss at the end.
+func TestStackRetransmit(t *testing.T) {
+
+	u := newTestUPF(t)
+	ln, port := u.listen(t)
+	received := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b, _ := ioutil.ReadAll(conn)
+			conn.Close()
+			received <- b
+		}
+	}()
+
+	for _, tc := range []struct {
+		name  string
+		size  int
+		lost  int // the index of the data segment lost.
+		timer bool
+	}{
+		{"fast retransmit", 100 * stackMSS, 20, false},
+		{"timeout", 3 * stackMSS, 2, true},
+	} {
+		var segments int32
+		u.setDrop(func(h tcpHeader) bool {
+			if len(h.data) == 0 {
+				return false
+			}
+			return atomic.AddInt32(&segments, 1) == int32(tc.lost+1)
+		})
+
+		sc, err := u.dial(port)
+		if err != nil {
+			t.Fatalf("%s: failed to dial: %v", tc.name, err)
+		}
+		data := testData(tc.size)
+		start := time.Now()
+		if _, err = sc.Write(data); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		sc.Close()
+		<-sc.done
+		elapsed := time.Since(start)
+
+		actual := <-received
+		if !bytes.Equal(actual, data) {
+			t.Errorf("%s: %d bytes received of %d", tc.name,
+				len(actual), len(data))
+		}
+		if sc.f.stats.Retransmits == 0 {
+			t.Errorf("%s: no retransmission", tc.name)
+		}
+		if sc.c.ssthresh == ^uint32(0) {
+			t.Errorf("%s: the window is not reduced", tc.name)
+		}
+		if tc.timer != (elapsed >= tcpMinRTO) {
+			t.Errorf("%s: recovered in %v", tc.name, elapsed)
+		}
+	}
+	u.setDrop(nil)
+}
+
+// the data from the peer is read after the FIN, and the receive window is
+// closed by the data not read.
+func TestStackFIN(t *testing.T) {
+
+	u := newTestUPF(t)
+	ln, port := u.listen(t)
+	data := testData(4 * tcpRecvWindow)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write(data)
+		conn.Close()
+	}()
+
+	sc, err := u.dial(port)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	sc.mu.Lock()
+	buffered, wnd := len(sc.rcv), sc.rcvWnd
+	sc.mu.Unlock()
+	if buffered > tcpRecvWindow || buffered <= tcpRecvWindow-stackMSS ||
+		int(wnd) != tcpRecvWindow-buffered {
+		t.Errorf("receive buffer %d, window %d", buffered, wnd)
+	}
+
+	sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	actual, err := ioutil.ReadAll(sc)
+	if err != nil || !bytes.Equal(actual, data) {
+		t.Errorf("%d bytes received of %d: %v", len(actual), len(data), err)
+	}
+	sc.Close()
+	select {
+	case <-sc.done:
+	case <-time.After(3 * time.Second):
+		t.Errorf("connection is not closed")
+	}
+}
+
+func TestStackRST(t *testing.T) {
+
+	u := newTestUPF(t)
+
+	// no listener.
+	ln, port := u.listen(t)
+	ln.Close()
+	if _, err := u.dial(port); err == nil ||
+		!strings.Contains(err.Error(), "refused") {
+		t.Errorf("dial expect: connection refused, actual: %v", err)
+	}
+
+	// the peer aborts the connection.
+	ln, port = u.listen(t)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}()
+	sc, err := u.dial(port)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	sc.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err = sc.Read(make([]byte, 1)); err == nil ||
+		!strings.Contains(err.Error(), "reset") {
+		t.Errorf("read expect: connection reset, actual: %v", err)
+	}
+	<-sc.done
+}
+
+func TestCongestionWindow(t *testing.T) {
+
+	const mss = 1000
+	c := &tcpConn{una: 0, high: 10 * mss, wnd: 64 * mss, mss: mss,
+		cwnd: initialWindow(mss), ssthresh: ^uint32(0)}
+	if c.cwnd != 4*mss {
+		t.Errorf("initial window expect: %d, actual: %d", 4*mss, c.cwnd)
+	}
+
+	// slow start by the MSS at most for each ACK.
+	c.ackNewData(2 * mss)
+	c.una = 2 * mss
+	if c.cwnd != 5*mss {
+		t.Errorf("slow start expect: %d, actual: %d", 5*mss, c.cwnd)
+	}
+
+	// the fast retransmit on the third duplicate ACK.
+	for i := 1; i <= 3; i++ {
+		if c.dupAck() != (i == 3) {
+			t.Errorf("fast retransmit on duplicate ACK %d", i)
+		}
+	}
+	if c.ssthresh != 4*mss || c.cwnd != 7*mss || !c.recovery {
+		t.Errorf("fast recovery: ssthresh %d, cwnd %d", c.ssthresh, c.cwnd)
+	}
+	c.dupAck()
+	if c.cwnd != 8*mss {
+		t.Errorf("inflated window expect: %d, actual: %d", 8*mss, c.cwnd)
+	}
+
+	// the partial ACK deflates the window, and the full ACK ends the
+	// recovery.
+	if !c.ackNewData(4 * mss) {
+		t.Errorf("partial ACK is not detected")
+	}
+	c.una = 4 * mss
+	if c.cwnd != 7*mss {
+		t.Errorf("deflated window expect: %d, actual: %d", 7*mss, c.cwnd)
+	}
+	if c.ackNewData(10*mss) || c.recovery || c.cwnd != c.ssthresh {
+		t.Errorf("full ACK: recovery %v, cwnd %d", c.recovery, c.cwnd)
+	}
+	c.una = 10 * mss
+
+	// the congestion avoidance by the MSS in a window.
+	c.high = 14 * mss
+	c.ackNewData(11 * mss)
+	c.una = 11 * mss
+	if c.cwnd != 4*mss+mss/4 {
+		t.Errorf("congestion avoidance expect: %d, actual: %d",
+			4*mss+mss/4, c.cwnd)
+	}
+
+	// the loss window on the timeout.
+	c.nxt = c.high
+	c.timeout()
+	if c.cwnd != mss || c.ssthresh != 2*mss || c.nxt != c.una {
+		t.Errorf("timeout: cwnd %d, ssthresh %d, nxt %d",
+			c.cwnd, c.ssthresh, c.nxt)
+	}
+	if c.window() != mss {
+		t.Errorf("window expect: %d, actual: %d", mss, c.window())
+	}
+}